@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request, taken from a proxy in front of the server or made up
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID keeps IDs from the header that would garble the log out of it
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// accessLogger writes the access log to its own file, or is nil to write it to the log of the program
+var accessLogger *log.Logger
+
+type accessLogKey struct{}
+
+// accessLogEntry collects the details of a request logged once it has been answered
+type accessLogEntry struct {
+	id       string
+	status   int
+	username string
+}
+
+// accessLogWriter remembers the status of the response
+type accessLogWriter struct {
+	http.ResponseWriter
+	entry *accessLogEntry
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.entry.status == 0 {
+		w.entry.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.entry.status == 0 {
+		w.entry.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through, which streaming handlers such as pprof traces rely on
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLog logs every request with an ID, its status, how long it took, and the user that made it, using the
+// log prefix of the server. The ID is sent back in the X-Request-ID header to find the request in the log.
+func accessLog(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{id: r.Header.Get(requestIDHeader)}
+		if !validRequestID.MatchString(entry.id) {
+			entry.id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, entry.id)
+
+		next.ServeHTTP(&accessLogWriter{w, entry}, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		if entry.status == 0 {
+			entry.status = http.StatusOK
+		}
+		username := entry.username
+		if username == "" {
+			username = "-"
+		}
+		logf := log.Printf
+		if accessLogger != nil {
+			logf = accessLogger.Printf
+		}
+		logf("%v: %v %v %v %v %d %v %v", prefix, entry.id, r.RemoteAddr, r.Method, r.URL.Path, entry.status,
+			time.Since(start).Round(time.Microsecond), username)
+	})
+}
+
+// setAccessLogUser records the authenticated user of a request in the access log
+func setAccessLogUser(r *http.Request, username string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.username = username
+	}
+}
+
+// newRequestID makes up a random request ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+)
+
+// operatorNameType is the Operator-Name attribute of RFC 5580, which the radius package has no dictionary for
+const operatorNameType radius.Type = 126
+
+const (
+	accessPointQueueSize = 256
+	// accessPointSeenInterval is how often an access point whose details haven't changed is written again
+	accessPointSeenInterval = 5 * time.Minute
+)
+
+// AccessPoint is an access point seen in the Called-Station-Id of authentications, with the details of the NAS
+// that sent them. Access points are added and updated automatically.
+type AccessPoint struct {
+	Model
+	MAC           string `gorm:"unique_index;not null"`
+	NASIdentifier string
+	NASIP         string
+	OperatorName  string
+	// Client is the address of the RADIUS client the requests came from, such as the controller
+	Client     string
+	LastSSID   string
+	LastSeenAt time.Time
+}
+
+// calledStationMAC extracts the MAC address of the access point from a Called-Station-Id, which is either the
+// address alone or followed by the SSID
+func calledStationMAC(client Client, calledStationID string) string {
+	delimiter := client.SSIDDelimiter
+	if delimiter == "" {
+		delimiter = ":"
+	}
+	candidates := []string{calledStationID}
+	if i := strings.LastIndex(calledStationID, delimiter); i > 0 {
+		candidates = append(candidates, calledStationID[:i])
+	}
+	candidates = append(candidates, strings.Split(calledStationID, delimiter)[0])
+	for _, candidate := range candidates {
+		if mac := normalizeMACAddress(candidate); isValidMACFormat(mac) {
+			return mac
+		}
+	}
+	return ""
+}
+
+// operatorName returns the Operator-Name of a request, which starts with the digit of its namespace, such as
+// "1example.com" for a realm
+func operatorName(packet *radius.Packet) string {
+	return string(packet.Attributes.Get(operatorNameType))
+}
+
+// accessPointSighting is what was last written for an access point
+type accessPointSighting struct {
+	event   AuthEvent
+	written time.Time
+}
+
+// AccessPointRecorder keeps the AccessPoint table up to date from the authentications, writing in the
+// background and only when the details of an access point changed or it hasn't been written for a while
+type AccessPointRecorder struct {
+	db      *gorm.DB
+	events  chan AuthEvent
+	done    chan struct{}
+	dropped uint64
+
+	mutex sync.Mutex
+	seen  map[string]accessPointSighting
+}
+
+// NewAccessPointRecorder creates an AccessPointRecorder and starts writing
+func NewAccessPointRecorder(db *gorm.DB) *AccessPointRecorder {
+	r := &AccessPointRecorder{
+		db:     db,
+		events: make(chan AuthEvent, accessPointQueueSize),
+		done:   make(chan struct{}),
+		seen:   make(map[string]accessPointSighting),
+	}
+	go r.run()
+	return r
+}
+
+// AuthEvent records the access point of an authentication
+func (r *AccessPointRecorder) AuthEvent(event AuthEvent) {
+	if event.AccessPoint == "" {
+		return
+	}
+
+	r.mutex.Lock()
+	last, ok := r.seen[event.AccessPoint]
+	if ok && event.Time.Sub(last.written) < accessPointSeenInterval && last.event.NASIdentifier == event.NASIdentifier &&
+		last.event.NASIP == event.NASIP && last.event.OperatorName == event.OperatorName &&
+		last.event.Client == event.Client && last.event.SSID == event.SSID {
+		r.mutex.Unlock()
+		return
+	}
+	r.seen[event.AccessPoint] = accessPointSighting{event: event, written: event.Time}
+	r.mutex.Unlock()
+
+	select {
+	case r.events <- event:
+	default:
+		if dropped := atomic.AddUint64(&r.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+			log.Printf("RADIUS: Access point queue is full, %d updates dropped", dropped)
+		}
+	}
+}
+
+// Stop writes the queued access points and stops the recorder
+func (r *AccessPointRecorder) Stop() {
+	close(r.events)
+	<-r.done
+}
+
+func (r *AccessPointRecorder) run() {
+	defer close(r.done)
+	for event := range r.events {
+		var ap AccessPoint
+		err := r.db.FirstOrInit(&ap, AccessPoint{MAC: event.AccessPoint}).Error
+		if err == nil {
+			ap.NASIdentifier = event.NASIdentifier
+			ap.NASIP = event.NASIP
+			ap.OperatorName = event.OperatorName
+			ap.Client = event.Client
+			ap.LastSSID = event.SSID
+			ap.LastSeenAt = event.Time
+			err = r.db.Save(&ap).Error
+		}
+		if err != nil {
+			log.Printf("RADIUS: Unable to record access point %v: %v", event.AccessPoint, err)
+		}
+	}
+}
+
+// listAccessPointsCommand lists the access points seen in authentications, the most recently seen first
+func listAccessPointsCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-access-points", flag.ContinueOnError)
+	days := flags.Int("days", 0, "only list the access points seen in this many days, or 0 for all of them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := db.Order("last_seen_at desc")
+	if *days > 0 {
+		query = query.Where("last_seen_at >= ?", time.Now().AddDate(0, 0, -*days))
+	}
+	var aps []AccessPoint
+	if err := query.Find(&aps).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "MAC\tNAS-IDENTIFIER\tNAS-IP\tCLIENT\tOPERATOR\tLAST SSID\tFIRST SEEN\tLAST SEEN")
+	for _, ap := range aps {
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", prettyPrintMACAddress(ap.MAC), ap.NASIdentifier, ap.NASIP, ap.Client,
+			ap.OperatorName, ap.LastSSID, ap.CreatedAt.Local().Format(time.RFC3339), ap.LastSeenAt.Local().Format(time.RFC3339))
+	}
+	return out.Flush()
+}
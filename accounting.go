@@ -0,0 +1,143 @@
+package main
+
+import (
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// AccountingSession records a session reported by a RADIUS client through accounting (RFC 2866)
+type AccountingSession struct {
+	Model
+	// SessionID is the Acct-Session-Id, which is only unique for the client that reported it
+	SessionID string `gorm:"index"`
+	// EventID is the event ID of the authentication that started the session, if the NAS sent back its Class
+	EventID   string `gorm:"index"`
+	Client    string `gorm:"index"`
+	MAC       string `gorm:"index"`
+	Username  string
+	SSID      string
+	StartedAt time.Time
+	// StoppedAt is empty while the session is active
+	StoppedAt *time.Time `gorm:"index"`
+	// SessionTime is the length of the session in seconds
+	SessionTime    uint
+	InputOctets    uint64
+	OutputOctets   uint64
+	InputPackets   uint64
+	OutputPackets  uint64
+	TerminateCause string
+}
+
+// AccountingListener is told about an accounting session once it is stored. Listeners are called from the
+// accounting handler, so they must not block.
+type AccountingListener func(session AccountingSession)
+
+// accountingTerminateNASReboot is recorded for the sessions closed by an Accounting-On or Accounting-Off
+const accountingTerminateNASReboot = "NAS-Reboot"
+
+// accountingHandler records Accounting-Requests, only answering them once they are stored so the client
+// retransmits the ones that couldn't be
+func (rs *RadiusServer) accountingHandler(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccountingRequest {
+		return
+	}
+	r = withEventID(r, classEventID(r.Packet))
+
+	client, _ := rs.lookupClient(rs.DB, r.RemoteAddr)
+	nas := addrIP(r.RemoteAddr).String()
+	var err error
+	switch status := rfc2866.AcctStatusType_Get(r.Packet); status {
+	case rfc2866.AcctStatusType_Value_Start, rfc2866.AcctStatusType_Value_InterimUpdate, rfc2866.AcctStatusType_Value_Stop:
+		err = rs.recordAccounting(r, client, nas, status)
+	case rfc2866.AcctStatusType_Value_AccountingOn, rfc2866.AcctStatusType_Value_AccountingOff:
+		// The client restarted, so none of its sessions are active anymore
+		now := time.Now()
+		err = rs.DB.Model(&AccountingSession{}).Where("client = ? AND stopped_at IS NULL", nas).
+			Updates(map[string]interface{}{"stopped_at": &now, "terminate_cause": accountingTerminateNASReboot}).Error
+		requestLogf(r, "Accounting %v from %v", status, nas)
+	default:
+		requestLogf(r, "Ignoring accounting %v from %v", status, nas)
+	}
+	if err != nil {
+		requestLogf(r, "Unable to record accounting from %v: %v", nas, err)
+		return
+	}
+
+	rs.writeResponse(w, newResponse(r, radius.CodeAccountingResponse))
+}
+
+// recordAccounting creates or updates the session of a Start, Interim-Update, or Stop
+func (rs *RadiusServer) recordAccounting(r *radius.Request, client Client, nas string, status rfc2866.AcctStatusType) error {
+	sessionID := rfc2866.AcctSessionID_GetString(r.Packet)
+	var session AccountingSession
+	if err := rs.DB.Where("session_id = ? AND client = ?", sessionID, nas).Order("id desc").FirstOrInit(&session).Error; err != nil {
+		return err
+	}
+
+	// The time the event happened, before the client spent time retransmitting it
+	eventTime := time.Now().Add(-time.Duration(rfc2866.AcctDelayTime_Get(r.Packet)) * time.Second)
+	sessionTime := uint(rfc2866.AcctSessionTime_Get(r.Packet))
+
+	if session.ID == 0 {
+		session.SessionID = sessionID
+		session.Client = nas
+		session.StartedAt = eventTime.Add(-time.Duration(sessionTime) * time.Second)
+	}
+	mac := normalizeMACAddress(rfc2865.CallingStationID_GetString(r.Packet))
+	if !isValidMACFormat(mac) {
+		mac = normalizeMACAddress(rfc2865.UserName_GetString(r.Packet))
+	}
+	if isValidMACFormat(mac) {
+		session.MAC = mac
+	}
+	if id := eventID(r); id != "" {
+		session.EventID = id
+	}
+	if username := rfc2865.UserName_GetString(r.Packet); username != "" {
+		session.Username = username
+	}
+	if ssid := calledStationSSID(client, rfc2865.CalledStationID_GetString(r.Packet)); ssid != "" {
+		session.SSID = ssid
+	}
+
+	// Counters only grow, so a late Interim-Update can't undo a Stop
+	if status != rfc2866.AcctStatusType_Value_Start {
+		session.SessionTime = maxUint(session.SessionTime, sessionTime)
+		session.InputOctets = maxUint64(session.InputOctets, uint64(rfc2869.AcctInputGigawords_Get(r.Packet))<<32|uint64(rfc2866.AcctInputOctets_Get(r.Packet)))
+		session.OutputOctets = maxUint64(session.OutputOctets, uint64(rfc2869.AcctOutputGigawords_Get(r.Packet))<<32|uint64(rfc2866.AcctOutputOctets_Get(r.Packet)))
+		session.InputPackets = maxUint64(session.InputPackets, uint64(rfc2866.AcctInputPackets_Get(r.Packet)))
+		session.OutputPackets = maxUint64(session.OutputPackets, uint64(rfc2866.AcctOutputPackets_Get(r.Packet)))
+	}
+	if status == rfc2866.AcctStatusType_Value_Stop {
+		session.StoppedAt = &eventTime
+		if cause := rfc2866.AcctTerminateCause_Get(r.Packet); cause != 0 {
+			session.TerminateCause = cause.String()
+		}
+	}
+
+	if err := rs.DB.Save(&session).Error; err != nil {
+		return err
+	}
+	for _, listener := range rs.AccountingListeners {
+		listener(session)
+	}
+	return nil
+}
+
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
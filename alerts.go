@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert events
+const (
+	// alertEventUnknownMAC counts rejections of MAC addresses that aren't registered
+	alertEventUnknownMAC = "unknown_mac"
+	// alertEventRejectedMAC counts every rejection of a MAC address, whatever the reason
+	alertEventRejectedMAC = "rejected_mac"
+	// alertEventHoneypot counts requests for a honeypot network
+	alertEventHoneypot = "honeypot"
+)
+
+const alertQueueSize = 64
+
+// AlertRule sends an email when the same MAC address matches the event more than Threshold times within Window
+type AlertRule struct {
+	Event     string   `json:"event"`
+	Threshold int      `json:"threshold"`
+	Window    Duration `json:"window"`
+	To        []string `json:"to"`
+	// Quarantine moves the MAC address into the quarantine group when the rule is triggered
+	Quarantine bool `json:"quarantine"`
+}
+
+// matches reports whether an authentication event counts towards the rule
+func (rule AlertRule) matches(event AuthEvent) bool {
+	if event.Accepted || event.MAC == "" {
+		return false
+	}
+	switch rule.Event {
+	case alertEventUnknownMAC:
+		return event.Reason == authReasonUnknownDevice
+	case alertEventRejectedMAC:
+		return true
+	case alertEventHoneypot:
+		return event.Reason == authReasonHoneypot
+	}
+	return false
+}
+
+// validate checks a rule read from the configuration file
+func (rule AlertRule) validate() error {
+	switch rule.Event {
+	case alertEventUnknownMAC, alertEventRejectedMAC, alertEventHoneypot:
+	default:
+		return fmt.Errorf("unknown alert event %q", rule.Event)
+	}
+	// A single request for a honeypot is already suspicious
+	minThreshold := 1
+	if rule.Event == alertEventHoneypot {
+		minThreshold = 0
+	}
+	if rule.Threshold < minThreshold {
+		return fmt.Errorf("alert threshold must be at least %d", minThreshold)
+	}
+	if rule.Window.Duration <= 0 {
+		return fmt.Errorf("alert window must be set")
+	}
+	if len(rule.To) == 0 && !rule.Quarantine {
+		return fmt.Errorf("alert has no recipients")
+	}
+	return nil
+}
+
+// alertState tracks the matching events of one MAC address for one rule
+type alertState struct {
+	times []time.Time
+	ssids map[string]bool
+	// silencedUntil stops the same MAC address from sending another alert until the window has passed
+	silencedUntil time.Time
+}
+
+// Alert is the data passed to the alert email template
+type Alert struct {
+	Event  string
+	MAC    string
+	Count  int
+	Window time.Duration
+	SSIDs  []string
+	Client string
+	Time   time.Time
+	// Quarantined is set when the device was moved into the quarantine group
+	Quarantined bool
+}
+
+type queuedAlert struct {
+	to         []string
+	alert      Alert
+	mac        string
+	quarantine bool
+}
+
+// Alerter watches authentication events and emails the recipients of a rule when it is triggered, or quarantines
+// the device. Both happen in the background so the RADIUS handler never waits on the SMTP server or the database.
+type Alerter struct {
+	rules  []AlertRule
+	mailer *Mailer
+	// quarantine moves a device into the quarantine group, or is nil if there is none
+	quarantine func(mac string, event string) error
+
+	mutex     sync.Mutex
+	states    []map[string]*alertState
+	lastSweep time.Time
+	queue     chan queuedAlert
+	done      chan struct{}
+}
+
+// NewAlerter checks the rules, creates an Alerter, and starts sending. The mailer is nil when email isn't set up,
+// and quarantine is nil when there is no quarantine group.
+func NewAlerter(rules []AlertRule, mailer *Mailer, quarantine func(mac string, event string) error) (*Alerter, error) {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if rule.Quarantine && quarantine == nil {
+			return nil, fmt.Errorf("alert quarantines devices but quarantine.group is not set")
+		}
+	}
+
+	a := &Alerter{
+		rules:      rules,
+		mailer:     mailer,
+		quarantine: quarantine,
+		states:     make([]map[string]*alertState, len(rules)),
+		queue:      make(chan queuedAlert, alertQueueSize),
+		done:       make(chan struct{}),
+	}
+	for i := range a.states {
+		a.states[i] = make(map[string]*alertState)
+	}
+	go a.run()
+	return a, nil
+}
+
+// Observe counts an authentication event against the rules
+func (a *Alerter) Observe(event AuthEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, rule := range a.rules {
+		if !rule.matches(event) {
+			continue
+		}
+
+		state, ok := a.states[i][event.MAC]
+		if !ok {
+			state = &alertState{ssids: make(map[string]bool)}
+			a.states[i][event.MAC] = state
+		}
+		state.times = append(pruneAlertTimes(state.times, event.Time.Add(-rule.Window.Duration)), event.Time)
+		if event.SSID != "" {
+			state.ssids[event.SSID] = true
+		}
+
+		if len(state.times) <= rule.Threshold || event.Time.Before(state.silencedUntil) {
+			continue
+		}
+		state.silencedUntil = event.Time.Add(rule.Window.Duration)
+
+		alert := Alert{
+			Event:  rule.Event,
+			MAC:    prettyPrintMACAddress(event.MAC),
+			Count:  len(state.times),
+			Window: rule.Window.Duration,
+			Client: event.Client,
+			Time:   event.Time,
+		}
+		for ssid := range state.ssids {
+			alert.SSIDs = append(alert.SSIDs, ssid)
+		}
+		sort.Strings(alert.SSIDs)
+
+		select {
+		case a.queue <- queuedAlert{to: rule.To, alert: alert, mac: event.MAC, quarantine: rule.Quarantine}:
+		default:
+			log.Printf("ALERT: Queue is full, dropping alert for %v", alert.MAC)
+		}
+	}
+	if event.Time.Sub(a.lastSweep) >= time.Minute {
+		a.sweep(event.Time)
+		a.lastSweep = event.Time
+	}
+}
+
+// sweep forgets MAC addresses that have no events left in the window, so probing with random addresses doesn't
+// use up memory
+func (a *Alerter) sweep(now time.Time) {
+	for i, rule := range a.rules {
+		for mac, state := range a.states[i] {
+			if len(pruneAlertTimes(state.times, now.Add(-rule.Window.Duration))) == 0 && now.After(state.silencedUntil) {
+				delete(a.states[i], mac)
+			}
+		}
+	}
+}
+
+// pruneAlertTimes drops the times before cutoff
+func pruneAlertTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// Stop sends the queued alerts and stops the Alerter
+func (a *Alerter) Stop() {
+	close(a.queue)
+	<-a.done
+}
+
+func (a *Alerter) run() {
+	defer close(a.done)
+	for queued := range a.queue {
+		if queued.quarantine {
+			if err := a.quarantine(queued.mac, queued.alert.Event); err != nil {
+				log.Printf("ALERT: Unable to quarantine %v: %v", queued.alert.MAC, err)
+			} else {
+				log.Printf("ALERT: Quarantined %v", queued.alert.MAC)
+				queued.alert.Quarantined = true
+			}
+		}
+		if len(queued.to) == 0 || a.mailer == nil {
+			continue
+		}
+		if err := a.mailer.Send(queued.to, "alert", queued.alert); err != nil {
+			log.Printf("ALERT: Unable to send alert for %v: %v", queued.alert.MAC, err)
+		} else {
+			log.Printf("ALERT: Sent alert for %v to %v", queued.alert.MAC, queued.to)
+		}
+	}
+}
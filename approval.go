@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Proposal decisions
+const (
+	proposalApproved = "approved"
+	proposalRejected = "rejected"
+)
+
+// approvalGrantedKey is the gorm setting that lets an approved proposal run its command
+const approvalGrantedKey = "approval:granted"
+
+// approvalAdminKey is the gorm setting holding the administrative user given with -admin and -admin-password
+const approvalAdminKey = "approval:admin"
+
+// proposalSecretFlags are the flags whose values are encrypted when a command is saved as a proposal
+var proposalSecretFlags = []string{"secret", "shared-password", "password"}
+
+// adminLogin is the administrative user an admin running a command claims to be
+type adminLogin struct {
+	Username string
+	Password string
+}
+
+// ApprovalConfig stores which changes have to be approved by a second admin before they take effect
+type ApprovalConfig struct {
+	// Enabled stages the changes to clients, networks, and privileged groups as proposals
+	Enabled bool `json:"enabled"`
+	// PrivilegedGroups are the device groups whose settings and members need approval
+	PrivilegedGroups []string `json:"privileged_groups"`
+}
+
+// Proposal is a command waiting for the approval of a second admin, who runs it by approving it
+type Proposal struct {
+	Model
+	// Actor is the operating system user that proposed the change, who the command's changes are recorded as
+	Actor string `gorm:"not null"`
+	// Username is the administrative user that proposed the change
+	Username string
+	// Args are the JSON encoded arguments of the command, with the values of secret flags redacted
+	Args string `gorm:"not null"`
+	// Secrets are the values of the secret flags, encrypted with a key only the proposing admin is shown
+	Secrets []byte
+	// Reason is why the command needs approval
+	Reason string
+	// Decision is empty until another admin approves or rejects the proposal
+	Decision string
+	// DecidedBy is the administrative user that approved or rejected the proposal
+	DecidedBy string
+	DecidedAt *time.Time
+	// Error is why the command failed when it was approved
+	Error string
+}
+
+// requiresApproval explains why a command needs approval, or returns an empty string if it doesn't
+func (c ApprovalConfig) requiresApproval(db *gorm.DB, args []string) string {
+	for _, arg := range args[1:] {
+		if arg == "-h" || arg == "-help" || arg == "--help" {
+			return ""
+		}
+	}
+	privileged := func(flagName string) string {
+		for _, name := range flagValues(args[1:], flagName) {
+			if stringInSlice(name, c.PrivilegedGroups) {
+				return name
+			}
+		}
+		return ""
+	}
+	// Devices already in a privileged group, including those in the trash, can't be changed without approval either
+	privilegedDevice := func() string {
+		for _, mac := range flagValues(args[1:], "mac") {
+			var device Device
+			if db.Unscoped().Preload("DeviceGroups", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+				First(&device, "mac = ?", normalizeMACAddress(mac)).RecordNotFound() {
+				continue
+			}
+			for _, group := range device.DeviceGroups {
+				if stringInSlice(group.Name, c.PrivilegedGroups) {
+					return group.Name
+				}
+			}
+		}
+		return ""
+	}
+
+	switch args[0] {
+	case "add-client", "remove-client":
+		return "changes RADIUS clients"
+	case "set-network":
+		return "changes networks"
+	case "import-freeradius":
+		return "imports devices and groups"
+	case "restore":
+		return "replaces the database"
+	case "promote":
+		return "promotes a standby"
+	case "migrate":
+		// Listing the migrations doesn't change anything
+		for _, to := range flagValues(args[1:], "to") {
+			if !strings.HasPrefix(to, "-") {
+				return "undoes migrations"
+			}
+		}
+	case "purge-trash":
+		if len(flagValues(args[1:], "mac"))+len(flagValues(args[1:], "group")) > 0 {
+			return "permanently deletes devices or groups"
+		}
+		for _, days := range flagValues(args[1:], "days") {
+			if !strings.HasPrefix(days, "-") {
+				return "permanently deletes devices or groups"
+			}
+		}
+	case "add-user":
+		// Until there are two admins, nobody could approve the second one
+		var users int
+		if db.Model(&User{}).Count(&users); users >= 2 {
+			return "adds administrative users"
+		}
+	case "remove-user":
+		return "removes administrative users"
+	case "release":
+		return "releases a device from quarantine"
+	case "set-profile":
+		var groups []DeviceGroup
+		for _, name := range flagValues(args[1:], "name") {
+			db.Joins("JOIN reply_profiles ON reply_profiles.id = device_groups.reply_profile_id").
+				Where("reply_profiles.name = ?", name).Find(&groups)
+			for _, group := range groups {
+				if stringInSlice(group.Name, c.PrivilegedGroups) {
+					return fmt.Sprintf("changes the reply profile of privileged group %q", group.Name)
+				}
+			}
+		}
+	case "set-group", "remove-group", "restore-group", "enable-group", "disable-group":
+		if group := privileged("name"); group != "" {
+			return fmt.Sprintf("changes privileged group %q", group)
+		}
+		if group := privileged("parent"); group != "" {
+			return fmt.Sprintf("inherits from privileged group %q", group)
+		}
+		// set-group creates the networks it doesn't find, which set-network needs approval for
+		for _, ssid := range flagValues(args[1:], "network") {
+			if args[0] == "set-group" && db.Where(&Network{SSID: ssid}).First(&Network{}).RecordNotFound() {
+				return fmt.Sprintf("creates network %q", ssid)
+			}
+		}
+	case "add-attribute":
+		if group := privileged("group"); group != "" {
+			return fmt.Sprintf("changes privileged group %q", group)
+		}
+	case "remove-attribute":
+		var group DeviceGroup
+		for _, id := range flagValues(args[1:], "id") {
+			if !db.Joins("JOIN group_attributes ON group_attributes.device_group_id = device_groups.id").
+				First(&group, "group_attributes.id = ?", id).RecordNotFound() && stringInSlice(group.Name, c.PrivilegedGroups) {
+				return fmt.Sprintf("changes privileged group %q", group.Name)
+			}
+		}
+	case "add-device", "set-device", "issue-vouchers", "unifi-import", "add-credential":
+		if group := privileged("group"); group != "" {
+			return fmt.Sprintf("adds devices to privileged group %q", group)
+		}
+		fallthrough
+	case "remove-device", "restore-device", "enable-device", "disable-device", "quarantine":
+		if group := privilegedDevice(); group != "" {
+			return fmt.Sprintf("changes a device in privileged group %q", group)
+		}
+	case "bulk-devices":
+		if group := privileged("add-group"); group != "" {
+			return fmt.Sprintf("adds devices to privileged group %q", group)
+		}
+		if group := privileged("remove-group"); group != "" {
+			return fmt.Sprintf("changes devices in privileged group %q", group)
+		}
+		// Which devices the filters select is only known by running the query
+		change, err := parseBulkDeviceChange(args[1:], ioutil.Discard)
+		if err != nil || change.dryRun {
+			return ""
+		}
+		devices, _ := change.devices(db, time.Now())
+		for _, device := range devices {
+			var groups []DeviceGroup
+			db.Model(&device).Association("DeviceGroups").Find(&groups)
+			for _, group := range groups {
+				if stringInSlice(group.Name, c.PrivilegedGroups) {
+					return fmt.Sprintf("changes devices in privileged group %q", group.Name)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// flagValues finds the values given to a flag in the arguments of a command, as "-name value" or "-name=value"
+func flagValues(args []string, name string) []string {
+	var values []string
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		if arg == args[i] {
+			continue
+		}
+		if arg == name && i+1 < len(args) {
+			values = append(values, args[i+1])
+			i++
+		} else if strings.HasPrefix(arg, name+"=") {
+			values = append(values, arg[len(name)+1:])
+		}
+	}
+	return values
+}
+
+// replaceSecretArgs returns a copy of the arguments of a command with the value of each secret flag, in order,
+// replaced by what replace returns for it
+func replaceSecretArgs(args []string, replace func(value string) string) []string {
+	replaced := make([]string, len(args))
+	copy(replaced, args)
+	for i := 0; i < len(replaced); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(replaced[i], "-"), "-")
+		if arg == replaced[i] {
+			continue
+		}
+		for _, name := range proposalSecretFlags {
+			if arg == name && i+1 < len(replaced) {
+				replaced[i+1] = replace(replaced[i+1])
+				i++
+				break
+			} else if strings.HasPrefix(arg, name+"=") {
+				replaced[i] = replaced[i][:len(replaced[i])-len(arg)] + name + "=" + replace(arg[len(name)+1:])
+				break
+			}
+		}
+	}
+	return replaced
+}
+
+// redactedArgs shows the arguments of a command without the values of secret flags
+func redactedArgs(args []string) string {
+	return strings.Join(replaceSecretArgs(args, func(string) string { return auditRedacted }), " ")
+}
+
+// proposalCipher encrypts the secrets of a proposal with its key
+func proposalCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealProposalSecrets redacts the values of the secret flags of a command, and encrypts them with a new random key.
+// Only the proposing admin is shown the key, so the database never holds them in a usable form.
+func sealProposalSecrets(args []string) (redacted []string, sealed []byte, key string, err error) {
+	var secrets []string
+	redacted = replaceSecretArgs(args, func(value string) string {
+		secrets = append(secrets, value)
+		return auditRedacted
+	})
+	if len(secrets) == 0 {
+		return redacted, nil, "", nil
+	}
+
+	rawKey := make([]byte, 16)
+	if _, err := rand.Read(rawKey); err != nil {
+		return nil, nil, "", err
+	}
+	aead, err := proposalCipher(rawKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, "", err
+	}
+	return redacted, aead.Seal(nonce, nonce, plaintext, nil), hex.EncodeToString(rawKey), nil
+}
+
+// openProposalSecrets puts the secrets sealed by sealProposalSecrets back into the redacted arguments
+func openProposalSecrets(redacted []string, sealed []byte, key string) ([]string, error) {
+	rawKey, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(rawKey) != 16 {
+		return nil, errors.New("the key of the proposal is 32 hexadecimal digits")
+	}
+	aead, err := proposalCipher(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the secrets of the proposal are truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("incorrect key for the proposal")
+	}
+	var secrets []string
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, err
+	}
+
+	missing := false
+	args := replaceSecretArgs(redacted, func(string) string {
+		if len(secrets) == 0 {
+			missing = true
+			return ""
+		}
+		value := secrets[0]
+		secrets = secrets[1:]
+		return value
+	})
+	if missing || len(secrets) > 0 {
+		return nil, errors.New("the secrets of the proposal don't match its command")
+	}
+	return args, nil
+}
+
+// withAdminLogin returns a database handle for commands run by the administrative user given with -admin
+func withAdminLogin(db *gorm.DB, username, password string) *gorm.DB {
+	return db.Set(approvalAdminKey, adminLogin{Username: username, Password: password})
+}
+
+// authenticateAdmin checks the password of the administrative user given with -admin. Changes needing approval
+// are proposed and decided by administrative users rather than operating system users, since several admins may
+// share an account on the server.
+func authenticateAdmin(db *gorm.DB) (User, error) {
+	var user User
+	value, _ := db.Get(approvalAdminKey)
+	login, _ := value.(adminLogin)
+	if login.Username == "" {
+		return user, errors.New("changes needing approval are proposed and decided by an administrative user, give -admin and -admin-password before the command")
+	}
+	if db.First(&user, "username = ?", login.Username).RecordNotFound() || !checkPassword(user, login.Password) {
+		return user, errors.New("incorrect admin username or password")
+	}
+	if user.MustChangePassword {
+		return user, fmt.Errorf("%q has to change their password first", user.Username)
+	}
+	return user, nil
+}
+
+// auditActor is who is making changes through a database handle
+func auditActor(db *gorm.DB) string {
+	if value, ok := db.Get(auditActorKey); ok {
+		return value.(string)
+	}
+	return auditSystemActor
+}
+
+// proposeChange stores a command as a proposal instead of running it
+func proposeChange(db *gorm.DB, args []string, reason string) error {
+	admin, err := authenticateAdmin(db)
+	if err != nil {
+		return err
+	}
+	redacted, sealed, key, err := sealProposalSecrets(args)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(redacted)
+	if err != nil {
+		return err
+	}
+	proposal := Proposal{Actor: auditActor(db), Username: admin.Username, Args: string(encoded), Secrets: sealed, Reason: reason}
+	if err := db.Create(&proposal).Error; err != nil {
+		return err
+	}
+
+	if key == "" {
+		fmt.Printf("The command %v, so it was saved as proposal %d for another admin to approve with \"approve -id %d\"\n", reason, proposal.ID, proposal.ID)
+		return nil
+	}
+	fmt.Printf("The command %v, so it was saved as proposal %d for another admin to approve with \"approve -id %d -key %v\". "+
+		"Its secrets are only stored encrypted with this key, so give it to the approving admin.\n", reason, proposal.ID, proposal.ID, key)
+	return nil
+}
+
+// proposalsCommand lists the proposals waiting for approval, or all of them
+func proposalsCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("proposals", flag.ContinueOnError)
+	all := flags.Bool("all", false, "also list the proposals that were decided")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := db.Order("id")
+	if !*all {
+		query = query.Where("decision = ?", "")
+	}
+	var proposals []Proposal
+	if err := query.Find(&proposals).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tPROPOSED\tBY\tREASON\tCOMMAND\tDECISION")
+	for _, proposal := range proposals {
+		var proposed []string
+		json.Unmarshal([]byte(proposal.Args), &proposed)
+		decision := "pending"
+		if proposal.Decision != "" {
+			decision = fmt.Sprintf("%v by %v", proposal.Decision, proposal.DecidedBy)
+			if proposal.Error != "" {
+				decision += ", failed: " + proposal.Error
+			}
+		}
+		proposedBy := proposal.Actor
+		if proposal.Username != "" {
+			proposedBy = fmt.Sprintf("%v (%v)", proposal.Username, proposal.Actor)
+		}
+		fmt.Fprintf(out, "%d\t%v\t%v\t%v\t%v\t%v\n", proposal.ID, proposal.CreatedAt.Local().Format(time.RFC3339), proposedBy,
+			proposal.Reason, redactedArgs(proposed), decision)
+	}
+	return out.Flush()
+}
+
+// approveCommand runs a proposal as the admin who proposed it, which a different admin has to do
+func approveCommand(config Config, db *gorm.DB, args []string) error {
+	return decideProposal(config, db, "approve", proposalApproved, args)
+}
+
+// rejectCommand discards a proposal, which the admin who proposed it can do too
+func rejectCommand(config Config, db *gorm.DB, args []string) error {
+	return decideProposal(config, db, "reject", proposalRejected, args)
+}
+
+func decideProposal(config Config, db *gorm.DB, command string, decision string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	id := flags.Uint("id", 0, "ID of the proposal")
+	key := flags.String("key", "", "key the proposing admin was given for a proposal with secrets")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	admin, err := authenticateAdmin(db)
+	if err != nil {
+		return err
+	}
+	var proposal Proposal
+	if db.First(&proposal, *id).RecordNotFound() {
+		return fmt.Errorf("proposal %d does not exist", *id)
+	}
+	if proposal.Decision != "" {
+		return fmt.Errorf("proposal %d has already been %v", proposal.ID, proposal.Decision)
+	}
+	if decision == proposalApproved && (admin.Username == proposal.Username || proposal.Username == "" && auditActor(db) == proposal.Actor) {
+		return errors.New("a proposal has to be approved by another admin than the one who proposed it")
+	}
+	var proposed []string
+	if err := json.Unmarshal([]byte(proposal.Args), &proposed); err != nil || len(proposed) == 0 {
+		return fmt.Errorf("proposal %d has no command", proposal.ID)
+	}
+	if decision == proposalApproved && len(proposal.Secrets) > 0 {
+		if *key == "" {
+			return fmt.Errorf("proposal %d has secrets, give the -key the proposing admin was shown", proposal.ID)
+		}
+		if proposed, err = openProposalSecrets(proposed, proposal.Secrets, *key); err != nil {
+			return err
+		}
+	}
+
+	// Only one admin can decide
+	result := db.Model(&proposal).Where("decision = ?", "").Updates(map[string]interface{}{"decision": decision, "decided_by": admin.Username, "decided_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("proposal %d has already been decided", proposal.ID)
+	}
+	if decision == proposalRejected {
+		fmt.Printf("Rejected proposal %d\n", proposal.ID)
+		return nil
+	}
+
+	fmt.Printf("Approved proposal %d, running %v\n", proposal.ID, redactedArgs(proposed))
+	err = runCommand(config, withAuditActor(db, proposal.Actor).Set(approvalGrantedKey, proposal.ID), proposed)
+	if err != nil {
+		db.Model(&proposal).Update("error", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// openTestDatabase creates a migrated database in a temporary directory, removed when the test finishes
+func openTestDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	db.LogMode(false)
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	registerAuditCallbacks(db)
+	return db
+}
+
+// addTestUser creates an administrative user with a password
+func addTestUser(t *testing.T, db *gorm.DB, username, password string) {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&User{Username: username, Password: hash}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	db := openTestDatabase(t)
+	config := ApprovalConfig{Enabled: true, PrivilegedGroups: []string{"admins"}}
+
+	adminProfile := ReplyProfile{Name: "admin-vlan", VLAN: 10}
+	guestProfile := ReplyProfile{Name: "guest-vlan", VLAN: 20}
+	for _, profile := range []*ReplyProfile{&adminProfile, &guestProfile} {
+		if err := db.Create(profile).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	admins := DeviceGroup{Name: "admins", ReplyProfileID: &adminProfile.ID}
+	guests := DeviceGroup{Name: "guests", ReplyProfileID: &guestProfile.ID}
+	for _, group := range []*DeviceGroup{&admins, &guests} {
+		if err := db.Create(group).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, device := range []Device{{MAC: "001122334455", DeviceGroups: []DeviceGroup{admins}}, {MAC: "aabbccddeeff", DeviceGroups: []DeviceGroup{guests}}} {
+		if err := db.Create(&device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&Network{SSID: "Corp"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, db, "alice", "correct horse battery")
+
+	tests := []struct {
+		args     []string
+		approval bool
+	}{
+		{[]string{"set-profile", "-name", "admin-vlan", "-vlan", "1"}, true},
+		{[]string{"set-profile", "-name=admin-vlan", "-acl", "any"}, true},
+		{[]string{"set-profile", "-name", "guest-vlan", "-vlan", "1"}, false},
+		{[]string{"set-profile", "-name", "new-profile"}, false},
+		{[]string{"migrate"}, false},
+		{[]string{"migrate", "-to", "-1"}, false},
+		{[]string{"migrate", "-to", "3"}, true},
+		{[]string{"migrate", "-to=0"}, true},
+		{[]string{"purge-trash"}, false},
+		{[]string{"purge-trash", "-days", "-1"}, false},
+		{[]string{"purge-trash", "-days", "30"}, true},
+		{[]string{"purge-trash", "-mac", "001122334455"}, true},
+		{[]string{"purge-trash", "-group", "guests"}, true},
+		{[]string{"promote"}, true},
+		// A single admin can add the second one, who can then approve the rest
+		{[]string{"add-user", "-username", "bob", "-password", "x"}, false},
+		{[]string{"remove-user", "-username", "alice"}, true},
+		{[]string{"quarantine", "-mac", "00:11:22:33:44:55"}, true},
+		{[]string{"quarantine", "-mac", "aabbccddeeff"}, false},
+		{[]string{"release", "-mac", "aabbccddeeff"}, true},
+		{[]string{"set-group", "-name", "admins"}, true},
+		{[]string{"set-group", "-name", "guests"}, false},
+		{[]string{"set-group", "-name", "guests", "-network", "Corp"}, false},
+		{[]string{"set-group", "-name", "guests", "-network", "Corp", "-network=Lab"}, true},
+		{[]string{"remove-device", "-mac", "001122334455"}, true},
+		{[]string{"remove-device", "-mac", "aabbccddeeff"}, false},
+		{[]string{"bulk-devices", "-mac", "aabbccddeeff", "-disable"}, false},
+		{[]string{"bulk-devices", "-mac", "aabbccddeeff", "-mac", "00:11:22:33:44:55", "-disable"}, true},
+		{[]string{"bulk-devices", "-search", "00:11", "-remove"}, true},
+		{[]string{"bulk-devices", "-search", "00:11", "-remove", "-dry-run"}, false},
+		{[]string{"bulk-devices", "-group", "guests", "-add-group", "admins"}, true},
+		{[]string{"bulk-devices", "-group", "guests", "-remove-group", "guests"}, false},
+		{[]string{"bulk-devices", "-disabled", "-enable"}, false},
+		{[]string{"release", "-h"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			reason := config.requiresApproval(db, test.args)
+			if (reason != "") != test.approval {
+				t.Errorf("got reason %q, want approval %v", reason, test.approval)
+			}
+		})
+	}
+
+	addTestUser(t, db, "bob", "correct horse battery")
+	if reason := config.requiresApproval(db, []string{"add-user", "-username", "carol", "-password", "x"}); reason == "" {
+		t.Error("adding a third admin didn't need approval")
+	}
+}
+
+func TestProposalSecrets(t *testing.T) {
+	args := []string{"add-client", "-ip", "10.0.0.1", "-secret", "s3cret", "--shared-password=hunter2", "-name", "ap"}
+	redacted, sealed, key, err := sealProposalSecrets(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"add-client", "-ip", "10.0.0.1", "-secret", auditRedacted, "--shared-password=" + auditRedacted, "-name", "ap"}
+	if strings.Join(redacted, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", redacted, want)
+	}
+	if strings.Contains(string(sealed), "s3cret") || strings.Contains(string(sealed), "hunter2") {
+		t.Error("the sealed secrets are readable")
+	}
+
+	opened, err := openProposalSecrets(redacted, sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(opened, " ") != strings.Join(args, " ") {
+		t.Errorf("got %q, want %q", opened, args)
+	}
+
+	_, _, otherKey, err := sealProposalSecrets(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, badKey := range []string{otherKey, "", "not hex", key[:30]} {
+		if _, err := openProposalSecrets(redacted, sealed, badKey); err == nil {
+			t.Errorf("key %q was accepted", badKey)
+		}
+	}
+	if _, err := openProposalSecrets(redacted[:4], sealed, key); err == nil {
+		t.Error("secrets were put into a command with fewer secret flags")
+	}
+	if _, err := openProposalSecrets(redacted, sealed[:10], key); err == nil {
+		t.Error("truncated secrets were accepted")
+	}
+
+	redacted, sealed, key, err = sealProposalSecrets([]string{"set-network", "-ssid", "Corp"})
+	if err != nil || sealed != nil || key != "" || len(redacted) != 3 {
+		t.Errorf("a command without secrets got %q, %x, %q, %v", redacted, sealed, key, err)
+	}
+}
+
+func TestApproveProposal(t *testing.T) {
+	db := openTestDatabase(t)
+	config := Config{Approval: ApprovalConfig{Enabled: true}}
+	addTestUser(t, db, "alice", "alice password")
+	addTestUser(t, db, "bob", "bob password")
+	// Both admins use the same account on the server
+	shared := withAuditActor(db, "cli:radius")
+	asAlice := withAdminLogin(shared, "alice", "alice password")
+	asBob := withAdminLogin(shared, "bob", "bob password")
+
+	args := []string{"add-client", "-ip", "10.0.0.1", "-secret", "s3cret"}
+	if err := runCommand(config, shared, args); err == nil {
+		t.Error("a change was proposed without an admin")
+	}
+	if err := runCommand(config, withAdminLogin(shared, "alice", "wrong"), args); err == nil {
+		t.Error("a change was proposed with the wrong password")
+	}
+	if err := runCommand(config, asAlice, args); err != nil {
+		t.Fatal(err)
+	}
+
+	var proposal Proposal
+	if err := db.First(&proposal).Error; err != nil {
+		t.Fatal(err)
+	}
+	if proposal.Username != "alice" || strings.Contains(proposal.Args, "s3cret") || len(proposal.Secrets) == 0 {
+		t.Fatalf("got proposal by %q with args %v and %d bytes of secrets", proposal.Username, proposal.Args, len(proposal.Secrets))
+	}
+	var clients int
+	db.Model(&Client{}).Count(&clients)
+	if clients != 0 {
+		t.Fatal("the client was added before the proposal was approved")
+	}
+
+	// The key is only shown to alice, so encrypt the stored arguments again to get one for the test
+	_, sealed, key, err := sealProposalSecrets(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&proposal).UpdateColumn("secrets", sealed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	approve := []string{"approve", "-id", "1", "-key", key}
+	if err := runCommand(config, asAlice, approve); err == nil {
+		t.Error("alice approved her own proposal")
+	}
+	if err := runCommand(config, withAdminLogin(shared, "bob", "alice password"), approve); err == nil {
+		t.Error("a proposal was approved with the wrong password")
+	}
+	if err := runCommand(config, asBob, []string{"approve", "-id", "1"}); err == nil {
+		t.Error("a proposal with secrets was approved without its key")
+	}
+	if err := runCommand(config, asBob, approve); err != nil {
+		t.Fatal(err)
+	}
+
+	var client Client
+	if err := db.First(&client).Error; err != nil {
+		t.Fatal(err)
+	}
+	if client.Secret != "s3cret" {
+		t.Errorf("got secret %q, want the proposed one", client.Secret)
+	}
+	db.First(&proposal, proposal.ID)
+	if proposal.Decision != proposalApproved || proposal.DecidedBy != "bob" {
+		t.Errorf("got decision %q by %q", proposal.Decision, proposal.DecidedBy)
+	}
+}
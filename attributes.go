@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+	"layeh.com/radius/dictionary"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// Formats of the value of a GroupAttribute, named like the data types of RADIUS dictionaries
+const (
+	attributeFormatString  = "string"
+	attributeFormatInteger = "integer"
+	attributeFormatIPAddr  = "ipaddr"
+	attributeFormatOctets  = "octets"
+)
+
+var attributeFormats = []string{attributeFormatString, attributeFormatInteger, attributeFormatIPAddr, attributeFormatOctets}
+
+// maxTunnelTag is the highest tag of a tunnel attribute (RFC 2868 section 3.1)
+const maxTunnelTag = 0x1f
+
+// GroupAttribute is a reply attribute added to the Access-Accept of a group's devices as it is, for controllers
+// needing attributes that reply profiles don't set
+type GroupAttribute struct {
+	Model
+	DeviceGroupID uint `gorm:"not null;index"`
+	// Name describes the attribute, such as its name in the vendor's dictionary
+	Name string
+	// VendorID is the vendor of a Vendor-Specific attribute, or 0 for a standard attribute
+	VendorID uint32
+	// Type is the number of the attribute, or its vendor type for a Vendor-Specific attribute
+	Type   uint8 `gorm:"not null"`
+	Format string
+	Value  string
+	// Tag groups the tunnel attributes of RFC 2868 that belong together, or is 0 for an untagged attribute
+	Tag uint8
+}
+
+// encode converts the value of the attribute to the bytes sent, with the tag in front
+func (a GroupAttribute) encode() ([]byte, error) {
+	var value []byte
+	switch a.Format {
+	case attributeFormatString:
+		value = []byte(a.Value)
+	case attributeFormatInteger:
+		number, err := strconv.ParseUint(a.Value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", a.Value)
+		}
+		value = uint32Bytes(uint(number))
+	case attributeFormatIPAddr:
+		ip := net.ParseIP(a.Value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", a.Value)
+		}
+		value = ip
+	case attributeFormatOctets:
+		decoded, err := hex.DecodeString(strings.TrimPrefix(a.Value, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value %q", a.Value)
+		}
+		value = decoded
+	default:
+		return nil, fmt.Errorf("unknown format %q", a.Format)
+	}
+
+	if a.Tag > 0 {
+		// Tagged integers give up their first byte to the tag, while other values are prefixed with it
+		if a.Format == attributeFormatInteger {
+			if value[0] != 0 {
+				return nil, fmt.Errorf("tagged integer %v is larger than 24 bits", a.Value)
+			}
+			value[0] = a.Tag
+		} else {
+			value = append([]byte{a.Tag}, value...)
+		}
+	}
+	return value, nil
+}
+
+// validate checks the attribute can be sent
+func (a GroupAttribute) validate() error {
+	switch {
+	case a.Type == 0:
+		return errors.New("the attribute type must be between 1 and 255")
+	case a.VendorID == 0 && a.Type == uint8(rfc2865.VendorSpecific_Type):
+		return errors.New("Vendor-Specific attributes are set with -vendor and the vendor type")
+	case a.VendorID == 0 && (a.Type == uint8(rfc2869.EAPMessage_Type) || a.Type == uint8(rfc2869.MessageAuthenticator_Type) ||
+		a.Type == uint8(rfc2865.ProxyState_Type)):
+		return fmt.Errorf("attribute %d is set by the server itself", a.Type)
+	case a.Tag > maxTunnelTag:
+		return fmt.Errorf("the tag must be between 1 and %d", maxTunnelTag)
+	}
+	value, err := a.encode()
+	if err != nil {
+		return err
+	}
+	max := 253
+	// Vendor-Specific attributes also hold the vendor ID, vendor type, and length
+	if a.VendorID != 0 {
+		max -= 6
+	}
+	if len(value) > max {
+		return fmt.Errorf("the value is %d bytes long, longer than the %d bytes an attribute can hold", len(value), max)
+	}
+	return nil
+}
+
+// setFromDictionary sets the vendor, type, and format of the attribute from its definition in a dictionary
+func (a *GroupAttribute) setFromDictionary(dict *dictionary.Dictionary, name string) error {
+	vendor, definition := lookupDictionaryAttribute(dict, name)
+	if definition == nil {
+		return fmt.Errorf("attribute %q is not in the dictionaries, load the vendor's with radius.dictionaries", name)
+	}
+	if len(definition.OID) != 1 {
+		return fmt.Errorf("attribute %v is nested in attribute %d, which isn't supported", name, definition.OID[0])
+	}
+	if vendor != nil && (vendor.GetTypeOctets() != 1 || vendor.GetLengthOctets() != 1) {
+		return fmt.Errorf("vendor %v uses format=%d,%d, but only 1,1 is supported", vendor.Name, vendor.GetTypeOctets(), vendor.GetLengthOctets())
+	}
+	if a.Tag > 0 && !definition.HasTag() {
+		return fmt.Errorf("attribute %v doesn't have a tag", name)
+	}
+
+	switch definition.Type {
+	case dictionary.AttributeString:
+		a.Format = attributeFormatString
+	case dictionary.AttributeInteger, dictionary.AttributeDate:
+		a.Format = attributeFormatInteger
+	case dictionary.AttributeIPAddr:
+		a.Format = attributeFormatIPAddr
+	case dictionary.AttributeOctets:
+		a.Format = attributeFormatOctets
+	default:
+		return fmt.Errorf("attribute %v has type %v, set it with -type and its encoded value in hex with -format %v", name, definition.Type, attributeFormatOctets)
+	}
+	if vendor != nil {
+		a.VendorID = uint32(vendor.Number)
+	}
+	a.Type = uint8(definition.OID[0])
+	if a.Name == "" {
+		a.Name = definition.Name
+	}
+	return nil
+}
+
+// key identifies the attribute regardless of its value, so a group can override the attributes of its parent
+func (a GroupAttribute) key() string {
+	return fmt.Sprintf("%d:%d", a.VendorID, a.Type)
+}
+
+// String shows the vendor and type of the attribute, with its name if it has one or the dictionaries know it
+func (a GroupAttribute) String() string {
+	id := strconv.Itoa(int(a.Type))
+	if a.VendorID != 0 {
+		id = fmt.Sprintf("26/%d/%d", a.VendorID, a.Type)
+	}
+	name := a.Name
+	if name == "" {
+		name = dictionaryAttributeName(radiusDictionary, a.VendorID, a.Type)
+	}
+	if name != "" {
+		return fmt.Sprintf("%v (%v)", name, id)
+	}
+	return id
+}
+
+// addGroupAttribute adds a group attribute to a response, logging attributes that can't be encoded
+func addGroupAttribute(p *radius.Packet, attribute GroupAttribute) {
+	value, err := attribute.encode()
+	if err == nil && attribute.VendorID != 0 {
+		err = addVendorAttribute(p, attribute.VendorID, attribute.Type, value)
+	} else if err == nil {
+		p.Add(radius.Type(attribute.Type), radius.Attribute(value))
+	}
+	if err != nil {
+		log.Printf("RADIUS: Unable to add attribute %v: %v", attribute, err)
+	}
+}
+
+// addAttributeCommand adds a reply attribute to a device group
+func addAttributeCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("add-attribute", flag.ContinueOnError)
+	groupName := flags.String("group", "", "name of the device group")
+	dictionaryName := flags.String("attribute", "", "name of the attribute in the dictionaries, instead of -vendor, -type, and -format")
+	name := flags.String("name", "", "description of the attribute, such as its name in the vendor's dictionary")
+	vendor := flags.Uint("vendor", 0, "vendor ID of a Vendor-Specific attribute, or 0 for a standard attribute")
+	attributeType := flags.Uint("type", 0, "number of the attribute, or its vendor type with -vendor")
+	format := flags.String("format", attributeFormatString, "format of the value: "+strings.Join(attributeFormats, ", "))
+	value := flags.String("value", "", "value of the attribute, in hex for the octets format")
+	tag := flags.Uint("tag", 0, "tag of a tunnel attribute, or 0 for none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var group DeviceGroup
+	if db.First(&group, "name = ?", *groupName).RecordNotFound() {
+		return fmt.Errorf("device group %q does not exist", *groupName)
+	}
+	if *attributeType > 255 || *tag > 255 || *vendor > 1<<32-1 {
+		return errors.New("-type and -tag must be between 0 and 255, and -vendor a 32 bit number")
+	}
+	attribute := GroupAttribute{
+		DeviceGroupID: group.ID,
+		Name:          *name,
+		VendorID:      uint32(*vendor),
+		Type:          uint8(*attributeType),
+		Format:        *format,
+		Value:         *value,
+		Tag:           uint8(*tag),
+	}
+	if *dictionaryName != "" {
+		set := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if set["vendor"] || set["type"] || set["format"] {
+			return errors.New("-attribute can't be combined with -vendor, -type, or -format")
+		}
+		if err := attribute.setFromDictionary(radiusDictionary, *dictionaryName); err != nil {
+			return err
+		}
+	}
+	if err := attribute.validate(); err != nil {
+		return err
+	}
+	if err := db.Create(&attribute).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Added attribute %d, %v, to device group %q\n", attribute.ID, attribute, group.Name)
+	return nil
+}
+
+// removeAttributeCommand removes a reply attribute from its device group
+func removeAttributeCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-attribute", flag.ContinueOnError)
+	id := flags.Uint("id", 0, "ID of the attribute, as shown by list-attributes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var attribute GroupAttribute
+	if db.First(&attribute, *id).RecordNotFound() {
+		return fmt.Errorf("attribute %d does not exist", *id)
+	}
+	if err := db.Delete(&attribute).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed attribute %d, %v\n", attribute.ID, attribute)
+	return nil
+}
+
+// listAttributesCommand lists the reply attributes of the device groups
+func listAttributesCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-attributes", flag.ContinueOnError)
+	groupName := flags.String("group", "", "only list the attributes of this device group")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := db.Table("group_attributes").Select("group_attributes.*, device_groups.name AS group_name").
+		Joins("JOIN device_groups ON device_groups.id = group_attributes.device_group_id").Order("device_groups.name, group_attributes.id")
+	if *groupName != "" {
+		query = query.Where("device_groups.name = ?", *groupName)
+	}
+	var attributes []struct {
+		GroupAttribute
+		GroupName string
+	}
+	if err := query.Scan(&attributes).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tGROUP\tATTRIBUTE\tTAG\tFORMAT\tVALUE")
+	for _, attribute := range attributes {
+		tag := ""
+		if attribute.Tag > 0 {
+			tag = strconv.Itoa(int(attribute.Tag))
+		}
+		fmt.Fprintf(out, "%d\t%v\t%v\t%v\t%v\t%v\n", attribute.ID, attribute.GroupName, attribute.GroupAttribute, tag, attribute.Format, attribute.Value)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os/user"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AuditLog records a change to the configuration stored in the database
+type AuditLog struct {
+	ID         uint      `gorm:"primary_key"`
+	CreatedAt  time.Time `gorm:"index"`
+	Actor      string    `gorm:"index"`
+	Action     string
+	ObjectType string `gorm:"index"`
+	ObjectID   uint
+	// Before and After are the JSON encoded record, empty for the side that doesn't exist
+	Before string
+	After  string
+}
+
+// Audit actions
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+	auditActionDelete = "delete"
+)
+
+const (
+	// auditActorKey is the gorm setting holding who is making changes through a database handle
+	auditActorKey = "audit:actor"
+	// auditBeforeKey passes the record as it was before an update or delete to the after callback
+	auditBeforeKey = "audit:before"
+	// auditListenersKey holds the listeners for the changes recorded outside of the callbacks
+	auditListenersKey = "audit:listeners"
+	// auditSystemActor is recorded when no actor has been set
+	auditSystemActor = "system"
+	auditRedacted    = "<redacted>"
+	auditChanged     = "<changed>"
+)
+
+// auditedModels are the records whose changes are recorded
+var auditedModels = []interface{}{&Device{}, &DeviceGroup{}, &Network{}, &Client{}, &User{}, &Credential{}, &Certificate{}, &ReplyProfile{}, &GroupAttribute{}, &Voucher{}, &SponsorRequest{}}
+
+// auditSecretFields are left out of the recorded values, only showing if they were set
+var auditSecretFields = []string{"Password", "NTHash", "Secret", "Code", "SharedPassword", "PSK", "ResetToken"}
+
+// AuditListener is told about every change recorded in the audit log
+type AuditListener func(entry AuditLog)
+
+// withAuditActor returns a database handle that records changes as made by actor
+func withAuditActor(db *gorm.DB, actor string) *gorm.DB {
+	return db.Set(auditActorKey, actor)
+}
+
+// commandActor names the operating system user running an administrative command
+func commandActor() string {
+	if current, err := user.Current(); err == nil {
+		return "cli:" + current.Username
+	}
+	return "cli"
+}
+
+// registerAuditCallbacks records every create, update, and delete of an audited model in the AuditLog table and
+// passes the entries to the listeners
+func registerAuditCallbacks(db *gorm.DB, listeners ...AuditListener) {
+	tables := make(map[string]bool)
+	for _, model := range auditedModels {
+		tables[db.NewScope(model).TableName()] = true
+	}
+	audited := func(scope *gorm.Scope) bool {
+		return tables[scope.TableName()] && !scope.PrimaryKeyZero()
+	}
+
+	db.InstantSet(auditListenersKey, listeners)
+
+	// gorm logs every callback it registers, which would show up before the output of every command
+	db = db.New()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(ioutil.Discard, "", 0)})
+
+	// Changes are recorded once the associations saved with the record, such as the groups of a device, are too
+	db.Callback().Create().After("gorm:save_after_associations").Register("audit:create", func(scope *gorm.Scope) {
+		if audited(scope) && !scope.HasError() {
+			writeAuditLog(scope, listeners, auditActionCreate, nil, auditColumns(scope, scope.Value))
+		}
+	})
+
+	loadBefore := func(scope *gorm.Scope) {
+		if audited(scope) {
+			scope.InstanceSet(auditBeforeKey, auditLoadCurrent(scope))
+		}
+	}
+	db.Callback().Update().Before("gorm:update").Register("audit:before_update", loadBefore)
+	db.Callback().Delete().Before("gorm:delete").Register("audit:before_delete", loadBefore)
+
+	db.Callback().Update().After("gorm:save_after_associations").Register("audit:update", func(scope *gorm.Scope) {
+		if before, ok := scope.InstanceGet(auditBeforeKey); ok && !scope.HasError() {
+			if after := auditLoadCurrent(scope); !reflect.DeepEqual(before, after) {
+				writeAuditLog(scope, listeners, auditActionUpdate, before.(map[string]interface{}), after)
+			}
+		}
+	})
+	db.Callback().Delete().After("gorm:delete").Register("audit:delete", func(scope *gorm.Scope) {
+		if before, ok := scope.InstanceGet(auditBeforeKey); ok && !scope.HasError() {
+			writeAuditLog(scope, listeners, auditActionDelete, before.(map[string]interface{}), nil)
+		}
+	})
+}
+
+// auditAssociationChange runs change, which changes the associations of a record such as the groups of a device,
+// and records it as an update of the record, since gorm changes associations without running the callbacks
+func auditAssociationChange(db *gorm.DB, value interface{}, change func() error) error {
+	scope := db.NewScope(value)
+	before := auditLoadCurrent(scope)
+	if err := change(); err != nil {
+		return err
+	}
+	if after := auditLoadCurrent(scope); before != nil && !reflect.DeepEqual(before, after) {
+		listeners, _ := db.Get(auditListenersKey)
+		listenerList, _ := listeners.([]AuditListener)
+		writeAuditLog(scope, listenerList, auditActionUpdate, before, after)
+	}
+	return nil
+}
+
+// auditLoadCurrent reads the columns of the stored record a scope is changing
+func auditLoadCurrent(scope *gorm.Scope) map[string]interface{} {
+	current := reflect.New(reflect.Indirect(reflect.ValueOf(scope.Value)).Type()).Interface()
+	// Records in the trash are restored and purged with changes too
+	if err := scope.NewDB().Unscoped().First(current, scope.PrimaryKeyValue()).Error; err != nil {
+		return nil
+	}
+	return auditColumns(scope, current)
+}
+
+// auditColumns collects the column values of a record, leaving out associations
+func auditColumns(scope *gorm.Scope, value interface{}) map[string]interface{} {
+	columns := make(map[string]interface{})
+	for _, field := range scope.New(value).Fields() {
+		// The time of the change is the time of the entry
+		if field.IsNormal && field.Name != "UpdatedAt" {
+			columns[field.Name] = field.Field.Interface()
+		}
+	}
+	// The groups of a device are part of its history, including groups in the trash
+	if device, ok := value.(*Device); ok && device.ID != 0 {
+		groups := []string{}
+		scope.NewDB().Table("device_groups").Joins("JOIN device_devicegroups ON device_devicegroups.device_group_id = device_groups.id").
+			Where("device_devicegroups.device_id = ?", device.ID).Order("name").Pluck("name", &groups)
+		columns["DeviceGroups"] = groups
+	}
+	return columns
+}
+
+// auditJSON encodes the columns of a record with the secrets redacted. Secrets that differ from the other
+// side of the change are shown as changed.
+func auditJSON(columns, other map[string]interface{}) string {
+	if columns == nil {
+		return ""
+	}
+
+	redacted := make(map[string]interface{}, len(columns))
+	for name, value := range columns {
+		redacted[name] = value
+	}
+	for _, name := range auditSecretFields {
+		value, ok := columns[name]
+		if !ok || reflect.ValueOf(value).Len() == 0 {
+			continue
+		}
+		if other != nil && !reflect.DeepEqual(value, other[name]) {
+			redacted[name] = auditChanged
+		} else {
+			redacted[name] = auditRedacted
+		}
+	}
+
+	encoded, err := json.Marshal(redacted)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+func writeAuditLog(scope *gorm.Scope, listeners []AuditListener, action string, before, after map[string]interface{}) {
+	actor := auditSystemActor
+	if value, ok := scope.Get(auditActorKey); ok {
+		actor = value.(string)
+	}
+
+	id, _ := scope.PrimaryKeyValue().(uint)
+	entry := AuditLog{
+		Actor:      actor,
+		Action:     action,
+		ObjectType: scope.GetModelStruct().ModelType.Name(),
+		ObjectID:   id,
+		Before:     auditJSON(before, nil),
+		After:      auditJSON(after, before),
+	}
+	if err := scope.NewDB().Create(&entry).Error; err != nil {
+		log.Printf("AUDIT: Unable to record %v of %v %v: %v", action, entry.ObjectType, id, err)
+		return
+	}
+	for _, listener := range listeners {
+		listener(entry)
+	}
+}
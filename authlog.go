@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc3162"
+)
+
+// Authentication methods
+const (
+	authMethodMAC    = "mac"
+	authMethodEAPTLS = "eap-tls"
+	authMethodPEAP   = "peap"
+	// authMethodEAP is used when an EAP conversation is rejected before a method is chosen
+	authMethodEAP = "eap"
+)
+
+// Reasons an authentication was rejected
+const (
+	authReasonUnknownDevice     = "unknown device"
+	authReasonUnknownUser       = "unknown user"
+	authReasonSSIDNotAllowed    = "ssid not allowed"
+	authReasonWrongPassword     = "wrong password"
+	authReasonRevoked           = "revoked certificate"
+	authReasonWrongDevice       = "credential not assigned to device"
+	authReasonHandshakeFailed   = "tls handshake failed"
+	authReasonNotWireless       = "not a wireless port"
+	authReasonInvalidMACAddress = "invalid mac address"
+	authReasonExpired           = "registration expired"
+	authReasonClientNotAllowed  = "ssid not allowed for client"
+	authReasonDisabled          = "device disabled"
+	authReasonSessionLimit      = "too many sessions"
+	authReasonHoneypot          = "honeypot network"
+)
+
+// AuthEvent describes the outcome of an authentication
+type AuthEvent struct {
+	// EventID is shared by the log lines, the auth log entry, and the accounting sessions of the authentication
+	EventID  string    `json:"event_id"`
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	MAC      string    `json:"mac"`
+	Username string    `json:"username"`
+	SSID     string    `json:"ssid"`
+	Client   string    `json:"client"`
+	Accepted bool      `json:"accepted"`
+	Reason   string    `json:"reason,omitempty"`
+	// NASIdentifier, NASIP, and OperatorName are the attributes of the same name sent by the NAS
+	NASIdentifier string `json:"nas_identifier,omitempty"`
+	NASIP         string `json:"nas_ip,omitempty"`
+	OperatorName  string `json:"operator_name,omitempty"`
+	// AccessPoint is the MAC address of the access point from the Called-Station-Id
+	AccessPoint string `json:"access_point,omitempty"`
+}
+
+// AuthListener is told about every authentication. Listeners are called from the RADIUS handler, so they must
+// not block.
+type AuthListener func(event AuthEvent)
+
+// authEvent fills in the details every event shares and passes it to the listeners
+func (rs *RadiusServer) authEvent(r *radius.Request, event AuthEvent) {
+	if len(rs.AuthListeners) == 0 {
+		return
+	}
+
+	event.EventID = eventID(r)
+	event.Time = time.Now()
+	event.Client = addrIP(r.RemoteAddr).String()
+	if event.MAC == "" {
+		if mac := normalizeMACAddress(rfc2865.CallingStationID_GetString(r.Packet)); isValidMACFormat(mac) {
+			event.MAC = mac
+		}
+	}
+	event.NASIdentifier = rfc2865.NASIdentifier_GetString(r.Packet)
+	if ip, err := rfc2865.NASIPAddress_Lookup(r.Packet); err == nil {
+		event.NASIP = ip.String()
+	} else if ip, err := rfc3162.NASIPv6Address_Lookup(r.Packet); err == nil {
+		event.NASIP = ip.String()
+	}
+	event.OperatorName = operatorName(r.Packet)
+	client, _ := rs.lookupClient(rs.DB, r.RemoteAddr)
+	event.AccessPoint = calledStationMAC(client, rfc2865.CalledStationID_GetString(r.Packet))
+	for _, listener := range rs.AuthListeners {
+		listener(event)
+	}
+}
+
+// AuthLog records the outcome of an authentication
+type AuthLog struct {
+	ID            uint      `gorm:"primary_key"`
+	EventID       string    `gorm:"index"`
+	CreatedAt     time.Time `gorm:"index"`
+	Method        string
+	MAC           string `gorm:"index"`
+	Username      string
+	SSID          string
+	Client        string
+	Accepted      bool
+	Reason        string
+	NASIdentifier string
+	NASIP         string
+	OperatorName  string
+	AccessPoint   string
+}
+
+const (
+	authLogQueueSize     = 4096
+	authLogBatchSize     = 200
+	authLogFlushInterval = time.Second
+)
+
+// AuthLogWriter stores authentication events in the AuthLog table in the background, in batches, so the
+// RADIUS handler never waits on the database
+type AuthLogWriter struct {
+	db      *gorm.DB
+	events  chan AuthEvent
+	done    chan struct{}
+	dropped uint64
+
+	// mu keeps requests that outlived the shutdown from queueing events after Stop
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// NewAuthLogWriter creates an AuthLogWriter and starts writing
+func NewAuthLogWriter(db *gorm.DB) *AuthLogWriter {
+	w := &AuthLogWriter{
+		db:     db,
+		events: make(chan AuthEvent, authLogQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Log queues an event, dropping it if the database can't keep up
+func (w *AuthLogWriter) Log(event AuthEvent) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.stopped {
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		if dropped := atomic.AddUint64(&w.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+			log.Printf("AUTHLOG: Queue is full, %d events dropped", dropped)
+		}
+	}
+}
+
+// Stop writes the queued events and stops the writer
+func (w *AuthLogWriter) Stop() {
+	w.mu.Lock()
+	w.stopped = true
+	close(w.events)
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *AuthLogWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(authLogFlushInterval)
+	defer ticker.Stop()
+
+	var batch []AuthEvent
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= authLogBatchSize {
+				w.write(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = nil
+		}
+	}
+}
+
+// write stores a batch in one transaction
+func (w *AuthLogWriter) write(batch []AuthEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	tx := w.db.Begin()
+	for _, event := range batch {
+		entry := AuthLog{
+			EventID:       event.EventID,
+			CreatedAt:     event.Time,
+			Method:        event.Method,
+			MAC:           event.MAC,
+			Username:      event.Username,
+			SSID:          event.SSID,
+			Client:        event.Client,
+			Accepted:      event.Accepted,
+			Reason:        event.Reason,
+			NASIdentifier: event.NASIdentifier,
+			NASIP:         event.NASIP,
+			OperatorName:  event.OperatorName,
+			AccessPoint:   event.AccessPoint,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			tx.Rollback()
+			log.Printf("AUTHLOG: Unable to write %d events: %v", len(batch), err)
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("AUTHLOG: Unable to write %d events: %v", len(batch), err)
+	}
+}
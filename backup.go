@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// databasePath is the SQLite database holding all records
+const databasePath = "data.db"
+
+// backupCommand writes a consistent snapshot of the database, which can be taken while the server is running
+func backupCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := flags.String("out", "", "file to write the backup to (default data-<time>.db)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = "data-" + time.Now().Format("20060102-150405") + ".db"
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%v already exists", *out)
+	}
+	if err := db.Exec("VACUUM INTO ?", *out).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved a backup to %v\n", *out)
+	return nil
+}
+
+// restoreCommand replaces the database with a backup after checking it, keeping the current database beside it
+func restoreCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := flags.String("in", "", "backup file to restore")
+	confirm := flags.Bool("confirm", false, "confirm that the server is stopped and the current records should be replaced")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+	if err := checkBackup(*in); err != nil {
+		return fmt.Errorf("%v is not a usable backup: %v", *in, err)
+	}
+	if !*confirm {
+		return errors.New("stop the server and add -confirm to replace the current records")
+	}
+
+	// Keep the current database in case the wrong backup was restored
+	previous := databasePath + ".before-restore-" + time.Now().Format("20060102-150405")
+	if err := db.Exec("VACUUM INTO ?", previous).Error; err != nil {
+		return fmt.Errorf("unable to save the current database: %v", err)
+	}
+	db.Close()
+	if err := copyFile(*in, databasePath); err != nil {
+		return err
+	}
+	// A journal left by the previous database must not be applied to the restored one
+	os.Remove(databasePath + "-journal")
+	os.Remove(databasePath + "-wal")
+	os.Remove(databasePath + "-shm")
+
+	fmt.Printf("Restored %v, the previous database was saved to %v\n", *in, previous)
+	return nil
+}
+
+// checkBackup verifies a file is an intact database with the tables of this program
+func checkBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	backup, err := gorm.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var result string
+	if err := backup.Raw("PRAGMA integrity_check").Row().Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+	for _, model := range []interface{}{&Device{}, &DeviceGroup{}, &Client{}} {
+		if !backup.HasTable(model) {
+			return fmt.Errorf("missing the %v table", backup.NewScope(model).TableName())
+		}
+	}
+	return nil
+}
+
+// copyFile replaces dst with the contents of src
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
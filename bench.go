@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// benchAccessPoint is the documentation MAC address of RFC 7042 sent as the access point in the Called-Station-Id
+const benchAccessPoint = "00-00-5e-00-53-00"
+
+// benchResult is the outcome of one synthetic Access-Request
+type benchResult struct {
+	code    radius.Code
+	latency time.Duration
+	err     error
+}
+
+// benchCommand sends synthetic MAC authentication requests to a RADIUS server and reports the latencies
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	server := flags.String("server", "127.0.0.1:1812", "address of the RADIUS server")
+	secret := flags.String("secret", "", "shared secret of this host as a RADIUS client")
+	requests := flags.Int("requests", 10000, "number of requests to send")
+	concurrency := flags.Int("concurrency", 50, "number of requests in flight at once")
+	macs := flags.Int("macs", 1000, "number of different random MAC addresses to use, or 0 for a new one per request")
+	macFile := flags.String("mac-file", "", "file with one MAC address per line to use instead of random ones, such as registered devices")
+	ssid := flags.String("ssid", "Bench", "SSID sent in the Called-Station-Id")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *secret == "" {
+		return errors.New("-secret is required")
+	}
+	if *requests < 1 || *concurrency < 1 {
+		return errors.New("-requests and -concurrency must be at least 1")
+	}
+
+	var pool []string
+	var err error
+	if *macFile != "" {
+		pool, err = readBenchMACs(*macFile)
+	} else {
+		for i := 0; i < *macs && err == nil; i++ {
+			var mac string
+			mac, err = randomBenchMAC()
+			pool = append(pool, mac)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan int)
+	results := make(chan benchResult, *requests)
+	client := &radius.Client{}
+	var wait sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for n := range jobs {
+				var mac string
+				if len(pool) > 0 {
+					mac = pool[n%len(pool)]
+				} else if random, err := randomBenchMAC(); err == nil {
+					mac = random
+				} else {
+					results <- benchResult{err: err}
+					continue
+				}
+				results <- sendBenchRequest(client, *server, *secret, mac, *ssid, *timeout)
+			}
+		}()
+	}
+
+	fmt.Printf("Sending %d requests to %v with %d in flight\n", *requests, *server, *concurrency)
+	start := time.Now()
+	for n := 0; n < *requests; n++ {
+		jobs <- n
+	}
+	close(jobs)
+	wait.Wait()
+	elapsed := time.Since(start)
+	close(results)
+
+	latencies := make(map[string][]time.Duration)
+	failures := make(map[string]int)
+	for result := range results {
+		if result.err != nil {
+			failures[result.err.Error()]++
+			continue
+		}
+		latencies[result.code.String()] = append(latencies[result.code.String()], result.latency)
+	}
+
+	fmt.Printf("Finished in %v, %.0f requests/s\n\n", elapsed.Round(time.Millisecond), float64(*requests)/elapsed.Seconds())
+	fmt.Printf("%-15s %8s %10s %10s %10s %10s\n", "RESULT", "COUNT", "P50", "P90", "P99", "MAX")
+	var codes []string
+	for code := range latencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		values := latencies[code]
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		fmt.Printf("%-15s %8d %10v %10v %10v %10v\n", code, len(values),
+			benchPercentile(values, 50), benchPercentile(values, 90), benchPercentile(values, 99), benchPercentile(values, 100))
+	}
+	for failure, count := range failures {
+		fmt.Printf("%-15s %8d %v\n", "Error", count, failure)
+	}
+	return nil
+}
+
+// sendBenchRequest sends one MAC authentication request the way a wireless controller does
+func sendBenchRequest(client *radius.Client, server, secret, mac, ssid string, timeout time.Duration) benchResult {
+	packet := newMACAuthRequest(secret, mac, benchAccessPoint+":"+ssid)
+	if err := addMessageAuthenticator(packet); err != nil {
+		return benchResult{err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	response, err := client.Exchange(ctx, packet, server)
+	if err == context.DeadlineExceeded {
+		err = errors.New("no response")
+	}
+	if err != nil {
+		return benchResult{err: err}
+	}
+	return benchResult{code: response.Code, latency: time.Since(start)}
+}
+
+// newMACAuthRequest builds a MAC authentication Access-Request the way a wireless controller does, before the
+// Message-Authenticator is added
+func newMACAuthRequest(secret, mac, calledStationID string) *radius.Packet {
+	packet := radius.New(radius.CodeAccessRequest, []byte(secret))
+	rfc2865.UserName_SetString(packet, mac)
+	rfc2865.NASPortType_Set(packet, rfc2865.NASPortType_Value_Wireless80211)
+	rfc2865.CalledStationID_SetString(packet, calledStationID)
+	rfc2865.CallingStationID_SetString(packet, mac)
+	return packet
+}
+
+// benchPercentile picks the latency at a percentile of the sorted values
+func benchPercentile(sorted []time.Duration, percentile int) time.Duration {
+	index := (len(sorted)*percentile+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index].Round(time.Microsecond)
+}
+
+// randomBenchMAC creates a random locally administered MAC address
+func randomBenchMAC() (string, error) {
+	var mac [6]byte
+	if _, err := rand.Read(mac[:]); err != nil {
+		return "", err
+	}
+	mac[0] = mac[0]&0xfc | 0x02
+	return fmt.Sprintf("%x", mac[:]), nil
+}
+
+// readBenchMACs reads the MAC addresses of a file, one per line
+func readBenchMACs(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var macs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		mac := normalizeMACAddress(line)
+		if !isValidMACFormat(mac) {
+			return nil, fmt.Errorf("invalid MAC address %q", line)
+		}
+		macs = append(macs, mac)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(macs) == 0 {
+		return nil, fmt.Errorf("no MAC addresses in %v", path)
+	}
+	return macs, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Chat notification events
+const (
+	chatEventUnknownDevice     = "unknown_device"
+	chatEventAdminLoginFailure = "admin_login_failure"
+	chatEventSecretMismatch    = "client_secret_mismatch"
+)
+
+var chatEvents = []string{chatEventUnknownDevice, chatEventAdminLoginFailure, chatEventSecretMismatch}
+
+// Chat services, which differ in the field holding the message
+const (
+	chatSlack   = "slack"
+	chatDiscord = "discord"
+	chatTeams   = "teams"
+)
+
+const (
+	chatQueueSize = 256
+	// chatNotifyInterval stops the same device or client from being notified again for a while, since
+	// controllers retry rejected requests
+	chatNotifyInterval = time.Hour
+)
+
+// ChatConfig stores the settings for posting notifications to a chat service's incoming webhook
+type ChatConfig struct {
+	// Type is "slack", "discord", or "teams"
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Events selects the notifications posted, or all of them if empty
+	Events []string `json:"events"`
+}
+
+// validate checks a chat integration read from the configuration file
+func (c ChatConfig) validate() error {
+	switch c.Type {
+	case chatSlack, chatDiscord, chatTeams:
+	default:
+		return fmt.Errorf("unknown chat type %q", c.Type)
+	}
+	parsed, err := url.Parse(c.URL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("invalid chat webhook URL %q", c.URL)
+	}
+	for _, event := range c.Events {
+		if !stringInSlice(event, chatEvents) {
+			return fmt.Errorf("unknown chat event %q", event)
+		}
+	}
+	return nil
+}
+
+// body formats a message the way the chat service expects it
+func (c ChatConfig) body(text string) ([]byte, error) {
+	field := "text"
+	if c.Type == chatDiscord {
+		field = "content"
+	}
+	return json.Marshal(map[string]string{field: text})
+}
+
+type chatMessage struct {
+	event string
+	text  string
+}
+
+// ChatNotifier posts notifications to Slack, Discord, or Teams in the background
+type ChatNotifier struct {
+	configs []ChatConfig
+	client  *http.Client
+
+	mutex     sync.Mutex
+	notified  map[string]time.Time
+	lastSweep time.Time
+	queue     chan chatMessage
+	done      chan struct{}
+}
+
+// NewChatNotifier checks the chat integrations and starts posting, or returns nil if there are none
+func NewChatNotifier(configs []ChatConfig) (*ChatNotifier, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &ChatNotifier{
+		configs:  configs,
+		client:   &http.Client{Timeout: webhookTimeout},
+		notified: make(map[string]time.Time),
+		queue:    make(chan chatMessage, chatQueueSize),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// AuthEvent notifies about devices that aren't registered
+func (c *ChatNotifier) AuthEvent(event AuthEvent) {
+	if event.Accepted || event.Reason != authReasonUnknownDevice || event.MAC == "" {
+		return
+	}
+	c.notify(chatEventUnknownDevice, event.MAC, fmt.Sprintf("Unknown device %v was rejected from %q through RADIUS client %v", prettyPrintMACAddress(event.MAC), event.SSID, event.Client))
+}
+
+// SecretMismatch notifies about a RADIUS client sending requests signed with a different shared secret
+func (c *ChatNotifier) SecretMismatch(client string) {
+	c.notify(chatEventSecretMismatch, client, fmt.Sprintf("RADIUS client %v sent a request with an invalid Message-Authenticator, its shared secret probably doesn't match", client))
+}
+
+// LoginFailure notifies about a wrong password for an administrative user
+func (c *ChatNotifier) LoginFailure(username string) {
+	c.notify(chatEventAdminLoginFailure, username, fmt.Sprintf("Failed login for administrative user %q", username))
+}
+
+// notify queues a message unless the same event was recently notified for key
+func (c *ChatNotifier) notify(event, key, text string) {
+	c.mutex.Lock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= time.Minute {
+		for notifiedKey, notified := range c.notified {
+			if now.Sub(notified) >= chatNotifyInterval {
+				delete(c.notified, notifiedKey)
+			}
+		}
+		c.lastSweep = now
+	}
+	if notified, ok := c.notified[event+" "+key]; ok && now.Sub(notified) < chatNotifyInterval {
+		c.mutex.Unlock()
+		return
+	}
+	c.notified[event+" "+key] = now
+	c.mutex.Unlock()
+
+	select {
+	case c.queue <- chatMessage{event: event, text: text}:
+	default:
+		log.Printf("CHAT: Queue is full, dropping %v notification", event)
+	}
+}
+
+// Stop posts the queued notifications and stops the notifier
+func (c *ChatNotifier) Stop() {
+	close(c.queue)
+	<-c.done
+}
+
+func (c *ChatNotifier) run() {
+	defer close(c.done)
+	for message := range c.queue {
+		for _, config := range c.configs {
+			if len(config.Events) > 0 && !stringInSlice(message.event, config.Events) {
+				continue
+			}
+			if err := c.post(config, message.text); err != nil {
+				log.Printf("CHAT: Unable to post %v notification to %v: %v", message.event, config.Type, err)
+			}
+		}
+	}
+}
+
+// post sends a message, retrying with backoff like the webhooks
+func (c *ChatNotifier) post(config ChatConfig, text string) error {
+	body, err := config.body(text)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookRetryBackoff
+	for attempt := 1; ; attempt++ {
+		var response *http.Response
+		response, err = c.client.Post(config.URL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode < 200 || response.StatusCode > 299 {
+				err = fmt.Errorf("server replied %v", response.Status)
+			}
+		}
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
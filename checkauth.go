@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+)
+
+// checkAuthCommand runs the MAC authentication policy for a device without a RADIUS request and explains the
+// outcome, to debug why a device is or isn't allowed on a network
+func checkAuthCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("check-auth", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address of the device")
+	ssid := flags.String("ssid", "", "SSID the device joins")
+	clientAddress := flags.String("client", "", "IP address the RADIUS client sends requests from")
+	password := flags.String("password", "", "User-Password the client sends, for clients and networks that check it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(*clientAddress)
+	if ip == nil {
+		return errors.New("-client must be an IP address")
+	}
+	*mac = normalizeMACAddress(*mac)
+
+	rs := NewRadiusServer(db)
+	rs.RejectReplyMessage = config.RADIUS.RejectReplyMessage
+	rs.QuarantineGroup = config.Quarantine.Group
+	if err := rs.resolveClientHostnames(); err != nil {
+		return err
+	}
+	addr := &net.UDPAddr{IP: ip}
+	client, found := rs.lookupClient(rs.DB, addr)
+	if !found {
+		fmt.Printf("Result:   dropped, %v is not a registered RADIUS client\n", ip)
+		return nil
+	}
+	fmt.Printf("Client:   %v\n", client.ClientIP)
+
+	code := radius.CodeAccessReject
+	var reason string
+	var decision macDecision
+	// evaluated is set once the device and network have been looked up
+	evaluated := false
+	switch {
+	case !clientAllowsSSID(client, *ssid):
+		reason = authReasonClientNotAllowed
+	case rs.lookupNetwork(rs.DB, *ssid).Honeypot:
+		reason = authReasonHoneypot
+	case !isValidMACFormat(*mac):
+		reason = authReasonInvalidMACAddress
+	default:
+		decision = rs.authorizeMAC(rs.DB, client, ip.String(), *ssid, *mac, *password)
+		reason = decision.reason
+		evaluated = reason != authReasonWrongPassword
+		if decision.accepted {
+			code = radius.CodeAccessAccept
+		}
+	}
+
+	if decision.found {
+		device := prettyPrintMACAddress(decision.device.MAC)
+		if device == "" {
+			device = decision.device.MAC
+		}
+		if decision.device.Name != "" {
+			device += " (" + decision.device.Name + ")"
+		}
+		if decision.device.MAC != *mac {
+			device += ", matching " + prettyPrintMACAddress(*mac)
+		}
+		fmt.Printf("Device:   %v\n", device)
+		var groups []string
+		for _, group := range decision.device.DeviceGroups {
+			groups = append(groups, group.Name)
+		}
+		if rs.quarantined(decision.device) {
+			fmt.Printf("Groups:   %v (quarantined, its other groups don't apply)\n", strings.Join(groups, ", "))
+		} else {
+			fmt.Printf("Groups:   %v\n", strings.Join(groups, ", "))
+		}
+	} else if evaluated {
+		fmt.Printf("Device:   not registered\n")
+	}
+	if evaluated {
+		for name, access := range networkAccessNames {
+			if access == decision.access {
+				fmt.Printf("Network:  %q with access %v\n", *ssid, name)
+			}
+		}
+	}
+
+	fmt.Printf("Result:   %v\n", code)
+	switch {
+	case reason != "":
+		fmt.Printf("Reason:   %v\n", reason)
+	case len(decision.groups) > 0:
+		var granting []string
+		for _, group := range decision.groups {
+			if groupAllowsSSID(group, *ssid) {
+				granting = append(granting, group.Name)
+			}
+		}
+		fmt.Printf("Allowed:  by group %v\n", strings.Join(granting, ", "))
+	case decision.registered():
+		fmt.Printf("Allowed:  by the network, which allows any registered device\n")
+	default:
+		fmt.Printf("Allowed:  by the network, which allows any device\n")
+	}
+
+	// Build the reply the client would get
+	request := &radius.Request{Packet: radius.New(radius.CodeAccessRequest, []byte(client.Secret)), RemoteAddr: addr}
+	response := newResponse(request, code)
+	if code == radius.CodeAccessAccept {
+		rs.addReplyAttributes(request, response, decision.groups, *ssid)
+		if decision.registered() && decision.device.PSK != "" {
+			rs.addDevicePSK(request, response, decision.device.PSK, *ssid)
+		}
+	} else {
+		rs.addRejectReason(response, reason)
+	}
+	if len(response.Attributes) > 0 {
+		// Skip the line with the code and identifier
+		dump := dumpPacket(radiusDictionary, response)
+		fmt.Printf("Reply:\n%v\n", dump[strings.Index(dump, "\n")+1:])
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Attributes a client can put the MAC address of MAC authentication in
+const (
+	macSourceUserName         = "user-name"
+	macSourceCallingStationID = "calling-station-id"
+)
+
+// RADIUSSecret looks up the secret of the RADIUS client a packet came from. Packets from addresses that
+// aren't in the Client table get an empty secret, which makes the packet server silently drop them.
+func (rs *RadiusServer) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	return rs.clientSecret(ctx, remoteAddr, "")
+}
+
+// listenerSecrets looks up client secrets for packets received on one listener
+type listenerSecrets struct {
+	rs   *RadiusServer
+	name string
+}
+
+// RADIUSSecret looks up the secret of the RADIUS client a packet came from, dropping packets from clients
+// assigned to another listener
+func (s listenerSecrets) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	return s.rs.clientSecret(ctx, remoteAddr, s.name)
+}
+
+// clientSecret looks up the secret of the client at remoteAddr, if it may use the listener, or any listener if
+// it is empty
+func (rs *RadiusServer) clientSecret(ctx context.Context, remoteAddr net.Addr, listener string) ([]byte, error) {
+	db, cancel := rs.requestDB(ctx)
+	defer cancel()
+	var client Client
+	var found bool
+	if !rs.timedLookup(db, remoteAddr, func() { client, found = rs.lookupClient(db, remoteAddr) }) {
+		return nil, nil
+	}
+	if !found || client.Secret == "" || (listener != "" && client.Listener != "" && client.Listener != listener) {
+		dropped := atomic.AddUint64(&rs.droppedPackets, 1)
+		switch {
+		case !found:
+			log.Printf("RADIUS: Dropping packet from unregistered client %v (%d dropped)", remoteAddr, dropped)
+			logSecurityEvent(securityUnknownClient, addrIP(remoteAddr), "")
+		case client.Secret == "":
+			log.Printf("RADIUS: Dropping packet from client %v without a secret (%d dropped)", remoteAddr, dropped)
+		default:
+			log.Printf("RADIUS: Dropping packet from client %v on the %v listener, which it is not assigned to (%d dropped)", remoteAddr, listener, dropped)
+		}
+		return nil, nil
+	}
+
+	return []byte(client.Secret), nil
+}
+
+// DroppedPackets returns how many packets have been dropped because they came from unregistered clients
+func (rs *RadiusServer) DroppedPackets() uint64 {
+	return atomic.LoadUint64(&rs.droppedPackets)
+}
+
+// lookupClient finds the Client entry for the address a packet came from
+func (rs *RadiusServer) lookupClient(db *gorm.DB, remoteAddr net.Addr) (Client, bool) {
+	ip := addrIP(remoteAddr)
+	if ip == nil {
+		return Client{}, false
+	}
+
+	var clients []Client
+	var generation uint64
+	cached := false
+	if rs.devices != nil {
+		clients, cached, generation = rs.devices.getClients()
+	}
+	if !cached {
+		if err := db.Preload("Networks").Find(&clients).Error; err != nil {
+			log.Printf("RADIUS: Unable to load clients: %v", err)
+			return Client{}, false
+		}
+		if rs.devices != nil {
+			rs.devices.putClients(clients, generation)
+		}
+	}
+
+	return matchClient(clients, ip, rs.hostnames)
+}
+
+// matchClient finds the client for an IP address, preferring an exact address or hostname over the most specific CIDR range
+func matchClient(clients []Client, ip net.IP, hostnames *clientHostnames) (Client, bool) {
+	best := -1
+	bestPrefix := -1
+	for i, client := range clients {
+		if clientIP := net.ParseIP(client.ClientIP); clientIP != nil {
+			if clientIP.Equal(ip) {
+				return client, true
+			}
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(client.ClientIP); err == nil {
+			if network.Contains(ip) {
+				if prefix, _ := network.Mask.Size(); prefix > bestPrefix {
+					best = i
+					bestPrefix = prefix
+				}
+			}
+			continue
+		}
+
+		for _, address := range hostnames.lookup(client.ClientIP) {
+			if address.Equal(ip) {
+				return client, true
+			}
+		}
+	}
+
+	if best == -1 {
+		return Client{}, false
+	}
+	return clients[best], true
+}
+
+// clientAllowsSSID checks if a client may grant access to the SSID. A client limited to some networks can't
+// grant access when the SSID is unknown.
+func clientAllowsSSID(client Client, ssid string) bool {
+	if len(client.Networks) == 0 {
+		return true
+	}
+	for _, network := range client.Networks {
+		if network.SSID == ssid {
+			return true
+		}
+	}
+	return false
+}
+
+// calledStationSSID extracts the SSID from a Called-Station-Id, which is usually the AP MAC address and SSID
+// separated by a colon. Clients that format it differently can set another delimiter or field.
+func calledStationSSID(client Client, calledStationID string) string {
+	// Some controllers only send the AP MAC address
+	if calledStationID == "" || isValidMACFormat(normalizeMACAddress(calledStationID)) {
+		return client.DefaultSSID
+	}
+
+	delimiter := client.SSIDDelimiter
+	if delimiter == "" {
+		delimiter = ":"
+	}
+	fields := strings.Split(calledStationID, delimiter)
+
+	var ssid string
+	switch {
+	case client.SSIDField == 0:
+		ssid = fields[len(fields)-1]
+	case client.SSIDField <= len(fields):
+		ssid = fields[client.SSIDField-1]
+	}
+	if ssid == "" {
+		return client.DefaultSSID
+	}
+	return ssid
+}
+
+// requestMAC returns the MAC address of a MAC authentication from the first attribute of the client's MAC
+// source holding a valid address, or the normalized value of the last one if none does
+func requestMAC(client Client, packet *radius.Packet) string {
+	var mac string
+	for _, source := range strings.Split(client.MACSource, ",") {
+		switch source {
+		case macSourceCallingStationID:
+			mac = normalizeMACAddress(rfc2865.CallingStationID_GetString(packet))
+		default:
+			mac = normalizeMACAddress(rfc2865.UserName_GetString(packet))
+		}
+		if isValidMACFormat(mac) {
+			return mac
+		}
+	}
+	return mac
+}
+
+// parseMACSource checks a comma-separated list of MAC source attributes
+func parseMACSource(s string) (string, error) {
+	sources := strings.Split(strings.ToLower(strings.Replace(s, " ", "", -1)), ",")
+	for i, source := range sources {
+		if source != macSourceUserName && source != macSourceCallingStationID {
+			return "", fmt.Errorf("unknown MAC source %q, expected %v or %v", source, macSourceUserName, macSourceCallingStationID)
+		}
+		if stringInSlice(source, sources[:i]) {
+			return "", fmt.Errorf("MAC source %q is listed twice", source)
+		}
+	}
+	return strings.Join(sources, ","), nil
+}
+
+// addrIP extracts the IP address from a network address. IPv4 clients reaching a dual-stack socket are
+// returned as plain IPv4 addresses rather than IPv4-mapped IPv6 addresses.
+func addrIP(addr net.Addr) net.IP {
+	var ip net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP
+	} else {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		ip = net.ParseIP(host)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// normalizeClientAddress writes IP addresses and CIDR ranges in their canonical form, so the same IPv6
+// address is always stored and looked up the same way. Hostnames are returned lowercase.
+func normalizeClientAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		return network.String()
+	}
+	return strings.ToLower(address)
+}
+
+// isClientHostname reports if a client address is a DNS hostname rather than an IP address or CIDR range
+func isClientHostname(address string) bool {
+	return net.ParseIP(address) == nil && !strings.Contains(address, "/")
+}
+
+// clientHostnames caches the addresses of clients configured by hostname, so matching a packet doesn't wait on DNS
+type clientHostnames struct {
+	mu        sync.RWMutex
+	addresses map[string][]net.IP
+	stop      chan struct{}
+}
+
+func newClientHostnames() *clientHostnames {
+	return &clientHostnames{
+		addresses: make(map[string][]net.IP),
+	}
+}
+
+// lookup returns the addresses of a hostname from the last refresh. It never resolves the hostname itself, since
+// it runs for every packet and a slow DNS server would hold up every request, so a hostname is unknown until it
+// is first refreshed.
+func (ch *clientHostnames) lookup(hostname string) []net.IP {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.addresses[hostname]
+}
+
+// refresh re-resolves the hostnames of all clients, keeping the previous addresses if resolution fails
+func (ch *clientHostnames) refresh(clients []Client) {
+	ch.mu.RLock()
+	previous := ch.addresses
+	ch.mu.RUnlock()
+
+	addresses := make(map[string][]net.IP)
+	for _, client := range clients {
+		if isClientHostname(client.ClientIP) {
+			addresses[client.ClientIP] = resolveClientHostname(client.ClientIP, previous[client.ClientIP])
+		}
+	}
+
+	ch.mu.Lock()
+	ch.addresses = addresses
+	ch.mu.Unlock()
+}
+
+func resolveClientHostname(hostname string, previous []net.IP) []net.IP {
+	addresses, err := net.LookupIP(hostname)
+	if err != nil {
+		log.Printf("RADIUS: Unable to resolve client %v: %v", hostname, err)
+		return previous
+	}
+	return addresses
+}
+
+// resolveClientHostnames resolves the hostnames of all clients, for commands that look up clients without
+// starting the server
+func (rs *RadiusServer) resolveClientHostnames() error {
+	var clients []Client
+	if err := rs.DB.Find(&clients).Error; err != nil {
+		return err
+	}
+	rs.hostnames.refresh(clients)
+	return nil
+}
+
+// startClientHostnameRefresh re-resolves client hostnames on an interval until stopClientHostnameRefresh is called
+func (rs *RadiusServer) startClientHostnameRefresh(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	rs.hostnames.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := rs.resolveClientHostnames(); err != nil {
+					log.Printf("RADIUS: Unable to load clients: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(rs.hostnames.stop)
+}
+
+func (rs *RadiusServer) stopClientHostnameRefresh() {
+	if rs.hostnames.stop != nil {
+		close(rs.hostnames.stop)
+		rs.hostnames.stop = nil
+	}
+}
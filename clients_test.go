@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchClient(t *testing.T) {
+	clients := []Client{
+		{ClientIP: "10.0.0.0/8", Secret: "range"},
+		{ClientIP: "10.1.0.0/16", Secret: "subnet"},
+		{ClientIP: "10.1.2.3", Secret: "address"},
+		{ClientIP: "2001:db8::/32", Secret: "ipv6"},
+		{ClientIP: "localhost", Secret: "hostname"},
+	}
+	hostnames := newClientHostnames()
+
+	tests := []struct {
+		ip     string
+		secret string
+	}{
+		{"10.1.2.3", "address"},
+		{"10.1.2.4", "subnet"},
+		{"10.2.0.1", "range"},
+		{"2001:db8::1", "ipv6"},
+		{"192.168.0.1", ""},
+		// The hostname isn't resolved until the hostnames are refreshed
+		{"127.0.0.1", ""},
+	}
+	for _, test := range tests {
+		client, found := matchClient(clients, net.ParseIP(test.ip), hostnames)
+		if found != (test.secret != "") || client.Secret != test.secret {
+			t.Errorf("%v: got client %q, %v", test.ip, client.Secret, found)
+		}
+	}
+
+	hostnames.refresh(clients)
+	if client, found := matchClient(clients, net.ParseIP("127.0.0.1").To4(), hostnames); !found || client.Secret != "hostname" {
+		t.Errorf("got client %q, %v after resolving the hostnames", client.Secret, found)
+	}
+	// A hostname that can't be resolved has no addresses, without affecting the others
+	previous := hostnames.lookup("localhost")
+	hostnames.refresh([]Client{{ClientIP: "localhost"}, {ClientIP: "unresolvable.invalid"}})
+	if got := hostnames.lookup("localhost"); len(got) != len(previous) || len(hostnames.lookup("unresolvable.invalid")) != 0 {
+		t.Errorf("got %v and %v", got, hostnames.lookup("unresolvable.invalid"))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// changeCounterID is the row of the change counter
+const changeCounterID = 1
+
+// instanceName identifies this instance in the logs and in the locks of the background jobs
+var instanceName, _ = os.Hostname()
+
+// ClusterConfig stores the settings for running several instances against the same database
+type ClusterConfig struct {
+	// Instance names this instance in the logs and the job locks, or is empty to use the hostname without
+	// prefixing the logs
+	Instance string `json:"instance"`
+	// PollInterval is how often the database is checked for changes made by other instances or commands, to clear
+	// the cache right away, or 0 to only pick them up after radius.device_cache_ttl
+	PollInterval Duration `json:"poll_interval"`
+}
+
+// JobLock is held by the instance running a background job, such as the janitor, so the other instances sharing
+// the database skip it until the lock expires
+type JobLock struct {
+	Name      string `gorm:"primary_key"`
+	Instance  string `gorm:"not null"`
+	ExpiresAt time.Time
+}
+
+// ChangeCounter is a single row counting the changes to the records the RADIUS server caches
+type ChangeCounter struct {
+	ID    uint `gorm:"primary_key;auto_increment:false"`
+	Count uint64
+}
+
+// acquireJobLock takes or renews the lock of a job for this instance, reporting false if another instance holds it
+func acquireJobLock(db *gorm.DB, name string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result := db.Model(&JobLock{}).Where("name = ? AND (instance = ? OR expires_at < ?)", name, instanceName, now).
+		Updates(map[string]interface{}{"instance": instanceName, "expires_at": now.Add(ttl)})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return true, nil
+	}
+
+	// Nobody has run the job yet, unless another instance just created the lock
+	var lock JobLock
+	if !db.First(&lock, "name = ?", name).RecordNotFound() {
+		return false, nil
+	}
+	if err := db.Create(&JobLock{Name: name, Instance: instanceName, ExpiresAt: now.Add(ttl)}).Error; err != nil {
+		if !db.First(&lock, "name = ?", name).RecordNotFound() {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// runLocked runs a background job unless another instance holds its lock. The lock is kept for two intervals, so
+// another instance takes over the job when this one stops running it. A job run only once is locked for an hour.
+func runLocked(db *gorm.DB, name string, interval time.Duration, job func()) {
+	ttl := 2 * interval
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	acquired, err := acquireJobLock(db, name, ttl)
+	if err != nil {
+		log.Printf("DATABASE: Unable to lock the %v: %v", name, err)
+		return
+	}
+	if acquired {
+		job()
+	}
+}
+
+// registerChangeCounter counts the changes to the records the RADIUS server caches, in the same transaction as the
+// change, so instances polling the counter notice the changes of the others and of commands
+func registerChangeCounter(db *gorm.DB) {
+	ignored := cacheIgnoredTables(db)
+	count := func(scope *gorm.Scope) {
+		if !ignored[scope.TableName()] && !scope.HasError() {
+			if err := scope.NewDB().Exec("UPDATE change_counters SET count = count + 1 WHERE id = ?", changeCounterID).Error; err != nil {
+				log.Printf("DATABASE: Unable to count a change: %v", err)
+			}
+		}
+	}
+
+	// gorm logs every callback it registers
+	db = db.New()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(ioutil.Discard, "", 0)})
+
+	db.Callback().Create().After("gorm:create").Register("change_counter:create", count)
+	db.Callback().Update().After("gorm:update").Register("change_counter:update", count)
+	db.Callback().Delete().After("gorm:delete").Register("change_counter:delete", count)
+}
+
+// loadChangeCount reads the change counter
+func loadChangeCount(db *gorm.DB) (uint64, error) {
+	var counter ChangeCounter
+	err := db.First(&counter, changeCounterID).Error
+	return counter.Count, err
+}
+
+// startChangePolling clears the cache whenever the change counter moves, until stopChangePolling is called
+func (rs *RadiusServer) startChangePolling(interval time.Duration) {
+	if interval <= 0 || rs.devices == nil {
+		return
+	}
+	last, err := loadChangeCount(rs.DB)
+	if err != nil {
+		log.Printf("RADIUS: Unable to load the change counter: %v", err)
+	}
+	rs.pollStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				count, err := loadChangeCount(rs.DB)
+				if err != nil {
+					log.Printf("RADIUS: Unable to load the change counter: %v", err)
+					continue
+				}
+				if count != last {
+					rs.devices.invalidate()
+					last = count
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(rs.pollStop)
+}
+
+func (rs *RadiusServer) stopChangePolling() {
+	if rs.pollStop != nil {
+		close(rs.pollStop)
+		rs.pollStop = nil
+	}
+}
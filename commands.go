@@ -0,0 +1,1085 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// runCommand runs an administrative command instead of the servers
+func runCommand(config Config, db *gorm.DB, args []string) error {
+	// Stage sensitive changes for another admin to approve
+	if _, approved := db.Get(approvalGrantedKey); config.Approval.Enabled && !approved {
+		if reason := config.Approval.requiresApproval(db, args); reason != "" {
+			return proposeChange(db, args, reason)
+		}
+	}
+
+	switch args[0] {
+	case "issue-cert":
+		return issueCertCommand(config, db, args[1:])
+	case "revoke-cert":
+		return revokeCertCommand(db, args[1:])
+	case "add-client":
+		return addClientCommand(config, db, args[1:])
+	case "remove-client":
+		return removeClientCommand(db, args[1:])
+	case "list-clients":
+		return listClientsCommand(db, args[1:])
+	case "add-credential":
+		return addCredentialCommand(db, args[1:])
+	case "remove-credential":
+		return removeCredentialCommand(db, args[1:])
+	case "set-group":
+		return setGroupCommand(db, args[1:])
+	case "list-groups":
+		return listGroupsCommand(db, args[1:])
+	case "remove-group":
+		return removeGroupCommand(db, args[1:])
+	case "enable-group":
+		return enableGroupCommand(db, args[1:])
+	case "disable-group":
+		return disableGroupCommand(db, args[1:])
+	case "set-profile":
+		return setProfileCommand(db, args[1:])
+	case "add-attribute":
+		return addAttributeCommand(db, args[1:])
+	case "remove-attribute":
+		return removeAttributeCommand(db, args[1:])
+	case "list-attributes":
+		return listAttributesCommand(db, args[1:])
+	case "set-network":
+		return setNetworkCommand(db, args[1:])
+	case "audit-log":
+		return auditLogCommand(db, args[1:])
+	case "add-user":
+		return addUserCommand(config, db, args[1:])
+	case "change-password":
+		return changePasswordCommand(config, db, args[1:])
+	case "require-password-change":
+		return requirePasswordChangeCommand(db, args[1:])
+	case "remove-user":
+		return removeUserCommand(db, args[1:])
+	case "list-users":
+		return listUsersCommand(db, args[1:])
+	case "reset-password":
+		return resetPasswordCommand(config, db, args[1:])
+	case "send-test-email":
+		return sendTestEmailCommand(config, args[1:])
+	case "bench":
+		return benchCommand(args[1:])
+	case "test-auth":
+		return testAuthCommand(args[1:])
+	case "disconnect":
+		return disconnectCommand(db, args[1:])
+	case "usage":
+		return usageCommand(db, args[1:])
+	case "migrate":
+		return migrateCommand(db, args[1:])
+	case "prune":
+		NewJanitor(db, config.Retention).Run()
+		return nil
+	case "add-device":
+		return addDeviceCommand(db, args[1:])
+	case "set-device":
+		return setDeviceCommand(db, args[1:])
+	case "remove-device":
+		return removeDeviceCommand(db, args[1:])
+	case "restore-device":
+		return restoreDeviceCommand(db, args[1:])
+	case "enable-device":
+		return enableDeviceCommand(db, args[1:])
+	case "disable-device":
+		return disableDeviceCommand(db, args[1:])
+	case "quarantine":
+		return quarantineCommand(config, db, args[1:])
+	case "release":
+		return releaseCommand(config, db, args[1:])
+	case "stale-devices":
+		return staleDevicesCommand(db, args[1:])
+	case "trash":
+		return trashCommand(db, args[1:])
+	case "restore-group":
+		return restoreGroupCommand(db, args[1:])
+	case "purge-trash":
+		return purgeTrashCommand(db, args[1:])
+	case "device-history":
+		return deviceHistoryCommand(db, args[1:])
+	case "list-devices":
+		return listDevicesCommand(config, db, args[1:])
+	case "bulk-devices":
+		return bulkDevicesCommand(db, args[1:])
+	case "check-auth":
+		return checkAuthCommand(config, db, args[1:])
+	case "list-access-points":
+		return listAccessPointsCommand(db, args[1:])
+	case "list-unknown-ssids":
+		return listUnknownSSIDsCommand(db, args[1:])
+	case "rejected":
+		return rejectedCommand(config, db, args[1:])
+	case "issue-vouchers":
+		return issueVouchersCommand(db, args[1:])
+	case "redeem-voucher":
+		return redeemVoucherCommand(db, args[1:])
+	case "request-sponsor":
+		return requestSponsorCommand(config, db, args[1:])
+	case "import-freeradius":
+		return importFreeRADIUSCommand(db, args[1:])
+	case "unifi-clients":
+		return unifiClientsCommand(config, db, args[1:])
+	case "unifi-import":
+		return unifiImportCommand(config, db, args[1:])
+	case "ldap-sync":
+		return ldapSyncCommand(config, db, args[1:])
+	case "netbox-sync":
+		return netboxSyncCommand(config, db, args[1:])
+	case "proposals":
+		return proposalsCommand(db, args[1:])
+	case "approve":
+		return approveCommand(config, db, args[1:])
+	case "reject":
+		return rejectCommand(config, db, args[1:])
+	case "promote":
+		return promoteCommand(config, db, args[1:])
+	case "replication-status":
+		return replicationStatusCommand(config, db, args[1:])
+	case "backup":
+		return backupCommand(db, args[1:])
+	case "restore":
+		return restoreCommand(db, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// issueCertCommand issues an EAP-TLS client certificate for a registered device
+func issueCertCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("issue-cert", flag.ContinueOnError)
+	macFlag := flags.String("mac", "", "MAC address of the device")
+	days := flags.Int("days", 365, "number of days the certificate is valid")
+	out := flags.String("out", ".", "directory to write the certificate and key to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	mac := normalizeMACAddress(*macFlag)
+	if !isValidMACFormat(mac) {
+		return errors.New("a valid -mac is required")
+	}
+	var device Device
+	if db.First(&device, "MAC = ?", mac).RecordNotFound() {
+		return fmt.Errorf("device %v does not exist", prettyPrintMACAddress(mac))
+	}
+
+	ca, err := loadCertificateAuthority(config.EAP.PKIDir)
+	if err != nil {
+		return err
+	}
+	der, key, err := ca.IssueDeviceCertificate(mac, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(*out, mac+".crt")
+	keyPath := filepath.Join(*out, mac+".key")
+	if err := writeCertificateAndKey(certPath, keyPath, der, key); err != nil {
+		return err
+	}
+	// Include the CA so the device can be configured to trust the server
+	caPEM, err := ioutil.ReadFile(filepath.Join(config.EAP.PKIDir, caCertificateFile))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(*out, caCertificateFile), caPEM, 0644); err != nil {
+		return err
+	}
+
+	certificate, _, err := readCertificateAndKey(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	record := Certificate{
+		SerialNumber: certificate.SerialNumber.String(),
+		DeviceID:     device.ID,
+		CommonName:   certificate.Subject.CommonName,
+		NotAfter:     certificate.NotAfter,
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Issued certificate %v for %v: %v, %v\n", record.SerialNumber, prettyPrintMACAddress(mac), certPath, keyPath)
+	return nil
+}
+
+// revokeCertCommand marks an issued certificate as revoked so it can no longer be used for EAP-TLS
+func revokeCertCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("revoke-cert", flag.ContinueOnError)
+	serial := flags.String("serial", "", "serial number of the certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var certificate Certificate
+	if db.First(&certificate, "serial_number = ?", *serial).RecordNotFound() {
+		return fmt.Errorf("certificate %v does not exist", *serial)
+	}
+	if err := db.Model(&certificate).Update("revoked", true).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked certificate %v (%v)\n", certificate.SerialNumber, certificate.CommonName)
+	return nil
+}
+
+// stringListFlag collects the values of a flag that can be repeated
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// addCredentialCommand creates a PEAP credential for a device or a person
+func addCredentialCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("add-credential", flag.ContinueOnError)
+	username := flags.String("username", "", "username for PEAP authentication")
+	password := flags.String("password", "", "password for PEAP authentication")
+	macFlag := flags.String("mac", "", "MAC address of the device the credential is tied to")
+	var groups stringListFlag
+	flags.Var(&groups, "group", "device group for a credential not tied to a device (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *username == "" || *password == "" {
+		return errors.New("-username and -password are required")
+	}
+	credential := Credential{
+		Username: *username,
+		NTHash:   ntPasswordHash(*password),
+	}
+
+	if *macFlag != "" {
+		mac := normalizeMACAddress(*macFlag)
+		var device Device
+		if !isValidMACFormat(mac) || db.First(&device, "MAC = ?", mac).RecordNotFound() {
+			return fmt.Errorf("device %v does not exist", *macFlag)
+		}
+		credential.DeviceID = &device.ID
+	}
+	for _, name := range groups {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", name).RecordNotFound() {
+			return fmt.Errorf("device group %q does not exist", name)
+		}
+		credential.DeviceGroups = append(credential.DeviceGroups, group)
+	}
+
+	if err := db.Create(&credential).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Added credential %q\n", credential.Username)
+	return nil
+}
+
+// removeCredentialCommand deletes a PEAP credential
+func removeCredentialCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-credential", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the credential")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var credential Credential
+	if db.First(&credential, "username = ?", *username).RecordNotFound() {
+		return fmt.Errorf("credential %q does not exist", *username)
+	}
+	if err := db.Model(&credential).Association("DeviceGroups").Clear().Error; err != nil {
+		return err
+	}
+	if err := db.Delete(&credential).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed credential %q\n", credential.Username)
+	return nil
+}
+
+// addClientCommand registers a RADIUS client by address, CIDR range, or hostname
+func addClientCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("add-client", flag.ContinueOnError)
+	address := flags.String("ip", "", "IP address, CIDR range, or hostname of the client")
+	secret := flags.String("secret", "", "RADIUS shared secret")
+	vendor := flags.String("vendor", "", "controller vendor for reply profiles ("+strings.Join(replyVendors(), ", ")+")")
+	ssidDelimiter := flags.String("ssid-delimiter", ":", "delimiter between the fields of the Called-Station-Id")
+	ssidField := flags.Int("ssid-field", 0, "field of the Called-Station-Id holding the SSID, counting from 1, or 0 for the last")
+	defaultSSID := flags.String("default-ssid", "", "SSID to use when the Called-Station-Id does not include one")
+	listener := flags.String("listener", "", "name of the only listener the client is answered on, or \""+defaultListenerName+"\" for radius.listen")
+	var networks stringListFlag
+	flags.Var(&networks, "network", "SSID the client may grant access to (repeatable, any if not given)")
+	passwordMode := flags.String("password-mode", "ignore", "how the User-Password of MAC authentication is checked: ignore, mac, or shared")
+	sharedPassword := flags.String("shared-password", "", "password all devices send with -password-mode shared")
+	macSource := flags.String("mac-source", macSourceUserName, "attributes holding the MAC address of MAC authentication, in order of precedence: "+macSourceUserName+", "+macSourceCallingStationID+", or both separated by a comma")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*address = normalizeClientAddress(*address)
+	*vendor = strings.ToLower(*vendor)
+
+	if isClientHostname(*address) {
+		if *address == "" {
+			return errors.New("-ip is required")
+		}
+		if _, err := net.LookupIP(*address); err != nil {
+			fmt.Printf("Warning: %v does not resolve yet: %v\n", *address, err)
+		}
+	} else if _, _, err := net.ParseCIDR(*address); err != nil && net.ParseIP(*address) == nil {
+		return errors.New("-ip must be an IP address, CIDR range, or hostname")
+	}
+	if *secret == "" {
+		return errors.New("-secret is required")
+	}
+	if _, ok := replyTemplates[*vendor]; !ok {
+		return fmt.Errorf("unknown vendor %q", *vendor)
+	}
+	if *ssidDelimiter == "" || *ssidField < 0 {
+		return errors.New("-ssid-delimiter must not be empty and -ssid-field must not be negative")
+	}
+	mode, ok := passwordModeNames[*passwordMode]
+	if !ok {
+		return fmt.Errorf("unknown password mode %q", *passwordMode)
+	}
+	if mode == ClientPasswordModeSharedSecret && *sharedPassword == "" {
+		return errors.New("-shared-password is required with -password-mode shared")
+	}
+	source, err := parseMACSource(*macSource)
+	if err != nil {
+		return err
+	}
+	if *listener != "" && *listener != defaultListenerName {
+		found := false
+		for _, configured := range config.RADIUS.Listeners {
+			found = found || configured.Name == *listener
+		}
+		if !found {
+			return fmt.Errorf("unknown listener %q", *listener)
+		}
+	}
+
+	client := Client{
+		ClientIP:       *address,
+		Secret:         *secret,
+		Vendor:         *vendor,
+		SSIDDelimiter:  *ssidDelimiter,
+		SSIDField:      *ssidField,
+		DefaultSSID:    *defaultSSID,
+		Listener:       *listener,
+		PasswordMode:   mode,
+		SharedPassword: *sharedPassword,
+		MACSource:      source,
+	}
+	for _, ssid := range networks {
+		var network Network
+		if err := db.FirstOrCreate(&network, Network{SSID: ssid}).Error; err != nil {
+			return err
+		}
+		client.Networks = append(client.Networks, network)
+	}
+	if err := db.Create(&client).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Added client %v\n", client.ClientIP)
+	return nil
+}
+
+// removeClientCommand deletes a RADIUS client
+func removeClientCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-client", flag.ContinueOnError)
+	address := flags.String("ip", "", "IP address, CIDR range, or hostname of the client")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*address = normalizeClientAddress(*address)
+
+	var client Client
+	if db.First(&client, "client_ip = ?", *address).RecordNotFound() {
+		return fmt.Errorf("client %v does not exist", *address)
+	}
+	if err := db.Model(&client).Association("Networks").Clear().Error; err != nil {
+		return err
+	}
+	if err := db.Delete(&client).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed client %v\n", client.ClientIP)
+	return nil
+}
+
+// listClientsCommand lists the RADIUS clients without their secrets
+func listClientsCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-clients", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var clients []Client
+	if err := db.Preload("Networks").Order("client_ip").Find(&clients).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "CLIENT\tVENDOR\tLISTENER\tDEFAULT SSID\tMAC SOURCE\tNETWORKS")
+	for _, client := range clients {
+		var networks []string
+		for _, network := range client.Networks {
+			networks = append(networks, network.SSID)
+		}
+		macSource := client.MACSource
+		if macSource == "" {
+			macSource = macSourceUserName
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\n", client.ClientIP, client.Vendor, client.Listener, client.DefaultSSID, macSource, strings.Join(networks, ", "))
+	}
+	return out.Flush()
+}
+
+// setGroupCommand creates a device group or changes its reply attributes
+func setGroupCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("set-group", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the device group")
+	sessionTimeout := flags.Duration("session-timeout", 0, "maximum session length sent to the controller, or 0 for none")
+	idleTimeout := flags.Duration("idle-timeout", 0, "idle time before the controller ends the session, or 0 for none")
+	reauthenticate := flags.Bool("reauthenticate", false, "reauthenticate devices when the session times out instead of disconnecting them")
+	profile := flags.String("profile", "", "name of the reply profile, or empty for none")
+	maxSessions := flags.Uint("max-sessions", 0, "active accounting sessions a device may have before it is rejected, or 0 for no limit")
+	parent := flags.String("parent", "", "name of the group whose networks and reply attributes are inherited, or empty for none")
+	var networks stringListFlag
+	flags.Var(&networks, "network", "SSID the group is allowed on, or \""+wildcardSSID+"\" for any (repeatable, replaces the current list)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	var group DeviceGroup
+	if err := db.FirstOrInit(&group, DeviceGroup{Name: *name}).Error; err != nil {
+		return err
+	}
+	if group.ID == 0 {
+		if err := checkGroupNotTrashed(db, *name); err != nil {
+			return err
+		}
+	}
+
+	var replyProfile ReplyProfile
+	if *profile != "" && db.First(&replyProfile, "name = ?", *profile).RecordNotFound() {
+		return fmt.Errorf("reply profile %q does not exist", *profile)
+	}
+
+	var parentGroup DeviceGroup
+	if *parent != "" {
+		if db.First(&parentGroup, "name = ?", *parent).RecordNotFound() {
+			return fmt.Errorf("device group %q does not exist", *parent)
+		}
+		if group.ID != 0 {
+			loop, err := groupHasAncestor(db, parentGroup, group.ID)
+			if err != nil {
+				return err
+			}
+			if loop {
+				return fmt.Errorf("device group %q would inherit from itself through %q", group.Name, *parent)
+			}
+		}
+	}
+
+	// Only change the settings that were given
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "profile":
+			if *profile == "" {
+				group.ReplyProfileID = nil
+			} else {
+				group.ReplyProfileID = &replyProfile.ID
+			}
+			group.ReplyProfile = nil
+		case "parent":
+			if *parent == "" {
+				group.ParentID = nil
+			} else {
+				group.ParentID = &parentGroup.ID
+			}
+		case "session-timeout":
+			group.SessionTimeout = uint(sessionTimeout.Seconds())
+		case "idle-timeout":
+			group.IdleTimeout = uint(idleTimeout.Seconds())
+		case "reauthenticate":
+			group.Reauthenticate = *reauthenticate
+		case "max-sessions":
+			group.MaxSessions = *maxSessions
+		}
+	})
+	if err := db.Save(&group).Error; err != nil {
+		return err
+	}
+
+	if len(networks) > 0 {
+		var allowed []Network
+		for _, ssid := range networks {
+			var network Network
+			if err := db.FirstOrCreate(&network, Network{SSID: ssid}).Error; err != nil {
+				return err
+			}
+			allowed = append(allowed, network)
+		}
+		if err := db.Model(&group).Association("Networks").Replace(allowed).Error; err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Saved device group %q\n", group.Name)
+	return nil
+}
+
+// listGroupsCommand lists the device groups with their parent, networks, and number of devices
+func listGroupsCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-groups", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var groups []DeviceGroup
+	if err := db.Preload("Networks").Order("name").Find(&groups).Error; err != nil {
+		return err
+	}
+	names := make(map[uint]string)
+	for _, group := range groups {
+		names[group.ID] = group.Name
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "NAME\tPARENT\tNETWORKS\tDEVICES\tDISABLED")
+	for _, group := range groups {
+		parent := ""
+		if group.ParentID != nil {
+			parent = names[*group.ParentID]
+		}
+		var networks []string
+		for _, network := range group.Networks {
+			networks = append(networks, network.SSID)
+		}
+		var devices int
+		if err := db.Table("device_devicegroups").Joins("JOIN devices ON devices.id = device_devicegroups.device_id").
+			Where("device_group_id = ? AND devices.deleted_at IS NULL", group.ID).Count(&devices).Error; err != nil {
+			return err
+		}
+		disabled := ""
+		if group.Disabled {
+			disabled = "yes"
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%d\t%v\n", group.Name, parent, strings.Join(networks, ", "), devices, disabled)
+	}
+	return out.Flush()
+}
+
+// enableGroupCommand enables a device group that was disabled
+func enableGroupCommand(db *gorm.DB, args []string) error {
+	return setGroupDisabled(db, "enable-group", false, args)
+}
+
+// disableGroupCommand stops a device group from granting access until it is enabled again, keeping its devices
+func disableGroupCommand(db *gorm.DB, args []string) error {
+	return setGroupDisabled(db, "disable-group", true, args)
+}
+
+func setGroupDisabled(db *gorm.DB, command string, disabled bool, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	name := flags.String("name", "", "name of the device group")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var group DeviceGroup
+	if db.First(&group, "name = ?", *name).RecordNotFound() {
+		return fmt.Errorf("device group %q does not exist", *name)
+	}
+	group.Disabled = disabled
+	if err := db.Save(&group).Error; err != nil {
+		return err
+	}
+
+	if disabled {
+		fmt.Printf("Disabled device group %q\n", group.Name)
+	} else {
+		fmt.Printf("Enabled device group %q\n", group.Name)
+	}
+	return nil
+}
+
+// removeGroupCommand moves a device group to the trash. Its devices stay registered but are no longer granted
+// its networks or reply attributes.
+func removeGroupCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-group", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the device group")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var group DeviceGroup
+	if db.First(&group, "name = ?", *name).RecordNotFound() {
+		return fmt.Errorf("device group %q does not exist", *name)
+	}
+	var children int
+	if err := db.Model(&DeviceGroup{}).Where("parent_id = ?", group.ID).Count(&children).Error; err != nil {
+		return err
+	}
+	if children > 0 {
+		return fmt.Errorf("device group %q is the parent of %d groups, change their parent first", group.Name, children)
+	}
+	if err := db.Delete(&group).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved device group %q to the trash\n", group.Name)
+	return nil
+}
+
+// setProfileCommand creates a reply profile or changes its settings
+func setProfileCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("set-profile", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the reply profile")
+	vlan := flags.Uint("vlan", 0, "VLAN ID, or 0 for none")
+	role := flags.String("role", "", "controller role or user group")
+	acl := flags.String("acl", "", "controller ACL, filter, or address list name")
+	upload := flags.Uint("upload", 0, "upload limit in kbit/s, or 0 for none")
+	download := flags.Uint("download", 0, "download limit in kbit/s, or 0 for none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	if *vlan > 4094 {
+		return errors.New("-vlan must be between 1 and 4094")
+	}
+	var profile ReplyProfile
+	if err := db.FirstOrInit(&profile, ReplyProfile{Name: *name}).Error; err != nil {
+		return err
+	}
+
+	// Only change the settings that were given
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "vlan":
+			profile.VLAN = *vlan
+		case "role":
+			profile.Role = *role
+		case "acl":
+			profile.ACL = *acl
+		case "upload":
+			profile.UploadRate = *upload
+		case "download":
+			profile.DownloadRate = *download
+		}
+	})
+	if err := db.Save(&profile).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved reply profile %q\n", profile.Name)
+	return nil
+}
+
+// networkAccessNames are the names of the NetworkAccess values used on the command line
+var networkAccessNames = map[string]NetworkAccess{
+	"groups": NetworkAccessGroups,
+	"known":  NetworkAccessKnownDevices,
+	"any":    NetworkAccessAnyDevice,
+}
+
+// passwordModeNames are the names of the ClientPasswordMode values used on the command line
+var passwordModeNames = map[string]ClientPasswordMode{
+	"ignore": ClientPasswordModeIgnore,
+	"mac":    ClientPasswordModeMAC,
+	"shared": ClientPasswordModeSharedSecret,
+}
+
+// setNetworkCommand creates a network or changes which devices may use it and how their password is checked
+func setNetworkCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("set-network", flag.ContinueOnError)
+	ssid := flags.String("ssid", "", "SSID of the network")
+	access := flags.String("access", "groups", "devices allowed without a group: groups (none), known, or any")
+	passwordMode := flags.String("password-mode", "client", "how the User-Password of MAC authentication is checked: client (the client's mode), ignore, mac, or shared")
+	sharedPassword := flags.String("shared-password", "", "password all devices send with -password-mode shared")
+	honeypot := flags.Bool("honeypot", false, "reject and report every request for the network, which nothing legitimate should know")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *ssid == "" {
+		return errors.New("-ssid is required")
+	}
+	if *honeypot && *ssid == wildcardSSID {
+		return errors.New("the wildcard network can't be a honeypot")
+	}
+	value, ok := networkAccessNames[*access]
+	if !ok {
+		return fmt.Errorf("unknown access %q", *access)
+	}
+	mode, ok := passwordModeNames[*passwordMode]
+	if !ok && *passwordMode != "client" {
+		return fmt.Errorf("unknown password mode %q", *passwordMode)
+	}
+
+	var network Network
+	if err := db.FirstOrInit(&network, Network{SSID: *ssid}).Error; err != nil {
+		return err
+	}
+	// Only change the settings that were given
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "access":
+			network.Access = value
+		case "password-mode":
+			if ok {
+				network.PasswordMode = &mode
+			} else {
+				network.PasswordMode = nil
+			}
+		case "shared-password":
+			network.SharedPassword = *sharedPassword
+		case "honeypot":
+			network.Honeypot = *honeypot
+		}
+	})
+	if network.PasswordMode != nil && *network.PasswordMode == ClientPasswordModeSharedSecret && network.SharedPassword == "" {
+		return errors.New("-shared-password is required with -password-mode shared")
+	}
+	if err := db.Save(&network).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved network %q\n", network.SSID)
+	return nil
+}
+
+// auditLogCommand lists audit log entries, optionally filtered, as a table or as CSV for export
+func auditLogCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("audit-log", flag.ContinueOnError)
+	actor := flags.String("actor", "", "only show changes made by this actor")
+	objectType := flags.String("type", "", "only show changes to this type of record, such as Device or Client")
+	action := flags.String("action", "", "only show this action (create, update, or delete)")
+	since := flags.String("since", "", "only show changes on or after this date (YYYY-MM-DD or RFC 3339)")
+	until := flags.String("until", "", "only show changes before this date (YYYY-MM-DD or RFC 3339)")
+	format := flags.String("format", "text", "output format (text or csv)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := db.Order("created_at")
+	if *actor != "" {
+		query = query.Where("actor = ?", *actor)
+	}
+	if *objectType != "" {
+		query = query.Where("object_type = ?", *objectType)
+	}
+	if *action != "" {
+		query = query.Where("action = ?", *action)
+	}
+	if *since != "" {
+		t, err := parseCommandTime(*since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %v", err)
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if *until != "" {
+		t, err := parseCommandTime(*until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	var entries []AuditLog
+	if err := query.Find(&entries).Error; err != nil {
+		return err
+	}
+
+	switch *format {
+	case "text":
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "TIME\tACTOR\tACTION\tTYPE\tID\tBEFORE\tAFTER")
+		for _, entry := range entries {
+			fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", entry.CreatedAt.Local().Format(time.RFC3339), entry.Actor,
+				entry.Action, entry.ObjectType, entry.ObjectID, entry.Before, entry.After)
+		}
+		return out.Flush()
+	case "csv":
+		out := csv.NewWriter(os.Stdout)
+		out.Write([]string{"time", "actor", "action", "type", "id", "before", "after"})
+		for _, entry := range entries {
+			out.Write([]string{entry.CreatedAt.Format(time.RFC3339), entry.Actor, entry.Action, entry.ObjectType,
+				strconv.FormatUint(uint64(entry.ObjectID), 10), entry.Before, entry.After})
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+// parseCommandTime accepts a date in local time or a full RFC 3339 timestamp
+func parseCommandTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// addUserCommand creates an administrative user. The password is assigned by another admin, so by default
+// the user has to change it before using the account.
+func addUserCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("add-user", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the administrative user")
+	password := flags.String("password", "", "initial password")
+	mustChange := flags.Bool("must-change", true, "require the user to change the password")
+	email := flags.String("email", "", "email address for password resets and notifications")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *username == "" || *password == "" {
+		return errors.New("-username and -password are required")
+	}
+	if err := config.PasswordPolicy.Check(*username, *password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	user := User{Username: *username, Password: hash, Email: *email, MustChangePassword: *mustChange}
+	if err := db.Create(&user).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Added user %q\n", user.Username)
+	return nil
+}
+
+// changePasswordCommand lets a user replace their own password after proving they know the current one, or with
+// the token emailed by reset-password
+func changePasswordCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("change-password", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the administrative user")
+	current := flags.String("current", "", "current password")
+	token := flags.String("token", "", "password reset token from the email, instead of the current password")
+	password := flags.String("new", "", "new password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if (*current == "") == (*token == "") {
+		return errors.New("either -current or -token is required")
+	}
+	var user User
+	found := !db.First(&user, "username = ?", *username).RecordNotFound()
+	var valid bool
+	if *token != "" {
+		valid = found && user.ResetTokenExpiresAt != nil && time.Now().Before(*user.ResetTokenExpiresAt) &&
+			subtle.ConstantTimeCompare(user.ResetToken, hashResetToken(*token)) == 1
+	} else {
+		valid = found && checkPassword(user, *current)
+	}
+	if !valid {
+		if chat, _ := NewChatNotifier(config.Chat); chat != nil {
+			chat.LoginFailure(*username)
+			chat.Stop()
+		}
+		if *token != "" {
+			return errors.New("incorrect username or token, or the token has expired")
+		}
+		return errors.New("incorrect username or password")
+	}
+	if *token == "" && *password == *current {
+		return errors.New("the new password must be different")
+	}
+	if err := config.PasswordPolicy.Check(user.Username, *password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	// Changing the password also cancels a pending reset, and a token is only used once even when two changes race
+	query := db.Model(&user)
+	if *token != "" {
+		query = query.Where("reset_token = ?", user.ResetToken)
+	}
+	result := query.Updates(map[string]interface{}{
+		"password":               hash,
+		"must_change_password":   false,
+		"reset_token":            nil,
+		"reset_token_expires_at": nil,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("the token has already been used")
+	}
+
+	fmt.Printf("Changed the password of %q\n", user.Username)
+	return nil
+}
+
+// requirePasswordChangeCommand flags a user so they have to change their password
+func requirePasswordChangeCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("require-password-change", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the administrative user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var user User
+	if db.First(&user, "username = ?", *username).RecordNotFound() {
+		return fmt.Errorf("user %q does not exist", *username)
+	}
+	user.MustChangePassword = true
+	if err := db.Save(&user).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("%q must change their password\n", user.Username)
+	return nil
+}
+
+// removeUserCommand deletes an administrative user
+func removeUserCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-user", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the administrative user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var user User
+	if db.First(&user, "username = ?", *username).RecordNotFound() {
+		return fmt.Errorf("user %q does not exist", *username)
+	}
+	if err := db.Delete(&user).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed user %q\n", user.Username)
+	return nil
+}
+
+// listUsersCommand lists the administrative users
+func listUsersCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-users", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var users []User
+	if err := db.Order("username").Find(&users).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "USERNAME\tEMAIL\tMUST CHANGE PASSWORD")
+	for _, user := range users {
+		fmt.Fprintf(out, "%v\t%v\t%v\n", user.Username, user.Email, user.MustChangePassword)
+	}
+	return out.Flush()
+}
+
+// resetPasswordCommand emails a user a token that lets them choose a new password once, without ever sending a
+// password by email
+func resetPasswordCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ContinueOnError)
+	username := flags.String("username", "", "username of the administrative user")
+	validity := flags.Duration("validity", time.Hour, "how long the token can be used")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *validity <= 0 {
+		return errors.New("-validity must be positive")
+	}
+	mailer := NewMailer(config.SMTP)
+	if mailer == nil {
+		return errors.New("no SMTP server is configured")
+	}
+	var user User
+	if db.First(&user, "username = ?", *username).RecordNotFound() {
+		return fmt.Errorf("user %q does not exist", *username)
+	}
+	if user.Email == "" {
+		return fmt.Errorf("user %q does not have an email address", user.Username)
+	}
+
+	token, hash, err := generateResetToken()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(*validity)
+
+	// Store the token before sending it, replacing an earlier one, so a token in an email always works
+	if err := db.Model(&user).Updates(map[string]interface{}{"reset_token": hash, "reset_token_expires_at": expires}).Error; err != nil {
+		return err
+	}
+	data := struct {
+		Username, Token string
+		Expires         time.Time
+	}{user.Username, token, expires}
+	if err := mailer.Send([]string{user.Email}, "password-reset", data); err != nil {
+		return fmt.Errorf("unable to send the password reset: %v", err)
+	}
+
+	fmt.Printf("Sent a password reset for %q to %v, valid until %v\n", user.Username, user.Email, expires.Format(time.RFC3339))
+	return nil
+}
+
+// sendTestEmailCommand checks the SMTP settings by sending a test message
+func sendTestEmailCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("send-test-email", flag.ContinueOnError)
+	to := flags.String("to", "", "recipient address")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	if err := NewMailer(config.SMTP).Send([]string{*to}, "test", nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent a test message to %v\n", *to)
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config stores the settings read from the configuration file
+type Config struct {
+	RADIUS         RADIUSConfig         `json:"radius"`
+	EAP            EAPConfig            `json:"eap"`
+	PasswordPolicy PasswordPolicyConfig `json:"password_policy"`
+	SMTP           SMTPConfig           `json:"smtp"`
+	AuthLog        AuthLogConfig        `json:"auth_log"`
+	Alerts         []AlertRule          `json:"alerts"`
+	Roaming        RoamingConfig        `json:"roaming"`
+	Webhooks       []WebhookConfig      `json:"webhooks"`
+	MQTT           MQTTConfig           `json:"mqtt"`
+	Chat           []ChatConfig         `json:"chat"`
+	Status         StatusConfig         `json:"status"`
+	Debug          DebugConfig          `json:"debug"`
+	Retention      RetentionConfig      `json:"retention"`
+	StaleDevices   StaleDevicesConfig   `json:"stale_devices"`
+	Influx         InfluxConfig         `json:"influx"`
+	SNMP           SNMPConfig           `json:"snmp"`
+	Sponsor        SponsorConfig        `json:"sponsor"`
+	UniFi          UniFiConfig          `json:"unifi"`
+	DHCP           DHCPConfig           `json:"dhcp"`
+	Approval       ApprovalConfig       `json:"approval"`
+	Quarantine     QuarantineConfig     `json:"quarantine"`
+	Cluster        ClusterConfig        `json:"cluster"`
+	Replication    ReplicationConfig    `json:"replication"`
+	GRPC           GRPCConfig           `json:"grpc"`
+	Redis          RedisConfig          `json:"redis"`
+	Logging        LoggingConfig        `json:"logging"`
+	LDAP           LDAPConfig           `json:"ldap"`
+	NetBox         NetBoxConfig         `json:"netbox"`
+	SessionPoller  SessionPollerConfig  `json:"session_poller"`
+}
+
+// RADIUSConfig stores the settings for the RADIUS server
+type RADIUSConfig struct {
+	// Listen is the address the RADIUS server listens on, such as ":1812" for all IPv4 and IPv6 addresses
+	Listen string `json:"listen"`
+	// AccountingListen is the address accounting is received on, or empty to disable accounting
+	AccountingListen string `json:"accounting_listen"`
+	// RequireMessageAuthenticator drops Access-Requests that do not include a Message-Authenticator attribute
+	RequireMessageAuthenticator bool `json:"require_message_authenticator"`
+	// RejectReplyMessage includes the reason in a Reply-Message of Access-Rejects, such as "unknown device"
+	RejectReplyMessage bool `json:"reject_reply_message"`
+	// ClientResolveInterval is how often the addresses of clients configured by hostname are resolved again
+	ClientResolveInterval Duration `json:"client_resolve_interval"`
+	// MACRateLimit limits the requests for each MAC address
+	MACRateLimit RateLimitConfig `json:"mac_rate_limit"`
+	// NASRateLimit limits the requests from each RADIUS client address
+	NASRateLimit RateLimitConfig `json:"nas_rate_limit"`
+	// DuplicateCacheTTL is how long responses are kept for answering retransmitted requests
+	DuplicateCacheTTL Duration `json:"duplicate_cache_ttl"`
+	// DeviceCacheTTL is how long devices and networks are kept in memory after being loaded from the database
+	DeviceCacheTTL Duration `json:"device_cache_ttl"`
+	// PrewarmDevices loads all the devices into the cache at startup, not only the clients and networks
+	PrewarmDevices bool `json:"prewarm_devices"`
+	// MaxConcurrentRequests limits how many requests are handled at once, dropping the rest
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+	// RequestTimeout is how long a request may take before its response is dropped
+	RequestTimeout Duration `json:"request_timeout"`
+	// DatabaseTimeout is how long the lookups of a request may take before it is dropped
+	DatabaseTimeout Duration `json:"database_timeout"`
+	// ShutdownTimeout is how long the requests being handled may take to finish when the server stops
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Listeners are additional addresses authentication requests are received on
+	Listeners []RadiusListener `json:"listeners"`
+	// Dictionaries are FreeRADIUS dictionary files loaded at startup, so the attributes of other vendors can be
+	// referred to by name
+	Dictionaries []string `json:"dictionaries"`
+}
+
+// RateLimitConfig stores the settings for a rate limiter
+type RateLimitConfig struct {
+	// Rate is the sustained number of requests allowed per second, or 0 for no limit
+	Rate float64 `json:"rate"`
+	// Burst is how many requests may arrive at once before the rate applies
+	Burst int `json:"burst"`
+}
+
+// NewRateLimiter creates the configured rate limiter, or nil if it is disabled
+func (c RateLimitConfig) NewRateLimiter() *RateLimiter {
+	if c.Rate <= 0 {
+		return nil
+	}
+	return NewRateLimiter(c.Rate, c.Burst)
+}
+
+// EAPConfig stores the settings for EAP authentication and the built-in CA
+type EAPConfig struct {
+	// Enabled turns on EAP-TLS authentication
+	Enabled bool `json:"enabled"`
+	// PKIDir is where the CA and server certificates are stored, and created if missing
+	PKIDir string `json:"pki_dir"`
+	// ServerName is the name in the EAP-TLS server certificate, defaulting to the hostname
+	ServerName string `json:"server_name"`
+}
+
+// PasswordPolicyConfig stores the rules for administrative user passwords
+type PasswordPolicyConfig struct {
+	// MinLength is the minimum number of characters
+	MinLength int `json:"min_length"`
+	// MinClasses is how many of lowercase letters, uppercase letters, digits, and symbols must be used
+	MinClasses int `json:"min_classes"`
+}
+
+// SMTPConfig stores the settings for sending email
+type SMTPConfig struct {
+	// Host is the SMTP server, or empty to disable email
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Security is "starttls", "tls" for implicit TLS, or "none"
+	Security string `json:"security"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// From is the sender address, optionally with a name such as "WiFi <wifi@example.com>"
+	From string `json:"from"`
+	// TemplateDir holds <name>.tmpl files replacing the built-in email templates
+	TemplateDir string `json:"template_dir"`
+}
+
+// AuthLogConfig stores the settings for the authentication log
+type AuthLogConfig struct {
+	// Enabled stores the outcome of every authentication in the database
+	Enabled bool `json:"enabled"`
+}
+
+// MQTTConfig stores the settings for publishing events to an MQTT broker
+type MQTTConfig struct {
+	// Broker is the host and port of the broker, or empty to disable MQTT
+	Broker string `json:"broker"`
+	// TLS connects to the broker over TLS, usually on port 8883
+	TLS      bool   `json:"tls"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientID string `json:"client_id"`
+	// Topic is where events are published, with {event}, {mac}, and {ssid} replaced by those of the event
+	Topic string `json:"topic"`
+}
+
+// StatusConfig stores the settings for the health check server
+type StatusConfig struct {
+	// Listen is the address serving /healthz and /readyz, or empty to disable them
+	Listen string `json:"listen"`
+	// PresenceToken is the bearer token needed to read which devices are online from /presence, which is
+	// disabled if it is empty
+	PresenceToken string `json:"presence_token"`
+	// PresenceTimeout is how long a device counts as online since the last accounting update of its session, or
+	// 0 until the session stops
+	PresenceTimeout Duration `json:"presence_timeout"`
+}
+
+// DebugConfig stores the settings for the profiling server
+type DebugConfig struct {
+	// Listen is the address serving pprof and expvar to administrative users, or empty to disable them
+	Listen string `json:"listen"`
+}
+
+// RetentionConfig stores how long records are kept before the janitor removes them, with 0 keeping them forever
+type RetentionConfig struct {
+	AuthLogDays    int `json:"auth_log_days"`
+	AuditLogDays   int `json:"audit_log_days"`
+	AccountingDays int `json:"accounting_days"`
+	// ExpiredDeviceDays is how long temporary devices are kept after they expire
+	ExpiredDeviceDays int `json:"expired_device_days"`
+	// TrashDays is how long removed devices and device groups are kept in the trash
+	TrashDays int `json:"trash_days"`
+	// Interval is how often the janitor runs
+	Interval Duration `json:"interval"`
+}
+
+// StaleDevicesConfig stores when the janitor disables devices that haven't been seen in a long time
+type StaleDevicesConfig struct {
+	// DisableAfterDays disables devices not accepted in this many days, or never if 0
+	DisableAfterDays int `json:"disable_after_days"`
+	// Notify are the email addresses told about the devices disabled
+	Notify []string `json:"notify"`
+}
+
+// loadConfig reads the configuration file at path, using the defaults if the file does not exist
+func loadConfig(path string) (Config, error) {
+	config := Config{
+		RADIUS: RADIUSConfig{
+			Listen:                ":1812",
+			AccountingListen:      ":1813",
+			ClientResolveInterval: Duration{5 * time.Minute},
+			MACRateLimit:          RateLimitConfig{Rate: 1, Burst: 10},
+			NASRateLimit:          RateLimitConfig{Rate: 200, Burst: 500},
+			DuplicateCacheTTL:     Duration{30 * time.Second},
+			DeviceCacheTTL:        Duration{30 * time.Second},
+			MaxConcurrentRequests: 256,
+			RequestTimeout:        Duration{5 * time.Second},
+			DatabaseTimeout:       Duration{2 * time.Second},
+			ShutdownTimeout:       Duration{10 * time.Second},
+		},
+		EAP: EAPConfig{
+			PKIDir: "pki",
+		},
+		PasswordPolicy: PasswordPolicyConfig{
+			MinLength:  12,
+			MinClasses: 3,
+		},
+		SMTP: SMTPConfig{
+			Port:     587,
+			Security: smtpSecurityStartTLS,
+		},
+		AuthLog: AuthLogConfig{
+			Enabled: true,
+		},
+		Retention: RetentionConfig{
+			AuthLogDays:       90,
+			AuditLogDays:      365,
+			AccountingDays:    90,
+			ExpiredDeviceDays: 7,
+			TrashDays:         30,
+			Interval:          Duration{time.Hour},
+		},
+		DHCP: DHCPConfig{
+			Format: dhcpFormatDnsmasq,
+		},
+		UniFi: UniFiConfig{
+			Site: "default",
+		},
+		Sponsor: SponsorConfig{
+			Duration:     Duration{24 * time.Hour},
+			LinkValidity: Duration{72 * time.Hour},
+		},
+		Influx: InfluxConfig{
+			Interval: Duration{time.Minute},
+		},
+		SNMP: SNMPConfig{
+			OID: "1.3.6.1.4.1.8072.9999.1812",
+		},
+		Replication: ReplicationConfig{
+			Interval: Duration{time.Minute},
+		},
+		Redis: RedisConfig{
+			Prefix: "wifi-radius:",
+		},
+		MQTT: MQTTConfig{
+			ClientID: "simple-wifi-radius-authenticator",
+			Topic:    "wifi/{event}/{mac}",
+		},
+		LDAP: LDAPConfig{
+			Filter:        "(&(objectClass=computer)(macAddress=*))",
+			MACAttribute:  "macAddress",
+			NameAttribute: "cn",
+			Interval:      Duration{time.Hour},
+		},
+		SessionPoller: SessionPollerConfig{
+			Interval: Duration{5 * time.Minute},
+		},
+		NetBox: NetBoxConfig{
+			Tag:      "wifi",
+			Interval: Duration{time.Hour},
+		},
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+	return config, config.PasswordPolicy.validate()
+}
+
+// Duration is a time.Duration written as a string such as "5m" in the configuration file
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
@@ -11,11 +11,37 @@ type Model struct {
 	UpdatedAt time.Time
 }
 
-// Device stores the MAC addresses and is associated with zero or more device groups
+// Device stores the MAC addresses and is associated with zero or more device groups. A MAC address ending in
+// "*", such as "b827eb*", matches every address with that prefix that has no device of its own.
 type Device struct {
 	Model
 	MAC          string        `gorm:"unique;not null"`
 	DeviceGroups []DeviceGroup `gorm:"many2many:device_devicegroups;"`
+	// Name describes the device, such as its hostname
+	Name string
+
+	// ExpiresAt is when a device registered with a voucher is no longer allowed, or nil for never
+	ExpiresAt *time.Time
+	// LastSeenAt is when the device was last accepted, updated at most every deviceSeenInterval
+	LastSeenAt *time.Time
+	// Disabled devices are rejected but keep their groups, such as devices that haven't been seen in a long time
+	Disabled bool
+	// MaxSessions overrides the session limit of the device's groups, with 0 meaning no limit, or nil to use
+	// the groups' limit
+	MaxSessions *uint
+	// PSK is the private WPA passphrase the device connects with on an SSID with per-device PSKs, or empty
+	PSK string
+	// QuarantineRegistered marks a device that wasn't registered until it was quarantined, which release moves to
+	// the trash rather than leaving it registered
+	QuarantineRegistered bool
+
+	// DeletedAt is when the device was moved to the trash, which keeps its groups until it is purged
+	DeletedAt *time.Time `gorm:"index"`
+}
+
+// expired reports whether a device registered for a limited time is no longer allowed
+func (d Device) expired(now time.Time) bool {
+	return d.ExpiresAt != nil && now.After(*d.ExpiresAt)
 }
 
 // DeviceGroup store the groups a device can belong to and is associated with zero or more networks
@@ -23,20 +49,101 @@ type DeviceGroup struct {
 	Model
 	Name     string    `gorm:"unique;not null"`
 	Networks []Network `gorm:"many2many:devicegroup_ssids;"`
+	// ParentID is the group whose networks, and reply attributes not set on this group, are inherited
+	ParentID *uint
+
+	// SessionTimeout and IdleTimeout are sent to the controller in seconds, with 0 meaning no timeout
+	SessionTimeout uint
+	IdleTimeout    uint
+	// Reauthenticate asks the controller to reauthenticate devices when the session times out instead of disconnecting them
+	Reauthenticate bool
+	// ReplyProfile sets the VLAN, role, ACL, and rate limits of the group's devices
+	ReplyProfileID *uint
+	ReplyProfile   *ReplyProfile
+	// Attributes are added to the reply as they are, after those of the reply profile
+	Attributes []GroupAttribute
+	// MaxSessions is how many active accounting sessions a device may have before it is rejected, or 0 for no
+	// limit. A device sharing another's MAC address shows up as a second session.
+	MaxSessions uint
+
+	// Disabled groups don't grant their networks or reply attributes, nor do the groups inheriting from them
+	Disabled bool
+
+	// DeletedAt is when the group was moved to the trash, which keeps its devices and networks until it is purged
+	DeletedAt *time.Time `gorm:"index"`
+}
+
+// ReplyProfile holds the authorization sent to the controller, using the attributes of the client's vendor
+type ReplyProfile struct {
+	Model
+	Name string `gorm:"unique;not null"`
+	VLAN uint
+	Role string
+	ACL  string
+	// UploadRate and DownloadRate limit the bandwidth of each device in kbit/s, with 0 meaning no limit
+	UploadRate   uint
+	DownloadRate uint
 }
 
 // Network store the known SSIDs
 type Network struct {
 	Model
-	SSID string `gorm:"unique;not null"`
+	SSID   string `gorm:"unique;not null"`
+	Access NetworkAccess
+
+	// PasswordMode checks the User-Password of MAC authentication on this network instead of the client's
+	// mode, or nil to use the client's
+	PasswordMode *ClientPasswordMode
+	// SharedPassword is the password devices send with ClientPasswordModeSharedSecret
+	SharedPassword string
+
+	// Honeypot networks aren't broadcast to anyone legitimate, so every request for one is rejected and reported
+	Honeypot bool
 }
 
-// Client stores settings about each RADIUS client
+// NetworkAccess defines which devices may use a network with MAC authentication
+type NetworkAccess int
+
+const (
+	// NetworkAccessGroups only allows devices in a group that grants access to the network
+	NetworkAccessGroups NetworkAccess = 0
+	// NetworkAccessKnownDevices allows any registered device, even one without a group
+	NetworkAccessKnownDevices = 1
+	// NetworkAccessAnyDevice allows every MAC address, registered or not
+	NetworkAccessAnyDevice = 2
+)
+
+// wildcardSSID is the SSID of a network that matches any SSID, including when the controller doesn't send one
+const wildcardSSID = "*"
+
+// Client stores settings about each RADIUS client. ClientIP is a single address, a CIDR range, or a hostname
+// that is periodically resolved again.
 type Client struct {
 	Model
 	ClientIP     string `gorm:"unique;not null"`
-	PasswordMode int
+	PasswordMode ClientPasswordMode
 	Secret       string
+	// SharedPassword is the password devices send with ClientPasswordModeSharedSecret, separate from the secret
+	SharedPassword string
+	// Vendor selects the built-in template used to send reply profiles to the client
+	Vendor string
+
+	// SSIDDelimiter separates the fields of the Called-Station-Id, defaulting to ":"
+	SSIDDelimiter string
+	// SSIDField is the 1-based field of the Called-Station-Id holding the SSID, or 0 for the last field
+	SSIDField int
+	// DefaultSSID is used when the Called-Station-Id does not include an SSID
+	DefaultSSID string
+
+	// MACSource lists the attributes the MAC address of MAC authentication is taken from, separated by commas
+	// in order of precedence, defaulting to the User-Name
+	MACSource string
+
+	// Listener is the name of the only listener the client is answered on, or empty for all of them
+	Listener string
+
+	// Networks are the only SSIDs the client may grant access to, or empty for any
+	Networks []Network `gorm:"many2many:client_ssids;"`
 }
 
 // ClientPasswordMode defines how we process the password supplied by a RADIUS client
@@ -46,9 +153,9 @@ const (
 	// ClientPasswordModeIgnore will ignore the provided password
 	ClientPasswordModeIgnore ClientPasswordMode = 0
 	// ClientPasswordModeMAC will treat the password as a MAC address and compare it to the username
-	ClientPasswordModeMAC = 1
+	ClientPasswordModeMAC ClientPasswordMode = 1
 	// ClientPasswordModeSharedSecret will treat the password as a secondary shared secret that the RADIUS client will provide
-	ClientPasswordModeSharedSecret = 2
+	ClientPasswordModeSharedSecret ClientPasswordMode = 2
 )
 
 // User stores information about administrative users
@@ -56,4 +163,34 @@ type User struct {
 	Model
 	Username string `gorm:"unique;not null"`
 	Password []byte `gorm:"not null"`
+	// Email is where password resets and notifications are sent
+	Email string
+	// MustChangePassword is set when another admin assigned the password, so the user has to pick their own
+	MustChangePassword bool
+	// ResetToken is the hash of the token emailed by reset-password, cleared once it has been used
+	ResetToken          []byte
+	ResetTokenExpiresAt *time.Time
+}
+
+// Credential stores a username and password for PEAP authentication, separate from the administrative users.
+// A credential tied to a device can only be used by that device and is authorized by its groups, otherwise it
+// belongs to a person and is authorized by its own groups.
+type Credential struct {
+	Model
+	Username string `gorm:"unique;not null"`
+	// NTHash is the MD4 hash of the password that MS-CHAPv2 uses instead of the password itself
+	NTHash       []byte `gorm:"not null"`
+	DeviceID     *uint
+	Device       *Device
+	DeviceGroups []DeviceGroup `gorm:"many2many:credential_devicegroups;"`
+}
+
+// Certificate stores the client certificates issued to devices by the built-in CA
+type Certificate struct {
+	Model
+	SerialNumber string `gorm:"unique;not null"`
+	DeviceID     uint   `gorm:"not null"`
+	CommonName   string
+	NotAfter     time.Time
+	Revoked      bool
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DebugServer serves the profiling endpoints of net/http/pprof and the variables of expvar to administrative
+// users, on a listener separate from everything else
+type DebugServer struct {
+	DB *gorm.DB
+	// LoginFailureListeners are told the username of every failed login
+	LoginFailureListeners []func(username string)
+
+	server *http.Server
+	// logins limits password checks per address, since every check costs an argon2 hash
+	logins *RateLimiter
+}
+
+// NewDebugServer creates a DebugServer listening on addr
+func NewDebugServer(addr string, db *gorm.DB) *DebugServer {
+	s := &DebugServer{DB: db, logins: NewRateLimiter(1, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	// No write timeout, since CPU profiles and traces run for as long as requested
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           accessLog("DEBUG", s.authenticate(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start the debug server
+func (s *DebugServer) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("DEBUG: Starting server on %v", s.server.Addr)
+
+		listener, err := listen(s.server.Addr)
+		if err == nil {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("DEBUG: Error starting debug server: %v", err)
+		} else {
+			log.Printf("DEBUG: Stopped server")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop the debug server
+func (s *DebugServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// authenticate requires HTTP basic authentication with an administrative user. Users that still have to change
+// their password are refused.
+func (s *DebugServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if allowed, _ := s.logins.Allow(host); !allowed {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		var user User
+		if s.DB.First(&user, "username = ?", username).RecordNotFound() || !checkPassword(user, password) {
+			log.Printf("DEBUG: Failed login for %q from %v", username, r.RemoteAddr)
+			logSecurityEvent(securityLoginFailure, httpSource(r.RemoteAddr), fmt.Sprintf("service=debug user=%q", username))
+			for _, listener := range s.LoginFailureListeners {
+				listener(username)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.MustChangePassword {
+			http.Error(w, "The password has to be changed first", http.StatusForbidden)
+			return
+		}
+		setAccessLogUser(r, user.Username)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// deviceCacheMaxEntries bounds the memory used when a client sends many different MAC addresses
+const deviceCacheMaxEntries = 100000
+
+// deviceCache remembers the devices and networks looked up by the RADIUS handler, including ones that don't
+// exist, and the RADIUS clients, so repeated requests don't have to load them and their groups from the
+// database again
+type deviceCache struct {
+	ttl time.Duration
+
+	mu             sync.Mutex
+	devices        map[string]cachedDevice
+	networks       map[string]cachedNetwork
+	clients        []Client
+	clientsExpires time.Time
+	generation     uint64
+	lastSweep      time.Time
+}
+
+type cachedDevice struct {
+	device  Device
+	found   bool
+	expires time.Time
+}
+
+type cachedNetwork struct {
+	network Network
+	expires time.Time
+}
+
+func newDeviceCache(ttl time.Duration) *deviceCache {
+	return &deviceCache{
+		ttl:       ttl,
+		devices:   make(map[string]cachedDevice),
+		networks:  make(map[string]cachedNetwork),
+		lastSweep: time.Now(),
+	}
+}
+
+// getDevice returns a cached device lookup if it hasn't expired, otherwise the generation to pass to putDevice
+func (dc *deviceCache) getDevice(mac string) (cachedDevice, bool, uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	cached, ok := dc.devices[mac]
+	if !ok || time.Now().After(cached.expires) {
+		return cachedDevice{}, false, dc.generation
+	}
+	return cached, true, dc.generation
+}
+
+// putDevice stores a device lookup, unless the cache was invalidated since the lookup started
+func (dc *deviceCache) putDevice(mac string, device Device, found bool, generation uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if generation != dc.generation {
+		return
+	}
+	dc.sweep()
+	dc.devices[mac] = cachedDevice{device: device, found: found, expires: time.Now().Add(dc.ttl)}
+}
+
+// getNetwork returns a cached network if it hasn't expired, otherwise the generation to pass to putNetwork
+func (dc *deviceCache) getNetwork(ssid string) (Network, bool, uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	cached, ok := dc.networks[ssid]
+	if !ok || time.Now().After(cached.expires) {
+		return Network{}, false, dc.generation
+	}
+	return cached.network, true, dc.generation
+}
+
+// putNetwork stores a network, unless the cache was invalidated since the lookup started
+func (dc *deviceCache) putNetwork(ssid string, network Network, generation uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if generation != dc.generation {
+		return
+	}
+	dc.sweep()
+	dc.networks[ssid] = cachedNetwork{network: network, expires: time.Now().Add(dc.ttl)}
+}
+
+// getClients returns the cached clients if they haven't expired, otherwise the generation to pass to putClients
+func (dc *deviceCache) getClients() ([]Client, bool, uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.clients == nil || time.Now().After(dc.clientsExpires) {
+		return nil, false, dc.generation
+	}
+	return dc.clients, true, dc.generation
+}
+
+// putClients stores all the clients, unless the cache was invalidated since they were loaded
+func (dc *deviceCache) putClients(clients []Client, generation uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if generation != dc.generation {
+		return
+	}
+	if clients == nil {
+		clients = []Client{}
+	}
+	dc.clients = clients
+	dc.clientsExpires = time.Now().Add(dc.ttl)
+}
+
+// currentGeneration returns the generation to pass to the put methods for lookups starting now
+func (dc *deviceCache) currentGeneration() uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return dc.generation
+}
+
+// sweep removes the expired entries, and everything if the cache is still too big. The lock must be held.
+func (dc *deviceCache) sweep() {
+	now := time.Now()
+	full := len(dc.devices)+len(dc.networks) >= deviceCacheMaxEntries
+	if !full && now.Sub(dc.lastSweep) <= dc.ttl {
+		return
+	}
+
+	for mac, cached := range dc.devices {
+		if now.After(cached.expires) {
+			delete(dc.devices, mac)
+		}
+	}
+	for ssid, cached := range dc.networks {
+		if now.After(cached.expires) {
+			delete(dc.networks, ssid)
+		}
+	}
+	if len(dc.devices)+len(dc.networks) >= deviceCacheMaxEntries {
+		dc.devices = make(map[string]cachedDevice)
+		dc.networks = make(map[string]cachedNetwork)
+	}
+	dc.lastSweep = now
+}
+
+// invalidate forgets everything, including lookups that are still running
+func (dc *deviceCache) invalidate() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dc.devices = make(map[string]cachedDevice)
+	dc.networks = make(map[string]cachedNetwork)
+	dc.clients = nil
+	dc.generation++
+}
+
+// cacheIgnoredTables are the tables whose changes don't affect what the cache holds, such as the logs
+func cacheIgnoredTables(db *gorm.DB) map[string]bool {
+	return map[string]bool{
+		db.NewScope(&AuditLog{}).TableName(): true,
+		db.NewScope(&AuthLog{}).TableName():  true,
+		// Accounting is written all the time and never changes what a device may do
+		db.NewScope(&AccountingSession{}).TableName(): true,
+		// Access points are recorded after every authentication, which would otherwise empty the cache each time
+		db.NewScope(&AccessPoint{}).TableName(): true,
+		db.NewScope(&UnknownSSID{}).TableName(): true,
+		// Bookkeeping of the migrations and of the instances sharing the database
+		db.NewScope(&SchemaVersion{}).TableName():    true,
+		db.NewScope(&JobLock{}).TableName():          true,
+		db.NewScope(&ChangeCounter{}).TableName():    true,
+		db.NewScope(&ReplicationState{}).TableName(): true,
+	}
+}
+
+// registerDeviceCacheCallbacks invalidates the cache whenever this process changes a record, other than the logs
+func registerDeviceCacheCallbacks(db *gorm.DB, dc *deviceCache) {
+	ignored := cacheIgnoredTables(db)
+	invalidate := func(scope *gorm.Scope) {
+		if !ignored[scope.TableName()] && !scope.HasError() {
+			dc.invalidate()
+		}
+	}
+
+	// gorm logs every callback it registers
+	db = db.New()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(ioutil.Discard, "", 0)})
+
+	db.Callback().Create().After("gorm:create").Register("device_cache:create", invalidate)
+	db.Callback().Update().After("gorm:update").Register("device_cache:update", invalidate)
+	db.Callback().Delete().After("gorm:delete").Register("device_cache:delete", invalidate)
+}
+
+// prewarmCache loads the clients and networks, and the devices if PrewarmDevices is set, before the server
+// answers its first request, so the access points reconnecting after a restart don't all wait on the database
+// at once. The hostnames of clients are resolved too.
+func (rs *RadiusServer) prewarmCache() {
+	start := time.Now()
+	var clients []Client
+	if err := rs.DB.Preload("Networks").Find(&clients).Error; err != nil {
+		log.Printf("RADIUS: Unable to prewarm the cache: %v", err)
+		return
+	}
+	rs.hostnames.refresh(clients)
+	if rs.devices == nil {
+		return
+	}
+	generation := rs.devices.currentGeneration()
+	rs.devices.putClients(clients, generation)
+
+	var networks []Network
+	if err := rs.DB.Find(&networks).Error; err != nil {
+		log.Printf("RADIUS: Unable to prewarm the cache: %v", err)
+		return
+	}
+	for _, network := range networks {
+		rs.devices.putNetwork(network.SSID, network, generation)
+	}
+
+	var devices []Device
+	if rs.PrewarmDevices {
+		var count int
+		if err := rs.DB.Model(&Device{}).Count(&count).Error; err != nil {
+			log.Printf("RADIUS: Unable to prewarm the cache: %v", err)
+			return
+		}
+		// A cache that is already full would be emptied by the first lookup
+		if count+len(networks) >= deviceCacheMaxEntries {
+			log.Printf("RADIUS: Not prewarming the cache with %d devices, it only holds %d", count, deviceCacheMaxEntries)
+		} else if err := rs.DB.Preload("DeviceGroups").Preload("DeviceGroups.Networks").Preload("DeviceGroups.ReplyProfile").
+			Preload("DeviceGroups.Attributes").Find(&devices).Error; err != nil {
+			log.Printf("RADIUS: Unable to prewarm the cache: %v", err)
+			return
+		}
+	}
+	cached := 0
+	for _, device := range devices {
+		// Addresses matching a prefix are looked up as they come
+		if isValidMACPattern(device.MAC) {
+			continue
+		}
+		device.DeviceGroups = inheritGroups(rs.DB, rs.quarantineGroups(device.DeviceGroups))
+		rs.devices.putDevice(device.MAC, device, true, generation)
+		cached++
+	}
+
+	log.Printf("RADIUS: Prewarmed the cache with %d clients, %d networks, and %d devices in %v", len(clients), len(networks), cached,
+		time.Since(start).Round(time.Millisecond))
+}
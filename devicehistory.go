@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// deviceHistoryCommand shows the changes to a device recorded in the audit log, such as who added it to a group
+// and when, including those of earlier devices with the same MAC address that were purged
+func deviceHistoryCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("device-history", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+	if !isValidMACFormat(*mac) && !isValidMACPattern(*mac) {
+		return fmt.Errorf("invalid MAC address %q", *mac)
+	}
+
+	// Every entry of a device has its MAC address on one side
+	pattern := `%"MAC":"` + *mac + `"%`
+	var entries []AuditLog
+	if err := db.Where("object_type = ? AND (before LIKE ? OR after LIKE ?)", "Device", pattern, pattern).Order("created_at, id").Find(&entries).Error; err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no changes to device %v are recorded", *mac)
+	}
+
+	var device Device
+	if !db.Preload("DeviceGroups").Preload("DeviceGroups.Networks").First(&device, "mac = ?", *mac).RecordNotFound() {
+		var groups []string
+		for _, group := range device.DeviceGroups {
+			var networks []string
+			for _, network := range group.Networks {
+				networks = append(networks, network.SSID)
+			}
+			groups = append(groups, fmt.Sprintf("%v (%v)", group.Name, strings.Join(networks, ", ")))
+		}
+		fmt.Printf("Groups: %v\n\n", strings.Join(groups, ", "))
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "TIME\tACTOR\tCHANGE")
+	for _, entry := range entries {
+		for _, change := range describeDeviceChange(entry) {
+			fmt.Fprintf(out, "%v\t%v\t%v\n", entry.CreatedAt.Local().Format(time.RFC3339), entry.Actor, change)
+		}
+	}
+	return out.Flush()
+}
+
+// describeDeviceChange explains an audit log entry of a device in words, one line per change
+func describeDeviceChange(entry AuditLog) []string {
+	var before, after map[string]interface{}
+	if entry.Before != "" {
+		json.Unmarshal([]byte(entry.Before), &before)
+	}
+	if entry.After != "" {
+		json.Unmarshal([]byte(entry.After), &after)
+	}
+
+	switch entry.Action {
+	case auditActionCreate:
+		change := "registered"
+		if groups := auditStrings(after["DeviceGroups"]); len(groups) > 0 {
+			change += " in " + strings.Join(groups, ", ")
+		}
+		if name, _ := after["Name"].(string); name != "" {
+			change += fmt.Sprintf(" as %q", name)
+		}
+		if expires, ok := after["ExpiresAt"].(string); ok {
+			change += " until " + auditTime(expires)
+		}
+		return []string{change}
+	case auditActionDelete:
+		if before["DeletedAt"] != nil {
+			return []string{"purged from the trash"}
+		}
+		return []string{"moved to the trash"}
+	}
+
+	var changes []string
+	if added, removed := auditStringsDiff(auditStrings(before["DeviceGroups"]), auditStrings(after["DeviceGroups"])); len(added) > 0 || len(removed) > 0 {
+		if len(added) > 0 {
+			changes = append(changes, "added to "+strings.Join(added, ", "))
+		}
+		if len(removed) > 0 {
+			changes = append(changes, "removed from "+strings.Join(removed, ", "))
+		}
+	}
+	if before["Name"] != after["Name"] {
+		changes = append(changes, fmt.Sprintf("renamed from %q to %q", before["Name"], after["Name"]))
+	}
+	if before["Disabled"] != after["Disabled"] {
+		if after["Disabled"] == true {
+			changes = append(changes, "disabled")
+		} else {
+			changes = append(changes, "enabled")
+		}
+	}
+	if before["ExpiresAt"] != after["ExpiresAt"] {
+		if expires, ok := after["ExpiresAt"].(string); ok {
+			changes = append(changes, "allowed until "+auditTime(expires))
+		} else {
+			changes = append(changes, "made permanent")
+		}
+	}
+	if !reflect.DeepEqual(before["MaxSessions"], after["MaxSessions"]) {
+		if limit, ok := after["MaxSessions"].(float64); ok {
+			changes = append(changes, fmt.Sprintf("session limit set to %d", int(limit)))
+		} else {
+			changes = append(changes, "session limit taken from its groups")
+		}
+	}
+	if before["DeletedAt"] != nil && after["DeletedAt"] == nil {
+		changes = append(changes, "restored from the trash")
+	}
+	return changes
+}
+
+// auditStrings reads a list of strings decoded from the JSON of an audit log entry
+func auditStrings(value interface{}) []string {
+	values, _ := value.([]interface{})
+	var strs []string
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// auditStringsDiff finds the strings added to and removed from a list
+func auditStringsDiff(before, after []string) (added []string, removed []string) {
+	for _, str := range after {
+		if !stringInSlice(str, before) {
+			added = append(added, str)
+		}
+	}
+	for _, str := range before {
+		if !stringInSlice(str, after) {
+			removed = append(removed, str)
+		}
+	}
+	return added, removed
+}
+
+// auditTime shows a time encoded in an audit log entry in the local time zone
+func auditTime(value string) string {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// addDeviceCommand registers a device by MAC address, or a MAC prefix followed by "*"
+func addDeviceCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("add-device", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address of the device, or a prefix followed by \""+macWildcard+"\" to match every address starting with it")
+	name := flags.String("name", "", "description of the device, such as its hostname")
+	var groupNames stringListFlag
+	flags.Var(&groupNames, "group", "device group to add the device to (repeatable)")
+	duration := flags.Duration("duration", 0, "how long a temporary device is allowed, such as 8h, or 0 for a permanent device")
+	psk := flags.String("psk", "", "private WPA passphrase of the device, or \""+pskGenerate+"\" for a random one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	*mac = normalizeMACAddress(*mac)
+	if *duration < 0 {
+		return errors.New("-duration must not be negative")
+	}
+	if err := devicePSK(psk); err != nil {
+		return err
+	}
+	if !isValidMACFormat(*mac) && !isValidMACPattern(*mac) {
+		return fmt.Errorf("invalid MAC address %q", *mac)
+	}
+	if !db.First(&Device{}, "MAC = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v is already registered", *mac)
+	}
+	if err := purgeTrashedDevice(db, *mac); err != nil {
+		return err
+	}
+	var groups []DeviceGroup
+	for _, groupName := range groupNames {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", groupName).RecordNotFound() {
+			return fmt.Errorf("device group %q does not exist", groupName)
+		}
+		groups = append(groups, group)
+	}
+
+	device := Device{MAC: *mac, Name: *name, DeviceGroups: groups, PSK: *psk}
+	if *duration > 0 {
+		expires := time.Now().Add(*duration)
+		device.ExpiresAt = &expires
+	}
+	if err := db.Create(&device).Error; err != nil {
+		return err
+	}
+
+	if device.ExpiresAt != nil {
+		fmt.Printf("Added device %v until %v\n", device.MAC, device.ExpiresAt.Local().Format(time.RFC3339))
+	} else {
+		fmt.Printf("Added device %v\n", device.MAC)
+	}
+	if device.PSK != "" {
+		fmt.Printf("PSK: %v\n", device.PSK)
+	}
+	return nil
+}
+
+// devicePSK checks the -psk of a command, replacing "generate" with a random PSK
+func devicePSK(psk *string) error {
+	if *psk == pskGenerate {
+		generated, err := generatePSK()
+		if err != nil {
+			return err
+		}
+		*psk = generated
+	}
+	if *psk == "" {
+		return nil
+	}
+	return validatePSK(*psk)
+}
+
+// setDeviceCommand changes the name, session limit, PSK, or groups of a device
+func setDeviceCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("set-device", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of the device")
+	name := flags.String("name", "", "description of the device, such as its hostname")
+	maxSessions := flags.String("max-sessions", "group", "active accounting sessions the device may have, 0 for no limit, or \"group\" for the limit of its groups")
+	var groupNames stringListFlag
+	flags.Var(&groupNames, "group", "device group the device is in (repeatable, replaces the current groups)")
+	psk := flags.String("psk", "", "private WPA passphrase of the device, \""+pskGenerate+"\" for a random one, or empty to remove it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+	if err := devicePSK(psk); err != nil {
+		return err
+	}
+
+	var limit *uint
+	if *maxSessions != "group" {
+		value, err := strconv.ParseUint(*maxSessions, 10, 32)
+		if err != nil {
+			return fmt.Errorf("-max-sessions must be a number or \"group\"")
+		}
+		sessions := uint(value)
+		limit = &sessions
+	}
+
+	var device Device
+	if db.First(&device, "MAC = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v does not exist", *mac)
+	}
+	var groups []DeviceGroup
+	for _, groupName := range groupNames {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", groupName).RecordNotFound() {
+			return fmt.Errorf("device group %q does not exist", groupName)
+		}
+		groups = append(groups, group)
+	}
+	// Only change the settings that were given
+	pskChanged := false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			device.Name = *name
+		case "max-sessions":
+			device.MaxSessions = limit
+		case "psk":
+			device.PSK = *psk
+			pskChanged = true
+		}
+	})
+	if err := db.Save(&device).Error; err != nil {
+		return err
+	}
+	if len(groups) > 0 {
+		err := auditAssociationChange(db, &device, func() error {
+			return db.Model(&device).Association("DeviceGroups").Replace(groups).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Saved device %v\n", device.MAC)
+	if pskChanged && device.PSK != "" {
+		fmt.Printf("PSK: %v\n", device.PSK)
+	}
+	return nil
+}
+
+// removeDeviceCommand moves a device to the trash. Devices that PEAP credentials are tied to are kept, since
+// the credentials would otherwise be authorized by their own groups instead.
+func removeDeviceCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("remove-device", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+
+	var device Device
+	if db.First(&device, "MAC = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v does not exist", *mac)
+	}
+	if err := deleteDevice(db, device); err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved device %v to the trash\n", device.MAC)
+	return nil
+}
+
+// deleteDevice moves a device to the trash with its group memberships, unless credentials are tied to it
+func deleteDevice(db *gorm.DB, device Device) error {
+	var credentials int
+	if err := db.Model(&Credential{}).Where("device_id = ?", device.ID).Count(&credentials).Error; err != nil {
+		return err
+	}
+	if credentials > 0 {
+		return fmt.Errorf("device %v has %d credentials tied to it, remove them first", device.MAC, credentials)
+	}
+	return db.Delete(&device).Error
+}
+
+// enableDeviceCommand enables a device that was disabled
+func enableDeviceCommand(db *gorm.DB, args []string) error {
+	return setDeviceDisabled(db, "enable-device", false, args)
+}
+
+// disableDeviceCommand rejects a device until it is enabled again, keeping its groups
+func disableDeviceCommand(db *gorm.DB, args []string) error {
+	return setDeviceDisabled(db, "disable-device", true, args)
+}
+
+func setDeviceDisabled(db *gorm.DB, command string, disabled bool, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+
+	var device Device
+	if db.First(&device, "MAC = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v does not exist", *mac)
+	}
+	device.Disabled = disabled
+	if err := db.Save(&device).Error; err != nil {
+		return err
+	}
+
+	if disabled {
+		fmt.Printf("Disabled device %v\n", device.MAC)
+	} else {
+		fmt.Printf("Enabled device %v\n", device.MAC)
+	}
+	return nil
+}
+
+// deviceListOrders are the orders list-devices can sort the devices in
+var deviceListOrders = map[string]string{
+	"mac":       "mac",
+	"name":      "name, mac",
+	"added":     "created_at DESC, id DESC",
+	"last-seen": "last_seen_at IS NULL, last_seen_at DESC, mac",
+	"expires":   "expires_at IS NULL, expires_at, mac",
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, for searches with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// deviceFilter selects devices by the flags list-devices and bulk-devices share
+type deviceFilter struct {
+	search   string
+	group    string
+	disabled bool
+	expired  bool
+}
+
+// register adds the flags of the filter to a command
+func (f *deviceFilter) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.search, "search", "", "only the devices whose MAC address or name contains this")
+	flags.StringVar(&f.group, "group", "", "only the devices in this group")
+	flags.BoolVar(&f.disabled, "disabled", false, "only the disabled devices")
+	flags.BoolVar(&f.expired, "expired", false, "only the devices whose registration has expired")
+}
+
+// selects reports whether the filter narrows down the devices
+func (f deviceFilter) selects() bool {
+	return f.search != "" || f.group != "" || f.disabled || f.expired
+}
+
+// query selects the devices matching the filter in the database
+func (f deviceFilter) query(db *gorm.DB, now time.Time) (*gorm.DB, error) {
+	query := db.Model(&Device{})
+	if f.search != "" {
+		name := "%" + likeEscaper.Replace(f.search) + "%"
+		mac := "%" + likeEscaper.Replace(normalizeMACAddress(f.search)) + "%"
+		query = query.Where(`mac LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\'`, mac, name)
+	}
+	if f.group != "" {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", f.group).RecordNotFound() {
+			return nil, fmt.Errorf("device group %q does not exist", f.group)
+		}
+		query = query.Where("id IN (SELECT device_id FROM device_devicegroups WHERE device_group_id = ?)", group.ID)
+	}
+	if f.disabled {
+		query = query.Where("disabled = ?", true)
+	}
+	if f.expired {
+		query = query.Where("expires_at < ?", now)
+	}
+	return query, nil
+}
+
+// listDevicesCommand lists the registered devices with their groups and, when a DHCP lease file is configured,
+// their current address and hostname. The devices are searched, filtered, sorted, and paged in the query, so
+// only the page shown is loaded.
+func listDevicesCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-devices", flag.ContinueOnError)
+	var filter deviceFilter
+	filter.register(flags)
+	order := flags.String("sort", "mac", "sort by mac, name, added, last-seen, or expires")
+	limit := flags.Int("limit", 0, "number of devices to show, or 0 for all")
+	page := flags.Int("page", 1, "page of -limit devices to show")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	orderBy, ok := deviceListOrders[*order]
+	if !ok {
+		return fmt.Errorf("unknown -sort %q", *order)
+	}
+	if *limit < 0 {
+		return errors.New("-limit must not be negative")
+	}
+	if *page < 1 {
+		return errors.New("-page must be at least 1")
+	}
+
+	now := time.Now()
+	query, err := filter.query(db, now)
+	if err != nil {
+		return err
+	}
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+	query = query.Order(orderBy)
+	if *limit > 0 {
+		query = query.Limit(*limit).Offset((*page - 1) * *limit)
+	}
+	var devices []Device
+	if err := query.Preload("DeviceGroups").Find(&devices).Error; err != nil {
+		return err
+	}
+	leases, err := loadDHCPLeases(config.DHCP, now)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "MAC\tNAME\tGROUPS\tEXPIRES\tLAST SEEN\tDISABLED\tIP\tHOSTNAME")
+	for _, device := range devices {
+		var groups []string
+		for _, group := range device.DeviceGroups {
+			groups = append(groups, group.Name)
+		}
+
+		mac := prettyPrintMACAddress(device.MAC)
+		if mac == "" {
+			mac = device.MAC
+		}
+		expires := ""
+		if device.ExpiresAt != nil {
+			expires = device.ExpiresAt.Local().Format(time.RFC3339)
+			if device.expired(now) {
+				expires += " (expired)"
+			}
+		}
+		lastSeen := ""
+		if device.LastSeenAt != nil {
+			lastSeen = device.LastSeenAt.Local().Format(time.RFC3339)
+		}
+		disabled := ""
+		if device.Disabled {
+			disabled = "yes"
+		}
+		lease := leases[device.MAC]
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", mac, device.Name, strings.Join(groups, ", "), expires, lastSeen, disabled, lease.IP, lease.Hostname)
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if *limit > 0 {
+		first := (*page-1)**limit + 1
+		if len(devices) == 0 {
+			fmt.Printf("Page %d is past the last of the %d devices\n", *page, total)
+		} else {
+			fmt.Printf("Devices %d-%d of %d\n", first, first+len(devices)-1, total)
+		}
+	}
+	return nil
+}
+
+// bulkDeviceChange is what bulk-devices changes on the devices it selects
+type bulkDeviceChange struct {
+	filter       deviceFilter
+	macs         stringListFlag
+	remove       bool
+	enable       bool
+	disable      bool
+	addGroups    stringListFlag
+	removeGroups stringListFlag
+	dryRun       bool
+}
+
+// parseBulkDeviceChange reads the arguments of bulk-devices, printing the usage to output
+func parseBulkDeviceChange(args []string, output io.Writer) (*bulkDeviceChange, error) {
+	var c bulkDeviceChange
+	flags := flag.NewFlagSet("bulk-devices", flag.ContinueOnError)
+	flags.SetOutput(output)
+	c.filter.register(flags)
+	flags.Var(&c.macs, "mac", "MAC address or prefix of a device (repeatable)")
+	flags.BoolVar(&c.remove, "remove", false, "move the devices to the trash")
+	flags.BoolVar(&c.enable, "enable", false, "enable the devices")
+	flags.BoolVar(&c.disable, "disable", false, "disable the devices, keeping their groups")
+	flags.Var(&c.addGroups, "add-group", "device group to add the devices to (repeatable)")
+	flags.Var(&c.removeGroups, "remove-group", "device group to take the devices out of (repeatable)")
+	flags.BoolVar(&c.dryRun, "dry-run", false, "only list the devices that would be changed")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(c.macs) == 0 && !c.filter.selects() {
+		return nil, errors.New("select the devices with -mac, -search, -group, -disabled, or -expired")
+	}
+	changeGroups := len(c.addGroups)+len(c.removeGroups) > 0
+	switch {
+	case !c.remove && !c.enable && !c.disable && !changeGroups:
+		return nil, errors.New("one of -remove, -enable, -disable, -add-group, or -remove-group is required")
+	case c.remove && (c.enable || c.disable || changeGroups):
+		return nil, errors.New("-remove can't be combined with other changes")
+	case c.enable && c.disable:
+		return nil, errors.New("-enable and -disable can't be combined")
+	}
+	return &c, nil
+}
+
+// devices loads the devices matching both the -mac addresses and the filter, all of which must exist
+func (c *bulkDeviceChange) devices(db *gorm.DB, now time.Time) ([]Device, error) {
+	query, err := c.filter.query(db, now)
+	if err != nil {
+		return nil, err
+	}
+	var macs []string
+	for _, mac := range c.macs {
+		mac = normalizeMACAddress(mac)
+		if db.First(&Device{}, "mac = ?", mac).RecordNotFound() {
+			return nil, fmt.Errorf("device %v does not exist", mac)
+		}
+		macs = append(macs, mac)
+	}
+	if len(macs) > 0 {
+		query = query.Where("mac IN (?)", macs)
+	}
+	var devices []Device
+	if err := query.Order("mac").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// bulkDevicesCommand moves many devices to the trash, enables or disables them, or changes their groups at once.
+// Either every device is changed or, if one of them can't be, none is.
+func bulkDevicesCommand(db *gorm.DB, args []string) error {
+	change, err := parseBulkDeviceChange(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	loadGroups := func(names []string) ([]DeviceGroup, error) {
+		var groups []DeviceGroup
+		for _, name := range names {
+			var group DeviceGroup
+			if db.First(&group, "name = ?", name).RecordNotFound() {
+				return nil, fmt.Errorf("device group %q does not exist", name)
+			}
+			groups = append(groups, group)
+		}
+		return groups, nil
+	}
+	addGroups, err := loadGroups(change.addGroups)
+	if err != nil {
+		return err
+	}
+	removeGroups, err := loadGroups(change.removeGroups)
+	if err != nil {
+		return err
+	}
+
+	var devices []Device
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if devices, err = change.devices(tx, time.Now()); err != nil {
+			return err
+		}
+		if change.dryRun {
+			return nil
+		}
+		for i := range devices {
+			device := &devices[i]
+			switch {
+			case change.remove:
+				if err := deleteDevice(tx, *device); err != nil {
+					return err
+				}
+				continue
+			case change.enable, change.disable:
+				if err := tx.Model(device).Update("disabled", change.disable).Error; err != nil {
+					return err
+				}
+			}
+			if len(addGroups)+len(removeGroups) == 0 {
+				continue
+			}
+			err := auditAssociationChange(tx, device, func() error {
+				if len(addGroups) > 0 {
+					if err := tx.Model(device).Association("DeviceGroups").Append(addGroups).Error; err != nil {
+						return err
+					}
+				}
+				if len(removeGroups) > 0 {
+					return tx.Model(device).Association("DeviceGroups").Delete(removeGroups).Error
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if change.dryRun {
+		for _, device := range devices {
+			fmt.Println(device.MAC)
+		}
+		fmt.Printf("Would change %d devices\n", len(devices))
+		return nil
+	}
+	switch {
+	case change.remove:
+		fmt.Printf("Moved %d devices to the trash\n", len(devices))
+	case change.enable:
+		fmt.Printf("Enabled %d devices\n", len(devices))
+	case change.disable:
+		fmt.Printf("Disabled %d devices\n", len(devices))
+	}
+	if len(addGroups)+len(removeGroups) > 0 {
+		fmt.Printf("Changed the groups of %d devices\n", len(devices))
+	}
+	return nil
+}
+
+// rejectedDevice sums up the rejected authentications of a MAC address
+type rejectedDevice struct {
+	MAC      string
+	Attempts int
+	Last     AuthLog
+}
+
+// rejectedCommand lists the MAC addresses rejected recently, the most recent first, to find devices waiting to
+// be registered
+func rejectedCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("rejected", flag.ContinueOnError)
+	hours := flags.Int("hours", 24, "number of hours to look back")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var entries []AuthLog
+	since := time.Now().Add(-time.Duration(*hours) * time.Hour)
+	if err := db.Where("accepted = ? AND created_at >= ? AND mac <> ?", false, since, "").Order("created_at").Find(&entries).Error; err != nil {
+		return err
+	}
+	leases, err := loadDHCPLeases(config.DHCP, time.Now())
+	if err != nil {
+		return err
+	}
+
+	byMAC := make(map[string]*rejectedDevice)
+	for _, entry := range entries {
+		if byMAC[entry.MAC] == nil {
+			byMAC[entry.MAC] = &rejectedDevice{MAC: entry.MAC}
+		}
+		byMAC[entry.MAC].Attempts++
+		byMAC[entry.MAC].Last = entry
+	}
+	var rejected []*rejectedDevice
+	for _, device := range byMAC {
+		rejected = append(rejected, device)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		return rejected[i].Last.CreatedAt.After(rejected[j].Last.CreatedAt)
+	})
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "MAC\tATTEMPTS\tLAST\tREASON\tSSID\tIP\tHOSTNAME")
+	for _, device := range rejected {
+		lease := leases[device.MAC]
+		fmt.Fprintf(out, "%v\t%d\t%v\t%v\t%v\t%v\t%v\n", prettyPrintMACAddress(device.MAC), device.Attempts,
+			device.Last.CreatedAt.Local().Format(time.RFC3339), device.Last.Reason, device.Last.SSID, lease.IP, lease.Hostname)
+	}
+	return out.Flush()
+}
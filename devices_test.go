@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestParseBulkDeviceChange(t *testing.T) {
+	valid := [][]string{
+		{"-mac", "001122334455", "-remove"},
+		{"-search", "laptop", "-disable"},
+		{"-group", "staff", "-enable", "-add-group", "lab"},
+		{"-expired", "-add-group", "lab", "-remove-group", "staff"},
+	}
+	for _, args := range valid {
+		if _, err := parseBulkDeviceChange(args, ioutil.Discard); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"-remove"},
+		{"-mac", "001122334455"},
+		{"-mac", "001122334455", "-remove", "-disable"},
+		{"-mac", "001122334455", "-remove", "-add-group", "lab"},
+		{"-mac", "001122334455", "-enable", "-disable"},
+		{"-mac", "001122334455", "-unknown"},
+	}
+	for _, args := range invalid {
+		if _, err := parseBulkDeviceChange(args, ioutil.Discard); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+}
+
+// deviceGroupNames returns the MAC addresses of the devices with the names of their groups
+func deviceGroupNames(t *testing.T, db *gorm.DB) map[string]string {
+	t.Helper()
+	var devices []Device
+	if err := db.Preload("DeviceGroups").Find(&devices).Error; err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, device := range devices {
+		var groups []string
+		for _, group := range device.DeviceGroups {
+			groups = append(groups, group.Name)
+		}
+		names[device.MAC] = strings.Join(groups, ",")
+	}
+	return names
+}
+
+func TestBulkDevicesCommand(t *testing.T) {
+	db := openTestDatabase(t)
+	staff := DeviceGroup{Name: "staff"}
+	lab := DeviceGroup{Name: "lab"}
+	for _, group := range []*DeviceGroup{&staff, &lab} {
+		if err := db.Create(group).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices := []Device{
+		{MAC: "001122334455", Name: "laptop-1", DeviceGroups: []DeviceGroup{staff}},
+		{MAC: "001122334466", Name: "laptop-2", DeviceGroups: []DeviceGroup{staff, lab}},
+		{MAC: "aabbccddeeff", Name: "phone"},
+	}
+	for i := range devices {
+		if err := db.Create(&devices[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bulkDevicesCommand(db, []string{"-search", "laptop", "-disable"}); err != nil {
+		t.Fatal(err)
+	}
+	var disabled int
+	db.Model(&Device{}).Where("disabled = ?", true).Count(&disabled)
+	if disabled != 2 {
+		t.Errorf("got %d disabled devices", disabled)
+	}
+	if err := bulkDevicesCommand(db, []string{"-disabled", "-enable", "-mac", "00:11:22:33:44:55"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&Device{}).Where("disabled = ?", true).Count(&disabled)
+	if disabled != 1 {
+		t.Errorf("got %d disabled devices", disabled)
+	}
+
+	// Moving a group's devices to another adds each once
+	if err := bulkDevicesCommand(db, []string{"-group", "staff", "-add-group", "lab", "-remove-group", "staff"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"001122334455": "lab", "001122334466": "lab", "aabbccddeeff": ""}
+	if got := deviceGroupNames(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+
+	// Nothing is changed when one of the devices is unknown, or can't be removed
+	if err := bulkDevicesCommand(db, []string{"-mac", "001122334455", "-mac", "001122334477", "-remove"}); err == nil {
+		t.Error("an unknown device was removed")
+	}
+	if err := db.Create(&Credential{Username: "phone", NTHash: []byte{1}, DeviceID: &devices[2].ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := bulkDevicesCommand(db, []string{"-mac", "001122334455", "-mac", "aabbccddeeff", "-remove"}); err == nil {
+		t.Error("a device with a credential was removed")
+	}
+	if count, err := countTrash(db); err != nil || count != 0 {
+		t.Errorf("got %d in the trash, %v", count, err)
+	}
+
+	if err := bulkDevicesCommand(db, []string{"-group", "lab", "-remove", "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countTrash(db); err != nil || count != 0 {
+		t.Errorf("the dry run moved %d to the trash, %v", count, err)
+	}
+	if err := bulkDevicesCommand(db, []string{"-group", "lab", "-remove"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countTrash(db); err != nil || count != 2 {
+		t.Errorf("got %d in the trash, %v", count, err)
+	}
+	if err := bulkDevicesCommand(db, []string{"-group", "missing", "-remove"}); err == nil {
+		t.Error("an unknown group was accepted")
+	}
+}
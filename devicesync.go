@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// syncGroupDevices registers the MAC addresses loaded from an inventory, such as a directory, as devices in the
+// group, and removes the devices of the group that are no longer found from it. found maps each MAC address to the
+// name of its device. Devices that are already registered keep their name unless it is empty, and their other
+// groups. report is told about every change, which is only made if dryRun is false.
+func syncGroupDevices(db *gorm.DB, groupName string, approval ApprovalConfig, source string, load func() (map[string]string, error), dryRun bool, report func(change string)) error {
+	if approval.Enabled && stringInSlice(groupName, approval.PrivilegedGroups) {
+		return fmt.Errorf("device group %q needs approval for changes, so devices can't be synced into it", groupName)
+	}
+	var group DeviceGroup
+	if db.First(&group, "name = ?", groupName).RecordNotFound() {
+		return fmt.Errorf("device group %q does not exist", groupName)
+	}
+	found, err := load()
+	if err != nil {
+		return err
+	}
+	// The changes are made in one transaction, so a failure part of the way doesn't leave the group half synced
+	return db.Transaction(func(tx *gorm.DB) error {
+		var members []Device
+		err := tx.Joins("JOIN device_devicegroups ON device_devicegroups.device_id = devices.id").
+			Where("device_devicegroups.device_group_id = ?", group.ID).Find(&members).Error
+		if err != nil {
+			return err
+		}
+		// An empty result is more likely a broken filter or permissions than every device being gone
+		if len(found) == 0 && len(members) > 0 {
+			return fmt.Errorf("no MAC addresses were found in %v, not removing the %d devices of group %q", source, len(members), group.Name)
+		}
+		inGroup := make(map[string]bool)
+		for _, device := range members {
+			inGroup[device.MAC] = true
+		}
+
+		macs := make([]string, 0, len(found))
+		for mac := range found {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+		for _, mac := range macs {
+			if inGroup[mac] {
+				continue
+			}
+			var device Device
+			if tx.First(&device, "MAC = ?", mac).RecordNotFound() {
+				report(fmt.Sprintf("Adding device %v %q", prettyPrintMACAddress(mac), found[mac]))
+				if dryRun {
+					continue
+				}
+				if err := purgeTrashedDevice(tx, mac); err != nil {
+					return err
+				}
+				if err := tx.Create(&Device{MAC: mac, Name: found[mac], DeviceGroups: []DeviceGroup{group}}).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			report(fmt.Sprintf("Adding %v to group %q", prettyPrintMACAddress(mac), group.Name))
+			if dryRun {
+				continue
+			}
+			if device.Name == "" {
+				device.Name = found[mac]
+				if err := tx.Save(&device).Error; err != nil {
+					return err
+				}
+			}
+			err := auditAssociationChange(tx, &device, func() error {
+				return tx.Model(&device).Association("DeviceGroups").Append(group).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range members {
+			device := members[i]
+			if _, ok := found[device.MAC]; ok {
+				continue
+			}
+			report(fmt.Sprintf("Removing %v from group %q", prettyPrintMACAddress(device.MAC), group.Name))
+			if dryRun {
+				continue
+			}
+			err := auditAssociationChange(tx, &device, func() error {
+				return tx.Model(&device).Association("DeviceGroups").Delete(group).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeviceSync syncs the devices from an inventory on an interval
+type DeviceSync struct {
+	DB *gorm.DB
+	// Name prefixes the log lines, and Actor is who the changes are recorded in the audit log as
+	Name     string
+	Actor    string
+	Interval time.Duration
+	// Sync makes the changes, telling report about each one
+	Sync func(db *gorm.DB, report func(change string)) error
+	// Standby reports whether the records are pulled from a primary, which syncs them instead
+	Standby func() bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start syncs right away and then on every interval until Stop is called
+func (s *DeviceSync) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		runLocked(s.DB, s.Actor, s.Interval, s.Run)
+		if s.Interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runLocked(s.DB, s.Actor, s.Interval, s.Run)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running sync and stops the DeviceSync
+func (s *DeviceSync) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Run syncs the devices once
+func (s *DeviceSync) Run() {
+	if s.Standby != nil && s.Standby() {
+		return
+	}
+	changes := 0
+	err := s.Sync(withAuditActor(s.DB, s.Actor), func(change string) {
+		changes++
+	})
+	if err != nil {
+		log.Printf("%v: Unable to sync devices: %v", s.Name, err)
+		return
+	}
+	if changes > 0 {
+		log.Printf("%v: Synced the devices, making %d changes", s.Name, changes)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSyncGroupDevices(t *testing.T) {
+	db := openTestDatabase(t)
+	group := DeviceGroup{Name: "computers"}
+	if err := db.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range []Device{
+		{MAC: "001122334455", Name: "kept", DeviceGroups: []DeviceGroup{group}},
+		{MAC: "001122334466", Name: "gone", DeviceGroups: []DeviceGroup{group}},
+		{MAC: "001122334477"},
+	} {
+		if err := db.Create(&device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := map[string]string{"001122334455": "renamed", "001122334477": "unnamed", "001122334488": "new"}
+	load := func() (map[string]string, error) { return found, nil }
+	members := func() string {
+		var devices []Device
+		db.Joins("JOIN device_devicegroups ON device_devicegroups.device_id = devices.id").
+			Where("device_devicegroups.device_group_id = ?", group.ID).Order("mac").Find(&devices)
+		var names []string
+		for _, device := range devices {
+			names = append(names, device.MAC+" "+device.Name)
+		}
+		return strings.Join(names, ", ")
+	}
+	before := members()
+
+	var changes []string
+	report := func(change string) { changes = append(changes, change) }
+	if err := syncGroupDevices(db, "computers", ApprovalConfig{}, "the test", load, true, report); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || members() != before {
+		t.Errorf("the dry run reported %q and changed the group to %v", changes, members())
+	}
+
+	// A failure part of the way leaves the group as it was
+	db.Exec("CREATE TRIGGER fail_sync BEFORE INSERT ON devices WHEN NEW.mac = '001122334488' BEGIN SELECT RAISE(ABORT, 'failed'); END")
+	if err := syncGroupDevices(db, "computers", ApprovalConfig{}, "the test", load, false, func(string) {}); err == nil {
+		t.Error("the failed sync succeeded")
+	}
+	if got := members(); got != before {
+		t.Errorf("the failed sync changed the group to %v", got)
+	}
+	db.Exec("DROP TRIGGER fail_sync")
+
+	if err := syncGroupDevices(db, "computers", ApprovalConfig{}, "the test", load, false, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := members(), "001122334455 kept, 001122334477 unnamed, 001122334488 new"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var removed Device
+	if db.First(&removed, "mac = ?", "001122334466").RecordNotFound() {
+		t.Error("the device that is no longer found was deleted instead of removed from the group")
+	}
+
+	empty := func() (map[string]string, error) { return nil, nil }
+	if err := syncGroupDevices(db, "computers", ApprovalConfig{}, "the test", empty, false, func(string) {}); err == nil {
+		t.Error("an empty result removed every device")
+	}
+	privileged := ApprovalConfig{Enabled: true, PrivilegedGroups: []string{"computers"}}
+	if err := syncGroupDevices(db, "computers", privileged, "the test", load, false, func(string) {}); err == nil {
+		t.Error("devices were synced into a privileged group")
+	}
+	if err := syncGroupDevices(db, "missing", ApprovalConfig{}, "the test", load, false, func(string) {}); err == nil {
+		t.Error("devices were synced into a missing group")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DHCP lease file formats
+const (
+	dhcpFormatDnsmasq = "dnsmasq"
+	dhcpFormatISC     = "isc"
+	dhcpFormatKea     = "kea"
+)
+
+// DHCPConfig stores where to find the leases of the DHCP server, to show the address and hostname of devices
+type DHCPConfig struct {
+	// LeasesFile is the lease file of the DHCP server, or empty to not show leases
+	LeasesFile string `json:"leases_file"`
+	// Format is "dnsmasq", "isc" for ISC dhcpd, or "kea" for the CSV file of Kea's memfile backend
+	Format string `json:"format"`
+}
+
+// dhcpLease is the current lease of a MAC address
+type dhcpLease struct {
+	IP       string
+	Hostname string
+	Expires  time.Time
+}
+
+// loadDHCPLeases reads the leases that haven't expired, by normalized MAC address. It returns no leases if no
+// lease file is configured.
+func loadDHCPLeases(config DHCPConfig, now time.Time) (map[string]dhcpLease, error) {
+	if config.LeasesFile == "" {
+		return nil, nil
+	}
+	file, err := os.Open(config.LeasesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var leases map[string]dhcpLease
+	switch config.Format {
+	case dhcpFormatDnsmasq:
+		leases, err = parseDnsmasqLeases(file)
+	case dhcpFormatISC:
+		leases, err = parseISCLeases(file)
+	case dhcpFormatKea:
+		leases, err = parseKeaLeases(file)
+	default:
+		return nil, fmt.Errorf("unknown DHCP lease format %q", config.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v: %v", config.LeasesFile, err)
+	}
+
+	for mac, lease := range leases {
+		if !lease.Expires.IsZero() && now.After(lease.Expires) {
+			delete(leases, mac)
+		}
+	}
+	return leases, nil
+}
+
+// parseDnsmasqLeases reads lines of expiry time, MAC address, IP address, hostname, and client ID. An expiry
+// time of 0 is an infinite lease and a hostname of "*" is none.
+func parseDnsmasqLeases(r io.Reader) (map[string]dhcpLease, error) {
+	leases := make(map[string]dhcpLease)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		// IPv6 leases and the server DUID use the second field for other things
+		mac := normalizeMACAddress(fields[1])
+		if !isValidMACFormat(mac) {
+			continue
+		}
+
+		lease := dhcpLease{IP: fields[2]}
+		if expires, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expires != 0 {
+			lease.Expires = time.Unix(expires, 0)
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases[mac] = lease
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCLeases reads the lease blocks of ISC dhcpd. The file is appended to, so later blocks replace earlier
+// ones for the same address.
+func parseISCLeases(r io.Reader) (map[string]dhcpLease, error) {
+	leases := make(map[string]dhcpLease)
+	var lease dhcpLease
+	var mac string
+	active := true
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "lease":
+			lease = dhcpLease{IP: fields[1]}
+			mac = ""
+			active = true
+		case len(fields) >= 4 && fields[0] == "ends":
+			// Times are in UTC, after the day of the week
+			if expires, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				lease.Expires = expires
+			}
+		case len(fields) >= 3 && fields[0] == "binding" && fields[1] == "state":
+			active = fields[2] == "active"
+		case len(fields) >= 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+			mac = normalizeMACAddress(fields[2])
+		case len(fields) >= 2 && fields[0] == "client-hostname":
+			lease.Hostname = strings.Trim(fields[1], `"`)
+		case line == "}":
+			if isValidMACFormat(mac) {
+				if active {
+					leases[mac] = lease
+				} else if leases[mac].IP == lease.IP {
+					delete(leases, mac)
+				}
+			}
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// parseKeaLeases reads the CSV lease file of Kea, whose columns are named in the first row. Later rows replace
+// earlier ones for the same address.
+func parseKeaLeases(r io.Reader) (map[string]dhcpLease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "hwaddr", "expire", "hostname"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing the %v column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i := columns[name]; i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	leases := make(map[string]dhcpLease)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		mac := normalizeMACAddress(field(record, "hwaddr"))
+		if !isValidMACFormat(mac) {
+			continue
+		}
+		lease := dhcpLease{IP: field(record, "address"), Hostname: field(record, "hostname")}
+		if expires, err := strconv.ParseInt(field(record, "expire"), 10, 64); err == nil {
+			lease.Expires = time.Unix(expires, 0)
+		}
+		// A state other than 0 is a declined or expired-reclaimed lease
+		if state := field(record, "state"); state != "" && state != "0" {
+			delete(leases, mac)
+			continue
+		}
+		leases[mac] = lease
+	}
+	return leases, nil
+}
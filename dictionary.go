@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/debug"
+	"layeh.com/radius/dictionary"
+	"layeh.com/radius/rfc2865"
+)
+
+// radiusDictionary names the attributes in commands and packet dumps. It has the standard attributes, and the
+// vendors of the dictionaries loaded at startup.
+var radiusDictionary = debug.IncludedDictionary
+
+// loadDictionaries adds the vendors and attributes of FreeRADIUS dictionary files to the standard attributes.
+// Attributes that are already known are skipped, so files that include the standard dictionaries, like those
+// shipped with FreeRADIUS, can be loaded as they are.
+func loadDictionaries(paths []string) (*dictionary.Dictionary, error) {
+	dict := &dictionary.Dictionary{
+		Attributes: append([]*dictionary.Attribute(nil), debug.IncludedDictionary.Attributes...),
+		Values:     append([]*dictionary.Value(nil), debug.IncludedDictionary.Values...),
+	}
+	for _, path := range paths {
+		// $INCLUDE lines are relative to the directory of the file
+		parser := dictionary.Parser{Opener: &dictionary.FileSystemOpener{Root: filepath.Dir(path)}, IgnoreIdenticalAttributes: true}
+		parsed, err := parser.ParseFile(filepath.Base(path))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+
+		for _, attribute := range parsed.Attributes {
+			if dictionary.AttributeByName(dict.Attributes, attribute.Name) == nil && dictionary.AttributeByOID(dict.Attributes, attribute.OID) == nil {
+				dict.Attributes = append(dict.Attributes, attribute)
+			}
+		}
+		dict.Values = append(dict.Values, parsed.Values...)
+		for _, vendor := range parsed.Vendors {
+			existing := dictionary.VendorByNumber(dict.Vendors, vendor.Number)
+			if byName := dictionary.VendorByName(dict.Vendors, vendor.Name); byName != existing {
+				return nil, fmt.Errorf("%v: vendor %v (%d) conflicts with vendor %v (%d)", path, vendor.Name, vendor.Number, byName.Name, byName.Number)
+			}
+			if existing == nil {
+				dict.Vendors = append(dict.Vendors, vendor)
+				continue
+			}
+			for _, attribute := range vendor.Attributes {
+				if dictionary.AttributeByName(existing.Attributes, attribute.Name) == nil && dictionary.AttributeByOID(existing.Attributes, attribute.OID) == nil {
+					existing.Attributes = append(existing.Attributes, attribute)
+				}
+			}
+			existing.Values = append(existing.Values, vendor.Values...)
+		}
+	}
+	return dict, nil
+}
+
+// lookupDictionaryAttribute finds an attribute by name among the standard attributes and those of the vendors,
+// returning the vendor it belongs to or nil for a standard attribute
+func lookupDictionaryAttribute(dict *dictionary.Dictionary, name string) (*dictionary.Vendor, *dictionary.Attribute) {
+	if attribute := dictionary.AttributeByName(dict.Attributes, name); attribute != nil {
+		return nil, attribute
+	}
+	for _, vendor := range dict.Vendors {
+		if attribute := dictionary.AttributeByName(vendor.Attributes, name); attribute != nil {
+			return vendor, attribute
+		}
+	}
+	return nil, nil
+}
+
+// dictionaryAttributeName finds the name of a standard or vendor attribute, or returns an empty string if the
+// dictionary doesn't have it
+func dictionaryAttributeName(dict *dictionary.Dictionary, vendorID uint32, attributeType uint8) string {
+	attributes := dict.Attributes
+	if vendorID != 0 {
+		vendor := dictionary.VendorByNumber(dict.Vendors, int(vendorID))
+		if vendor == nil {
+			return ""
+		}
+		attributes = vendor.Attributes
+	}
+	if attribute := dictionary.AttributeByOID(attributes, dictionary.OID{int(attributeType)}); attribute != nil {
+		return attribute.Name
+	}
+	return ""
+}
+
+// dumpPacket shows a packet like debug.DumpString, also decoding the Vendor-Specific attributes of the vendors in
+// the dictionary
+func dumpPacket(dict *dictionary.Dictionary, p *radius.Packet) string {
+	lines := []string{fmt.Sprintf("%v Id %d", p.Code, p.Identifier)}
+	for _, avp := range p.Attributes {
+		lines = append(lines, dumpAttribute(dict, p, avp)...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dumpAttribute shows an attribute of a packet, one line for each attribute of a Vendor-Specific attribute
+func dumpAttribute(dict *dictionary.Dictionary, p *radius.Packet, avp *radius.AVP) []string {
+	// The packet is copied for the secret and authenticator that encrypted attributes are decrypted with
+	single := *p
+	single.Attributes = radius.Attributes{avp}
+	config := &debug.Config{Dictionary: dict}
+	var vendor *dictionary.Vendor
+	if avp.Type == rfc2865.VendorSpecific_Type {
+		vendorID, value, err := radius.VendorSpecific(avp.Attribute)
+		vendor = dictionary.VendorByNumber(dict.Vendors, int(vendorID))
+		// Vendors with types or lengths wider than a byte are shown undecoded
+		if err != nil || vendor == nil || vendor.GetTypeOctets() != 1 || vendor.GetLengthOctets() != 1 {
+			vendor = nil
+		} else if attributes, err := radius.ParseAttributes(value); err == nil && len(attributes) > 0 {
+			single.Attributes = attributes
+			config.Dictionary = &dictionary.Dictionary{Attributes: vendor.Attributes, Values: vendor.Values}
+		} else {
+			vendor = nil
+		}
+	}
+
+	lines := strings.Split(debug.DumpString(config, &single), "\n")[1:]
+	if vendor != nil {
+		// Attributes missing from the vendor's dictionary are shown by number
+		for i := range lines {
+			lines[i] = strings.Replace(lines[i], "  #", "  "+vendor.Name+"-#", 1)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc3576"
+)
+
+// disconnectPort is the default port of the Dynamic Authorization Server on a NAS (RFC 5176)
+const disconnectPort = "3799"
+
+// sendDisconnect asks a NAS to end the sessions of a MAC address with a Disconnect-Request (RFC 5176), signed
+// with the shared secret of the NAS as a RADIUS client
+func sendDisconnect(ctx context.Context, addr, secret, mac string) (*radius.Packet, error) {
+	packet := radius.New(radius.CodeDisconnectRequest, []byte(secret))
+	rfc2865.UserName_SetString(packet, mac)
+	// Calling-Station-Id in the format of RFC 3580 section 3.21
+	rfc2865.CallingStationID_SetString(packet, strings.Replace(prettyPrintMACAddress(mac), ":", "-", -1))
+	// The Message-Authenticator of a Disconnect-Request is calculated with the Authenticator field zeroed
+	packet.Authenticator = [16]byte{}
+	if err := addMessageAuthenticator(packet); err != nil {
+		return nil, err
+	}
+
+	client := &radius.Client{Retry: time.Second}
+	return client.Exchange(ctx, packet, addr)
+}
+
+// disconnectCommand disconnects a device from the NAS it is associated with
+func disconnectCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("disconnect", flag.ContinueOnError)
+	nas := flags.String("nas", "", "address of the registered RADIUS client the device is connected to, with an optional port (default "+disconnectPort+")")
+	macAddress := flags.String("mac", "", "MAC address of the device")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for a response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	mac := normalizeMACAddress(*macAddress)
+	if !isValidMACFormat(mac) {
+		return fmt.Errorf("invalid MAC address %q", *macAddress)
+	}
+	host, port, err := net.SplitHostPort(*nas)
+	if err != nil {
+		host, port = *nas, disconnectPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid NAS address %q", *nas)
+	}
+	addr := net.JoinHostPort(ip.String(), port)
+
+	rs := NewRadiusServer(db)
+	if err := rs.resolveClientHostnames(); err != nil {
+		return err
+	}
+	client, found := rs.lookupClient(rs.DB, &net.UDPAddr{IP: ip})
+	if !found || client.Secret == "" {
+		return fmt.Errorf("%v is not a registered RADIUS client with a secret", ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	response, err := sendDisconnect(ctx, addr, client.Secret, mac)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("no response from %v", addr)
+	} else if err != nil {
+		return err
+	}
+
+	switch response.Code {
+	case radius.CodeDisconnectACK:
+		fmt.Printf("Disconnected %v from %v\n", prettyPrintMACAddress(mac), addr)
+		return nil
+	case radius.CodeDisconnectNAK:
+		if cause := rfc3576.ErrorCause_Get(response); cause != 0 {
+			return errors.New("the NAS refused: " + cause.String())
+		}
+		return errors.New("the NAS refused")
+	default:
+		return errors.New("unexpected response " + strconv.Itoa(int(response.Code)))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// responseCache remembers recent responses so retransmitted requests are answered without processing them
+// again (RFC 5080 section 2.2.2)
+type responseCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	responses map[string]cachedResponse
+	lastSweep time.Time
+}
+
+type cachedResponse struct {
+	// packet is nil while the request is still being processed
+	packet  *radius.Packet
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:       ttl,
+		responses: make(map[string]cachedResponse),
+		lastSweep: time.Now(),
+	}
+}
+
+// duplicateKey identifies a request by the client address and port, the identifier, and the request authenticator
+func duplicateKey(remoteAddr net.Addr, p *radius.Packet) string {
+	return remoteAddr.String() + "/" + string([]byte{p.Identifier}) + string(p.Authenticator[:])
+}
+
+// start returns the response previously sent for a request, if it hasn't expired, or reports that the request
+// was seen when it is still being processed, so a retransmission isn't processed a second time while a slow
+// lookup or EAP round is under way. Otherwise the request is marked as being processed until its response is
+// stored or done is called.
+func (rc *responseCache) start(key string) (*radius.Packet, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	rc.sweep(now)
+	if response, ok := rc.responses[key]; ok && !now.After(response.expires) {
+		return response.packet, true
+	}
+	rc.responses[key] = cachedResponse{expires: now.Add(rc.ttl)}
+	return nil, false
+}
+
+// done forgets a request that was processed without a response, such as one that was dropped, so its
+// retransmissions are processed again
+func (rc *responseCache) done(key string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if response, ok := rc.responses[key]; ok && response.packet == nil {
+		delete(rc.responses, key)
+	}
+}
+
+// put stores the response sent for a request
+func (rc *responseCache) put(key string, packet *radius.Packet) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	rc.sweep(now)
+	rc.responses[key] = cachedResponse{packet: packet, expires: now.Add(rc.ttl)}
+}
+
+// sweep deletes the expired responses, at most once per ttl
+func (rc *responseCache) sweep(now time.Time) {
+	if now.Sub(rc.lastSweep) <= rc.ttl {
+		return
+	}
+	for k, response := range rc.responses {
+		if now.After(response.expires) {
+			delete(rc.responses, k)
+		}
+	}
+	rc.lastSweep = now
+}
+
+// cachingResponseWriter stores the response in the cache as it is written
+type cachingResponseWriter struct {
+	radius.ResponseWriter
+	cache *responseCache
+	key   string
+}
+
+func (w *cachingResponseWriter) Write(packet *radius.Packet) error {
+	w.cache.put(w.key, packet)
+	return w.ResponseWriter.Write(packet)
+}
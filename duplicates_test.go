@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(time.Minute)
+	request := radius.New(radius.CodeAccessRequest, []byte("s3cret"))
+	key := duplicateKey(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1645}, request)
+	if other := duplicateKey(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1646}, request); other == key {
+		t.Error("requests from different ports have the same key")
+	}
+
+	if response, seen := cache.start(key); seen || response != nil {
+		t.Fatalf("a new request was seen with response %v", response)
+	}
+	// A retransmission is dropped while the first copy is processed, and answered once its response is stored
+	if response, seen := cache.start(key); !seen || response != nil {
+		t.Errorf("got %v, %v while the request was processed", response, seen)
+	}
+	accept := request.Response(radius.CodeAccessAccept)
+	cache.put(key, accept)
+	cache.done(key)
+	if response, seen := cache.start(key); !seen || response != accept {
+		t.Errorf("got %v, %v after the response was stored", response, seen)
+	}
+
+	// A request processed without a response is processed again when it is retransmitted
+	dropped := duplicateKey(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1645}, request)
+	cache.start(dropped)
+	cache.done(dropped)
+	if response, seen := cache.start(dropped); seen || response != nil {
+		t.Errorf("got %v, %v after the request was dropped", response, seen)
+	}
+
+	// Expired responses are forgotten
+	cache = newResponseCache(time.Millisecond)
+	cache.start(key)
+	cache.put(key, accept)
+	time.Sleep(2 * time.Millisecond)
+	if response, seen := cache.start(key); seen || response != nil {
+		t.Errorf("got %v, %v after the response expired", response, seen)
+	}
+}
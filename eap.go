@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// EAP codes and method types (RFC 3748)
+const (
+	eapCodeRequest  = 1
+	eapCodeResponse = 2
+	eapCodeSuccess  = 3
+	eapCodeFailure  = 4
+
+	eapTypeIdentity = 1
+	eapTypeNak      = 3
+	eapTypeTLS      = 13
+	eapTypePEAP     = 25
+)
+
+// eapSessionTimeout is how long an EAP conversation may sit idle before it is discarded
+const eapSessionTimeout = 60 * time.Second
+
+// eapPacket is a decoded EAP packet
+type eapPacket struct {
+	Code       byte
+	Identifier byte
+	Type       byte
+	Data       []byte
+}
+
+func parseEAPPacket(b []byte) (*eapPacket, error) {
+	if len(b) < 4 {
+		return nil, errors.New("EAP packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return nil, errors.New("invalid EAP packet length")
+	}
+
+	packet := &eapPacket{Code: b[0], Identifier: b[1]}
+	if length > 4 {
+		packet.Type = b[4]
+		packet.Data = b[5:length]
+	}
+	return packet, nil
+}
+
+func (p *eapPacket) Encode() []byte {
+	length := 4
+	if p.Code == eapCodeRequest || p.Code == eapCodeResponse {
+		length += 1 + len(p.Data)
+	}
+
+	b := make([]byte, length)
+	b[0] = p.Code
+	b[1] = p.Identifier
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	if length > 4 {
+		b[4] = p.Type
+		copy(b[5:], p.Data)
+	}
+	return b
+}
+
+// getEAPMessage joins the EAP-Message attributes of a RADIUS packet
+func getEAPMessage(p *radius.Packet) []byte {
+	var message []byte
+	for _, avp := range p.Attributes {
+		if avp.Type == rfc2869.EAPMessage_Type {
+			message = append(message, avp.Attribute...)
+		}
+	}
+	return message
+}
+
+// setEAPMessage splits an EAP packet across as many EAP-Message attributes as needed
+func setEAPMessage(p *radius.Packet, message []byte) {
+	p.Del(rfc2869.EAPMessage_Type)
+	for len(message) > 0 {
+		n := len(message)
+		if n > 253 {
+			n = 253
+		}
+		p.Add(rfc2869.EAPMessage_Type, radius.Attribute(message[:n]))
+		message = message[n:]
+	}
+}
+
+// EAPServer holds the state of in-progress EAP conversations
+type EAPServer struct {
+	// TLSConfig requires a client certificate for EAP-TLS
+	TLSConfig *tls.Config
+	// PEAPConfig only authenticates the server, since the peer uses a password inside the tunnel
+	PEAPConfig *tls.Config
+
+	mu       sync.Mutex
+	sessions map[string]*eapSession
+}
+
+// eapSession tracks one EAP conversation, identified by the RADIUS State attribute
+type eapSession struct {
+	// Requests for a session are handled one at a time
+	sync.Mutex
+
+	state      string
+	eventID    string
+	identity   string
+	identifier byte
+	method     byte
+	expires    time.Time
+
+	tls  *eapTLSSession
+	peap *peapSession
+}
+
+// NewEAPServer creates a new instance of EAPServer
+func NewEAPServer(tlsConfig *tls.Config) *EAPServer {
+	peapConfig := tlsConfig.Clone()
+	peapConfig.ClientAuth = tls.NoClientCert
+	peapConfig.ClientCAs = nil
+
+	return &EAPServer{
+		TLSConfig:  tlsConfig,
+		PEAPConfig: peapConfig,
+		sessions:   make(map[string]*eapSession),
+	}
+}
+
+// newSession starts tracking a new conversation and discards any that have expired
+func (es *EAPServer) newSession(identity string, identifier byte, eventID string) (*eapSession, error) {
+	var state [16]byte
+	if _, err := rand.Read(state[:]); err != nil {
+		return nil, err
+	}
+	session := &eapSession{
+		state:      hex.EncodeToString(state[:]),
+		eventID:    eventID,
+		identity:   identity,
+		identifier: identifier,
+		method:     eapTypeTLS,
+		expires:    time.Now().Add(eapSessionTimeout),
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now()
+	for key, existing := range es.sessions {
+		if now.After(existing.expires) {
+			existing.close()
+			delete(es.sessions, key)
+		}
+	}
+	es.sessions[session.state] = session
+	return session, nil
+}
+
+// session looks up an active conversation by its State attribute
+func (es *EAPServer) session(state string) *eapSession {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	session, ok := es.sessions[state]
+	if !ok || time.Now().After(session.expires) {
+		return nil
+	}
+	session.expires = time.Now().Add(eapSessionTimeout)
+	return session
+}
+
+// eventID returns the event ID of an active conversation, without keeping it alive like session does
+func (es *EAPServer) eventID(state string) string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if session, ok := es.sessions[state]; ok && time.Now().Before(session.expires) {
+		return session.eventID
+	}
+	return ""
+}
+
+// endSession stops tracking a conversation once it has succeeded or failed
+func (es *EAPServer) endSession(session *eapSession) {
+	es.mu.Lock()
+	delete(es.sessions, session.state)
+	es.mu.Unlock()
+	session.close()
+}
+
+func (s *eapSession) close() {
+	if s.tls != nil {
+		s.tls.close()
+	}
+}
+
+// eapHandler processes Access-Requests that carry an EAP-Message
+func (rs *RadiusServer) eapHandler(w radius.ResponseWriter, r *radius.Request, requestedSSID string) {
+	// RFC 3579 requires a Message-Authenticator on all packets carrying EAP
+	if present, _ := verifyMessageAuthenticator(r.Packet); !present {
+		requestLogf(r, "Dropping EAP request from %v without a Message-Authenticator", r.RemoteAddr)
+		return
+	}
+
+	request, err := parseEAPPacket(getEAPMessage(r.Packet))
+	if err != nil || request.Code != eapCodeResponse {
+		requestLogf(r, "Dropping invalid EAP message from %v", r.RemoteAddr)
+		return
+	}
+
+	if rs.EAP == nil {
+		requestLogf(r, "EAP is not enabled")
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	// A new conversation starts with the peer's identity
+	state := rfc2865.State_GetString(r.Packet)
+	if state == "" {
+		if request.Type != eapTypeIdentity {
+			rs.eapFailure(w, r, request.Identifier, "")
+			return
+		}
+		session, err := rs.EAP.newSession(string(request.Data), request.Identifier, eventID(r))
+		if err != nil {
+			requestLogf(r, "Unable to start EAP session: %v", err)
+			return
+		}
+		requestLogf(r, "EAP identity %q started authentication", session.identity)
+		rs.eapChallenge(w, r, session, []byte{eapTLSFlagStart})
+		return
+	}
+
+	session := rs.EAP.session(state)
+	if session == nil {
+		requestLogf(r, "Unknown or expired EAP session from %v", r.RemoteAddr)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	// Ignore responses that don't answer our last request
+	if request.Identifier != session.identifier {
+		requestLogf(r, "Ignoring EAP response with unexpected identifier for %q", session.identity)
+		return
+	}
+
+	switch {
+	case request.Type == session.method:
+		rs.eapTLSHandler(w, r, session, request, requestedSSID)
+	// The peer can decline EAP-TLS before the handshake starts and ask for PEAP instead
+	case request.Type == eapTypeNak && session.tls == nil && bytes.IndexByte(request.Data, eapTypePEAP) != -1:
+		requestLogf(r, "EAP identity %q requested PEAP", session.identity)
+		session.method = eapTypePEAP
+		rs.eapChallenge(w, r, session, []byte{eapTLSFlagStart})
+	case request.Type == eapTypeNak:
+		requestLogf(r, "EAP identity %q declined the available EAP methods", session.identity)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+	default:
+		requestLogf(r, "Unsupported EAP type %v from %q", request.Type, session.identity)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+	}
+}
+
+// eapChallenge sends the next EAP-Request of a conversation in an Access-Challenge
+func (rs *RadiusServer) eapChallenge(w radius.ResponseWriter, r *radius.Request, session *eapSession, data []byte) {
+	session.identifier++
+	eap := eapPacket{Code: eapCodeRequest, Identifier: session.identifier, Type: session.method, Data: data}
+
+	response := newResponse(r, radius.CodeAccessChallenge)
+	setEAPMessage(response, eap.Encode())
+	rfc2865.State_SetString(response, session.state)
+	rs.writeResponse(w, response)
+}
+
+// eapMethodName names an EAP method for authentication events
+func eapMethodName(method byte) string {
+	if method == eapTypePEAP {
+		return authMethodPEAP
+	}
+	return authMethodEAPTLS
+}
+
+// eapFailure ends a conversation with an EAP-Failure in an Access-Reject, with the reason it was rejected if
+// it is an authentication outcome
+func (rs *RadiusServer) eapFailure(w radius.ResponseWriter, r *radius.Request, identifier byte, reason string) {
+	eap := eapPacket{Code: eapCodeFailure, Identifier: identifier}
+
+	response := newResponse(r, radius.CodeAccessReject)
+	setEAPMessage(response, eap.Encode())
+	rs.addRejectReason(response, reason)
+	rs.writeResponse(w, response)
+}
+
+// eapSuccess ends a conversation with an EAP-Success, the keying material, and the reply attributes of the
+// groups granting access in an Access-Accept
+func (rs *RadiusServer) eapSuccess(w radius.ResponseWriter, r *radius.Request, identifier byte, msk []byte, groups []DeviceGroup, ssid string) {
+	eap := eapPacket{Code: eapCodeSuccess, Identifier: identifier}
+
+	response := newResponse(r, radius.CodeAccessAccept)
+	setEAPMessage(response, eap.Encode())
+	rs.addReplyAttributes(r, response, groups, ssid)
+	if err := addMPPEKeys(response, msk); err != nil {
+		requestLogf(r, "Unable to add MPPE keys: %v", err)
+		rs.eapFailure(w, r, identifier, "")
+		return
+	}
+	rs.writeResponse(w, response)
+}
+
+// Microsoft vendor attributes carrying the keys for the WiFi 4-way handshake (RFC 2548)
+const (
+	vendorMicrosoft       = 311
+	msMPPESendKeyType     = 16
+	msMPPERecvKeyType     = 17
+	mppeKeyLength         = 32
+	minimumMSKLength      = 2 * mppeKeyLength
+	mppeSaltHighBitMarker = 0x80
+)
+
+// addMPPEKeys adds the MS-MPPE-Recv-Key and MS-MPPE-Send-Key attributes derived from the EAP master session key
+func addMPPEKeys(p *radius.Packet, msk []byte) error {
+	if len(msk) < minimumMSKLength {
+		return errors.New("master session key too short")
+	}
+
+	recvKey, err := newMPPEKeyAttribute(msMPPERecvKeyType, msk[:mppeKeyLength], p)
+	if err != nil {
+		return err
+	}
+	sendKey, err := newMPPEKeyAttribute(msMPPESendKeyType, msk[mppeKeyLength:minimumMSKLength], p)
+	if err != nil {
+		return err
+	}
+
+	p.Add(rfc2865.VendorSpecific_Type, recvKey)
+	p.Add(rfc2865.VendorSpecific_Type, sendKey)
+	return nil
+}
+
+// newMPPEKeyAttribute encrypts a key with the RADIUS secret and request authenticator (RFC 2548 section 2.4.2)
+func newMPPEKeyAttribute(vendorType byte, key []byte, p *radius.Packet) (radius.Attribute, error) {
+	var salt [2]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, err
+	}
+	salt[0] |= mppeSaltHighBitMarker
+
+	ciphertext := encryptMPPEKey(key, salt, p.Secret, p.Authenticator)
+	value := []byte{vendorType, byte(2 + len(salt) + len(ciphertext))}
+	value = append(value, salt[:]...)
+	value = append(value, ciphertext...)
+	return radius.NewVendorSpecific(vendorMicrosoft, value)
+}
+
+// encryptMPPEKey hides a key behind MD5 hashes chained from the secret, request authenticator, and salt
+func encryptMPPEKey(key []byte, salt [2]byte, secret []byte, authenticator [16]byte) []byte {
+	// The plaintext is the key length followed by the key, padded to a multiple of 16 bytes
+	plaintext := append([]byte{byte(len(key))}, key...)
+	if remainder := len(plaintext) % md5.Size; remainder != 0 {
+		plaintext = append(plaintext, make([]byte, md5.Size-remainder)...)
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	previous := append(authenticator[:], salt[:]...)
+	for i := 0; i < len(plaintext); i += md5.Size {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		block := hash.Sum(nil)
+		for j := range block {
+			ciphertext[i+j] = plaintext[i+j] ^ block[j]
+		}
+		previous = ciphertext[i : i+md5.Size]
+	}
+	return ciphertext
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestEncryptMPPEKey(t *testing.T) {
+	sequence := func(start byte, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = start + byte(i)
+		}
+		return b
+	}
+	var rfc5997Authenticator [16]byte
+	copy(rfc5997Authenticator[:], rfc5997StatusServer[4:20])
+	var sequenceAuthenticator [16]byte
+	copy(sequenceAuthenticator[:], sequence(0, 16))
+
+	// Calculated independently from the algorithm of RFC 2548 section 2.4.2
+	tests := []struct {
+		name          string
+		key           []byte
+		salt          [2]byte
+		secret        string
+		authenticator [16]byte
+		want          string
+	}{
+		{
+			name:          "32 byte key",
+			key:           sequence(0, 32),
+			salt:          [2]byte{0x80, 0x01},
+			secret:        "xyzzy5461",
+			authenticator: rfc5997Authenticator,
+			want:          "fb3e78ce34a1a2589207005bdbc7448d1425aca9a2d7351602122b81216eae1dac4240e1652478b7bc76e873630b0edc",
+		},
+		{
+			name:          "other salt and secret",
+			key:           sequence(0x20, 32),
+			salt:          [2]byte{0xa5, 0x5a},
+			secret:        "testing123",
+			authenticator: sequenceAuthenticator,
+			want:          "20883583f4a018103347db76db5e5780c4d73c7bfa805597bcedcdf10f93fe2f231bca8e0444feec2b32f241f5b8c53b",
+		},
+		{
+			name:   "16 byte key",
+			key:    sequence(0, 16),
+			salt:   [2]byte{0x80, 0x00},
+			secret: "s",
+			want:   "83cfb81332c1edb87c8e990b8f0b0511ba5c50a4426f5a81b320866a8e22d07f",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := encryptMPPEKey(test.key, test.salt, []byte(test.secret), test.authenticator)
+			if hex.EncodeToString(got) != test.want {
+				t.Errorf("got %x, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// decryptMPPEKey reverses the encryption of RFC 2548 section 2.4.2, returning the key without the padding
+func decryptMPPEKey(t *testing.T, value, secret []byte, authenticator [16]byte) []byte {
+	t.Helper()
+	salt, ciphertext := value[:2], value[2:]
+	if salt[0]&0x80 == 0 {
+		t.Errorf("salt %x doesn't have the high bit set", salt)
+	}
+	if len(ciphertext)%md5.Size != 0 {
+		t.Fatalf("ciphertext of %d bytes isn't a multiple of %d", len(ciphertext), md5.Size)
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	previous := append(authenticator[:], salt...)
+	for i := 0; i < len(ciphertext); i += md5.Size {
+		block := md5.Sum(append(append([]byte(nil), secret...), previous...))
+		for j := range block {
+			plaintext[i+j] = ciphertext[i+j] ^ block[j]
+		}
+		previous = ciphertext[i : i+md5.Size]
+	}
+	if int(plaintext[0]) > len(plaintext)-1 {
+		t.Fatalf("key length %d is longer than the plaintext", plaintext[0])
+	}
+	return plaintext[1 : 1+plaintext[0]]
+}
+
+func TestAddMPPEKeys(t *testing.T) {
+	request := radius.New(radius.CodeAccessRequest, []byte("testing123"))
+	response := request.Response(radius.CodeAccessAccept)
+	msk := make([]byte, 64)
+	for i := range msk {
+		msk[i] = byte(i)
+	}
+
+	if err := addMPPEKeys(response, msk); err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 5216 section 2.3: the first 32 bytes of the MSK are the MS-MPPE-Recv-Key and the next 32 the Send-Key
+	want := map[byte][]byte{msMPPERecvKeyType: msk[:32], msMPPESendKeyType: msk[32:]}
+	for _, attribute := range response.Attributes {
+		if attribute.Type != rfc2865.VendorSpecific_Type {
+			continue
+		}
+		vendor := binary.BigEndian.Uint32(attribute.Attribute[:4])
+		vendorType, length := attribute.Attribute[4], int(attribute.Attribute[5])
+		if vendor != vendorMicrosoft || length != len(attribute.Attribute)-4 {
+			t.Errorf("got vendor %d with length %d, want %d with %d", vendor, length, vendorMicrosoft, len(attribute.Attribute)-4)
+			continue
+		}
+		key := decryptMPPEKey(t, attribute.Attribute[6:], request.Secret, request.Authenticator)
+		if !bytes.Equal(key, want[vendorType]) {
+			t.Errorf("got key %x for type %d, want %x", key, vendorType, want[vendorType])
+		}
+		delete(want, vendorType)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing keys of types %v", want)
+	}
+
+	if err := addMPPEKeys(response, msk[:63]); err == nil {
+		t.Error("a 63 byte MSK was accepted")
+	}
+}
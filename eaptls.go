@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+)
+
+// EAP-TLS flags (RFC 5216 section 3.1)
+const (
+	eapTLSFlagLength = 0x80
+	eapTLSFlagMore   = 0x40
+	eapTLSFlagStart  = 0x20
+
+	eapTLSVersionMask = 0x07
+)
+
+const (
+	// eapTLSFragmentSize is the most TLS data sent in one EAP-Request, leaving room in a typical 1500 byte MTU
+	eapTLSFragmentSize = 1024
+	// eapTLSMaxMessageLength bounds how much fragmented data a peer may send in one TLS flight
+	eapTLSMaxMessageLength = 64 * 1024
+	// eapTLSHandshakeTimeout is how long the TLS stack may take to produce its next flight
+	eapTLSHandshakeTimeout = 10 * time.Second
+	// eapTLSKeyLabel is the TLS exporter label used to derive the EAP master session key
+	eapTLSKeyLabel = "client EAP encryption"
+)
+
+// newEAPTLSConfig creates the TLS settings for EAP-TLS, which require devices to present a certificate from the CA
+func newEAPTLSConfig(ca *CertificateAuthority, serverName string) (*tls.Config, error) {
+	certificate, err := ca.ServerCertificate(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.Pool(),
+		// The EAP-TLS key derivation used here is defined for TLS 1.2 (RFC 5216)
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// eapTLSSession runs a TLS handshake over the EAP-TLS messages of a conversation
+type eapTLSSession struct {
+	conn    *eapTLSConn
+	tls     *tls.Conn
+	done    chan error
+	started bool
+
+	finished     bool
+	handshakeErr error
+
+	// Fragments received from the peer that have not been passed to the TLS stack yet
+	incoming []byte
+	// Data from the TLS stack that still has to be sent to the peer
+	outgoing      []byte
+	firstFragment bool
+}
+
+func newEAPTLSSession(config *tls.Config) *eapTLSSession {
+	conn := newEAPTLSConn()
+	return &eapTLSSession{
+		conn: conn,
+		tls:  tls.Server(conn, config),
+		done: make(chan error, 1),
+	}
+}
+
+// exchange passes a complete flight from the peer to the TLS stack and collects its reply
+func (s *eapTLSSession) exchange(input []byte) (output []byte, finished bool, err error) {
+	if !s.started {
+		s.started = true
+		go func() {
+			s.done <- s.tls.Handshake()
+		}()
+	}
+
+	timeout := time.NewTimer(eapTLSHandshakeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case s.conn.incoming <- input:
+	case err := <-s.done:
+		return s.conn.takeOutput(), true, err
+	case <-timeout.C:
+		return nil, true, errors.New("timed out passing data to TLS")
+	}
+
+	select {
+	case <-s.conn.idle:
+		return s.conn.takeOutput(), false, nil
+	case err := <-s.done:
+		return s.conn.takeOutput(), true, err
+	case <-timeout.C:
+		return nil, true, errors.New("timed out waiting for TLS")
+	}
+}
+
+// queue sets data from the TLS stack to be sent to the peer
+func (s *eapTLSSession) queue(output []byte) {
+	s.outgoing = output
+	s.firstFragment = true
+}
+
+// readApplicationData decrypts data tunneled through the established TLS session
+func (s *eapTLSSession) readApplicationData(input []byte) ([]byte, error) {
+	s.conn.pending = append(s.conn.pending, input...)
+
+	var plaintext []byte
+	buffer := make([]byte, 4096)
+	for {
+		n, err := s.tls.Read(buffer)
+		plaintext = append(plaintext, buffer[:n]...)
+		if err == errEAPTLSWouldBlock {
+			return plaintext, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeApplicationData encrypts data to tunnel through the established TLS session and queues it for the peer
+func (s *eapTLSSession) writeApplicationData(plaintext []byte) error {
+	if _, err := s.tls.Write(plaintext); err != nil {
+		return err
+	}
+	s.queue(s.conn.takeOutput())
+	return nil
+}
+
+// nextFragment returns the EAP-TLS data for the next request to the peer
+func (s *eapTLSSession) nextFragment() []byte {
+	data := []byte{0}
+	if s.firstFragment && len(s.outgoing) > eapTLSFragmentSize {
+		data[0] |= eapTLSFlagLength
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(s.outgoing)))
+		data = append(data, length[:]...)
+	}
+	s.firstFragment = false
+
+	n := len(s.outgoing)
+	if n > eapTLSFragmentSize {
+		n = eapTLSFragmentSize
+		data[0] |= eapTLSFlagMore
+	}
+	data = append(data, s.outgoing[:n]...)
+	s.outgoing = s.outgoing[n:]
+	return data
+}
+
+func (s *eapTLSSession) close() {
+	s.conn.Close()
+}
+
+// eapTLSMasterSessionKey derives the 64 byte master session key from an established session (RFC 5216 section
+// 2.3). The full key material is 128 bytes, the rest being the extended master session key that isn't sent.
+func eapTLSMasterSessionKey(state tls.ConnectionState) ([]byte, error) {
+	keys, err := state.ExportKeyingMaterial(eapTLSKeyLabel, nil, 128)
+	if err != nil {
+		return nil, err
+	}
+	return keys[:minimumMSKLength], nil
+}
+
+// eapTLSHandler handles an EAP-Response for a TLS based method (EAP-TLS or PEAP) of a conversation
+func (rs *RadiusServer) eapTLSHandler(w radius.ResponseWriter, r *radius.Request, session *eapSession, request *eapPacket, requestedSSID string) {
+	if session.tls == nil {
+		config := rs.EAP.TLSConfig
+		if session.method == eapTypePEAP {
+			config = rs.EAP.PEAPConfig
+		}
+		session.tls = newEAPTLSSession(config)
+	}
+	s := session.tls
+
+	if len(request.Data) < 1 {
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+	// PEAP uses the low bits of the flags for its version
+	flags := request.Data[0] &^ eapTLSVersionMask
+	data := request.Data[1:]
+	if flags&eapTLSFlagLength != 0 {
+		if len(data) < 4 {
+			rs.EAP.endSession(session)
+			rs.eapFailure(w, r, request.Identifier, "")
+			return
+		}
+		data = data[4:]
+	}
+
+	// An empty response acknowledges our last fragment
+	if len(data) == 0 && flags&eapTLSFlagMore == 0 {
+		switch {
+		case len(s.outgoing) > 0:
+			rs.eapChallenge(w, r, session, s.nextFragment())
+		case s.finished && s.handshakeErr == nil && session.method == eapTypePEAP:
+			rs.peapHandler(w, r, session, request, nil, requestedSSID)
+		case s.finished && s.handshakeErr == nil:
+			rs.eapTLSComplete(w, r, session, request, requestedSSID)
+		default:
+			if s.handshakeErr != nil {
+				requestLogf(r, "EAP-TLS handshake with %q failed: %v", session.identity, s.handshakeErr)
+			}
+			rs.EAP.endSession(session)
+			rs.eapFailure(w, r, request.Identifier, "")
+		}
+		return
+	}
+
+	// Collect fragments until the peer has sent the whole flight
+	if len(s.incoming)+len(data) > eapTLSMaxMessageLength {
+		requestLogf(r, "EAP-TLS message from %q is too long", session.identity)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+	s.incoming = append(s.incoming, data...)
+	if flags&eapTLSFlagMore != 0 {
+		rs.eapChallenge(w, r, session, []byte{0})
+		return
+	}
+	input := s.incoming
+	s.incoming = nil
+
+	// Once the handshake is done the data is tunneled PEAP traffic
+	if s.finished && s.handshakeErr == nil && session.method == eapTypePEAP {
+		plaintext, err := s.readApplicationData(input)
+		if err != nil {
+			requestLogf(r, "Unable to decrypt PEAP data from %q: %v", session.identity, err)
+			rs.EAP.endSession(session)
+			rs.eapFailure(w, r, request.Identifier, "")
+			return
+		}
+		rs.peapHandler(w, r, session, request, plaintext, requestedSSID)
+		return
+	}
+
+	output, finished, err := s.exchange(input)
+	s.queue(output)
+	if finished && err == nil {
+		s.conn.setTunnel()
+	}
+	s.finished = finished
+	s.handshakeErr = err
+
+	switch {
+	case len(s.outgoing) > 0:
+		// This includes TLS alerts, which the peer acknowledges before we send the failure
+		rs.eapChallenge(w, r, session, s.nextFragment())
+	case finished && err == nil && session.method == eapTypePEAP:
+		rs.peapHandler(w, r, session, request, nil, requestedSSID)
+	case finished && err == nil:
+		rs.eapTLSComplete(w, r, session, request, requestedSSID)
+	default:
+		requestLogf(r, "EAP-TLS handshake with %q failed: %v", session.identity, err)
+		rs.authEvent(r, AuthEvent{Method: eapMethodName(session.method), Username: session.identity, SSID: requestedSSID, Reason: authReasonHandshakeFailed})
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, authReasonHandshakeFailed)
+	}
+}
+
+// eapTLSComplete authorizes the device named in the peer certificate once the handshake has finished
+func (rs *RadiusServer) eapTLSComplete(w radius.ResponseWriter, r *radius.Request, session *eapSession, request *eapPacket, requestedSSID string) {
+	defer rs.EAP.endSession(session)
+	event := AuthEvent{Method: authMethodEAPTLS, Username: session.identity, SSID: requestedSSID}
+
+	state := session.tls.tls.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+	certificate := state.PeerCertificates[0]
+
+	// Give up on the request if the database doesn't answer its lookups in time
+	db, cancel := rs.requestDB(r.Context())
+	defer cancel()
+	var issued Certificate
+	var revoked bool
+	var device Device
+	var mac string
+	var found bool
+	var access NetworkAccess
+	lookup := func() {
+		revoked = !db.First(&issued, "serial_number = ?", certificate.SerialNumber.String()).RecordNotFound() && issued.Revoked
+		device, mac, found = rs.lookupCertificateDevice(db, certificate)
+		access = rs.networkAccess(db, requestedSSID)
+	}
+	if !rs.timedLookup(db, r.RemoteAddr, lookup) {
+		return
+	}
+	reject := func(reason string) {
+		event.Reason = reason
+		rs.authEvent(r, event)
+		rs.eapFailure(w, r, request.Identifier, event.Reason)
+	}
+
+	// Refuse certificates that have been revoked
+	if revoked {
+		requestLogf(r, "EAP-TLS certificate %v for %q has been revoked", issued.SerialNumber, certificate.Subject.CommonName)
+		reject(authReasonRevoked)
+		return
+	}
+
+	// Decide as MAC authentication does: the groups of a registered device, or else the access of the network
+	registered := found && !device.Disabled && !device.expired(time.Now())
+	groups := device.DeviceGroups
+	if found {
+		event.MAC = device.MAC
+	}
+	switch {
+	case registered:
+		if !groupsAllowSSID(groups, requestedSSID) {
+			if access < NetworkAccessKnownDevices {
+				requestLogf(r, "%v received %v for %v", prettyPrintMACAddress(device.MAC), radius.CodeAccessReject, requestedSSID)
+				reject(authReasonSSIDNotAllowed)
+				return
+			}
+			// The network accepts the device, without the reply attributes of its groups
+			groups = nil
+		}
+		var limited bool
+		nas := addrIP(r.RemoteAddr).String()
+		if !rs.timedLookup(db, r.RemoteAddr, func() { limited = rs.sessionLimitReached(db, nas, mac, device, device.DeviceGroups, requestedSSID) }) {
+			return
+		}
+		if limited {
+			reject(authReasonSessionLimit)
+			return
+		}
+	case found && device.Disabled:
+		requestLogf(r, "%v is disabled", prettyPrintMACAddress(device.MAC))
+		reject(authReasonDisabled)
+		return
+	case found:
+		requestLogf(r, "Registration of %v has expired", prettyPrintMACAddress(device.MAC))
+		reject(authReasonExpired)
+		return
+	// Open networks also accept the certificates of devices that aren't registered
+	case access == NetworkAccessAnyDevice:
+		groups = nil
+	default:
+		requestLogf(r, "EAP-TLS certificate %q does not match a device", certificate.Subject.CommonName)
+		reject(authReasonUnknownDevice)
+		return
+	}
+
+	msk, err := eapTLSMasterSessionKey(state)
+	if err != nil {
+		requestLogf(r, "Unable to derive EAP-TLS keys for %q: %v", session.identity, err)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	name := fmt.Sprintf("%q", certificate.Subject.CommonName)
+	if found {
+		name = prettyPrintMACAddress(device.MAC)
+	}
+	requestLogf(r, "%v received %v for %v using EAP-TLS", name, radius.CodeAccessAccept, requestedSSID)
+	event.Accepted = true
+	rs.authEvent(r, event)
+	if registered {
+		rs.deviceSeen(device)
+	}
+	rs.eapSuccess(w, r, request.Identifier, msk, groups, requestedSSID)
+}
+
+// lookupCertificateDevice finds the device matching the MAC address in the certificate common name or a DNS
+// SAN, and returns that MAC address too, since the device may be a prefix matching many
+func (rs *RadiusServer) lookupCertificateDevice(db *gorm.DB, certificate *x509.Certificate) (Device, string, bool) {
+	names := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+	for _, name := range names {
+		mac := normalizeMACAddress(name)
+		if !isValidMACFormat(mac) {
+			continue
+		}
+		if device, found := rs.lookupDevice(db, mac); found {
+			return device, mac, true
+		}
+	}
+	return Device{}, "", false
+}
+
+// eapTLSConn is a net.Conn that carries TLS records through EAP messages instead of a socket. Reading
+// after all received data has been consumed signals that the TLS stack is waiting on the peer, so the
+// data it has written so far can be sent.
+type eapTLSConn struct {
+	incoming chan []byte
+	idle     chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+
+	pending  []byte
+	received bool
+	// tunnel is set once the handshake has finished, after which reads never block
+	tunnel bool
+
+	mu     sync.Mutex
+	output []byte
+}
+
+func newEAPTLSConn() *eapTLSConn {
+	return &eapTLSConn{
+		incoming: make(chan []byte),
+		idle:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// errEAPTLSWouldBlock is returned by reads in tunnel mode when everything received has been consumed. It is a
+// temporary error so the TLS connection remains usable for the next message.
+var errEAPTLSWouldBlock net.Error = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "no EAP data available" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+// setTunnel switches the connection to tunnel mode once the handshake goroutine has finished
+func (c *eapTLSConn) setTunnel() {
+	c.tunnel = true
+}
+
+func (c *eapTLSConn) Read(b []byte) (int, error) {
+	if c.tunnel && len(c.pending) == 0 {
+		return 0, errEAPTLSWouldBlock
+	}
+	for len(c.pending) == 0 {
+		if c.received {
+			select {
+			case c.idle <- struct{}{}:
+			case <-c.closed:
+				return 0, io.EOF
+			}
+		}
+		select {
+		case c.pending = <-c.incoming:
+			c.received = true
+		case <-c.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *eapTLSConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.output = append(c.output, b...)
+	return len(b), nil
+}
+
+func (c *eapTLSConn) takeOutput() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := c.output
+	c.output = nil
+	return output
+}
+
+func (c *eapTLSConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *eapTLSConn) LocalAddr() net.Addr                { return eapAddr{} }
+func (c *eapTLSConn) RemoteAddr() net.Addr               { return eapAddr{} }
+func (c *eapTLSConn) SetDeadline(t time.Time) error      { return nil }
+func (c *eapTLSConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *eapTLSConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type eapAddr struct{}
+
+func (eapAddr) Network() string { return "eap" }
+func (eapAddr) String() string  { return "eap" }
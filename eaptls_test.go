@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tls12PRF is the TLS 1.2 pseudorandom function with SHA-256 (RFC 5246 section 5)
+func tls12PRF(secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	var out []byte
+	a := seed
+	for len(out) < length {
+		hash := hmac.New(sha256.New, secret)
+		hash.Write(a)
+		a = hash.Sum(nil)
+
+		hash = hmac.New(sha256.New, secret)
+		hash.Write(a)
+		hash.Write(seed)
+		out = append(out, hash.Sum(nil)...)
+	}
+	return out[:length]
+}
+
+func TestTLS12PRF(t *testing.T) {
+	// The TLS 1.2 PRF test vector for SHA-256 published on the IETF TLS working group list
+	secret := decodeHex(t, "9bbe436ba940f017b17652849a71db35")
+	seed := decodeHex(t, "a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a6b301791e90d35c9c9a46b4e14baf9af" +
+		"0fa022f7077def17abfd3797c0564bab4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff70187347b66"
+	if got := hex.EncodeToString(tls12PRF(secret, "test label", seed, 100)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// recordingConn keeps a copy of everything read from a connection
+type recordingConn struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Write(b[:n])
+	return n, err
+}
+
+func TestEAPTLSMasterSessionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := loadCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := newEAPTLSConfig(ca, "radius.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, key, err := ca.IssueDeviceCertificate("001122334455", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keyLog bytes.Buffer
+	clientPipe, serverPipe := net.Pipe()
+	clientConn := &recordingConn{Conn: clientPipe}
+	client := tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.Pool(),
+		ServerName:   "radius.example.com",
+		// A cipher suite using the SHA-256 PRF
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		KeyLogWriter: &keyLog,
+	})
+	server := tls.Server(serverPipe, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Handshake()
+	}()
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	state := server.ConnectionState()
+	if state.Version != tls.VersionTLS12 {
+		t.Fatalf("got TLS version %x, want TLS 1.2", state.Version)
+	}
+
+	msk, err := eapTLSMasterSessionKey(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key log line is "CLIENT_RANDOM <client random> <master secret>", and the server random follows the
+	// record header, handshake header, and version at the start of the ServerHello
+	fields := strings.Fields(keyLog.String())
+	if len(fields) != 3 || fields[0] != "CLIENT_RANDOM" {
+		t.Fatalf("unexpected key log %q", keyLog.String())
+	}
+	clientRandom := decodeHex(t, fields[1])
+	masterSecret := decodeHex(t, fields[2])
+	serverHello := clientConn.read.Bytes()
+	if len(serverHello) < 43 || serverHello[0] != 0x16 || serverHello[5] != 0x02 {
+		t.Fatal("the server didn't start with a ServerHello")
+	}
+	serverRandom := serverHello[11:43]
+
+	// RFC 5216 section 2.3: Key_Material = TLS-PRF-128(master_secret, "client EAP encryption",
+	// client.random || server.random) and MSK = Key_Material(0, 63)
+	keyMaterial := tls12PRF(masterSecret, "client EAP encryption", append(clientRandom, serverRandom...), 128)
+	if !bytes.Equal(msk, keyMaterial[:64]) {
+		t.Errorf("got MSK %x, want %x", msk, keyMaterial[:64])
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// eventClassPrefix marks the Class attribute of an Access-Accept carrying the event ID, which the NAS sends back
+// in the accounting of the session
+const eventClassPrefix = "event:"
+
+type eventIDKey struct{}
+
+// withEventID tags a request with the ID of the authentication it belongs to
+func withEventID(r *radius.Request, id string) *radius.Request {
+	return r.WithContext(context.WithValue(r.Context(), eventIDKey{}, id))
+}
+
+// eventID returns the ID of the authentication a request belongs to, or an empty string if it has none
+func eventID(r *radius.Request) string {
+	id, _ := r.Context().Value(eventIDKey{}).(string)
+	return id
+}
+
+// requestEventID returns the ID of the EAP conversation an Access-Request continues, so all the rounds of an
+// authentication share it, or a new one
+func (rs *RadiusServer) requestEventID(r *radius.Request) string {
+	if state := rfc2865.State_GetString(r.Packet); state != "" && rs.EAP != nil {
+		if id := rs.EAP.eventID(state); id != "" {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// classEventID finds the event ID among the Class attributes the NAS copied from the Access-Accept
+func classEventID(packet *radius.Packet) string {
+	classes, _ := rfc2865.Class_GetStrings(packet)
+	for _, class := range classes {
+		if strings.HasPrefix(class, eventClassPrefix) {
+			id := strings.TrimPrefix(class, eventClassPrefix)
+			if validRequestID.MatchString(id) {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// requestLogf logs a line about a request, tagged with its event ID to find every line of an authentication
+func requestLogf(r *radius.Request, format string, args ...interface{}) {
+	if id := eventID(r); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf("RADIUS: "+format, args...)
+}
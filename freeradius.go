@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// FreeRADIUS export formats
+const (
+	freeradiusFormatUsers = "users"
+	freeradiusFormatSQL   = "sql"
+)
+
+// parseFreeRADIUSUsers finds the MAC addresses in a users, authorize, or authorized_macs file. Each entry starts
+// at the beginning of a line with the name, followed by check items, and its reply items are on the indented
+// lines after it. Entries whose name isn't a MAC address, such as DEFAULT, are skipped.
+func parseFreeRADIUSUsers(r io.Reader) ([]string, error) {
+	var macs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' || strings.HasPrefix(line, "$INCLUDE") {
+			continue
+		}
+		name := strings.Fields(line)[0]
+		if mac := normalizeMACAddress(strings.Trim(name, `"`)); isValidMACFormat(mac) {
+			macs = append(macs, mac)
+		}
+	}
+	return macs, scanner.Err()
+}
+
+// sqlInsert matches the start of an INSERT statement, with its table and optional column list
+var sqlInsert = regexp.MustCompile("(?i)INSERT\\s+INTO\\s+[`\"]?(\\w+)[`\"]?\\s*(\\(([^)]*)\\))?\\s*VALUES\\s*")
+
+// parseFreeRADIUSSQL finds the MAC addresses in the radcheck table of a SQL dump, along with their groups from
+// the radusergroup table
+func parseFreeRADIUSSQL(dump string) ([]string, map[string][]string, error) {
+	var macs []string
+	groups := make(map[string][]string)
+	seen := make(map[string]bool)
+
+	for _, match := range sqlInsert.FindAllStringSubmatchIndex(dump, -1) {
+		table := strings.ToLower(dump[match[2]:match[3]])
+		var columns []string
+		if match[6] != -1 {
+			for _, column := range strings.Split(dump[match[6]:match[7]], ",") {
+				columns = append(columns, strings.ToLower(strings.Trim(strings.TrimSpace(column), "`\"")))
+			}
+		}
+		if table != "radcheck" && table != "radusergroup" {
+			continue
+		}
+
+		rows, err := parseSQLValues(dump[match[1]:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read the %v rows: %v", table, err)
+		}
+		for _, row := range rows {
+			values := sqlRowValues(table, columns, row)
+			mac := normalizeMACAddress(values["username"])
+			if !isValidMACFormat(mac) {
+				continue
+			}
+			if !seen[mac] {
+				seen[mac] = true
+				macs = append(macs, mac)
+			}
+			if table == "radusergroup" && values["groupname"] != "" && !stringInSlice(values["groupname"], groups[mac]) {
+				groups[mac] = append(groups[mac], values["groupname"])
+			}
+		}
+	}
+	return macs, groups, nil
+}
+
+// sqlRowValues names the values of a row by column, using the columns of the default FreeRADIUS schema when the
+// INSERT statement doesn't list them
+func sqlRowValues(table string, columns, row []string) map[string]string {
+	if columns == nil {
+		switch {
+		case table == "radcheck":
+			columns = []string{"id", "username", "attribute", "op", "value"}
+		case len(row) == 4:
+			columns = []string{"id", "username", "groupname", "priority"}
+		default:
+			columns = []string{"username", "groupname", "priority"}
+		}
+	}
+	values := make(map[string]string)
+	for i, column := range columns {
+		if i < len(row) {
+			values[column] = row[i]
+		}
+	}
+	return values
+}
+
+// parseSQLValues reads the rows of the VALUES list of an INSERT statement, up to the semicolon ending it
+func parseSQLValues(s string) ([][]string, error) {
+	var rows [][]string
+	var row []string
+	inRow := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case !inRow && c == '(':
+			inRow = true
+			row = nil
+		case !inRow && c == ',':
+		case !inRow && c == ';':
+			return rows, nil
+		case !inRow:
+			return nil, fmt.Errorf("unexpected %q", c)
+		case c == ')':
+			inRow = false
+			rows = append(rows, row)
+		case c == ',':
+		case c == '\'':
+			// Quotes are escaped by doubling them, or with a backslash in MySQL dumps
+			var value strings.Builder
+			for i++; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					value.WriteByte(s[i])
+				} else if s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+					i++
+					value.WriteByte('\'')
+				} else if s[i] == '\'' {
+					break
+				} else {
+					value.WriteByte(s[i])
+				}
+			}
+			row = append(row, value.String())
+		default:
+			// Numbers and NULL
+			start := i
+			for i+1 < len(s) && s[i+1] != ',' && s[i+1] != ')' {
+				i++
+			}
+			row = append(row, strings.TrimSpace(s[start:i+1]))
+		}
+	}
+	if inRow {
+		return nil, errors.New("unterminated row")
+	}
+	return rows, nil
+}
+
+// importFreeRADIUSCommand registers the MAC addresses of a FreeRADIUS MAC authentication setup as devices
+func importFreeRADIUSCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("import-freeradius", flag.ContinueOnError)
+	format := flags.String("format", freeradiusFormatUsers, "format of the file: users (users, authorize, or authorized_macs files) or sql (a dump of the radcheck and radusergroup tables)")
+	path := flags.String("file", "", "file to import")
+	defaultGroup := flags.String("group", "", "device group for the devices without a group in the file")
+	dryRun := flags.Bool("dry-run", false, "only show what would be imported")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return errors.New("-file is required")
+	}
+	data, err := ioutil.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+
+	var macs []string
+	groups := make(map[string][]string)
+	switch *format {
+	case freeradiusFormatUsers:
+		macs, err = parseFreeRADIUSUsers(strings.NewReader(string(data)))
+	case freeradiusFormatSQL:
+		macs, groups, err = parseFreeRADIUSSQL(string(data))
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+	if *defaultGroup != "" {
+		for _, mac := range macs {
+			if len(groups[mac]) == 0 {
+				groups[mac] = []string{*defaultGroup}
+			}
+		}
+	}
+
+	if *dryRun {
+		for _, mac := range macs {
+			fmt.Printf("%v\t%v\n", prettyPrintMACAddress(mac), strings.Join(groups[mac], ", "))
+		}
+		fmt.Fprintf(os.Stderr, "%d devices found\n", len(macs))
+		return nil
+	}
+
+	tx := db.Begin()
+	created := 0
+	for _, mac := range macs {
+		var device Device
+		if err := tx.FirstOrInit(&device, Device{MAC: mac}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if device.ID == 0 {
+			if err := purgeTrashedDevice(tx, mac); err != nil {
+				tx.Rollback()
+				return err
+			}
+			created++
+		}
+		for _, name := range groups[mac] {
+			if err := checkGroupNotTrashed(tx, name); err != nil {
+				tx.Rollback()
+				return err
+			}
+			var group DeviceGroup
+			if err := tx.FirstOrCreate(&group, DeviceGroup{Name: name}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			device.DeviceGroups = append(device.DeviceGroups, group)
+		}
+		if err := tx.Save(&device).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d devices, %d of them new\n", len(macs), created)
+	return nil
+}
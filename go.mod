@@ -5,7 +5,7 @@ go 1.14
 require (
 	github.com/andskur/argon2-hashing v0.1.3
 	github.com/jinzhu/gorm v1.9.15
-	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
 	golang.org/x/sys v0.0.0-20200728102440-3e129f6d46b1 // indirect
 	layeh.com/radius v0.0.0-20200615152116-663b41c3bf86
 )
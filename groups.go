@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxGroupDepth bounds how many parents are followed, in case the database holds a loop
+const maxGroupDepth = 16
+
+// inheritGroups gives each group the networks of its parent groups, and the reply attributes it doesn't set
+// itself, including the attributes of GroupAttribute. Disabled groups, and groups with a disabled parent, are left out. Groups must be loaded with their
+// networks and reply profile.
+func inheritGroups(db *gorm.DB, groups []DeviceGroup) []DeviceGroup {
+	parents := make(map[uint]DeviceGroup)
+	inherited := make([]DeviceGroup, 0, len(groups))
+	for _, group := range groups {
+		if group.Disabled {
+			continue
+		}
+		parentID := group.ParentID
+		for depth := 0; parentID != nil && depth < maxGroupDepth; depth++ {
+			parent, ok := parents[*parentID]
+			if !ok {
+				if err := db.Preload("Networks").Preload("ReplyProfile").Preload("Attributes").First(&parent, *parentID).Error; err != nil {
+					log.Printf("RADIUS: Unable to load the parent of device group %q: %v", group.Name, err)
+					break
+				}
+				parents[*parentID] = parent
+			}
+			if parent.Disabled {
+				group.Disabled = true
+				break
+			}
+
+			// Copy the networks so the cached device isn't changed
+			group.Networks = append(group.Networks[:len(group.Networks):len(group.Networks)], parent.Networks...)
+			if group.SessionTimeout == 0 {
+				group.SessionTimeout = parent.SessionTimeout
+			}
+			if group.IdleTimeout == 0 {
+				group.IdleTimeout = parent.IdleTimeout
+			}
+			group.Reauthenticate = group.Reauthenticate || parent.Reauthenticate
+			if group.MaxSessions == 0 {
+				group.MaxSessions = parent.MaxSessions
+			}
+			if group.ReplyProfile == nil {
+				group.ReplyProfile = parent.ReplyProfile
+			}
+			group.Attributes = inheritAttributes(group.Attributes, parent.Attributes)
+			parentID = parent.ParentID
+		}
+		if !group.Disabled {
+			inherited = append(inherited, group)
+		}
+	}
+	return inherited
+}
+
+// inheritAttributes adds the attributes of a parent group that the group doesn't set itself
+func inheritAttributes(attributes, parent []GroupAttribute) []GroupAttribute {
+	set := make(map[string]bool)
+	for _, attribute := range attributes {
+		set[attribute.key()] = true
+	}
+	// Copy the attributes so the cached device isn't changed
+	inherited := attributes[:len(attributes):len(attributes)]
+	for _, attribute := range parent {
+		if !set[attribute.key()] {
+			inherited = append(inherited, attribute)
+		}
+	}
+	return inherited
+}
+
+// groupHasAncestor reports whether ancestorID is the group or one of its parents
+func groupHasAncestor(db *gorm.DB, group DeviceGroup, ancestorID uint) (bool, error) {
+	for depth := 0; depth < maxGroupDepth; depth++ {
+		if group.ID == ancestorID {
+			return true, nil
+		}
+		if group.ParentID == nil {
+			return false, nil
+		}
+		var parent DeviceGroup
+		if err := db.First(&parent, *group.ParentID).Error; err != nil {
+			return false, err
+		}
+		group = parent
+	}
+	return true, nil
+}
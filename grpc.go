@@ -0,0 +1,867 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// grpcService is the service of management.proto
+	grpcService = "wifiradius.v1.Management"
+	// grpcMaxMessageSize bounds a request message, the same as the default of gRPC servers
+	grpcMaxMessageSize = 4 << 20
+	// grpcStreamQueueSize is how many authentications a stream may fall behind before they are dropped
+	grpcStreamQueueSize = 256
+	// grpcShutdownTimeout is how long the unary calls in progress may take to finish when stopping
+	grpcShutdownTimeout = 10 * time.Second
+)
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcUnavailable        = 14
+)
+
+// GRPCConfig stores the settings for the gRPC management API, which provisioning systems use to manage the
+// devices and groups and to follow the authentications
+type GRPCConfig struct {
+	// Listen is the address serving the API, or empty to disable it
+	Listen string `json:"listen"`
+	// CertFile and KeyFile are the PEM encoded certificate and key the server presents
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile holds the PEM encoded certificates of the CAs that issue the client certificates
+	ClientCAFile string `json:"client_ca_file"`
+	// Clients are the common names of the client certificates that may connect, or empty for any certificate
+	// of the CAs
+	Clients []string `json:"clients"`
+}
+
+// validate checks the gRPC settings read from the configuration file
+func (c GRPCConfig) validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("grpc.cert_file and grpc.key_file must be set")
+	}
+	if c.ClientCAFile == "" {
+		return errors.New("grpc.client_ca_file must be set, since clients authenticate with certificates")
+	}
+	return nil
+}
+
+// grpcError is an error sent to the client with a gRPC status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e grpcError) Error() string {
+	return e.message
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// GRPCServer serves the management API over HTTP/2 with mutual TLS. Changes are recorded in the audit log as
+// made by "grpc:" followed by the common name of the client certificate.
+type GRPCServer struct {
+	DB       *gorm.DB
+	Config   GRPCConfig
+	Approval ApprovalConfig
+
+	server *http.Server
+	// stop ends the streams, which would otherwise keep the server from shutting down
+	stop chan struct{}
+
+	mutex   sync.Mutex
+	streams map[chan AuthEvent]struct{}
+	dropped uint64
+}
+
+// NewGRPCServer creates a GRPCServer listening on the configured address
+func NewGRPCServer(config GRPCConfig, approval ApprovalConfig, db *gorm.DB) (*GRPCServer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %v", config.ClientCAFile)
+	}
+
+	s := &GRPCServer{
+		DB:       db,
+		Config:   config,
+		Approval: approval,
+		stop:     make(chan struct{}),
+		streams:  make(map[chan AuthEvent]struct{}),
+	}
+	// gRPC needs HTTP/2, which net/http negotiates on TLS connections
+	s.server = &http.Server{
+		Addr:    config.Listen,
+		Handler: accessLog("GRPC", http.HandlerFunc(s.serve)),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"h2"},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+	return s, nil
+}
+
+// Start the gRPC server
+func (s *GRPCServer) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("GRPC: Starting server on %v", s.server.Addr)
+
+		listener, err := listen(s.server.Addr)
+		if err == nil {
+			err = s.server.ServeTLS(listener, "", "")
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("GRPC: Error starting gRPC server: %v", err)
+		} else {
+			log.Printf("GRPC: Stopped server")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop ends the streams and stops the gRPC server
+func (s *GRPCServer) Stop() {
+	close(s.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), grpcShutdownTimeout)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// AuthEvent sends an authentication to the streams, dropping it for those that have fallen behind
+func (s *GRPCServer) AuthEvent(event AuthEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for stream := range s.streams {
+		select {
+		case stream <- event:
+		default:
+			if dropped := atomic.AddUint64(&s.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+				log.Printf("GRPC: A stream of authentications is falling behind, %d events dropped", dropped)
+			}
+		}
+	}
+}
+
+// serve answers a gRPC call. Every method takes a single request message, so the whole request is read first.
+func (s *GRPCServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/"+grpcService+"/")
+	if method == r.URL.Path {
+		writeGRPCStatus(w, grpcErrorf(grpcUnimplemented, "unknown service %v", strings.TrimPrefix(r.URL.Path, "/")))
+		return
+	}
+
+	name, err := s.authorize(r)
+	if err != nil {
+		log.Printf("GRPC: Refused %v from %v: %v", method, r.RemoteAddr, err)
+		writeGRPCStatus(w, err)
+		return
+	}
+	setAccessLogUser(r, name)
+	ctx := r.Context()
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	request, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+
+	if method == "StreamAuthEvents" {
+		writeGRPCStatus(w, s.streamAuthEvents(ctx, w))
+		return
+	}
+	// Each call changes the database in one transaction, so a failure leaves nothing half done
+	var response protoMessage
+	err = withAuditActor(s.DB.New(), "grpc:"+name).Transaction(func(tx *gorm.DB) error {
+		var err error
+		switch method {
+		case "ListDevices":
+			response, err = s.listDevices(tx, request)
+		case "GetDevice":
+			response, err = s.getDevice(tx, request)
+		case "PutDevice":
+			response, err = s.putDevice(tx, request)
+		case "DeleteDevice":
+			response, err = s.deleteDevice(tx, request)
+		case "ListGroups":
+			response, err = s.listGroups(tx)
+		case "PutGroup":
+			response, err = s.putGroup(tx, request)
+		case "DeleteGroup":
+			response, err = s.deleteGroup(tx, request)
+		default:
+			err = grpcErrorf(grpcUnimplemented, "unknown method %v", method)
+		}
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return err
+	})
+	if err == nil {
+		writeGRPCMessage(w, response)
+	}
+	writeGRPCStatus(w, err)
+}
+
+// authorize returns the common name of the client certificate the TLS handshake verified, if it may connect
+func (s *GRPCServer) authorize(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", grpcErrorf(grpcPermissionDenied, "a client certificate is required")
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(s.Config.Clients) > 0 && !stringInSlice(name, s.Config.Clients) {
+		return "", grpcErrorf(grpcPermissionDenied, "client %q is not allowed", name)
+	}
+	return name, nil
+}
+
+// checkApproval refuses a change the equivalent command would have to propose for approval, since proposals
+// are made and approved on the command line
+func (s *GRPCServer) checkApproval(db *gorm.DB, args []string) error {
+	if !s.Approval.Enabled {
+		return nil
+	}
+	if reason := s.Approval.requiresApproval(db, args); reason != "" {
+		return grpcErrorf(grpcFailedPrecondition, "the change %v and needs approval, make it with %v on the command line", reason, args[0])
+	}
+	return nil
+}
+
+// streamAuthEvents sends the authentications until the client cancels the call or the server stops
+func (s *GRPCServer) streamAuthEvents(ctx context.Context, w http.ResponseWriter) error {
+	events := make(chan AuthEvent, grpcStreamQueueSize)
+	s.mutex.Lock()
+	s.streams[events] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.streams, events)
+		s.mutex.Unlock()
+	}()
+
+	// Send the headers right away, so the client knows the stream started
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-events:
+			if err := writeGRPCMessage(w, marshalGRPCAuthEvent(event)); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stop:
+			return grpcErrorf(grpcUnavailable, "the server is stopping")
+		}
+	}
+}
+
+// listDevices answers ListDevices
+func (s *GRPCServer) listDevices(db *gorm.DB, request []byte) (protoMessage, error) {
+	group, err := parseProtoString(request, 1)
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	if err := db.Preload("DeviceGroups").Order("mac").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+
+	var response protoMessage
+	for _, device := range devices {
+		message := grpcDeviceFromModel(device)
+		if group == "" || stringInSlice(group, message.Groups) {
+			response.message(1, message.marshal())
+		}
+	}
+	return response, nil
+}
+
+// getDevice answers GetDevice
+func (s *GRPCServer) getDevice(db *gorm.DB, request []byte) (protoMessage, error) {
+	mac, err := parseProtoString(request, 1)
+	if err != nil {
+		return nil, err
+	}
+	var device Device
+	if db.Preload("DeviceGroups").First(&device, "MAC = ?", normalizeMACAddress(mac)).RecordNotFound() {
+		return nil, grpcErrorf(grpcNotFound, "device %v does not exist", mac)
+	}
+	return grpcDeviceFromModel(device).marshal(), nil
+}
+
+// putDevice answers PutDevice
+func (s *GRPCServer) putDevice(db *gorm.DB, request []byte) (protoMessage, error) {
+	message, err := unmarshalGRPCDevice(request)
+	if err != nil {
+		return nil, err
+	}
+	mac := normalizeMACAddress(message.MAC)
+	if !isValidMACFormat(mac) && !isValidMACPattern(mac) {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid MAC address %q", message.MAC)
+	}
+	args := []string{"set-device", "-mac", mac}
+	for _, name := range message.Groups {
+		args = append(args, "-group", name)
+	}
+	if err := s.checkApproval(db, args); err != nil {
+		return nil, err
+	}
+	groups := []DeviceGroup{}
+	for _, name := range message.Groups {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", name).RecordNotFound() {
+			return nil, grpcErrorf(grpcFailedPrecondition, "device group %q does not exist", name)
+		}
+		groups = append(groups, group)
+	}
+
+	var device Device
+	if db.First(&device, "MAC = ?", mac).RecordNotFound() {
+		if err := purgeTrashedDevice(db, mac); err != nil {
+			return nil, err
+		}
+		device = Device{MAC: mac, Name: message.Name, DeviceGroups: groups, Disabled: message.Disabled, ExpiresAt: message.ExpiresAt}
+		if err := db.Create(&device).Error; err != nil {
+			return nil, err
+		}
+		return grpcDeviceFromModel(device).marshal(), nil
+	}
+
+	device.Name = message.Name
+	device.Disabled = message.Disabled
+	device.ExpiresAt = message.ExpiresAt
+	if err := db.Save(&device).Error; err != nil {
+		return nil, err
+	}
+	err = auditAssociationChange(db, &device, func() error {
+		return db.Model(&device).Association("DeviceGroups").Replace(groups).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	device.DeviceGroups = groups
+	return grpcDeviceFromModel(device).marshal(), nil
+}
+
+// deleteDevice answers DeleteDevice
+func (s *GRPCServer) deleteDevice(db *gorm.DB, request []byte) (protoMessage, error) {
+	mac, err := parseProtoString(request, 1)
+	if err != nil {
+		return nil, err
+	}
+	mac = normalizeMACAddress(mac)
+	if err := s.checkApproval(db, []string{"remove-device", "-mac", mac}); err != nil {
+		return nil, err
+	}
+	var device Device
+	if db.First(&device, "MAC = ?", mac).RecordNotFound() {
+		return nil, grpcErrorf(grpcNotFound, "device %v does not exist", mac)
+	}
+	if err := deleteDevice(db, device); err != nil {
+		return nil, err
+	}
+	return protoMessage{}, nil
+}
+
+// listGroups answers ListGroups
+func (s *GRPCServer) listGroups(db *gorm.DB) (protoMessage, error) {
+	var groups []DeviceGroup
+	if err := db.Preload("Networks").Order("name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string)
+	for _, group := range groups {
+		names[group.ID] = group.Name
+	}
+
+	var response protoMessage
+	for _, group := range groups {
+		parent := ""
+		if group.ParentID != nil {
+			parent = names[*group.ParentID]
+		}
+		response.message(1, grpcGroupFromModel(group, parent).marshal())
+	}
+	return response, nil
+}
+
+// putGroup answers PutGroup
+func (s *GRPCServer) putGroup(db *gorm.DB, request []byte) (protoMessage, error) {
+	message, err := unmarshalGRPCGroup(request)
+	if err != nil {
+		return nil, err
+	}
+	if message.Name == "" {
+		return nil, grpcErrorf(grpcInvalidArgument, "the group needs a name")
+	}
+	args := []string{"set-group", "-name", message.Name, "-parent", message.Parent}
+	for _, ssid := range message.Networks {
+		args = append(args, "-network", ssid)
+	}
+	if err := s.checkApproval(db, args); err != nil {
+		return nil, err
+	}
+
+	var group DeviceGroup
+	if err := db.FirstOrInit(&group, DeviceGroup{Name: message.Name}).Error; err != nil {
+		return nil, err
+	}
+	if group.ID == 0 {
+		if err := checkGroupNotTrashed(db, message.Name); err != nil {
+			return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+		}
+	}
+	group.ParentID = nil
+	if message.Parent != "" {
+		var parent DeviceGroup
+		if db.First(&parent, "name = ?", message.Parent).RecordNotFound() {
+			return nil, grpcErrorf(grpcFailedPrecondition, "device group %q does not exist", message.Parent)
+		}
+		if group.ID != 0 {
+			loop, err := groupHasAncestor(db, parent, group.ID)
+			if err != nil {
+				return nil, err
+			}
+			if loop {
+				return nil, grpcErrorf(grpcFailedPrecondition, "device group %q would inherit from itself through %q", group.Name, parent.Name)
+			}
+		}
+		group.ParentID = &parent.ID
+	}
+	group.Disabled = message.Disabled
+	if err := db.Save(&group).Error; err != nil {
+		return nil, err
+	}
+
+	networks := []Network{}
+	for _, ssid := range message.Networks {
+		var network Network
+		if err := db.FirstOrCreate(&network, Network{SSID: ssid}).Error; err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	if err := db.Model(&group).Association("Networks").Replace(networks).Error; err != nil {
+		return nil, err
+	}
+	group.Networks = networks
+	return grpcGroupFromModel(group, message.Parent).marshal(), nil
+}
+
+// deleteGroup answers DeleteGroup
+func (s *GRPCServer) deleteGroup(db *gorm.DB, request []byte) (protoMessage, error) {
+	name, err := parseProtoString(request, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkApproval(db, []string{"remove-group", "-name", name}); err != nil {
+		return nil, err
+	}
+	var group DeviceGroup
+	if db.First(&group, "name = ?", name).RecordNotFound() {
+		return nil, grpcErrorf(grpcNotFound, "device group %q does not exist", name)
+	}
+	var children int
+	if err := db.Model(&DeviceGroup{}).Where("parent_id = ?", group.ID).Count(&children).Error; err != nil {
+		return nil, err
+	}
+	if children > 0 {
+		return nil, grpcErrorf(grpcFailedPrecondition, "device group %q is the parent of %d groups, change their parent first", group.Name, children)
+	}
+	if err := db.Delete(&group).Error; err != nil {
+		return nil, err
+	}
+	return protoMessage{}, nil
+}
+
+// readGRPCMessage reads the single message of a request: a compression flag, the length, and the message
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessageSize {
+		return nil, grpcErrorf(grpcResourceExhausted, "the request message is larger than %d bytes", grpcMaxMessageSize)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	return message, nil
+}
+
+// writeGRPCMessage sends a response message
+func writeGRPCMessage(w io.Writer, message protoMessage) error {
+	framed := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(message)))
+	_, err := w.Write(append(framed, message...))
+	return err
+}
+
+// writeGRPCStatus ends a call with the status of err in the trailers
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	switch e := err.(type) {
+	case nil:
+	case grpcError:
+		code, message = e.code, e.message
+	default:
+		code, message = grpcUnknown, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(message))
+	}
+}
+
+// grpcPercentEncode escapes a status message as gRPC requires, leaving the printable ASCII characters
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout reads the Grpc-Timeout header, a number followed by a unit such as "30S" or "500m"
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(value) < 2 {
+		return 0, false
+	}
+	unit, ok := units[value[len(value)-1]]
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcDevice is the Device message of management.proto
+type grpcDevice struct {
+	MAC        string
+	Name       string
+	Groups     []string
+	Disabled   bool
+	ExpiresAt  *time.Time
+	LastSeenAt *time.Time
+}
+
+func grpcDeviceFromModel(device Device) grpcDevice {
+	message := grpcDevice{
+		MAC:        device.MAC,
+		Name:       device.Name,
+		Disabled:   device.Disabled,
+		ExpiresAt:  device.ExpiresAt,
+		LastSeenAt: device.LastSeenAt,
+	}
+	for _, group := range device.DeviceGroups {
+		message.Groups = append(message.Groups, group.Name)
+	}
+	return message
+}
+
+func (d grpcDevice) marshal() protoMessage {
+	var m protoMessage
+	m.string(1, d.MAC)
+	m.string(2, d.Name)
+	for _, group := range d.Groups {
+		m.bytes(3, []byte(group))
+	}
+	m.bool(4, d.Disabled)
+	m.timestamp(5, d.ExpiresAt)
+	m.timestamp(6, d.LastSeenAt)
+	return m
+}
+
+func unmarshalGRPCDevice(b []byte) (grpcDevice, error) {
+	var d grpcDevice
+	fields, err := parseProto(b)
+	if err != nil {
+		return d, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			d.MAC = string(field.bytes)
+		case 2:
+			d.Name = string(field.bytes)
+		case 3:
+			d.Groups = append(d.Groups, string(field.bytes))
+		case 4:
+			d.Disabled = field.varint != 0
+		case 5:
+			expires, err := parseProtoTimestamp(field.bytes)
+			if err != nil {
+				return d, err
+			}
+			d.ExpiresAt = &expires
+		}
+	}
+	return d, nil
+}
+
+// grpcGroup is the Group message of management.proto
+type grpcGroup struct {
+	Name     string
+	Networks []string
+	Parent   string
+	Disabled bool
+}
+
+func grpcGroupFromModel(group DeviceGroup, parent string) grpcGroup {
+	message := grpcGroup{Name: group.Name, Parent: parent, Disabled: group.Disabled}
+	for _, network := range group.Networks {
+		message.Networks = append(message.Networks, network.SSID)
+	}
+	return message
+}
+
+func (g grpcGroup) marshal() protoMessage {
+	var m protoMessage
+	m.string(1, g.Name)
+	for _, network := range g.Networks {
+		m.bytes(2, []byte(network))
+	}
+	m.string(3, g.Parent)
+	m.bool(4, g.Disabled)
+	return m
+}
+
+func unmarshalGRPCGroup(b []byte) (grpcGroup, error) {
+	var g grpcGroup
+	fields, err := parseProto(b)
+	if err != nil {
+		return g, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			g.Name = string(field.bytes)
+		case 2:
+			g.Networks = append(g.Networks, string(field.bytes))
+		case 3:
+			g.Parent = string(field.bytes)
+		case 4:
+			g.Disabled = field.varint != 0
+		}
+	}
+	return g, nil
+}
+
+// marshalGRPCAuthEvent encodes the AuthEvent message of management.proto
+func marshalGRPCAuthEvent(event AuthEvent) protoMessage {
+	var m protoMessage
+	m.string(1, event.EventID)
+	m.timestamp(2, &event.Time)
+	m.string(3, event.Method)
+	m.string(4, event.MAC)
+	m.string(5, event.Username)
+	m.string(6, event.SSID)
+	m.string(7, event.Client)
+	m.bool(8, event.Accepted)
+	m.string(9, event.Reason)
+	m.string(10, event.NASIdentifier)
+	m.string(11, event.NASIP)
+	m.string(12, event.OperatorName)
+	m.string(13, event.AccessPoint)
+	return m
+}
+
+// protoMessage builds a protobuf message. Scalar fields holding their zero value are left out, as proto3 does.
+type protoMessage []byte
+
+func (m *protoMessage) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	*m = append(*m, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// tag starts a field: its number and wire type, 0 for varints and 2 for length-delimited values
+func (m *protoMessage) tag(field int, wireType uint64) {
+	m.varint(uint64(field)<<3 | wireType)
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.tag(field, 2)
+	m.varint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+func (m *protoMessage) bool(field int, v bool) {
+	if v {
+		m.tag(field, 0)
+		m.varint(1)
+	}
+}
+
+func (m *protoMessage) message(field int, message protoMessage) {
+	m.bytes(field, message)
+}
+
+// timestamp adds a google.protobuf.Timestamp, or leaves the field out for nil
+func (m *protoMessage) timestamp(field int, t *time.Time) {
+	if t == nil {
+		return
+	}
+	var timestamp protoMessage
+	if seconds := t.Unix(); seconds != 0 {
+		timestamp.tag(1, 0)
+		timestamp.varint(uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		timestamp.tag(2, 0)
+		timestamp.varint(uint64(nanos))
+	}
+	m.message(field, timestamp)
+}
+
+// protoField is a varint or length-delimited field of a received protobuf message
+type protoField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+var errInvalidProto = grpcError{grpcInvalidArgument, "invalid request message"}
+
+// parseProto reads the fields of a protobuf message, skipping the fixed-size ones no request uses
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 {
+			return nil, errInvalidProto
+		}
+		b = b[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if field.varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, errInvalidProto
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, errInvalidProto
+			}
+			b = b[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return nil, errInvalidProto
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return nil, errInvalidProto
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// parseProtoString returns a string field of a message, or an empty string if it isn't set
+func parseProtoString(b []byte, number int) (string, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return "", err
+	}
+	value := ""
+	for _, field := range fields {
+		if field.number == number {
+			value = string(field.bytes)
+		}
+	}
+	return value, nil
+}
+
+// parseProtoTimestamp reads a google.protobuf.Timestamp
+func parseProtoTimestamp(b []byte) (time.Time, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var seconds, nanos int64
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			seconds = int64(field.varint)
+		case 2:
+			nanos = int64(int32(field.varint))
+		}
+	}
+	return time.Unix(seconds, nanos), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGRPCDeviceMarshal(t *testing.T) {
+	expires := time.Unix(1500000000, 5)
+	device := grpcDevice{MAC: "001122334455", Groups: []string{"a", ""}, Disabled: true, ExpiresAt: &expires}
+
+	// Encoded independently from the protobuf encoding rules: the name is left out since it is empty, the empty group
+	// is kept since it is an element of a repeated field, and the timestamp is {seconds: 1500000000, nanos: 5}
+	want := "0a0c303031313232333334343535" + "1a0161" + "1a00" + "2001" + "2a080880dea0cb051005"
+	got := device.marshal()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("got %x, want %v", []byte(got), want)
+	}
+
+	decoded, err := unmarshalGRPCDevice(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.ExpiresAt.Equal(expires) {
+		t.Errorf("got expiry %v, want %v", decoded.ExpiresAt, expires)
+	}
+	decoded.ExpiresAt = device.ExpiresAt
+	if !reflect.DeepEqual(decoded, device) {
+		t.Errorf("got %+v, want %+v", decoded, device)
+	}
+}
+
+func TestParseProto(t *testing.T) {
+	// A group with an unknown fixed64 field 9 and fixed32 field 10, which are skipped
+	fields, err := parseProto(decodeHex(t, "0a057374616666"+"490102030405060708"+"5501020304"+"2001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || fields[0].number != 1 || string(fields[0].bytes) != "staff" || fields[1].number != 4 || fields[1].varint != 1 {
+		t.Errorf("got %+v", fields)
+	}
+
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"truncated string", "0a05737461"},
+		{"truncated fixed64", "49010203"},
+		{"truncated fixed32", "0d0102"},
+		{"missing varint", "08"},
+		{"varint longer than 64 bits", "08ffffffffffffffffff02"},
+		{"unterminated varint", "08ffff"},
+		{"unterminated key", "80"},
+		{"start group, which proto3 doesn't use", "0b"},
+		{"end group", "0c"},
+		{"wire type 6", "0e"},
+		{"wire type 7", "0f"},
+		{"field number 0", "00"},
+		{"length longer than the message", "0affffffff0f"},
+		{"length of 2^63", "0a808080808080808080" + "01"},
+		{"length of 2^64-1", "0affffffffffffffffff01"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseProto(decodeHex(t, test.message)); err == nil {
+				t.Errorf("%v was accepted", test.message)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTruncatedMessages(t *testing.T) {
+	expires := time.Unix(1500000000, 5)
+	device := grpcDevice{MAC: "001122334455", Name: "laptop", Groups: []string{"staff"}, Disabled: true, ExpiresAt: &expires}.marshal()
+	group := grpcGroup{Name: "staff", Networks: []string{"Corp"}, Parent: "all", Disabled: true}.marshal()
+
+	// Every prefix either fails or decodes the fields it holds in full, without panicking
+	for i := 0; i < len(device); i++ {
+		if decoded, err := unmarshalGRPCDevice(device[:i]); err == nil && decoded.Name == "laptop" && decoded.ExpiresAt != nil {
+			t.Errorf("a prefix of %d bytes decoded as the whole device", i)
+		}
+	}
+	for i := 0; i < len(group); i++ {
+		if decoded, err := unmarshalGRPCGroup(group[:i]); err == nil && decoded.Disabled {
+			t.Errorf("a prefix of %d bytes decoded as the whole group", i)
+		}
+	}
+
+	// A timestamp field holding an invalid message
+	if _, err := unmarshalGRPCDevice(decodeHex(t, "2a020880")); err == nil {
+		t.Error("a truncated timestamp was accepted")
+	}
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		want  string
+		code  int
+	}{
+		{"message", "00000000020801", "0801", grpcOK},
+		{"empty message", "0000000000", "", grpcOK},
+		{"missing frame", "", "", grpcInvalidArgument},
+		{"truncated header", "000000", "", grpcInvalidArgument},
+		{"truncated message", "0000000005080108", "", grpcInvalidArgument},
+		{"compressed", "01000000020801", "", grpcUnimplemented},
+		{"larger than the limit", "0000400001", "", grpcResourceExhausted},
+		{"length of 4 GiB", "00ffffffff", "", grpcResourceExhausted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := readGRPCMessage(bytes.NewReader(decodeHex(t, test.frame)))
+			code := grpcOK
+			if err != nil {
+				code = err.(grpcError).code
+			}
+			if code != test.code || hex.EncodeToString(message) != test.want {
+				t.Errorf("got %x with code %d, want %v with code %d", message, code, test.want, test.code)
+			}
+		})
+	}
+}
+
+func TestGRPCPutGroupApproval(t *testing.T) {
+	db := openTestDatabase(t)
+	if err := db.Create(&Network{SSID: "Corp"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	s := &GRPCServer{DB: db, Approval: ApprovalConfig{Enabled: true}}
+
+	// A new network needs approval, so the group isn't created either
+	_, err := s.putGroup(db, grpcGroup{Name: "staff", Networks: []string{"Corp", "Guest"}}.marshal())
+	if status, ok := err.(grpcError); !ok || status.code != grpcFailedPrecondition {
+		t.Fatalf("got %v, want a failed precondition", err)
+	}
+	var groups, networks int
+	db.Model(&DeviceGroup{}).Count(&groups)
+	db.Model(&Network{}).Count(&networks)
+	if groups != 0 || networks != 1 {
+		t.Errorf("got %d groups and %d networks after the refused call", groups, networks)
+	}
+
+	response, err := s.putGroup(db, grpcGroup{Name: "staff", Networks: []string{"Corp"}}.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group, err := unmarshalGRPCGroup(response); err != nil || len(group.Networks) != 1 || group.Networks[0] != "Corp" {
+		t.Errorf("got %+v, %v", group, err)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"30S", 30 * time.Second, true},
+		{"500m", 500 * time.Millisecond, true},
+		{"1H", time.Hour, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"10x", 0, false},
+		{"-1S", 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseGRPCTimeout(test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestGRPCPercentEncode(t *testing.T) {
+	if got, want := grpcPercentEncode("device group \"é\" is 100% full\n"), "device group \"%C3%A9\" is 100%25 full%0A"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
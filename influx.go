@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	influxQueueSize     = 4096
+	influxBatchSize     = 500
+	influxFlushInterval = 10 * time.Second
+	influxTimeout       = 10 * time.Second
+)
+
+// influxTagEscaper escapes the characters with a meaning in the tags of the line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxStringEscaper escapes the characters with a meaning in the string fields of the line protocol
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// InfluxConfig stores where the accounting data is exported for long-term dashboards
+type InfluxConfig struct {
+	// URL is the address of the InfluxDB server, such as "http://influxdb:8086", or empty to disable the export
+	URL string `json:"url"`
+	// Org, Bucket, and Token select where InfluxDB 2 writes the points
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+	Token  string `json:"token"`
+	// Database, Username, and Password are used instead for InfluxDB 1
+	Database string `json:"database"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Interval is how often the number of active sessions is written
+	Interval Duration `json:"interval"`
+}
+
+// validate checks the InfluxDB settings read from the configuration file
+func (c InfluxConfig) validate() error {
+	parsed, err := url.Parse(c.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid InfluxDB URL %q", c.URL)
+	}
+	if (c.Bucket == "") == (c.Database == "") {
+		return fmt.Errorf("either influx.bucket or influx.database must be set")
+	}
+	if c.Interval.Duration <= 0 {
+		return fmt.Errorf("influx.interval must be set")
+	}
+	return nil
+}
+
+// writeURL builds the write endpoint of InfluxDB 2, or of InfluxDB 1 if a database is set
+func (c InfluxConfig) writeURL() string {
+	query := url.Values{"precision": {"s"}}
+	path := "/api/v2/write"
+	if c.Database != "" {
+		path = "/write"
+		query.Set("db", c.Database)
+	} else {
+		query.Set("org", c.Org)
+		query.Set("bucket", c.Bucket)
+	}
+	return strings.TrimSuffix(c.URL, "/") + path + "?" + query.Encode()
+}
+
+// InfluxExporter writes the traffic of accounting sessions and the number of active sessions to InfluxDB in
+// the line protocol. Points are written in the background, in batches, and dropped if InfluxDB is unreachable,
+// so neither the RADIUS handler nor the database waits on it.
+type InfluxExporter struct {
+	config  InfluxConfig
+	db      *gorm.DB
+	client  *http.Client
+	lines   chan string
+	stop    chan struct{}
+	done    chan struct{}
+	dropped uint64
+}
+
+// NewInfluxExporter checks the settings and starts exporting, or returns nil if no InfluxDB is configured
+func NewInfluxExporter(config InfluxConfig, db *gorm.DB) (*InfluxExporter, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	e := &InfluxExporter{
+		config: config,
+		db:     db,
+		client: &http.Client{Timeout: influxTimeout},
+		lines:  make(chan string, influxQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// AccountingSession writes the counters of a session after an accounting update
+func (e *InfluxExporter) AccountingSession(session AccountingSession) {
+	e.queue(fmt.Sprintf("wifi_session,mac=%v,ssid=%v,client=%v session_id=\"%v\",session_time=%di,input_octets=%di,output_octets=%di,input_packets=%di,output_packets=%di %d",
+		influxTag(session.MAC), influxTag(session.SSID), influxTag(session.Client), influxStringEscaper.Replace(session.SessionID), session.SessionTime,
+		session.InputOctets, session.OutputOctets, session.InputPackets, session.OutputPackets, time.Now().Unix()))
+}
+
+// influxTag escapes a tag value, which can't be empty
+func influxTag(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return influxTagEscaper.Replace(value)
+}
+
+// queue adds a line to the next batch, dropping it if InfluxDB can't keep up
+func (e *InfluxExporter) queue(line string) {
+	select {
+	case e.lines <- line:
+	default:
+		if dropped := atomic.AddUint64(&e.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+			log.Printf("INFLUX: Queue is full, %d points dropped", dropped)
+		}
+	}
+}
+
+// Stop writes the queued points and stops the exporter
+func (e *InfluxExporter) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *InfluxExporter) run() {
+	defer close(e.done)
+	flush := time.NewTicker(influxFlushInterval)
+	defer flush.Stop()
+	count := time.NewTicker(e.config.Interval.Duration)
+	defer count.Stop()
+
+	var batch []string
+	for {
+		select {
+		case line := <-e.lines:
+			batch = append(batch, line)
+			if len(batch) >= influxBatchSize {
+				e.write(batch)
+				batch = nil
+			}
+		case <-count.C:
+			// The instances share the sessions, so only one of them counts them
+			runLocked(e.db, "influx session count", e.config.Interval.Duration, func() {
+				batch = append(batch, e.activeSessions()...)
+			})
+		case <-flush.C:
+			e.write(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case line := <-e.lines:
+					batch = append(batch, line)
+				default:
+					e.write(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// activeSessions counts the sessions without a Stop by SSID
+func (e *InfluxExporter) activeSessions() []string {
+	var sessions []AccountingSession
+	if err := e.db.Where("stopped_at IS NULL").Find(&sessions).Error; err != nil {
+		log.Printf("INFLUX: Unable to count the active sessions: %v", err)
+		return nil
+	}
+	active := make(map[string]int)
+	for _, session := range sessions {
+		active[session.SSID]++
+	}
+
+	now := time.Now().Unix()
+	var lines []string
+	for ssid, count := range active {
+		lines = append(lines, fmt.Sprintf("wifi_active_sessions,ssid=%v count=%di %d", influxTag(ssid), count, now))
+	}
+	return lines
+}
+
+// write sends a batch of lines, logging and dropping it if InfluxDB rejects it
+func (e *InfluxExporter) write(batch []string) {
+	if len(batch) == 0 {
+		return
+	}
+	request, err := http.NewRequest(http.MethodPost, e.config.writeURL(), strings.NewReader(strings.Join(batch, "\n")+"\n"))
+	if err != nil {
+		log.Printf("INFLUX: Unable to write %d points: %v", len(batch), err)
+		return
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.config.Token != "" {
+		request.Header.Set("Authorization", "Token "+e.config.Token)
+	} else if e.config.Username != "" {
+		request.SetBasicAuth(e.config.Username, e.config.Password)
+	}
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		log.Printf("INFLUX: Unable to write %d points: %v", len(batch), err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		log.Printf("INFLUX: Unable to write %d points: server replied %v: %v", len(batch), response.Status, strings.TrimSpace(string(message)))
+	}
+}
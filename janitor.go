@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Janitor removes old log entries and accounting sessions on an interval, as set by the retention settings
+type Janitor struct {
+	DB     *gorm.DB
+	Config RetentionConfig
+	// StaleDevices disables devices that haven't been seen in a long time, emailing Mailer's recipients
+	StaleDevices StaleDevicesConfig
+	Mailer       *Mailer
+	// Standby reports whether the records are pulled from a primary, which cleans them up instead
+	Standby func() bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewJanitor creates a Janitor
+func NewJanitor(db *gorm.DB, config RetentionConfig) *Janitor {
+	return &Janitor{DB: db, Config: config}
+}
+
+// Start cleans up right away and then on every interval until Stop is called
+func (j *Janitor) Start() {
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go func() {
+		defer close(j.done)
+		runLocked(j.DB, "janitor", j.Config.Interval.Duration, j.Run)
+		if j.Config.Interval.Duration <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(j.Config.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runLocked(j.DB, "janitor", j.Config.Interval.Duration, j.Run)
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running clean up and stops the Janitor
+func (j *Janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
+
+// Run removes everything older than its retention period. A period of 0 keeps everything.
+func (j *Janitor) Run() {
+	j.prune("auth log entries", j.Config.AuthLogDays, func(cutoff time.Time) *gorm.DB {
+		return j.DB.Where("created_at < ?", cutoff).Delete(&AuthLog{})
+	})
+	// Sessions without a Stop that haven't been updated in as long are abandoned, such as when a controller
+	// was replaced
+	j.prune("accounting sessions", j.Config.AccountingDays, func(cutoff time.Time) *gorm.DB {
+		return j.DB.Where("stopped_at < ? OR (stopped_at IS NULL AND updated_at < ?)", cutoff, cutoff).Delete(&AccountingSession{})
+	})
+	if j.Standby != nil && j.Standby() {
+		return
+	}
+	j.prune("audit log entries", j.Config.AuditLogDays, func(cutoff time.Time) *gorm.DB {
+		return j.DB.Where("created_at < ?", cutoff).Delete(&AuditLog{})
+	})
+	if j.Config.ExpiredDeviceDays > 0 {
+		j.removeExpiredDevices()
+	}
+	if j.StaleDevices.DisableAfterDays > 0 {
+		j.disableStaleDevices()
+	}
+	if j.Config.TrashDays > 0 {
+		j.emptyTrash()
+	}
+}
+
+// emptyTrash purges the devices and device groups that have been in the trash for the configured number of days
+func (j *Janitor) emptyTrash() {
+	devices, groups, err := purgeTrash(withAuditActor(j.DB, "janitor"), time.Now().AddDate(0, 0, -j.Config.TrashDays))
+	if err != nil {
+		log.Printf("JANITOR: Unable to empty the trash: %v", err)
+	}
+	if devices > 0 || groups > 0 {
+		log.Printf("JANITOR: Purged %d devices and %d device groups from the trash", devices, groups)
+	}
+}
+
+// removeExpiredDevices moves the temporary devices that expired more than the configured number of days ago to
+// the trash. They are already rejected from when they expire.
+func (j *Janitor) removeExpiredDevices() {
+	days := j.Config.ExpiredDeviceDays
+	var devices []Device
+	if err := j.DB.Where("expires_at < ?", time.Now().AddDate(0, 0, -days)).Find(&devices).Error; err != nil {
+		log.Printf("JANITOR: Unable to find expired devices: %v", err)
+		return
+	}
+
+	removed := 0
+	db := withAuditActor(j.DB, "janitor")
+	for _, device := range devices {
+		if err := deleteDevice(db, device); err != nil {
+			log.Printf("JANITOR: Unable to remove expired device %v: %v", device.MAC, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("JANITOR: Moved %d devices expired more than %d days ago to the trash", removed, days)
+	}
+}
+
+// disableStaleDevices disables the devices that haven't been seen in the configured number of days
+func (j *Janitor) disableStaleDevices() {
+	days := j.StaleDevices.DisableAfterDays
+	devices, err := disableStaleDevices(withAuditActor(j.DB, "janitor"), time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("JANITOR: Unable to disable stale devices: %v", err)
+	}
+	if len(devices) == 0 {
+		return
+	}
+	log.Printf("JANITOR: Disabled %d devices not seen in %d days", len(devices), days)
+
+	if j.Mailer != nil && len(j.StaleDevices.Notify) > 0 {
+		data := staleDevicesEmail{Days: days}
+		for _, device := range devices {
+			data.Devices = append(data.Devices, newStaleDevice(device))
+		}
+		if err := j.Mailer.Send(j.StaleDevices.Notify, "stale-devices", data); err != nil {
+			log.Printf("JANITOR: Unable to send the stale device notification: %v", err)
+		}
+	}
+}
+
+func (j *Janitor) prune(name string, days int, remove func(cutoff time.Time) *gorm.DB) {
+	if days <= 0 {
+		return
+	}
+	result := remove(time.Now().AddDate(0, 0, -days))
+	if result.Error != nil {
+		log.Printf("JANITOR: Unable to remove %v: %v", name, result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("JANITOR: Removed %d %v older than %d days", result.RowsAffected, name, days)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ldapTimeout = 30 * time.Second
+	// ldapPageSize is how many entries are asked for at once, below the 1000 Active Directory sends at most
+	ldapPageSize = 500
+	// ldapMaxMessage limits the size of a message read from the server
+	ldapMaxMessage = 16 << 20
+)
+
+// LDAP operations and the BER tags they use beside those of SNMP
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+	ldapControls          = 0xa0
+	ldapBoolean           = 0x01
+	ldapEnumerated        = 0x0a
+	ldapSet               = 0x31
+
+	ldapStartTLSOID     = "1.3.6.1.4.1.1466.20037"
+	ldapPagedResultsOID = "1.2.840.113556.1.4.319"
+)
+
+// LDAPConfig stores the directory devices are synced from, such as the computer objects of Active Directory
+type LDAPConfig struct {
+	// URL is the directory server, such as ldaps://dc.example.com, or empty to not sync devices
+	URL string `json:"url"`
+	// StartTLS upgrades an ldap:// connection to TLS before binding
+	StartTLS bool `json:"start_tls"`
+	// CAFile holds the certificates the server is verified with instead of the system ones, such as the
+	// certificate of an internal CA
+	CAFile       string `json:"ca_file"`
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	// BaseDN and Filter select the objects holding the MAC addresses
+	BaseDN string `json:"base_dn"`
+	Filter string `json:"filter"`
+	// MACAttribute holds the MAC addresses of an object, and NameAttribute the name of its devices
+	MACAttribute  string `json:"mac_attribute"`
+	NameAttribute string `json:"name_attribute"`
+	// Group is the device group the devices are synced into. Devices in it that are no longer found in the
+	// directory are removed from it.
+	Group string `json:"group"`
+	// Interval is how often the devices are synced, or 0 to only sync them with the ldap-sync command
+	Interval Duration `json:"interval"`
+}
+
+// validate checks the settings before connecting
+func (c LDAPConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return fmt.Errorf("ldap.url must start with ldap:// or ldaps://")
+	case u.Hostname() == "":
+		return fmt.Errorf("ldap.url has no host")
+	case c.StartTLS && u.Scheme == "ldaps":
+		return fmt.Errorf("ldap.start_tls only applies to ldap:// URLs")
+	case u.Scheme == "ldap" && !c.StartTLS && c.BindPassword != "":
+		return fmt.Errorf("the bind password would be sent in the clear, use ldaps:// or ldap.start_tls")
+	case c.BaseDN == "":
+		return fmt.Errorf("ldap.base_dn is required")
+	case c.MACAttribute == "":
+		return fmt.Errorf("ldap.mac_attribute is required")
+	case c.Group == "":
+		return fmt.Errorf("ldap.group is required")
+	case c.Interval.Duration < 0:
+		return fmt.Errorf("ldap.interval can't be negative")
+	}
+	if _, err := compileLDAPFilter(c.Filter); err != nil {
+		return fmt.Errorf("invalid ldap.filter: %v", err)
+	}
+	return nil
+}
+
+// tlsConfig verifies the server with CAFile, or the system certificates
+func (c LDAPConfig) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if c.CAFile != "" {
+		certificates, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(certificates) {
+			return nil, fmt.Errorf("no certificates found in %v", c.CAFile)
+		}
+	}
+	return config, nil
+}
+
+// ldapConn is a connection to an LDAP server, used for one request at a time
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int64
+}
+
+// dialLDAP connects to the server, upgrades the connection to TLS if needed, and binds
+func dialLDAP(config LDAPConfig) (*ldapConn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	tlsConfig, err := config.tlsConfig(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	if config.StartTLS {
+		if err := c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %v", err)
+		}
+	}
+	if err := c.bind(config.BindDN, config.BindPassword); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("bind failed: %v", err)
+	}
+	return c, nil
+}
+
+// send writes a message with the next message ID, which it returns
+func (c *ldapConn) send(op []byte, controls []byte) (int64, error) {
+	c.nextID++
+	message := append(berInt(c.nextID), op...)
+	message = append(message, controls...)
+	c.conn.SetDeadline(time.Now().Add(ldapTimeout))
+	_, err := c.conn.Write(berTLV(berSequence, message))
+	return c.nextID, err
+}
+
+// receive reads the next message, returning its ID, the tag and content of its operation, and its controls
+func (c *ldapConn) receive() (int64, byte, []byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, 0, nil, nil, err
+	}
+	if header[0] != berSequence {
+		return 0, 0, nil, nil, fmt.Errorf("unexpected tag %#x", header[0])
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return 0, 0, nil, nil, errors.New("invalid length")
+		}
+		encoded := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, encoded); err != nil {
+			return 0, 0, nil, nil, err
+		}
+		length = 0
+		for _, b := range encoded {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessage {
+		return 0, 0, nil, nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, message); err != nil {
+		return 0, 0, nil, nil, err
+	}
+
+	r := berReader{data: message}
+	id := r.integer()
+	tag, op := r.read()
+	var controls []byte
+	if len(r.data) > 0 {
+		controls = r.expect(ldapControls)
+	}
+	return id, tag, op, controls, r.err
+}
+
+// request sends an operation and reads the response, which must have the tag
+func (c *ldapConn) request(op []byte, responseTag byte) error {
+	id, err := c.send(op, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		responseID, tag, content, _, err := c.receive()
+		if err != nil {
+			return err
+		}
+		// Message ID 0 is a notice that the server is closing the connection
+		if responseID == 0 {
+			return ldapResult(content)
+		}
+		if responseID != id {
+			continue
+		}
+		if tag != responseTag {
+			return fmt.Errorf("unexpected response %#x", tag)
+		}
+		return ldapResult(content)
+	}
+}
+
+// ldapResult turns an LDAPResult into an error unless it reports success
+func ldapResult(content []byte) error {
+	r := berReader{data: content}
+	code := r.expect(ldapEnumerated)
+	r.expect(berOctetString)
+	message := r.expect(berOctetString)
+	if r.err != nil {
+		return r.err
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	if result != 0 {
+		if len(message) == 0 {
+			return fmt.Errorf("result code %d", result)
+		}
+		return fmt.Errorf("result code %d: %s", result, strings.TrimRight(string(message), "\x00\n"))
+	}
+	return nil
+}
+
+// startTLS switches the connection to TLS
+func (c *ldapConn) startTLS(config *tls.Config) error {
+	if err := c.request(berTLV(ldapExtendedRequest, berTLV(0x80, []byte(ldapStartTLSOID))), ldapExtendedResponse); err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// bind authenticates with a simple bind, or anonymously if dn is empty
+func (c *ldapConn) bind(dn, password string) error {
+	request := berInt(3)
+	request = append(request, berTLV(berOctetString, []byte(dn))...)
+	request = append(request, berTLV(0x80, []byte(password))...)
+	return c.request(berTLV(ldapBindRequest, request), ldapBindResponse)
+}
+
+// search finds the entries under baseDN matching the filter in the whole subtree, calling found with the DN and
+// the attributes of each one, keyed by their lowercase names. The results are asked for a page at a time, which
+// servers not supporting paging ignore.
+func (c *ldapConn) search(baseDN string, filter []byte, attributes []string, found func(dn string, values map[string][][]byte)) error {
+	var selected []byte
+	for _, attribute := range attributes {
+		selected = append(selected, berTLV(berOctetString, []byte(attribute))...)
+	}
+	request := berTLV(berOctetString, []byte(baseDN))
+	request = append(request, berTLV(ldapEnumerated, []byte{2})...) // wholeSubtree
+	request = append(request, berTLV(ldapEnumerated, []byte{0})...) // neverDerefAliases
+	request = append(request, berInt(0)...)                         // no size limit
+	request = append(request, berInt(int64(ldapTimeout/time.Second))...)
+	request = append(request, berTLV(ldapBoolean, []byte{0})...) // typesOnly
+	request = append(request, filter...)
+	request = append(request, berTLV(berSequence, selected)...)
+	op := berTLV(ldapSearchRequest, request)
+
+	var cookie []byte
+	for {
+		paging := append(berInt(ldapPageSize), berTLV(berOctetString, cookie)...)
+		control := append(berTLV(berOctetString, []byte(ldapPagedResultsOID)), berTLV(berOctetString, berTLV(berSequence, paging))...)
+		id, err := c.send(op, berTLV(ldapControls, berTLV(berSequence, control)))
+		if err != nil {
+			return err
+		}
+
+		cookie = nil
+	page:
+		for {
+			responseID, tag, content, controls, err := c.receive()
+			if err != nil {
+				return err
+			}
+			if responseID == 0 {
+				return ldapResult(content)
+			}
+			if responseID != id {
+				continue
+			}
+			switch tag {
+			case ldapSearchResultEntry:
+				dn, values, err := parseLDAPEntry(content)
+				if err != nil {
+					return err
+				}
+				found(dn, values)
+			case ldapSearchResultRef:
+				// Referrals to other servers aren't followed
+			case ldapSearchResultDone:
+				if err := ldapResult(content); err != nil {
+					return err
+				}
+				cookie = ldapPagingCookie(controls)
+				break page
+			default:
+				return fmt.Errorf("unexpected response %#x", tag)
+			}
+		}
+		if len(cookie) == 0 {
+			return nil
+		}
+	}
+}
+
+// parseLDAPEntry reads the DN and attributes of a SearchResultEntry
+func parseLDAPEntry(content []byte) (string, map[string][][]byte, error) {
+	r := berReader{data: content}
+	dn := string(r.expect(berOctetString))
+	attributes := berReader{data: r.expect(berSequence)}
+	values := make(map[string][][]byte)
+	for r.err == nil && attributes.err == nil && len(attributes.data) > 0 {
+		attribute := berReader{data: attributes.expect(berSequence)}
+		name := strings.ToLower(string(attribute.expect(berOctetString)))
+		set := berReader{data: attribute.expect(ldapSet)}
+		for attribute.err == nil && set.err == nil && len(set.data) > 0 {
+			values[name] = append(values[name], set.expect(berOctetString))
+		}
+		if attribute.err != nil {
+			return "", nil, attribute.err
+		}
+		if set.err != nil {
+			return "", nil, set.err
+		}
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return dn, values, attributes.err
+}
+
+// ldapPagingCookie finds the cookie of the next page in the controls of a SearchResultDone, which is empty after
+// the last page
+func ldapPagingCookie(controls []byte) []byte {
+	r := berReader{data: controls}
+	for r.err == nil && len(r.data) > 0 {
+		control := berReader{data: r.expect(berSequence)}
+		oid := string(control.expect(berOctetString))
+		var value []byte
+		for control.err == nil && len(control.data) > 0 {
+			if tag, content := control.read(); tag == berOctetString {
+				value = content
+			}
+		}
+		if oid != ldapPagedResultsOID {
+			continue
+		}
+		outer := berReader{data: value}
+		paging := berReader{data: outer.expect(berSequence)}
+		paging.integer()
+		cookie := paging.expect(berOctetString)
+		if outer.err != nil || paging.err != nil {
+			return nil
+		}
+		return cookie
+	}
+	return nil
+}
+
+// Close unbinds and closes the connection
+func (c *ldapConn) Close() error {
+	c.send([]byte{ldapUnbindRequest, 0}, nil)
+	return c.conn.Close()
+}
+
+// compileLDAPFilter encodes a filter written as in RFC 4515, such as (&(objectClass=computer)(macAddress=*))
+func compileLDAPFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	encoded, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after the filter", rest)
+	}
+	return encoded, nil
+}
+
+// parseLDAPFilter encodes the parenthesized filter at the start of s, returning what follows it
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, "", errors.New("expected (")
+	}
+	s = s[1:]
+
+	var encoded []byte
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var filters []byte
+		for len(s) > 0 && s[0] == '(' {
+			filter, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			filters = append(filters, filter...)
+			s = rest
+		}
+		encoded = berTLV(tag, filters)
+	case '!':
+		filter, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		encoded = berTLV(0xa2, filter)
+		s = rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errors.New("missing )")
+		}
+		item, err := ldapFilterItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		encoded = item
+		s = s[end:]
+	}
+
+	if len(s) == 0 || s[0] != ')' {
+		return nil, "", errors.New("missing )")
+	}
+	return encoded, s[1:], nil
+}
+
+// ldapFilterItem encodes a comparison such as objectClass=computer, cn=LT-*, or
+// userAccountControl:1.2.840.113556.1.4.803:=2
+func ldapFilterItem(item string) ([]byte, error) {
+	equals := strings.IndexByte(item, '=')
+	if equals <= 0 || strings.ContainsAny(item[:equals], "()*\\ ") {
+		return nil, fmt.Errorf("invalid comparison %q", item)
+	}
+	attribute, value := item[:equals], item[equals+1:]
+	pair := func(tag byte, attribute string) ([]byte, error) {
+		unescaped, err := ldapUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		return berTLV(tag, append(berTLV(berOctetString, []byte(attribute)), berTLV(berOctetString, unescaped)...)), nil
+	}
+
+	switch {
+	case strings.HasSuffix(attribute, ":"):
+		// Extensible match: attribute, ":dn", and the matching rule are each optional
+		var content []byte
+		parts := strings.Split(strings.TrimSuffix(attribute, ":"), ":")
+		dn := false
+		rule := ""
+		for _, part := range parts[1:] {
+			if strings.EqualFold(part, "dn") {
+				dn = true
+			} else {
+				rule = part
+			}
+		}
+		if rule != "" {
+			content = append(content, berTLV(0x81, []byte(rule))...)
+		}
+		if parts[0] != "" {
+			content = append(content, berTLV(0x82, []byte(parts[0]))...)
+		}
+		unescaped, err := ldapUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, berTLV(0x83, unescaped)...)
+		if dn {
+			content = append(content, berTLV(0x84, []byte{0xff})...)
+		}
+		return berTLV(0xa9, content), nil
+	case strings.HasSuffix(attribute, ">"):
+		return pair(0xa5, strings.TrimSuffix(attribute, ">"))
+	case strings.HasSuffix(attribute, "<"):
+		return pair(0xa6, strings.TrimSuffix(attribute, "<"))
+	case strings.HasSuffix(attribute, "~"):
+		return pair(0xa8, strings.TrimSuffix(attribute, "~"))
+	case value == "*":
+		return berTLV(0x87, []byte(attribute)), nil
+	case strings.Contains(value, "*"):
+		parts := strings.Split(value, "*")
+		var substrings []byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := ldapUnescape(part)
+			if err != nil {
+				return nil, err
+			}
+			tag := byte(0x81)
+			if i == 0 {
+				tag = 0x80
+			} else if i == len(parts)-1 {
+				tag = 0x82
+			}
+			substrings = append(substrings, berTLV(tag, unescaped)...)
+		}
+		return berTLV(0xa4, append(berTLV(berOctetString, []byte(attribute)), berTLV(berSequence, substrings)...)), nil
+	default:
+		return pair(0xa3, attribute)
+	}
+}
+
+// ldapUnescape decodes the \XX escapes of a filter value
+func ldapUnescape(value string) ([]byte, error) {
+	var unescaped []byte
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+3 > len(value) {
+				return nil, fmt.Errorf("invalid escape in %q", value)
+			}
+			b, err := hex.DecodeString(value[i+1 : i+3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape in %q", value)
+			}
+			unescaped = append(unescaped, b...)
+			i += 2
+		case '(', ')', '*':
+			return nil, fmt.Errorf("%q must be escaped in %q", value[i], value)
+		default:
+			unescaped = append(unescaped, value[i])
+		}
+	}
+	return unescaped, nil
+}
+
+// ldapMACAddresses reads the MAC addresses of an attribute, written with any delimiters or stored as 6 bytes
+func ldapMACAddresses(values [][]byte) []string {
+	var macs []string
+	for _, value := range values {
+		mac := normalizeMACAddress(string(value))
+		if !isValidMACFormat(mac) && len(value) == 6 {
+			mac = hex.EncodeToString(value)
+		}
+		if isValidMACFormat(mac) {
+			macs = append(macs, mac)
+		}
+	}
+	return macs
+}
+
+// loadLDAPDevices finds the MAC addresses in the directory, with the name of the object holding each one
+func loadLDAPDevices(config LDAPConfig) (map[string]string, error) {
+	filter, err := compileLDAPFilter(config.Filter)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialLDAP(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	devices := make(map[string]string)
+	attributes := []string{config.MACAttribute}
+	if config.NameAttribute != "" {
+		attributes = append(attributes, config.NameAttribute)
+	}
+	err = conn.search(config.BaseDN, filter, attributes, func(dn string, values map[string][][]byte) {
+		name := dn
+		if names := values[strings.ToLower(config.NameAttribute)]; len(names) > 0 {
+			name = string(names[0])
+		}
+		for _, mac := range ldapMACAddresses(values[strings.ToLower(config.MACAttribute)]) {
+			devices[mac] = name
+		}
+	})
+	return devices, err
+}
+
+// syncLDAPDevices syncs the MAC addresses found in the directory into the group
+func syncLDAPDevices(db *gorm.DB, config LDAPConfig, approval ApprovalConfig, dryRun bool, report func(change string)) error {
+	load := func() (map[string]string, error) {
+		return loadLDAPDevices(config)
+	}
+	return syncGroupDevices(db, config.Group, approval, "the directory", load, dryRun, report)
+}
+
+// NewLDAPSync checks the configuration and creates a DeviceSync syncing the devices from the directory
+func NewLDAPSync(config LDAPConfig, approval ApprovalConfig, db *gorm.DB) (*DeviceSync, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &DeviceSync{
+		DB:       db,
+		Name:     "LDAP",
+		Actor:    "ldap-sync",
+		Interval: config.Interval.Duration,
+		Sync: func(db *gorm.DB, report func(change string)) error {
+			return syncLDAPDevices(db, config, approval, false, report)
+		},
+	}, nil
+}
+
+// ldapSyncCommand syncs the devices from the directory right away, or shows what would change
+func ldapSyncCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("ldap-sync", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only show the changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.LDAP.URL == "" {
+		return errors.New("no LDAP directory is configured")
+	}
+	if err := config.LDAP.validate(); err != nil {
+		return err
+	}
+
+	changes := 0
+	err := syncLDAPDevices(db, config.LDAP, config.Approval, *dryRun, func(change string) {
+		fmt.Println(change)
+		changes++
+	})
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		fmt.Println("The devices are up to date")
+	}
+	return nil
+}
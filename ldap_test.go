@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// ldapConnReading returns a connection that receives the messages
+func ldapConnReading(t *testing.T, messages string) *ldapConn {
+	return &ldapConn{reader: bufio.NewReader(bytes.NewReader(decodeHex(t, messages)))}
+}
+
+func TestLDAPReceive(t *testing.T) {
+	// A SearchResultDone for message 2 with a paged results control holding the cookie "ab"
+	controls := "a025" + "3023" + "0416" + hex.EncodeToString([]byte(ldapPagedResultsOID)) + "0409" + "3007" + "020100" + "04026162"
+	done := "3033" + "020102" + "65070a010004000400" + controls
+
+	connection := ldapConnReading(t, "300c02010161070a010004000400"+done)
+	id, tag, content, _, err := connection.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || tag != ldapBindResponse || ldapResult(content) != nil {
+		t.Errorf("got message %d with tag %#x and result %v", id, tag, ldapResult(content))
+	}
+	id, tag, _, control, err := connection.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 || tag != ldapSearchResultDone || string(ldapPagingCookie(control)) != "ab" {
+		t.Errorf("got message %d with tag %#x and cookie %q", id, tag, ldapPagingCookie(control))
+	}
+	if _, _, _, _, err := connection.receive(); err == nil {
+		t.Error("a message was read after the last one")
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		valid   bool
+	}{
+		{"long form length", "30810c02010161070a010004000400", true},
+		{"not a sequence", "310c02010161070a010004000400", false},
+		{"indefinite length", "308002010161070a0100040004000000", false},
+		{"length of 5 bytes", "30850000000c0c02010161070a010004000400", false},
+		{"larger than the limit", "308401000001", false},
+		{"truncated length", "3082", false},
+		{"missing message ID", "3007" + "61070a010004000400", false},
+		{"message ID of 9 bytes", "3014" + "0209010203040506070809" + "61070a010004000400", false},
+		{"invalid controls", "300e02010161070a01000400040030", false},
+		{"operation longer than the message", "300c02010161080a010004000400", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, _, err := ldapConnReading(t, test.message).receive()
+			if (err == nil) != test.valid {
+				t.Errorf("got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+
+	// Every prefix of a message is truncated
+	for i := 0; i < len(done)/2; i++ {
+		if _, _, _, _, err := ldapConnReading(t, done[:2*i]).receive(); err == nil {
+			t.Errorf("a prefix of %d bytes was accepted", i)
+		}
+	}
+}
+
+func TestLDAPResult(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"0a010004000400", ""},
+		{"0a01310400" + "0405" + hex.EncodeToString([]byte("oops\n")), "result code 49: oops"},
+		{"0a02010004000400", "result code 256"},
+		{"0a01000400", "truncated value"},
+		{"040100", "expected tag 0xa, got 0x4"},
+	}
+
+	for _, test := range tests {
+		err := ldapResult(decodeHex(t, test.content))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%v: got %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestParseLDAPEntry(t *testing.T) {
+	// CN=LT-1,DC=example with a macAddress written as text and as bytes, and a cn
+	macAddress := "040a" + hex.EncodeToString([]byte("macAddress")) + "311b" +
+		"0411" + hex.EncodeToString([]byte("00:11:22:33:44:55")) + "0406aabbccddeeff"
+	entry := "0412" + hex.EncodeToString([]byte("CN=LT-1,DC=example")) + "3039" + "3029" + macAddress +
+		"300c" + "0402636e" + "310604044c542d31"
+
+	dn, values, err := parseLDAPEntry(decodeHex(t, entry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][][]byte{
+		"macaddress": {[]byte("00:11:22:33:44:55"), {0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}},
+		"cn":         {[]byte("LT-1")},
+	}
+	if dn != "CN=LT-1,DC=example" || !reflect.DeepEqual(values, want) {
+		t.Errorf("got %q with %q", dn, values)
+	}
+	if macs := ldapMACAddresses(values["macaddress"]); !reflect.DeepEqual(macs, []string{"001122334455", "aabbccddeeff"}) {
+		t.Errorf("got MAC addresses %v", macs)
+	}
+
+	// Every prefix is truncated, since the lengths of the DN and attributes tell where they end
+	for i := 0; i < len(entry)/2; i++ {
+		if dn, values, err := parseLDAPEntry(decodeHex(t, entry[:2*i])); err == nil {
+			t.Errorf("a prefix of %d bytes was accepted as %q with %q", i, dn, values)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		entry string
+		valid bool
+	}{
+		{"no attributes", "0400" + "3000", true},
+		{"attribute without values", "0400" + "3006" + "300404003100", true},
+		{"missing DN", "3000", false},
+		{"attribute without a set", "0400" + "3004" + "30020400", false},
+		{"attribute that isn't a sequence", "0400" + "3006" + "310404003100", false},
+		{"value that isn't an octet string", "0400" + "3008" + "300604003102" + "0200", false},
+		{"set longer than the attribute", "0400" + "3006" + "300404003105", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := parseLDAPEntry(decodeHex(t, test.entry))
+			if (err == nil) != test.valid {
+				t.Errorf("got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestCompileLDAPFilter(t *testing.T) {
+	hexString := func(s string) string { return hex.EncodeToString([]byte(s)) }
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"(cn=Babs)", "a30a" + "0402636e" + "0404" + hexString("Babs")},
+		{"cn=Babs", "a30a" + "0402636e" + "0404" + hexString("Babs")},
+		{"(objectClass=*)", "870b" + hexString("objectClass")},
+		{"(&(a=b)(!(c=*)))", "a00d" + "a306040161040162" + "a203870163"},
+		{"(|(a=b))", "a108" + "a306040161040162"},
+		{"(cn=a*b*c)", "a40f" + "0402636e" + "3009" + "800161" + "810162" + "820163"},
+		{"(cn=*b*)", "a409" + "0402636e" + "3003" + "810162"},
+		{"(cn=a\\2ab)", "a309" + "0402636e" + "0403612a62"},
+		{"(cn>=b)", "a507" + "0402636e" + "040162"},
+		{"(cn<=b)", "a607" + "0402636e" + "040162"},
+		{"(cn~=b)", "a807" + "0402636e" + "040162"},
+		{"(userAccountControl:1.2.840.113556.1.4.803:=2)", "a92f" + "8116" + hexString("1.2.840.113556.1.4.803") +
+			"8212" + hexString("userAccountControl") + "830132"},
+		{"(cn:dn:=b)", "a90a" + "8202636e" + "830162" + "8401ff"},
+	}
+	for _, test := range tests {
+		got, err := compileLDAPFilter(test.filter)
+		if err != nil {
+			t.Errorf("%v: %v", test.filter, err)
+			continue
+		}
+		if hex.EncodeToString(got) != test.want {
+			t.Errorf("%v: got %x, want %v", test.filter, got, test.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"",
+		"(",
+		"()",
+		"(cn=a",
+		"(&(a=b)",
+		"(&(a=b)x)",
+		"(!",
+		"(!(a=b)",
+		"(a=b))",
+		"(a=b)(c=d)",
+		"(=b)",
+		"(a b=c)",
+		"(cn=a(b)",
+		"(cn=a\\2)",
+		"(cn=a\\zz)",
+		"(cn=a*\\2)",
+	} {
+		if encoded, err := compileLDAPFilter(invalid); err == nil {
+			t.Errorf("%q was accepted as %x", invalid, encoded)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// recoveredHandler keeps a panic while handling a request, such as on an attribute that isn't formatted the way
+// the code expects, from taking the whole server down. The request is dropped and logged with the stack.
+func (rs *RadiusServer) recoveredHandler(handler radius.HandlerFunc) radius.HandlerFunc {
+	return func(w radius.ResponseWriter, r *radius.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				panicked := atomic.AddUint64(&rs.panickedRequests, 1)
+				log.Printf("RADIUS: Panic handling %v (id %d, User-Name %q, Calling-Station-Id %q) from %v, dropping it (%d dropped): %v\n%s",
+					r.Code, r.Identifier, rfc2865.UserName_GetString(r.Packet), rfc2865.CallingStationID_GetString(r.Packet),
+					r.RemoteAddr, panicked, err, debug.Stack())
+			}
+		}()
+		handler(w, r)
+	}
+}
+
+// limitedHandler runs the RADIUS handler for at most MaxConcurrentRequests requests at once and drops the
+// requests that arrive while all are busy, so a slow database can't pile up goroutines. Responses that aren't
+// ready within RequestTimeout are dropped too, since the client will have retransmitted or given up by then.
+func (rs *RadiusServer) limitedHandler(w radius.ResponseWriter, r *radius.Request) {
+	if rs.slots != nil {
+		select {
+		case rs.slots <- struct{}{}:
+			defer func() { <-rs.slots }()
+		default:
+			if shed := atomic.AddUint64(&rs.shedRequests, 1); shed == 1 || shed%1000 == 0 {
+				log.Printf("RADIUS: Too many requests in progress, dropping request from %v (%d dropped)", r.RemoteAddr, shed)
+			}
+			return
+		}
+	}
+
+	if rs.RequestTimeout > 0 {
+		// The context of the request is cancelled as soon as the server stops, which would count the requests
+		// being drained as timed out
+		ctx, cancel := context.WithTimeout(context.Background(), rs.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+		w = &deadlineResponseWriter{ResponseWriter: w, rs: rs, r: r}
+	}
+
+	rs.radiusHandler(w, r)
+}
+
+// ShedRequests returns how many requests have been dropped because too many were in progress
+func (rs *RadiusServer) ShedRequests() uint64 {
+	return atomic.LoadUint64(&rs.shedRequests)
+}
+
+// PanickedRequests returns how many requests have been dropped because handling them panicked
+func (rs *RadiusServer) PanickedRequests() uint64 {
+	return atomic.LoadUint64(&rs.panickedRequests)
+}
+
+// TimedOutRequests returns how many responses have been dropped because they took too long
+func (rs *RadiusServer) TimedOutRequests() uint64 {
+	return atomic.LoadUint64(&rs.timedOutRequests)
+}
+
+// deadlineResponseWriter drops the response once the request's context has expired
+type deadlineResponseWriter struct {
+	radius.ResponseWriter
+	rs *RadiusServer
+	r  *radius.Request
+}
+
+func (w *deadlineResponseWriter) Write(packet *radius.Packet) error {
+	if err := w.r.Context().Err(); err != nil {
+		timedOut := atomic.AddUint64(&w.rs.timedOutRequests, 1)
+		log.Printf("RADIUS: Request from %v took longer than %v, dropping the response (%d dropped)", w.r.RemoteAddr, w.rs.RequestTimeout, timedOut)
+		return err
+	}
+	return w.ResponseWriter.Write(packet)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileTimeFormat stamps the name of a rotated log file, so the names sort by age
+const logFileTimeFormat = "20060102T150405.000"
+
+// LoggingConfig stores the files the logs are written to, for hosts without a syslog daemon. Logs without a file
+// are written to the standard error as before.
+type LoggingConfig struct {
+	// File receives the log of the program
+	File LogFileConfig `json:"file"`
+	// AccessFile receives the requests answered by the HTTP servers instead of the log of the program
+	AccessFile LogFileConfig `json:"access_file"`
+	// AuthFile receives a line of JSON with the outcome of every authentication
+	AuthFile LogFileConfig `json:"auth_file"`
+	// SecurityFile receives the failures and floods for fail2ban or CrowdSec, which are only logged there when it
+	// is set
+	SecurityFile LogFileConfig `json:"security_file"`
+}
+
+// LogFileConfig stores the path of a log file and when it is rotated
+type LogFileConfig struct {
+	// Path is the log file, or empty to not write one
+	Path string `json:"path"`
+	// MaxSize is the size in megabytes the file is rotated at, or 0 to not rotate it by size
+	MaxSize int `json:"max_size_mb"`
+	// MaxAge is how long the file is written before it is rotated, or 0 to not rotate it by age
+	MaxAge Duration `json:"max_age"`
+	// MaxBackups is how many rotated files are kept, or 0 to keep them all
+	MaxBackups int `json:"max_backups"`
+	// Compress gzips the rotated files
+	Compress bool `json:"compress"`
+}
+
+// rotatingFile is a log file that is renamed with the time and replaced by a new one once it gets too large or too
+// old. Rotated files are compressed and pruned in the background.
+type rotatingFile struct {
+	config LogFileConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	cleanup sync.Mutex
+}
+
+// openLogFile opens a log file for appending, creating it and its directory if needed
+func openLogFile(config LogFileConfig) (*rotatingFile, error) {
+	if config.MaxSize < 0 || config.MaxAge.Duration < 0 || config.MaxBackups < 0 {
+		return nil, fmt.Errorf("%v: max_size_mb, max_age, and max_backups can't be negative", config.Path)
+	}
+	f := &rotatingFile{config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.config.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends to the file, rotating it first if the write would take it past the size limit or it is too old
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooLarge := f.config.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > int64(f.config.MaxSize)<<20
+	tooOld := f.config.MaxAge.Duration > 0 && f.size > 0 && time.Since(f.opened) >= f.config.MaxAge.Duration
+	if tooLarge || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the file rather than losing the log, the next write tries again
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %v: %v\n", f.config.Path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file with the current time and opens a new one, with f.mu held
+func (f *rotatingFile) rotate() error {
+	ext := filepath.Ext(f.config.Path)
+	rotated := strings.TrimSuffix(f.config.Path, ext) + "-" + time.Now().Format(logFileTimeFormat) + ext
+	if err := os.Rename(f.config.Path, rotated); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		// Write to the rotated file until a new one can be opened
+		f.file, _ = os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0640)
+		if f.file == nil {
+			return err
+		}
+		f.opened = time.Now()
+		return err
+	}
+	go f.cleanUp(rotated)
+	return nil
+}
+
+// cleanUp compresses a rotated file and removes the oldest rotated files past MaxBackups
+func (f *rotatingFile) cleanUp(rotated string) {
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+
+	if f.config.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compress log file %v: %v\n", rotated, err)
+		}
+	}
+	if f.config.MaxBackups == 0 {
+		return
+	}
+	backups, err := f.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to list the rotated files of %v: %v\n", f.config.Path, err)
+		return
+	}
+	for len(backups) > f.config.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to remove log file %v: %v\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// backups lists the rotated files, oldest first
+func (f *rotatingFile) backups() ([]string, error) {
+	dir := filepath.Dir(f.config.Path)
+	ext := filepath.Ext(f.config.Path)
+	prefix := strings.TrimSuffix(filepath.Base(f.config.Path), ext) + "-"
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if _, err := time.Parse(logFileTimeFormat, stamp); err == nil {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// gzipFile replaces a file with a gzipped copy
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file, after which writes fail
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// logFiles holds the log files opened for the servers
+type logFiles struct {
+	files []*rotatingFile
+	// auth is the file the authentications are written to, or nil
+	auth *rotatingFile
+}
+
+// openLogFiles opens the configured log files and sends the log of the program, the access log, and the security
+// log to them
+func openLogFiles(config LoggingConfig) (*logFiles, error) {
+	l := &logFiles{}
+	open := func(config LogFileConfig) (*rotatingFile, error) {
+		if config.Path == "" {
+			return nil, nil
+		}
+		file, err := openLogFile(config)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.files = append(l.files, file)
+		return file, nil
+	}
+
+	file, err := open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	accessFile, err := open(config.AccessFile)
+	if err != nil {
+		return nil, err
+	}
+	if l.auth, err = open(config.AuthFile); err != nil {
+		return nil, err
+	}
+	securityFile, err := open(config.SecurityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if file != nil {
+		log.SetOutput(file)
+	}
+	if accessFile != nil {
+		accessLogger = log.New(accessFile, log.Prefix(), log.Flags())
+	}
+	if securityFile != nil {
+		securityLog = securityFile
+	}
+	return l, nil
+}
+
+// AuthEvent writes an authentication to the auth log file
+func (l *logFiles) AuthEvent(event AuthEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if _, err := l.auth.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to write to the auth log file: %v", err)
+	}
+}
+
+// Close closes the log files, sending the logs back to the standard error
+func (l *logFiles) Close() {
+	log.SetOutput(os.Stderr)
+	accessLogger = nil
+	securityLog = nil
+	for _, file := range l.files {
+		file.Close()
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SMTP connection security modes
+const (
+	smtpSecurityStartTLS = "starttls"
+	smtpSecurityTLS      = "tls"
+	smtpSecurityNone     = "none"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// emailTemplates are the built-in messages. The subject is the first line and the body follows a blank line.
+var emailTemplates = map[string]string{
+	"test": `Test message from simple-wifi-radius-authenticator
+
+This is a test message. Email notifications are working.
+`,
+	"password-reset": `Reset your password
+
+A password reset was requested for {{.Username}}. Choose a new password with:
+
+    simple-wifi-radius-authenticator change-password -username {{.Username}} -token {{.Token}} -new <new password>
+
+The token can be used once until {{.Expires.Format "2006-01-02 15:04 MST"}}. Your current password keeps working, so ignore this message if you didn't ask for a reset.
+`,
+	"alert": `{{if eq .Event "unknown_mac"}}Unknown device{{else if eq .Event "honeypot"}}Honeypot probed by{{else}}Rejected device{{end}} {{.MAC}}
+
+{{.MAC}} was rejected {{.Count}} times in the last {{.Window}}{{if eq .Event "unknown_mac"}} because it is not a registered device{{else if eq .Event "honeypot"}} because it asked for a honeypot network{{end}}.
+
+Last request: {{.Time.Format "2006-01-02 15:04:05 MST"}} from {{.Client}}
+{{- if .SSIDs}}
+Networks: {{range $i, $ssid := .SSIDs}}{{if $i}}, {{end}}{{$ssid}}{{end}}
+{{- end}}
+{{- if .Quarantined}}
+
+The device has been moved into the quarantine group. Release it with "release -mac {{.MAC}}".
+{{- end}}
+`,
+	"roaming": `{{.MAC}} authenticated at two sites
+
+{{.MAC}} authenticated at {{.To.Site}} {{.Elapsed}} after authenticating at {{.From.Site}}, sooner than a device can travel between them. Another device may be using its MAC address.
+
+{{.From.Site}}: {{.From.Time.Format "2006-01-02 15:04:05 MST"}} from {{.From.Client}}{{if .From.SSID}} on {{.From.SSID}}{{end}}
+{{.To.Site}}: {{.To.Time.Format "2006-01-02 15:04:05 MST"}} from {{.To.Client}}{{if .To.SSID}} on {{.To.SSID}}{{end}}
+`,
+	"stale-devices": `{{len .Devices}} devices disabled
+
+These devices haven't been seen in {{.Days}} days and have been disabled. They keep their groups and can be enabled again with enable-device.
+{{range .Devices}}
+{{.MAC}}{{if .Name}} ({{.Name}}){{end}}, last seen {{.LastSeen}}
+{{- end}}
+`,
+	"sponsor-request": `{{.Guest}} asks for WiFi access
+
+{{.Guest}} registered the device {{.MAC}} and named you as their sponsor. Approving it allows the device on the network for {{.Duration}}.
+
+Approve: {{.ApproveURL}}
+Deny: {{.DenyURL}}
+
+The links can be used until {{.Expires.Format "2006-01-02 15:04 MST"}}.
+`,
+}
+
+// Mailer sends templated email messages through an SMTP server
+type Mailer struct {
+	config SMTPConfig
+}
+
+// NewMailer creates a Mailer, or returns nil if no SMTP server is configured
+func NewMailer(config SMTPConfig) *Mailer {
+	if config.Host == "" {
+		return nil
+	}
+	return &Mailer{config: config}
+}
+
+// Send renders a template with data and sends it to the recipients
+func (m *Mailer) Send(to []string, name string, data interface{}) error {
+	if m == nil {
+		return errors.New("no SMTP server is configured")
+	}
+	subject, body, err := m.render(name, data)
+	if err != nil {
+		return err
+	}
+	return m.send(to, m.message(to, subject, body))
+}
+
+// render executes a template, which can be replaced by <name>.tmpl in the template directory
+func (m *Mailer) render(name string, data interface{}) (string, string, error) {
+	text, ok := emailTemplates[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown email template %q", name)
+	}
+	if m.config.TemplateDir != "" {
+		custom, err := ioutil.ReadFile(filepath.Join(m.config.TemplateDir, name+".tmpl"))
+		if err == nil {
+			text = string(custom)
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", "", err
+	}
+
+	parts := strings.SplitN(rendered.String(), "\n\n", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("email template %q must start with a subject line followed by a blank line", name)
+	}
+	return strings.TrimSpace(parts[0]), parts[1], nil
+}
+
+// message builds a plain text message with the headers mail servers expect
+func (m *Mailer) message(to []string, subject, body string) []byte {
+	var id [16]byte
+	rand.Read(id[:])
+	domain := "localhost"
+	if i := strings.LastIndex(m.config.From, "@"); i != -1 {
+		domain = strings.TrimRight(m.config.From[i+1:], ">")
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", m.config.From)
+	fmt.Fprintf(&message, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%v@%v>\r\n", hex.EncodeToString(id[:]), domain)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return message.Bytes()
+}
+
+// send delivers a message over SMTP using the configured security mode
+func (m *Mailer) send(to []string, message []byte) error {
+	switch m.config.Security {
+	case smtpSecurityStartTLS, smtpSecurityTLS, smtpSecurityNone:
+	default:
+		return fmt.Errorf("unknown SMTP security %q", m.config.Security)
+	}
+	from, err := mail.ParseAddress(m.config.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %v", err)
+	}
+
+	addr := net.JoinHostPort(m.config.Host, fmt.Sprint(m.config.Port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	if m.config.Security == smtpSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.config.Security == smtpSecurityStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
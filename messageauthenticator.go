@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// messageAuthenticatorSum calculates the Message-Authenticator (RFC 2869 section 5.14) for a packet. The
+// attribute value is treated as zeroes and the Authenticator field holds the request authenticator, which
+// radius.Packet.Response copies into replies.
+func messageAuthenticatorSum(p *radius.Packet) ([]byte, error) {
+	packet := *p
+	packet.Attributes = make(radius.Attributes, len(p.Attributes))
+	for i, avp := range p.Attributes {
+		if avp.Type == rfc2869.MessageAuthenticator_Type {
+			avp = &radius.AVP{Type: avp.Type, Attribute: make(radius.Attribute, md5.Size)}
+		}
+		packet.Attributes[i] = avp
+	}
+
+	encoded, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+	// Encode fills in the response authenticator for replies, so put the request authenticator back
+	copy(encoded[4:20], p.Authenticator[:])
+
+	hash := hmac.New(md5.New, p.Secret)
+	hash.Write(encoded)
+	return hash.Sum(nil), nil
+}
+
+// verifyMessageAuthenticator reports whether the packet carries a Message-Authenticator and if it is valid
+func verifyMessageAuthenticator(p *radius.Packet) (present bool, valid bool) {
+	received, ok := p.Lookup(rfc2869.MessageAuthenticator_Type)
+	if !ok {
+		return false, false
+	}
+	if len(received) != md5.Size {
+		return true, false
+	}
+
+	expected, err := messageAuthenticatorSum(p)
+	return true, err == nil && hmac.Equal(received, expected)
+}
+
+// addMessageAuthenticator signs a reply with a Message-Authenticator placed as the first attribute, as
+// recommended for mitigating BlastRADIUS forgeries
+func addMessageAuthenticator(p *radius.Packet) error {
+	p.Del(rfc2869.MessageAuthenticator_Type)
+	avp := &radius.AVP{Type: rfc2869.MessageAuthenticator_Type, Attribute: make(radius.Attribute, md5.Size)}
+	p.Attributes = append(radius.Attributes{avp}, p.Attributes...)
+
+	sum, err := messageAuthenticatorSum(p)
+	if err != nil {
+		return err
+	}
+	copy(avp.Attribute, sum)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// rfc5997StatusServer is the Status-Server request of RFC 5997 section 6.1, signed with a Message-Authenticator
+// (RFC 2869 section 5.14, RFC 3579 section 3.2) using the secret "xyzzy5461"
+var rfc5997StatusServer = []byte{
+	0x0c, 0xda, 0x00, 0x26, 0x8a, 0x54, 0xf4, 0x68, 0x6f, 0xb3, 0x94, 0xc5, 0x28, 0x66, 0xe3, 0x02,
+	0x18, 0x5d, 0x06, 0x23, 0x50, 0x12, 0x5a, 0x66, 0x5e, 0x2e, 0x1e, 0x84, 0x11, 0xf3, 0xe2, 0x43,
+	0x82, 0x20, 0x97, 0xc8, 0x4f, 0xa3,
+}
+
+func TestVerifyMessageAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		modify  func(p *radius.Packet)
+		present bool
+		valid   bool
+	}{
+		{
+			name:    "RFC 5997 section 6.1",
+			secret:  "xyzzy5461",
+			present: true,
+			valid:   true,
+		},
+		{
+			name:    "wrong secret",
+			secret:  "xyzzy5462",
+			present: true,
+		},
+		{
+			name:   "attribute added after signing",
+			secret: "xyzzy5461",
+			modify: func(p *radius.Packet) {
+				rfc2865.UserName_SetString(p, "alice")
+			},
+			present: true,
+		},
+		{
+			name:   "authenticator changed",
+			secret: "xyzzy5461",
+			modify: func(p *radius.Packet) {
+				p.Authenticator[0] ^= 1
+			},
+			present: true,
+		},
+		{
+			name:   "truncated",
+			secret: "xyzzy5461",
+			modify: func(p *radius.Packet) {
+				p.Set(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size-1))
+			},
+			present: true,
+		},
+		{
+			name:   "missing",
+			secret: "xyzzy5461",
+			modify: func(p *radius.Packet) {
+				p.Del(rfc2869.MessageAuthenticator_Type)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := radius.Parse(rfc5997StatusServer, []byte(test.secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.modify != nil {
+				test.modify(p)
+			}
+
+			present, valid := verifyMessageAuthenticator(p)
+			if present != test.present || valid != test.valid {
+				t.Errorf("got present %v and valid %v, want %v and %v", present, valid, test.present, test.valid)
+			}
+		})
+	}
+}
+
+func TestMessageAuthenticatorSum(t *testing.T) {
+	p, err := radius.Parse(rfc5997StatusServer, []byte("xyzzy5461"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := messageAuthenticatorSum(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(sum), "5a665e2e1e8411f3e243822097c84fa3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAddMessageAuthenticator(t *testing.T) {
+	request, err := radius.Parse(rfc5997StatusServer, []byte("xyzzy5461"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := request.Response(radius.CodeAccessAccept)
+	rfc2865.ReplyMessage_SetString(response, "Welcome")
+	// A stale Message-Authenticator is replaced rather than added twice
+	response.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+
+	if err := addMessageAuthenticator(response); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(response.Attributes); n != 2 || response.Attributes[0].Type != rfc2869.MessageAuthenticator_Type {
+		t.Fatalf("got %d attributes with type %v first, want 2 with the Message-Authenticator first", n, response.Attributes[0].Type)
+	}
+
+	// RFC 3579 section 3.2: the HMAC-MD5 of the reply with the request authenticator and the attribute zeroed
+	encoded, err := response.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := append([]byte(nil), encoded...)
+	copy(signed[4:20], request.Authenticator[:])
+	copy(signed[22:38], make([]byte, md5.Size))
+	hash := hmac.New(md5.New, []byte("xyzzy5461"))
+	hash.Write(signed)
+	if want := hash.Sum(nil); !bytes.Equal(encoded[22:38], want) {
+		t.Errorf("got %x, want %x", encoded[22:38], want)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SchemaVersion records a migration applied to the database
+type SchemaVersion struct {
+	Version   uint `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName keeps the versions in the schema_version table
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// migration changes the schema or the data of the database from the previous version. down undoes up, or is
+// nil if the migration can't be undone.
+type migration struct {
+	version uint
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations are applied in order of version, each in its own transaction. Databases that already applied a
+// migration never run it again, so a change to the schema or data is a new migration appended with the next
+// version rather than an edit of an existing one. The first migration creates the tables of the current models,
+// so migrations adding a column with AutoMigrate do nothing on new databases.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create tables",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Device{}, &DeviceGroup{}, &Network{}, &Client{}, &User{}, &Certificate{}, &Credential{}, &ReplyProfile{},
+				&AuditLog{}, &AuthLog{}, &AccountingSession{}, &Voucher{}, &SponsorRequest{}, &AccessPoint{}).Error
+		},
+	},
+	{
+		version: 2,
+		name:    "normalize device MAC addresses",
+		up:      normalizeDeviceMACs,
+		// Earlier versions look devices up by the normalized address too, so there is nothing to undo
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 3,
+		name:    "add the trash for devices and device groups",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Device{}, &DeviceGroup{}).Error
+		},
+		// Earlier versions would see the devices and groups in the trash as active again
+		down: func(tx *gorm.DB) error {
+			count, err := countTrash(tx)
+			if err == nil && count > 0 {
+				err = fmt.Errorf("%d devices and groups are in the trash, restore or purge them first", count)
+			}
+			return err
+		},
+	},
+	{
+		version: 4,
+		name:    "add proposals for changes needing approval",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Proposal{}).Error
+		},
+		// Earlier versions would apply changes without approval, so pending proposals have to be decided first
+		down: func(tx *gorm.DB) error {
+			var pending int
+			if err := tx.Model(&Proposal{}).Where("decision = ?", "").Count(&pending).Error; err != nil {
+				return err
+			}
+			if pending > 0 {
+				return fmt.Errorf("%d proposals are pending, approve or reject them first", pending)
+			}
+			return tx.DropTableIfExists(&Proposal{}).Error
+		},
+	},
+	{
+		version: 5,
+		name:    "add honeypot networks",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Network{}).Error
+		},
+		// Earlier versions would let devices join the honeypots
+		down: func(tx *gorm.DB) error {
+			var honeypots int
+			if err := tx.Model(&Network{}).Where("honeypot = ?", true).Count(&honeypots).Error; err != nil {
+				return err
+			}
+			if honeypots > 0 {
+				return fmt.Errorf("%d networks are honeypots, change them with \"set-network -honeypot=false\" first", honeypots)
+			}
+			return nil
+		},
+	},
+	{
+		version: 6,
+		name:    "add group attributes",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&GroupAttribute{}).Error
+		},
+		// Earlier versions would leave the attributes out of the replies
+		down: func(tx *gorm.DB) error {
+			var attributes int
+			if err := tx.Model(&GroupAttribute{}).Count(&attributes).Error; err != nil {
+				return err
+			}
+			if attributes > 0 {
+				return fmt.Errorf("%d group attributes are set, remove them with remove-attribute first", attributes)
+			}
+			return tx.DropTableIfExists(&GroupAttribute{}).Error
+		},
+	},
+	{
+		version: 7,
+		name:    "add job locks and the change counter for several instances",
+		up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&JobLock{}, &ChangeCounter{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&ChangeCounter{ID: changeCounterID}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&JobLock{}, &ChangeCounter{}).Error
+		},
+	},
+	{
+		version: 8,
+		name:    "add the replication state",
+		up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&ReplicationState{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&ReplicationState{ID: replicationStateID}).Error
+		},
+		// Earlier versions would accept changes on a standby that the next pull throws away
+		down: func(tx *gorm.DB) error {
+			var state ReplicationState
+			if err := tx.First(&state, replicationStateID).Error; err != nil {
+				return err
+			}
+			if state.LastPulledAt != nil && state.PromotedAt == nil {
+				return errors.New("this instance is a standby, promote it first")
+			}
+			return tx.DropTableIfExists(&ReplicationState{}).Error
+		},
+	},
+	{
+		version: 9,
+		name:    "add event IDs to the auth log and accounting sessions",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&AuthLog{}, &AccountingSession{}).Error
+		},
+		// Earlier versions leave the column empty
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 10,
+		name:    "add private PSKs to devices",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Device{}).Error
+		},
+		// Earlier versions don't send the PSKs, so the devices can't connect to SSIDs with per-device PSKs
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 11,
+		name:    "add the unknown SSIDs",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&UnknownSSID{}).Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&UnknownSSID{}).Error
+		},
+	},
+	{
+		version: 12,
+		name:    "record the devices registered by quarantine",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Device{}).Error
+		},
+		// Earlier versions move every released device without other groups to the trash
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 13,
+		name:    "add password reset tokens",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&User{}).Error
+		},
+		// Earlier versions ignore the tokens, so clear them rather than leave them usable after upgrading again
+		down: func(tx *gorm.DB) error {
+			return tx.Model(&User{}).Updates(map[string]interface{}{"reset_token": nil, "reset_token_expires_at": nil}).Error
+		},
+	},
+	{
+		version: 14,
+		name:    "encrypt the secrets of proposals",
+		up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&Proposal{}).Error; err != nil {
+				return err
+			}
+			return redactProposalSecrets(tx)
+		},
+		// Earlier versions would run the redacted values, so reject the proposals with secrets
+		down: func(tx *gorm.DB) error {
+			return tx.Model(&Proposal{}).Where("decision = ? AND secrets IS NOT NULL", "").
+				Updates(map[string]interface{}{"decision": proposalRejected, "decided_by": auditSystemActor, "decided_at": time.Now(),
+					"error": "its secrets can't be decrypted by this version, propose it again"}).Error
+		},
+	},
+}
+
+// redactProposalSecrets removes the values of secret flags stored in the proposals before they were encrypted.
+// Nobody was given a key for them, so the pending proposals with secrets are rejected and have to be proposed again.
+func redactProposalSecrets(tx *gorm.DB) error {
+	var proposals []Proposal
+	if err := tx.Find(&proposals).Error; err != nil {
+		return err
+	}
+	for _, proposal := range proposals {
+		var args []string
+		if err := json.Unmarshal([]byte(proposal.Args), &args); err != nil {
+			continue
+		}
+		redacted, sealed, _, err := sealProposalSecrets(args)
+		if err != nil {
+			return err
+		}
+		if sealed == nil {
+			continue
+		}
+		encoded, err := json.Marshal(redacted)
+		if err != nil {
+			return err
+		}
+		changes := map[string]interface{}{"args": string(encoded)}
+		if proposal.Decision == "" {
+			changes["decision"] = proposalRejected
+			changes["decided_by"] = auditSystemActor
+			changes["decided_at"] = time.Now()
+			changes["error"] = "its secrets were removed when upgrading, propose it again"
+		}
+		if err := tx.Model(&proposal).UpdateColumns(changes).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeDeviceMACs rewrites the MAC addresses of devices entered with delimiters or in upper case, which never
+// matched a request, in the normalized form they are looked up by
+func normalizeDeviceMACs(tx *gorm.DB) error {
+	var devices []Device
+	if err := tx.Find(&devices).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, device := range devices {
+		existing[device.MAC] = true
+	}
+	for _, device := range devices {
+		mac := normalizeMACAddress(device.MAC)
+		if mac == device.MAC || (!isValidMACFormat(mac) && !isValidMACPattern(mac)) {
+			continue
+		}
+		if existing[mac] {
+			log.Printf("DATABASE: Not normalizing device %v, device %v already exists", device.MAC, mac)
+			continue
+		}
+		if err := tx.Model(&device).UpdateColumn("mac", mac).Error; err != nil {
+			return err
+		}
+		existing[mac] = true
+	}
+	return nil
+}
+
+// latestSchemaVersion is the version of the database after all the migrations are applied
+func latestSchemaVersion() uint {
+	return migrations[len(migrations)-1].version
+}
+
+// appliedSchemaVersions loads the versions of the migrations applied to the database
+func appliedSchemaVersions(db *gorm.DB) (map[uint]SchemaVersion, error) {
+	if err := db.AutoMigrate(&SchemaVersion{}).Error; err != nil {
+		return nil, err
+	}
+	var versions []SchemaVersion
+	if err := db.Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[uint]SchemaVersion)
+	for _, version := range versions {
+		applied[version.Version] = version
+	}
+	return applied, nil
+}
+
+// migrateDatabase applies the migrations the database is missing. A database migrated by a newer version of
+// the program is refused, since it may have columns or data this version doesn't know how to handle.
+func migrateDatabase(db *gorm.DB) error {
+	applied, err := appliedSchemaVersions(db)
+	if err != nil {
+		return err
+	}
+	for version := range applied {
+		if version > latestSchemaVersion() {
+			return fmt.Errorf("the database has schema version %d but this version of the program only supports up to %d, "+
+				"roll it back with \"migrate -to %d\" using the newer version", version, latestSchemaVersion(), latestSchemaVersion())
+		}
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		tx := db.Begin()
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%v) failed: %v", m.version, m.name, err)
+		}
+		if err := tx.Create(&SchemaVersion{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		log.Printf("DATABASE: Applied migration %d, %v", m.version, m.name)
+	}
+	return nil
+}
+
+// migrateCommand lists the migrations, or undoes those after a version before going back to an older version of
+// the program
+func migrateCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := flags.Int("to", -1, "undo the migrations after this version, or -1 to only list them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	applied, err := appliedSchemaVersions(db)
+	if err != nil {
+		return err
+	}
+	if *to < 0 {
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "VERSION\tNAME\tAPPLIED\tREVERSIBLE")
+		for _, m := range migrations {
+			appliedAt := "pending"
+			if version, ok := applied[m.version]; ok {
+				appliedAt = version.AppliedAt.Local().Format(time.RFC3339)
+			}
+			reversible := "yes"
+			if m.down == nil {
+				reversible = "no"
+			}
+			fmt.Fprintf(out, "%d\t%v\t%v\t%v\n", m.version, m.name, appliedAt, reversible)
+		}
+		return out.Flush()
+	}
+
+	target := uint(*to)
+	for i := len(migrations) - 1; i >= 0 && migrations[i].version > target; i-- {
+		if _, ok := applied[migrations[i].version]; ok && migrations[i].down == nil {
+			return fmt.Errorf("migration %d (%v) can't be undone", migrations[i].version, migrations[i].name)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0 && migrations[i].version > target; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		tx := db.Begin()
+		if err := m.down(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("undoing migration %d (%v) failed: %v", m.version, m.name, err)
+		}
+		if err := tx.Delete(&SchemaVersion{}, "version = ?", m.version).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		fmt.Printf("Undid migration %d, %v\n", m.version, m.name)
+	}
+	fmt.Printf("The database is at schema version %d, install a version of the program using it before starting the server again\n", target)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != uint(i+1) {
+			t.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+		if m.up == nil {
+			t.Errorf("migration %d has nothing to apply", m.version)
+		}
+	}
+	if latestSchemaVersion() != uint(len(migrations)) {
+		t.Errorf("got latest version %d", latestSchemaVersion())
+	}
+}
+
+// schemaVersions returns the versions applied to the database in order
+func schemaVersions(t *testing.T, db *gorm.DB) []uint {
+	t.Helper()
+	applied, err := appliedSchemaVersions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []uint
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	db := openTestDatabase(t)
+	versions := schemaVersions(t, db)
+	if len(versions) != len(migrations) || versions[len(versions)-1] != latestSchemaVersion() {
+		t.Fatalf("got versions %v", versions)
+	}
+
+	// Migrating again applies nothing
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if again := schemaVersions(t, db); len(again) != len(versions) {
+		t.Errorf("got versions %v", again)
+	}
+
+	// A database migrated by a newer version of the program is refused
+	if err := db.Create(&SchemaVersion{Version: latestSchemaVersion() + 1, AppliedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDatabase(db); err == nil {
+		t.Error("a newer schema version was accepted")
+	}
+}
+
+func TestNormalizeDeviceMACs(t *testing.T) {
+	db := openTestDatabase(t)
+	for _, mac := range []string{"00:11:22:33:44:55", "AA-BB-CC-DD-EE-FF", "aabbccddeeff", "00:11:22:*", "not a MAC"} {
+		if err := db.Exec("INSERT INTO devices (mac) VALUES (?)", mac).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := normalizeDeviceMACs(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var devices []Device
+	if err := db.Order("id").Find(&devices).Error; err != nil {
+		t.Fatal(err)
+	}
+	var macs []string
+	for _, device := range devices {
+		macs = append(macs, device.MAC)
+	}
+	// The address already registered in the normalized form is left alone, as is what isn't an address
+	want := []string{"001122334455", "AA-BB-CC-DD-EE-FF", "aabbccddeeff", "001122*", "not a MAC"}
+	if len(macs) != len(want) {
+		t.Fatalf("got %q", macs)
+	}
+	for i := range want {
+		if macs[i] != want[i] {
+			t.Errorf("got %q, want %q", macs, want)
+			break
+		}
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	db := openTestDatabase(t)
+	device := Device{MAC: "001122334455"}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateCommand(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if versions := schemaVersions(t, db); len(versions) != len(migrations) {
+		t.Errorf("listing the migrations changed the versions to %v", versions)
+	}
+
+	// The first migration can't be undone, so nothing is
+	if err := migrateCommand(db, []string{"-to", "0"}); err == nil {
+		t.Error("the tables were dropped")
+	}
+	if versions := schemaVersions(t, db); len(versions) != len(migrations) {
+		t.Errorf("got versions %v", versions)
+	}
+
+	// Undoing stops at the migration that refuses, keeping what was undone after it
+	if err := migrateCommand(db, []string{"-to", "1"}); err == nil {
+		t.Error("the trash was dropped while a device is in it")
+	}
+	if versions := schemaVersions(t, db); len(versions) != 3 || versions[2] != 3 {
+		t.Errorf("got versions %v", versions)
+	}
+	if db.HasTable(&Proposal{}) {
+		t.Error("the proposals of an undone migration are still there")
+	}
+
+	if _, _, err := purgeTrash(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateCommand(db, []string{"-to", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if versions := schemaVersions(t, db); len(versions) != 1 || versions[0] != 1 {
+		t.Errorf("got versions %v", versions)
+	}
+
+	// Upgrading again applies the undone migrations
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if versions := schemaVersions(t, db); len(versions) != len(migrations) {
+		t.Errorf("got versions %v", versions)
+	}
+	if !db.HasTable(&Proposal{}) || !db.HasTable(&GroupAttribute{}) {
+		t.Error("the tables of the migrations applied again are missing")
+	}
+}
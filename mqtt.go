@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPingReq    = 12
+	mqttDisconnect = 14
+)
+
+const (
+	mqttQueueSize = 1024
+	mqttTimeout   = 10 * time.Second
+	mqttKeepAlive = 60 * time.Second
+	// mqttMaxBackoff is the longest wait between attempts to reconnect to the broker
+	mqttMaxBackoff = 5 * time.Minute
+	// mqttMaxLength is the longest packet after its fixed header, whose length takes at most four bytes
+	mqttMaxLength = 268435455
+)
+
+// mqttTopicEscaper replaces the characters that can't be used in the parts of a topic
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// MQTTPublisher publishes authentication events to an MQTT broker with QoS 0. Events are published in the
+// background, and dropped while the broker is unreachable, so the RADIUS handler never waits on it.
+type MQTTPublisher struct {
+	config MQTTConfig
+	queue  chan mqttMessage
+	done   chan struct{}
+}
+
+// NewMQTTPublisher creates an MQTTPublisher and starts publishing, or returns nil if no broker is configured
+func NewMQTTPublisher(config MQTTConfig) *MQTTPublisher {
+	if config.Broker == "" {
+		return nil
+	}
+	p := &MQTTPublisher{
+		config: config,
+		queue:  make(chan mqttMessage, mqttQueueSize),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// AuthEvent publishes an authentication
+func (p *MQTTPublisher) AuthEvent(event AuthEvent) {
+	name := webhookEventAuthReject
+	if event.Accepted {
+		name = webhookEventAuthAccept
+	}
+	p.publish(name, event.MAC, event.SSID, event)
+}
+
+// publish queues an event for the topic built from its name, MAC address, and SSID
+func (p *MQTTPublisher) publish(name, mac, ssid string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("MQTT: Unable to encode %v event: %v", name, err)
+		return
+	}
+	topic := strings.NewReplacer(
+		"{event}", mqttTopicEscaper.Replace(name),
+		"{mac}", mqttTopicEscaper.Replace(mac),
+		"{ssid}", mqttTopicEscaper.Replace(ssid),
+	).Replace(p.config.Topic)
+	// The length of a topic takes two bytes
+	if len(topic) > 0xffff {
+		log.Printf("MQTT: Topic of %v event is too long, dropping it", name)
+		return
+	}
+
+	select {
+	case p.queue <- mqttMessage{topic: topic, payload: payload}:
+	default:
+		log.Printf("MQTT: Queue is full, dropping %v event", name)
+	}
+}
+
+// Stop publishes the queued events and disconnects from the broker
+func (p *MQTTPublisher) Stop() {
+	close(p.queue)
+	<-p.done
+}
+
+func (p *MQTTPublisher) run() {
+	defer close(p.done)
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+
+	var conn net.Conn
+	var closed chan struct{}
+	var retryAt time.Time
+	backoff := time.Second
+	disconnect := func() {
+		conn.Close()
+		conn = nil
+		closed = nil
+	}
+
+	for {
+		select {
+		case message, ok := <-p.queue:
+			if !ok {
+				if conn != nil {
+					p.write(conn, mqttDisconnect<<4, nil)
+					disconnect()
+				}
+				return
+			}
+
+			if conn == nil {
+				if time.Now().Before(retryAt) {
+					continue
+				}
+				var err error
+				if conn, err = p.connect(); err != nil {
+					log.Printf("MQTT: Unable to connect to %v, retrying in %v: %v", p.config.Broker, backoff, err)
+					retryAt = time.Now().Add(backoff)
+					if backoff *= 2; backoff > mqttMaxBackoff {
+						backoff = mqttMaxBackoff
+					}
+					continue
+				}
+				log.Printf("MQTT: Connected to %v", p.config.Broker)
+				backoff = time.Second
+				closed = make(chan struct{})
+				go mqttDiscard(conn, closed)
+			}
+
+			var body []byte
+			body = mqttAppendString(body, message.topic)
+			body = append(body, message.payload...)
+			if err := p.write(conn, mqttPublish<<4, body); err != nil {
+				log.Printf("MQTT: Unable to publish to %v: %v", p.config.Broker, err)
+				disconnect()
+			}
+		case <-ping.C:
+			if conn != nil {
+				if err := p.write(conn, mqttPingReq<<4, nil); err != nil {
+					log.Printf("MQTT: Lost connection to %v: %v", p.config.Broker, err)
+					disconnect()
+				}
+			}
+		case <-closed:
+			log.Printf("MQTT: Broker %v closed the connection", p.config.Broker)
+			disconnect()
+		}
+	}
+}
+
+// connect opens a connection to the broker and logs in
+func (p *MQTTPublisher) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if p.config.TLS {
+		host, _, _ := net.SplitHostPort(p.config.Broker)
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.config.Broker, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", p.config.Broker)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Protocol name and level of MQTT 3.1.1, a clean session, and the credentials
+	body := mqttAppendString(nil, "MQTT")
+	flags := byte(0x02)
+	if p.config.Username != "" {
+		flags |= 0x80
+		if p.config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(mqttKeepAlive/time.Second))
+	body = mqttAppendString(body, p.config.ClientID)
+	if flags&0x80 != 0 {
+		body = mqttAppendString(body, p.config.Username)
+	}
+	if flags&0x40 != 0 {
+		body = mqttAppendString(body, p.config.Password)
+	}
+	if err := p.write(conn, mqttConnect<<4, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if ack[0]>>4 != mqttConnAck || ack[1] != 2 {
+		conn.Close()
+		return nil, errors.New("unexpected reply from broker")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused the connection with code %d", ack[3])
+	}
+	return conn, nil
+}
+
+// write sends a control packet with its remaining length
+func (p *MQTTPublisher) write(conn net.Conn, header byte, body []byte) error {
+	length, err := mqttRemainingLength(len(body))
+	if err != nil {
+		return err
+	}
+	packet := append([]byte{header}, length...)
+	packet = append(packet, body...)
+
+	conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err = conn.Write(packet)
+	return err
+}
+
+// mqttRemainingLength encodes the length of a packet after its fixed header, seven bits per byte
+func mqttRemainingLength(length int) ([]byte, error) {
+	if length > mqttMaxLength {
+		return nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	var encoded []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			return encoded, nil
+		}
+	}
+}
+
+// mqttAppendString appends a length prefixed UTF-8 string
+func mqttAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttDiscard reads and ignores what the broker sends, such as ping responses, and closes closed when the
+// connection is lost
+func mqttDiscard(conn net.Conn, closed chan struct{}) {
+	io.Copy(ioutil.Discard, conn)
+	close(closed)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+	// The examples of section 2.2.3 of MQTT 3.1.1
+	tests := []struct {
+		length  int
+		encoded string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{128, "8001"},
+		{16383, "ff7f"},
+		{16384, "808001"},
+		{2097151, "ffff7f"},
+		{2097152, "80808001"},
+		{268435455, "ffffff7f"},
+	}
+	for _, test := range tests {
+		encoded, err := mqttRemainingLength(test.length)
+		if err != nil || hex.EncodeToString(encoded) != test.encoded {
+			t.Errorf("%d: got %x, %v, want %v", test.length, encoded, err, test.encoded)
+		}
+	}
+	if encoded, err := mqttRemainingLength(mqttMaxLength + 1); err == nil {
+		t.Errorf("a packet longer than the maximum got length %x", encoded)
+	}
+}
+
+// mqttBroker accepts one connection, checks the CONNECT packet, and answers it with reply. What the client sends
+// after it is sent to received once the client disconnects.
+func mqttBroker(t *testing.T, want, reply string, received chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		connect := make([]byte, len(want)/2)
+		if _, err := io.ReadFull(conn, connect); err != nil {
+			t.Error(err)
+			return
+		}
+		if hex.EncodeToString(connect) != want {
+			t.Errorf("got CONNECT %x, want %v", connect, want)
+		}
+		conn.Write(decodeHex(t, reply))
+		if received != nil {
+			rest, _ := ioutil.ReadAll(conn)
+			received <- hex.EncodeToString(rest)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestMQTTConnect(t *testing.T) {
+	// MQTT 3.1.1 with a clean session, a username and password, and a keep alive of 60 seconds
+	connect := "1013" + "00044d515454" + "04" + "c2" + "003c" + "000163" + "000175" + "000170"
+	anonymous := "100d" + "00044d515454" + "04" + "02" + "003c" + "000163"
+
+	tests := []struct {
+		name    string
+		config  MQTTConfig
+		connect string
+		reply   string
+		err     string
+	}{
+		{"accepted", MQTTConfig{ClientID: "c", Username: "u", Password: "p"}, connect, "20020000", ""},
+		{"anonymous", MQTTConfig{ClientID: "c"}, anonymous, "20020000", ""},
+		{"refused", MQTTConfig{ClientID: "c"}, anonymous, "20020005", "broker refused the connection with code 5"},
+		{"not a CONNACK", MQTTConfig{ClientID: "c"}, anonymous, "30020000", "unexpected reply from broker"},
+		{"longer CONNACK", MQTTConfig{ClientID: "c"}, anonymous, "2003000000", "unexpected reply from broker"},
+		{"truncated CONNACK", MQTTConfig{ClientID: "c"}, anonymous, "2002", "EOF"},
+		{"no reply", MQTTConfig{ClientID: "c"}, anonymous, "", "EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Broker = mqttBroker(t, test.connect, test.reply, nil)
+			p := &MQTTPublisher{config: test.config}
+			conn, err := p.connect()
+			if conn != nil {
+				conn.Close()
+			}
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if !strings.HasSuffix(got, test.err) || (got == "") != (test.err == "") {
+				t.Errorf("got %q, want %q", got, test.err)
+			}
+		})
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	received := make(chan string, 1)
+	broker := mqttBroker(t, "100d"+"00044d515454"+"04"+"02"+"003c"+"000163", "20020000", received)
+	p := NewMQTTPublisher(MQTTConfig{Broker: broker, ClientID: "c", Topic: "wifi/{event}/{ssid}"})
+	p.publish("auth.accept", "001122334455", "Guest/5+#", map[string]string{"a": "b"})
+	p.Stop()
+
+	// A PUBLISH with QoS 0 to wifi/auth.accept/Guest_5__, then a DISCONNECT
+	topic := "wifi/auth.accept/Guest_5__"
+	payload := `{"a":"b"}`
+	want := "3025" + "001a" + hex.EncodeToString([]byte(topic)) + hex.EncodeToString([]byte(payload)) + "e000"
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the broker received nothing")
+	}
+}
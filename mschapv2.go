@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/des"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// MS-CHAPv2 magic constants for the authenticator response (RFC 2759 section 8.7)
+var (
+	mschapv2Magic1 = []byte("Magic server to client signing constant")
+	mschapv2Magic2 = []byte("Pad to make it do more than one iteration")
+)
+
+// ntPasswordHash is the MD4 hash of the UTF-16LE password, which is all MS-CHAPv2 needs to verify a user
+func ntPasswordHash(password string) []byte {
+	encoded := utf16.Encode([]rune(password))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		b[2*i] = byte(r)
+		b[2*i+1] = byte(r >> 8)
+	}
+
+	hash := md4.New()
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+// mschapv2ChallengeHash combines the challenges and the user name without any domain prefix
+func mschapv2ChallengeHash(peerChallenge, authenticatorChallenge []byte, username string) []byte {
+	if i := strings.LastIndex(username, `\`); i != -1 {
+		username = username[i+1:]
+	}
+
+	hash := sha1.New()
+	hash.Write(peerChallenge)
+	hash.Write(authenticatorChallenge)
+	hash.Write([]byte(username))
+	return hash.Sum(nil)[:8]
+}
+
+// mschapv2NTResponse calculates the response the peer should have sent for the password hash
+func mschapv2NTResponse(authenticatorChallenge, peerChallenge []byte, username string, passwordHash []byte) []byte {
+	challenge := mschapv2ChallengeHash(peerChallenge, authenticatorChallenge, username)
+
+	// The 16 byte hash is zero padded and split into three DES keys
+	key := make([]byte, 21)
+	copy(key, passwordHash)
+
+	response := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		block, err := des.NewCipher(expandDESKey(key[7*i : 7*i+7]))
+		if err != nil {
+			panic(err)
+		}
+		block.Encrypt(response[8*i:8*i+8], challenge)
+	}
+	return response
+}
+
+// mschapv2AuthenticatorResponse calculates the "S=" value that proves to the peer we know its password
+func mschapv2AuthenticatorResponse(passwordHash, ntResponse, peerChallenge, authenticatorChallenge []byte, username string) string {
+	hash := md4.New()
+	hash.Write(passwordHash)
+	passwordHashHash := hash.Sum(nil)
+
+	digest := sha1.New()
+	digest.Write(passwordHashHash)
+	digest.Write(ntResponse)
+	digest.Write(mschapv2Magic1)
+	intermediate := digest.Sum(nil)
+
+	digest = sha1.New()
+	digest.Write(intermediate)
+	digest.Write(mschapv2ChallengeHash(peerChallenge, authenticatorChallenge, username))
+	digest.Write(mschapv2Magic2)
+
+	return "S=" + strings.ToUpper(hex.EncodeToString(digest.Sum(nil)))
+}
+
+// expandDESKey spreads 56 key bits across 8 bytes, leaving room for the parity bits DES ignores
+func expandDESKey(key []byte) []byte {
+	return []byte{
+		key[0] & 0xfe,
+		key[0]<<7 | key[1]>>1,
+		key[1]<<6 | key[2]>>2,
+		key[2]<<5 | key[3]>>3,
+		key[3]<<4 | key[4]>>4,
+		key[4]<<3 | key[5]>>5,
+		key[5]<<2 | key[6]>>6,
+		key[6] << 1,
+	}
+}
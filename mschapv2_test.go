@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The values of the MS-CHAPv2 example in RFC 2759 section 9.2
+const (
+	rfc2759Password               = "clientPass"
+	rfc2759AuthenticatorChallenge = "5b5d7c7d7b3f2f3e3c2c602132262628"
+	rfc2759PeerChallenge          = "21402324255e262a28295f2b3a337c7e"
+	rfc2759Challenge              = "d02e4386bce91226"
+	rfc2759PasswordHash           = "44ebba8d5312b8d611474411f56989ae"
+	rfc2759NTResponse             = "82309ecd8d708b5ea08faa3981cd83544233114a3d85d6df"
+	rfc2759AuthenticatorResponse  = "S=407A5589115FD0D6209F510FE9C04566932CDA56"
+)
+
+func TestNTPasswordHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"RFC 2759 section 9.2", rfc2759Password, rfc2759PasswordHash},
+		{"empty", "", "31d6cfe0d16ae931b73c59d7e0c089c0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hex.EncodeToString(ntPasswordHash(test.password)); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMSCHAPv2(t *testing.T) {
+	authenticatorChallenge := decodeHex(t, rfc2759AuthenticatorChallenge)
+	peerChallenge := decodeHex(t, rfc2759PeerChallenge)
+	passwordHash := decodeHex(t, rfc2759PasswordHash)
+
+	// Windows peers send the user name with the domain, which isn't part of the challenge hash
+	for _, username := range []string{"User", `EXAMPLE\User`} {
+		t.Run(username, func(t *testing.T) {
+			challenge := mschapv2ChallengeHash(peerChallenge, authenticatorChallenge, username)
+			if got := hex.EncodeToString(challenge); got != rfc2759Challenge {
+				t.Errorf("got challenge %v, want %v", got, rfc2759Challenge)
+			}
+
+			ntResponse := mschapv2NTResponse(authenticatorChallenge, peerChallenge, username, passwordHash)
+			if got := hex.EncodeToString(ntResponse); got != rfc2759NTResponse {
+				t.Errorf("got NT-Response %v, want %v", got, rfc2759NTResponse)
+			}
+
+			response := mschapv2AuthenticatorResponse(passwordHash, ntResponse, peerChallenge, authenticatorChallenge, username)
+			if response != rfc2759AuthenticatorResponse {
+				t.Errorf("got authenticator response %v, want %v", response, rfc2759AuthenticatorResponse)
+			}
+		})
+	}
+}
+
+func TestMSCHAPv2WrongPassword(t *testing.T) {
+	authenticatorChallenge := decodeHex(t, rfc2759AuthenticatorChallenge)
+	peerChallenge := decodeHex(t, rfc2759PeerChallenge)
+
+	ntResponse := mschapv2NTResponse(authenticatorChallenge, peerChallenge, "User", ntPasswordHash("serverPass"))
+	if bytes.Equal(ntResponse, decodeHex(t, rfc2759NTResponse)) {
+		t.Error("a different password gave the same NT-Response")
+	}
+}
+
+func TestExpandDESKey(t *testing.T) {
+	// Each group of 7 bits of the first 7 bytes of the RFC 2759 section 9.2 password hash. DES ignores the lowest
+	// bit of each byte, so it isn't compared.
+	got := expandDESKey(decodeHex(t, rfc2759PasswordHash)[:7])
+	for i := range got {
+		got[i] &= 0xfe
+	}
+	if want := decodeHex(t, "4474ee50d4984a70"); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
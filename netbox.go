@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const netboxTimeout = 30 * time.Second
+
+// NetBoxConfig stores how to reach NetBox, whose interfaces with a tag are synced into a device group
+type NetBoxConfig struct {
+	// URL is the address of NetBox, such as "https://netbox.example.com", or empty to not sync devices
+	URL string `json:"url"`
+	// Token is an API token, which needs write permission on interfaces to push the names back
+	Token string `json:"token"`
+	// Tag is the slug of the tag marking the interfaces of devices allowed on the WiFi
+	Tag string `json:"tag"`
+	// Group is the device group the devices are synced into. Devices in it whose interfaces no longer have the tag
+	// are removed from it.
+	Group string `json:"group"`
+	// PushNames writes the names of the devices to the descriptions of their interfaces in NetBox
+	PushNames bool `json:"push_names"`
+	// Interval is how often the devices are synced, or 0 to only sync them with the netbox-sync command
+	Interval Duration `json:"interval"`
+}
+
+// validate checks the settings before connecting
+func (c NetBoxConfig) validate() error {
+	parsed, err := url.Parse(c.URL)
+	switch {
+	case err != nil || parsed.Scheme != "https" || parsed.Host == "":
+		return fmt.Errorf("invalid NetBox URL %q", c.URL)
+	case c.Token == "":
+		return errors.New("netbox.token is required")
+	case c.Tag == "":
+		return errors.New("netbox.tag is required")
+	case c.Group == "":
+		return errors.New("netbox.group is required")
+	case c.Interval.Duration < 0:
+		return errors.New("netbox.interval can't be negative")
+	}
+	return nil
+}
+
+// netboxInterface is an interface of a device in NetBox
+type netboxInterface struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Device      struct {
+		Name string `json:"name"`
+	} `json:"device"`
+	// MACAddress is the MAC address before NetBox 4.2, which moved it to PrimaryMACAddress
+	MACAddress        string `json:"mac_address"`
+	PrimaryMACAddress *struct {
+		MACAddress string `json:"mac_address"`
+	} `json:"primary_mac_address"`
+}
+
+// mac returns the normalized MAC address of the interface, whichever version of NetBox it came from
+func (i netboxInterface) mac() string {
+	mac := i.MACAddress
+	if i.PrimaryMACAddress != nil && i.PrimaryMACAddress.MACAddress != "" {
+		mac = i.PrimaryMACAddress.MACAddress
+	}
+	return normalizeMACAddress(mac)
+}
+
+// netboxClient talks to the REST API of NetBox
+type netboxClient struct {
+	config NetBoxConfig
+	client *http.Client
+}
+
+func newNetBoxClient(config NetBoxConfig) *netboxClient {
+	return &netboxClient{config: config, client: &http.Client{Timeout: netboxTimeout}}
+}
+
+// request sends a request with the API token, decoding the JSON response into result if it isn't nil
+func (c *netboxClient) request(method, address string, body interface{}, result interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, address, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Token "+c.config.Token)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("NetBox answered %v to %v %v", response.Status, method, request.URL.Path)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// interfaces lists the interfaces with the tag, following the pages of the results
+func (c *netboxClient) interfaces() ([]netboxInterface, error) {
+	query := url.Values{"tag": {c.config.Tag}, "limit": {"1000"}}
+	next := strings.TrimSuffix(c.config.URL, "/") + "/api/dcim/interfaces/?" + query.Encode()
+	var interfaces []netboxInterface
+	for next != "" {
+		var page struct {
+			Next    *string           `json:"next"`
+			Results []netboxInterface `json:"results"`
+		}
+		if err := c.request(http.MethodGet, next, nil, &page); err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, page.Results...)
+		next = ""
+		if page.Next != nil {
+			next = *page.Next
+		}
+	}
+	return interfaces, nil
+}
+
+// setDescription changes the description of an interface
+func (c *netboxClient) setDescription(id int, description string) error {
+	address := fmt.Sprintf("%v/api/dcim/interfaces/%d/", strings.TrimSuffix(c.config.URL, "/"), id)
+	return c.request(http.MethodPatch, address, map[string]string{"description": description}, nil)
+}
+
+// syncNetBoxDevices syncs the MAC addresses of the tagged interfaces into the group, named after their NetBox
+// device, and then pushes the names of the registered devices back to the descriptions of their interfaces if
+// PushNames is set
+func syncNetBoxDevices(db *gorm.DB, config NetBoxConfig, approval ApprovalConfig, dryRun bool, report func(change string)) error {
+	client := newNetBoxClient(config)
+	var interfaces []netboxInterface
+	load := func() (map[string]string, error) {
+		var err error
+		if interfaces, err = client.interfaces(); err != nil {
+			return nil, err
+		}
+		found := make(map[string]string)
+		for _, i := range interfaces {
+			if mac := i.mac(); isValidMACFormat(mac) {
+				found[mac] = i.Device.Name
+			}
+		}
+		return found, nil
+	}
+	if err := syncGroupDevices(db, config.Group, approval, "NetBox", load, dryRun, report); err != nil {
+		return err
+	}
+	if !config.PushNames {
+		return nil
+	}
+
+	sort.Slice(interfaces, func(a, b int) bool { return interfaces[a].ID < interfaces[b].ID })
+	for _, i := range interfaces {
+		mac := i.mac()
+		if !isValidMACFormat(mac) {
+			continue
+		}
+		var device Device
+		if db.First(&device, "MAC = ?", mac).RecordNotFound() || device.Name == "" || device.Name == i.Description {
+			continue
+		}
+		report(fmt.Sprintf("Setting the description of %v %v in NetBox to %q", i.Device.Name, i.Name, device.Name))
+		if dryRun {
+			continue
+		}
+		if err := client.setDescription(i.ID, device.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewNetBoxSync checks the configuration and creates a DeviceSync syncing the devices with NetBox
+func NewNetBoxSync(config NetBoxConfig, approval ApprovalConfig, db *gorm.DB) (*DeviceSync, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &DeviceSync{
+		DB:       db,
+		Name:     "NETBOX",
+		Actor:    "netbox-sync",
+		Interval: config.Interval.Duration,
+		Sync: func(db *gorm.DB, report func(change string)) error {
+			return syncNetBoxDevices(db, config, approval, false, report)
+		},
+	}, nil
+}
+
+// netboxSyncCommand syncs the devices with NetBox right away, or shows what would change
+func netboxSyncCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("netbox-sync", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only show the changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.NetBox.URL == "" {
+		return errors.New("no NetBox is configured")
+	}
+	if err := config.NetBox.validate(); err != nil {
+		return err
+	}
+
+	changes := 0
+	err := syncNetBoxDevices(db, config.NetBox, config.Approval, *dryRun, func(change string) {
+		fmt.Println(change)
+		changes++
+	})
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		fmt.Println("The devices are up to date")
+	}
+	return nil
+}
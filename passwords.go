@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+
+	argon2 "github.com/andskur/argon2-hashing"
+)
+
+// hashPassword hashes an administrative user password with argon2id
+func hashPassword(password string) ([]byte, error) {
+	return argon2.GenerateFromPassword([]byte(password), argon2.DefaultParams)
+}
+
+// checkPassword reports if password matches the stored hash of a user
+func checkPassword(user User, password string) bool {
+	return argon2.CompareHashAndPassword(user.Password, []byte(password)) == nil
+}
+
+// passwordClasses is the number of character classes a password can use: lowercase letters, uppercase letters,
+// digits, and symbols
+const passwordClasses = 4
+
+// validate checks the password policy read from the configuration file, as a policy no password can follow would
+// lock out every user
+func (c PasswordPolicyConfig) validate() error {
+	if c.MinClasses < 0 || c.MinClasses > passwordClasses {
+		return fmt.Errorf("password_policy.min_classes must be between 0 and %d", passwordClasses)
+	}
+	if c.MinLength <= 0 {
+		return fmt.Errorf("password_policy.min_length must be positive")
+	}
+	if c.MinLength < c.MinClasses {
+		return fmt.Errorf("password_policy.min_length must be at least password_policy.min_classes")
+	}
+	return nil
+}
+
+// Check verifies a new password follows the policy
+func (c PasswordPolicyConfig) Check(username, password string) error {
+	if len([]rune(password)) < c.MinLength {
+		return fmt.Errorf("the password must be at least %d characters", c.MinLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, used := range []bool{lower, upper, digit, symbol} {
+		if used {
+			classes++
+		}
+	}
+	if classes < c.MinClasses {
+		return fmt.Errorf("the password must use at least %d of lowercase letters, uppercase letters, digits, and symbols", c.MinClasses)
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return fmt.Errorf("the password must not contain the username")
+	}
+	return nil
+}
+
+// passwordResetTokenSize is the number of random bytes in a password reset token
+const passwordResetTokenSize = 16
+
+// generateResetToken creates a random password reset token, returning it and the hash that is stored instead
+func generateResetToken() (string, []byte, error) {
+	random := make([]byte, passwordResetTokenSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(random)
+	return token, hashResetToken(token), nil
+}
+
+// hashResetToken hashes a password reset token. Tokens are random, so unlike passwords they don't need a slow hash.
+func hashResetToken(token string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(token))))
+	return hash[:]
+}
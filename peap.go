@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Inner EAP types used inside the PEAP tunnel
+const (
+	eapTypeMSCHAPv2 = 26
+	eapTypeTLV      = 33
+)
+
+// MS-CHAPv2 op codes
+const (
+	mschapv2OpChallenge = 1
+	mschapv2OpResponse  = 2
+	mschapv2OpSuccess   = 3
+)
+
+// EAP-TLV result (draft-josefsson-pppext-eap-tls-eap)
+const (
+	tlvMandatory     = 0x8000
+	tlvTypeResult    = 3
+	tlvResultSuccess = 1
+)
+
+// PEAP phase 2 states
+const (
+	peapStateIdentity = iota
+	peapStateChallenge
+	peapStateSuccess
+	peapStateResult
+)
+
+const (
+	mschapv2ChallengeLength = 16
+	mschapv2ResponseLength  = 49
+	mschapv2ServerName      = "simple-wifi-radius-authenticator"
+)
+
+// peapSession tracks the inner MS-CHAPv2 authentication of a PEAP conversation
+type peapSession struct {
+	state      int
+	username   string
+	credential Credential
+	found      bool
+	challenge  []byte
+	mschapID   byte
+}
+
+// peapHandler handles decrypted phase 2 messages, or starts phase 2 when plaintext is nil
+func (rs *RadiusServer) peapHandler(w radius.ResponseWriter, r *radius.Request, session *eapSession, request *eapPacket, plaintext []byte, requestedSSID string) {
+	p := session.peap
+	if p == nil {
+		session.peap = &peapSession{state: peapStateIdentity}
+		rs.peapSend(w, r, session, request, eapTypeIdentity, nil)
+		return
+	}
+
+	inner, err := parsePEAPInnerPacket(plaintext, request.Identifier)
+	if err != nil {
+		requestLogf(r, "Invalid PEAP message from %q: %v", session.identity, err)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	switch {
+	case p.state == peapStateIdentity && inner.Type == eapTypeIdentity:
+		// Give up on the request if the database doesn't answer in time
+		db, cancel := rs.requestDB(r.Context())
+		defer cancel()
+		username := string(inner.Data)
+		var credential Credential
+		var found bool
+		lookup := func() {
+			found = !db.Preload("Device").Preload("Device.DeviceGroups").Preload("Device.DeviceGroups.Networks").Preload("Device.DeviceGroups.ReplyProfile").Preload("Device.DeviceGroups.Attributes").
+				Preload("DeviceGroups").Preload("DeviceGroups.Networks").Preload("DeviceGroups.ReplyProfile").Preload("DeviceGroups.Attributes").First(&credential, "username = ?", username).RecordNotFound()
+		}
+		if !rs.timedLookup(db, r.RemoteAddr, lookup) {
+			return
+		}
+		p.username, p.credential, p.found = username, credential, found
+
+		// Challenge unknown users as well so they can't be told apart from a wrong password
+		p.challenge = make([]byte, mschapv2ChallengeLength)
+		if _, err := rand.Read(p.challenge); err != nil {
+			rs.EAP.endSession(session)
+			rs.eapFailure(w, r, request.Identifier, "")
+			return
+		}
+		p.mschapID = session.identifier + 1
+		p.state = peapStateChallenge
+
+		data := append([]byte{mschapv2ChallengeLength}, p.challenge...)
+		data = append(data, mschapv2ServerName...)
+		rs.peapSend(w, r, session, request, eapTypeMSCHAPv2, newMSCHAPv2Message(mschapv2OpChallenge, p.mschapID, data))
+
+	case p.state == peapStateChallenge && inner.Type == eapTypeMSCHAPv2:
+		authenticatorResponse, err := p.verifyResponse(inner.Data)
+		if err != nil {
+			requestLogf(r, "PEAP authentication for %q failed: %v", p.username, err)
+			reason := authReasonWrongPassword
+			if !p.found {
+				reason = authReasonUnknownUser
+			}
+			rs.authEvent(r, AuthEvent{Method: authMethodPEAP, Username: p.username, SSID: requestedSSID, Reason: reason})
+			rs.EAP.endSession(session)
+			rs.eapFailure(w, r, request.Identifier, reason)
+			return
+		}
+		p.state = peapStateSuccess
+		message := authenticatorResponse + " M=Authentication succeeded"
+		rs.peapSend(w, r, session, request, eapTypeMSCHAPv2, newMSCHAPv2Message(mschapv2OpSuccess, p.mschapID, []byte(message)))
+
+	case p.state == peapStateSuccess && inner.Type == eapTypeMSCHAPv2 && len(inner.Data) > 0 && inner.Data[0] == mschapv2OpSuccess:
+		p.state = peapStateResult
+		rs.peapSend(w, r, session, request, eapTypeTLV, newTLVResult(tlvResultSuccess))
+
+	case p.state == peapStateResult && inner.Type == eapTypeTLV:
+		rs.peapComplete(w, r, session, request, inner.Data, requestedSSID)
+
+	default:
+		requestLogf(r, "Unexpected PEAP message type %v from %q", inner.Type, session.identity)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+	}
+}
+
+// peapComplete authorizes the credential once the peer has acknowledged the successful result
+func (rs *RadiusServer) peapComplete(w radius.ResponseWriter, r *radius.Request, session *eapSession, request *eapPacket, result []byte, requestedSSID string) {
+	defer rs.EAP.endSession(session)
+	p := session.peap
+	event := AuthEvent{Method: authMethodPEAP, Username: p.username, SSID: requestedSSID}
+
+	if len(result) < 6 || binary.BigEndian.Uint16(result[0:2])&^tlvMandatory != tlvTypeResult || binary.BigEndian.Uint16(result[4:6]) != tlvResultSuccess {
+		requestLogf(r, "PEAP peer %q did not acknowledge the result", p.username)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	reject := func(reason string) {
+		event.Reason = reason
+		rs.authEvent(r, event)
+		rs.eapFailure(w, r, request.Identifier, event.Reason)
+	}
+
+	// Credentials tied to a device may only be used by that device and use its groups
+	groups := p.credential.DeviceGroups
+	device := p.credential.Device
+	if device != nil {
+		if mac := normalizeMACAddress(rfc2865.CallingStationID_GetString(r.Packet)); mac != device.MAC {
+			requestLogf(r, "PEAP credential %q is not assigned to %v", p.username, prettyPrintMACAddress(mac))
+			reject(authReasonWrongDevice)
+			return
+		}
+		groups = device.DeviceGroups
+	}
+
+	// Give up on the request if the database doesn't answer its lookups in time
+	db, cancel := rs.requestDB(r.Context())
+	defer cancel()
+	var access NetworkAccess
+	lookup := func() {
+		groups = inheritGroups(db, rs.quarantineGroups(groups))
+		access = rs.networkAccess(db, requestedSSID)
+	}
+	if !rs.timedLookup(db, r.RemoteAddr, lookup) {
+		return
+	}
+
+	// Decide as MAC authentication does, with the credential as the registration: its groups or those of its
+	// device, or else the access of the network
+	registered := device == nil || (!device.Disabled && !device.expired(time.Now()))
+	switch {
+	case registered:
+		limitGroups := groups
+		if !groupsAllowSSID(groups, requestedSSID) {
+			if access < NetworkAccessKnownDevices {
+				requestLogf(r, "%q received %v for %v using PEAP", p.username, radius.CodeAccessReject, requestedSSID)
+				reject(authReasonSSIDNotAllowed)
+				return
+			}
+			// The network accepts the credential, without the reply attributes of its groups
+			groups = nil
+		}
+		var limited bool
+		if device != nil {
+			nas := addrIP(r.RemoteAddr).String()
+			if !rs.timedLookup(db, r.RemoteAddr, func() { limited = rs.sessionLimitReached(db, nas, device.MAC, *device, limitGroups, requestedSSID) }) {
+				return
+			}
+		}
+		if limited {
+			reject(authReasonSessionLimit)
+			return
+		}
+	// Credentials of devices that are disabled or expired are rejected, even on open networks
+	case device.Disabled:
+		requestLogf(r, "PEAP credential %q belongs to %v, which is disabled", p.username, prettyPrintMACAddress(device.MAC))
+		reject(authReasonDisabled)
+		return
+	default:
+		requestLogf(r, "PEAP credential %q belongs to %v, whose registration has expired", p.username, prettyPrintMACAddress(device.MAC))
+		reject(authReasonExpired)
+		return
+	}
+
+	state := session.tls.tls.ConnectionState()
+	msk, err := eapTLSMasterSessionKey(state)
+	if err != nil {
+		requestLogf(r, "Unable to derive PEAP keys for %q: %v", p.username, err)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+
+	requestLogf(r, "%q received %v for %v using PEAP", p.username, radius.CodeAccessAccept, requestedSSID)
+	event.Accepted = true
+	rs.authEvent(r, event)
+	if device != nil && registered {
+		rs.deviceSeen(*device)
+	}
+	rs.eapSuccess(w, r, request.Identifier, msk, groups, requestedSSID)
+}
+
+// verifyResponse checks an MS-CHAPv2 response against the stored password hash and returns the authenticator response
+func (p *peapSession) verifyResponse(data []byte) (string, error) {
+	// Op-Code, MS-CHAPv2-ID, MS-Length, Value-Size, Response, Name
+	if len(data) < 5+mschapv2ResponseLength || data[0] != mschapv2OpResponse || data[4] != mschapv2ResponseLength {
+		return "", errors.New("invalid MS-CHAPv2 response")
+	}
+	if data[1] != p.mschapID {
+		return "", errors.New("MS-CHAPv2 identifier mismatch")
+	}
+	if !p.found {
+		return "", errors.New("unknown user")
+	}
+
+	response := data[5 : 5+mschapv2ResponseLength]
+	peerChallenge := response[0:16]
+	ntResponse := response[24:48]
+
+	expected := mschapv2NTResponse(p.challenge, peerChallenge, p.username, p.credential.NTHash)
+	if subtle.ConstantTimeCompare(expected, ntResponse) != 1 {
+		return "", errors.New("wrong password")
+	}
+
+	return mschapv2AuthenticatorResponse(p.credential.NTHash, ntResponse, peerChallenge, p.challenge, p.username), nil
+}
+
+// peapSend encrypts an inner EAP-Request and sends it to the peer
+func (rs *RadiusServer) peapSend(w radius.ResponseWriter, r *radius.Request, session *eapSession, request *eapPacket, eapType byte, data []byte) {
+	inner := eapPacket{Code: eapCodeRequest, Identifier: session.identifier + 1, Type: eapType, Data: data}
+	plaintext := inner.Encode()
+	// PEAPv0 leaves out the EAP header of inner packets, except for TLVs
+	if eapType != eapTypeTLV {
+		plaintext = plaintext[4:]
+	}
+
+	if err := session.tls.writeApplicationData(plaintext); err != nil {
+		requestLogf(r, "Unable to encrypt PEAP data for %q: %v", session.identity, err)
+		rs.EAP.endSession(session)
+		rs.eapFailure(w, r, request.Identifier, "")
+		return
+	}
+	rs.eapChallenge(w, r, session, session.tls.nextFragment())
+}
+
+// parsePEAPInnerPacket decodes a decrypted phase 2 packet, which only has an EAP header if it is a TLV
+func parsePEAPInnerPacket(plaintext []byte, identifier byte) (*eapPacket, error) {
+	if len(plaintext) >= 5 && plaintext[0] == eapCodeResponse && plaintext[4] == eapTypeTLV {
+		return parseEAPPacket(plaintext)
+	}
+	if len(plaintext) < 1 {
+		return nil, errors.New("empty PEAP message")
+	}
+	return &eapPacket{Code: eapCodeResponse, Identifier: identifier, Type: plaintext[0], Data: plaintext[1:]}, nil
+}
+
+// newMSCHAPv2Message builds the data of an MS-CHAPv2 EAP message, where MS-Length covers everything from the op code on
+func newMSCHAPv2Message(opCode byte, id byte, data []byte) []byte {
+	message := make([]byte, 4, 4+len(data))
+	message[0] = opCode
+	message[1] = id
+	binary.BigEndian.PutUint16(message[2:4], uint16(4+len(data)))
+	return append(message, data...)
+}
+
+// newTLVResult builds a mandatory Result TLV
+func newTLVResult(status uint16) []byte {
+	tlv := make([]byte, 6)
+	binary.BigEndian.PutUint16(tlv[0:2], tlvMandatory|tlvTypeResult)
+	binary.BigEndian.PutUint16(tlv[2:4], 2)
+	binary.BigEndian.PutUint16(tlv[4:6], status)
+	return tlv
+}
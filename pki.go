@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CertificateAuthority is the built-in CA that issues the EAP-TLS server and device certificates
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+
+	dir string
+}
+
+const (
+	caCertificateFile     = "ca.crt"
+	caKeyFile             = "ca.key"
+	serverCertificateFile = "server.crt"
+	serverKeyFile         = "server.key"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 2 * 365 * 24 * time.Hour
+)
+
+// loadCertificateAuthority loads the CA from dir, creating a new one if it does not exist yet
+func loadCertificateAuthority(dir string) (*CertificateAuthority, error) {
+	ca := &CertificateAuthority{dir: dir}
+
+	certificate, key, err := readCertificateAndKey(filepath.Join(dir, caCertificateFile), filepath.Join(dir, caKeyFile))
+	if err == nil {
+		ca.Certificate = certificate
+		ca.Key = key
+		return ca, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Generate a new self-signed CA
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ca.Key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newCertificateTemplate("Simple WiFi RADIUS Authenticator CA", caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.Key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Certificate, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	if err := writeCertificateAndKey(filepath.Join(dir, caCertificateFile), filepath.Join(dir, caKeyFile), der, ca.Key); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// Pool returns a certificate pool containing only the CA, for verifying device certificates
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// ServerCertificate loads the EAP-TLS server certificate, issuing one for name if it does not exist yet
+func (ca *CertificateAuthority) ServerCertificate(name string) (tls.Certificate, error) {
+	certPath := filepath.Join(ca.dir, serverCertificateFile)
+	keyPath := filepath.Join(ca.dir, serverKeyFile)
+
+	if certificate, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		return certificate, nil
+	} else if _, statErr := os.Stat(certPath); !os.IsNotExist(statErr) {
+		return tls.Certificate{}, err
+	}
+
+	template, err := newCertificateTemplate(name, serverValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.DNSNames = []string{name}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	der, key, err := ca.Issue(template)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeCertificateAndKey(certPath, keyPath, der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// IssueDeviceCertificate creates a client certificate for a device with its MAC address as the common name
+func (ca *CertificateAuthority) IssueDeviceCertificate(mac string, validity time.Duration) ([]byte, *rsa.PrivateKey, error) {
+	template, err := newCertificateTemplate(prettyPrintMACAddress(mac), validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return ca.Issue(template)
+}
+
+// Issue signs a certificate for a newly generated key using the template
+func (ca *CertificateAuthority) Issue(template *x509.Certificate) ([]byte, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, key, nil
+}
+
+func newCertificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func readCertificateAndKey(certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("invalid PEM data in " + certPath + " or " + keyPath)
+	}
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certificate, key, nil
+}
+
+func writeCertificateAndKey(certPath, keyPath string, der []byte, key *rsa.PrivateKey) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
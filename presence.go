@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// presenceDevice is a registered device in the answer to /presence
+type presenceDevice struct {
+	MAC    string `json:"mac"`
+	Name   string `json:"name"`
+	Online bool   `json:"online"`
+	// SSID and Since are those of the latest session of a device that is online
+	SSID  string     `json:"ssid,omitempty"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// presence answers which registered devices are online, for presence detection in home automation such as Home
+// Assistant. A device is online while it has an accounting session without a Stop, updated within
+// PresenceTimeout if set. Without a mac parameter, the devices that are online are listed; with one, that
+// device is answered whether it is online or not. An address registered by a prefix is answered with the name of
+// the prefix's device.
+func (s *StatusServer) presence(w http.ResponseWriter, r *http.Request) {
+	if s.PresenceToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.PresenceToken)) != 1 {
+		log.Printf("STATUS: Refused presence to %v with an invalid token", r.RemoteAddr)
+		logSecurityEvent(securityTokenFailure, httpSource(r.RemoteAddr), "service=presence")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="presence"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	sessions := s.DB.Where("stopped_at IS NULL")
+	if s.PresenceTimeout > 0 {
+		sessions = sessions.Where("updated_at >= ?", time.Now().Add(-s.PresenceTimeout))
+	}
+	var mac string
+	if r.URL.Query().Get("mac") != "" {
+		mac = normalizeMACAddress(r.URL.Query().Get("mac"))
+		if !isValidMACFormat(mac) {
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+		sessions = sessions.Where("mac = ?", mac)
+	}
+	var active []AccountingSession
+	if err := sessions.Order("started_at").Find(&active).Error; err != nil {
+		log.Printf("STATUS: Unable to load the accounting sessions: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	latest := make(map[string]AccountingSession)
+	for _, session := range active {
+		latest[session.MAC] = session
+	}
+
+	var macs []string
+	if mac != "" {
+		macs = []string{mac}
+	} else {
+		for online := range latest {
+			macs = append(macs, online)
+		}
+		sort.Strings(macs)
+	}
+	var devices []Device
+	if err := s.DB.Where("MAC IN (?)", macs).Find(&devices).Error; err != nil {
+		log.Printf("STATUS: Unable to load the devices: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	registered := make(map[string]Device, len(devices))
+	for _, device := range devices {
+		registered[device.MAC] = device
+	}
+
+	result := make([]presenceDevice, 0, len(macs))
+	for _, address := range macs {
+		device, ok := registered[address]
+		// Fall back to the longest prefix matching the address, as authentication does
+		if !ok {
+			id, matched := s.Radius.matchDevicePattern(s.DB, address)
+			if !matched || s.DB.First(&device, id).Error != nil {
+				continue
+			}
+		}
+		answer := presenceDevice{MAC: prettyPrintMACAddress(address), Name: device.Name}
+		if session, ok := latest[address]; ok {
+			since := session.StartedAt
+			answer.Online = true
+			answer.SSID = session.SSID
+			answer.Since = &since
+		}
+		result = append(result, answer)
+	}
+
+	if mac != "" && len(result) == 0 {
+		http.Error(w, "device not registered", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if mac != "" {
+		json.NewEncoder(w).Encode(result[0])
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	db := openTestDatabase(t)
+	for _, device := range []Device{
+		{MAC: "001122334455", Name: "phone"},
+		{MAC: "001122334466", Name: "laptop"},
+		{MAC: "b827eb*", Name: "sensors"},
+	} {
+		if err := db.Create(&device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	started := time.Now().Add(-time.Hour)
+	for _, session := range []AccountingSession{
+		{SessionID: "phone", MAC: "001122334455", SSID: "Home", StartedAt: started},
+		{SessionID: "sensor", MAC: "b827eb000001", SSID: "IoT", StartedAt: started},
+		{SessionID: "guest", MAC: "aabbccddeeff", SSID: "Guest", StartedAt: started},
+	} {
+		if err := db.Create(&session).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rs := NewRadiusServer(db)
+	s := &StatusServer{DB: db, Radius: &rs, PresenceToken: "token"}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/presence"+query, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		s.presence(w, r)
+		return w
+	}
+
+	w := get("")
+	var online []presenceDevice
+	if err := json.Unmarshal(w.Body.Bytes(), &online); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, device := range online {
+		names = append(names, device.MAC+" "+device.Name)
+	}
+	if want := []string{"00:11:22:33:44:55 phone", "B8:27:EB:00:00:01 sensors"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v online, want %v", names, want)
+	}
+
+	tests := []struct {
+		mac    string
+		code   int
+		name   string
+		online bool
+	}{
+		{"00:11:22:33:44:55", http.StatusOK, "phone", true},
+		{"00:11:22:33:44:66", http.StatusOK, "laptop", false},
+		{"b8:27:eb:00:00:01", http.StatusOK, "sensors", true},
+		{"b8:27:eb:00:00:02", http.StatusOK, "sensors", false},
+		{"aa:bb:cc:dd:ee:ff", http.StatusNotFound, "", false},
+		{"aa:bb:cc", http.StatusBadRequest, "", false},
+	}
+	for _, test := range tests {
+		w := get("?mac=" + test.mac)
+		if w.Code != test.code {
+			t.Errorf("%v: got status %d, want %d", test.mac, w.Code, test.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var device presenceDevice
+		if err := json.Unmarshal(w.Body.Bytes(), &device); err != nil {
+			t.Fatal(err)
+		}
+		if device.Name != test.name || device.Online != test.online {
+			t.Errorf("%v: got %+v", test.mac, device)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/presence", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	s.presence(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with an invalid token", w.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/vendors/mikrotik"
+)
+
+const (
+	// pskGenerate asks add-device and set-device for a random PSK
+	pskGenerate = "generate"
+	// pskGeneratedLength is the length of a random PSK, from the alphabet of the vouchers so it is easy to type
+	pskGeneratedLength = 16
+)
+
+// Vendor IDs and attribute types of the private PSKs that the radius package has no dictionary for
+const (
+	vendorCisco         = 9
+	ciscoAVPair         = 1
+	vendorAruba         = 14823
+	arubaMPSKPassphrase = 48
+	ruckusDPSK          = 153
+	// ruckusPMKIterations and ruckusPMKLength derive the PMK from the passphrase as WPA2 does
+	ruckusPMKIterations = 4096
+	ruckusPMKLength     = 32
+	// tunnelPasswordNoTags is the tag of a Tunnel-Password that isn't grouped with other tunnel attributes
+	tunnelPasswordNoTags = 0
+)
+
+// validatePSK checks a WPA passphrase, which is 8 to 63 printable ASCII characters
+func validatePSK(psk string) error {
+	if len(psk) < 8 || len(psk) > 63 {
+		return errors.New("a PSK must be 8 to 63 characters")
+	}
+	for _, c := range psk {
+		if c < 0x20 || c > 0x7e {
+			return errors.New("a PSK can only have printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// generatePSK creates a random passphrase
+func generatePSK() (string, error) {
+	max := big.NewInt(int64(len(voucherAlphabet)))
+	psk := make([]byte, pskGeneratedLength)
+	for i := range psk {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		psk[i] = voucherAlphabet[n.Int64()]
+	}
+	return string(psk), nil
+}
+
+// addDevicePSK adds the private PSK of a device to an Access-Accept in the attributes the vendor of the client
+// reads it from: Cisco iPSK, Aruba MPSK, Ruckus DPSK, and MikroTik have their own, and the others the standard
+// Tunnel-Password. Ruckus takes the PMK derived from the passphrase and the SSID rather than the passphrase.
+func (rs *RadiusServer) addDevicePSK(r *radius.Request, p *radius.Packet, psk, ssid string) {
+	client, _ := rs.lookupClient(rs.DB, r.RemoteAddr)
+	var err error
+	switch client.Vendor {
+	case "cisco":
+		if err = addVendorAttribute(p, vendorCisco, ciscoAVPair, []byte("psk-mode=ascii")); err == nil {
+			err = addVendorAttribute(p, vendorCisco, ciscoAVPair, []byte("psk="+psk))
+		}
+	case "aruba":
+		err = addEncryptedVendorAttribute(p, vendorAruba, arubaMPSKPassphrase, []byte(psk))
+	case "ruckus":
+		if ssid == "" {
+			requestLogf(r, "No SSID to derive the PSK of the device for client %v", client.ClientIP)
+			return
+		}
+		pmk := pbkdf2SHA1([]byte(psk), []byte(ssid), ruckusPMKIterations, ruckusPMKLength)
+		err = addEncryptedVendorAttribute(p, vendorRuckus, ruckusDPSK, pmk)
+	case "mikrotik":
+		err = mikrotik.MikrotikWirelessPSK_SetString(p, psk)
+	default:
+		err = addTunnelPassword(p, []byte(psk))
+	}
+	if err != nil {
+		requestLogf(r, "Unable to add the PSK of the device: %v", err)
+	}
+}
+
+// tunnelPasswordSalt creates the salt of an RFC 2868 encrypted attribute, whose most significant bit must be set
+func tunnelPasswordSalt() ([]byte, error) {
+	salt := make([]byte, 2)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salt[0] |= 0x80
+	return salt, nil
+}
+
+// addTunnelPassword adds an untagged Tunnel-Password, encrypted with the shared secret and the authenticator of
+// the request
+func addTunnelPassword(p *radius.Packet, value []byte) error {
+	salt, err := tunnelPasswordSalt()
+	if err != nil {
+		return err
+	}
+	attribute, err := radius.NewTunnelPassword(value, salt, p.Secret, p.Authenticator[:])
+	if err != nil {
+		return err
+	}
+	p.Add(rfc2868.TunnelPassword_Type, append(radius.Attribute{tunnelPasswordNoTags}, attribute...))
+	return nil
+}
+
+// addEncryptedVendorAttribute adds a Vendor-Specific attribute encrypted like a Tunnel-Password
+func addEncryptedVendorAttribute(p *radius.Packet, vendorID uint32, vendorType byte, value []byte) error {
+	salt, err := tunnelPasswordSalt()
+	if err != nil {
+		return err
+	}
+	encrypted, err := radius.NewTunnelPassword(value, salt, p.Secret, p.Authenticator[:])
+	if err != nil {
+		return err
+	}
+	return addVendorAttribute(p, vendorID, vendorType, encrypted)
+}
+
+// pbkdf2SHA1 derives a key with PBKDF2-HMAC-SHA1 (RFC 8018), as WPA derives the PMK from the passphrase
+func pbkdf2SHA1(password, salt []byte, iterations, length int) []byte {
+	var key []byte
+	for block := uint32(1); len(key) < length; block++ {
+		mac := hmac.New(sha1.New, password)
+		mac.Write(salt)
+		var index [4]byte
+		binary.BigEndian.PutUint32(index[:], block)
+		mac.Write(index[:])
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// QuarantineConfig stores the device group suspicious devices are moved to
+type QuarantineConfig struct {
+	// Group is the device group whose networks and reply profile, such as a remediation VLAN, are the only ones
+	// its devices get, or empty to disable quarantine
+	Group string `json:"group"`
+}
+
+// quarantineGroups leaves only the quarantine group of a quarantined device, so its other groups don't grant
+// their networks or reply attributes
+func (rs *RadiusServer) quarantineGroups(groups []DeviceGroup) []DeviceGroup {
+	if rs.QuarantineGroup == "" {
+		return groups
+	}
+	for _, group := range groups {
+		if group.Name == rs.QuarantineGroup {
+			return []DeviceGroup{group}
+		}
+	}
+	return groups
+}
+
+// quarantined reports whether a device loaded with its groups is in the quarantine group
+func (rs *RadiusServer) quarantined(device Device) bool {
+	for _, group := range device.DeviceGroups {
+		if rs.QuarantineGroup != "" && group.Name == rs.QuarantineGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantineDevice adds a device to the quarantine group, registering it if it isn't, and reports whether it
+// wasn't already quarantined
+func quarantineDevice(db *gorm.DB, groupName string, mac string, name string) (bool, error) {
+	if groupName == "" {
+		return false, errors.New("quarantine.group is not set")
+	}
+	var group DeviceGroup
+	if db.First(&group, "name = ?", groupName).RecordNotFound() {
+		return false, fmt.Errorf("quarantine group %q does not exist, create it with set-group", groupName)
+	}
+
+	var device Device
+	if db.Preload("DeviceGroups").First(&device, "mac = ?", mac).RecordNotFound() {
+		if err := purgeTrashedDevice(db, mac); err != nil {
+			return false, err
+		}
+		device = Device{MAC: mac, Name: name, DeviceGroups: []DeviceGroup{group}, QuarantineRegistered: true}
+		return true, db.Create(&device).Error
+	}
+	for _, existing := range device.DeviceGroups {
+		if existing.ID == group.ID {
+			return false, nil
+		}
+	}
+	err := auditAssociationChange(db, &device, func() error {
+		return db.Model(&device).Association("DeviceGroups").Append(group).Error
+	})
+	return err == nil, err
+}
+
+// quarantineCommand moves a device into the quarantine group, where it only gets the networks and reply
+// attributes of that group
+func quarantineCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("quarantine", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address of the device")
+	name := flags.String("name", "", "description of the device, if it isn't registered yet")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+	if !isValidMACFormat(*mac) {
+		return fmt.Errorf("invalid MAC address %q", *mac)
+	}
+
+	added, err := quarantineDevice(db, config.Quarantine.Group, *mac, *name)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("device %v is already quarantined", *mac)
+	}
+	fmt.Printf("Quarantined device %v in %q\n", *mac, config.Quarantine.Group)
+	return nil
+}
+
+// releaseCommand takes a device out of the quarantine group so its other groups apply again. A device that was
+// only registered by being quarantined, such as an unknown device quarantined by an alert, is moved to the trash
+// unless it was given other groups since.
+func releaseCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+	if config.Quarantine.Group == "" {
+		return errors.New("quarantine.group is not set")
+	}
+
+	var device Device
+	if db.Preload("DeviceGroups").First(&device, "mac = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v does not exist", *mac)
+	}
+	var groups []DeviceGroup
+	for _, group := range device.DeviceGroups {
+		if group.Name != config.Quarantine.Group {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == len(device.DeviceGroups) {
+		return fmt.Errorf("device %v is not quarantined", *mac)
+	}
+
+	if len(groups) == 0 && device.QuarantineRegistered {
+		if err := deleteDevice(db, device); err != nil {
+			return err
+		}
+		fmt.Printf("Released device %v, which was only registered by quarantine and was moved to the trash\n", *mac)
+		return nil
+	}
+	err := auditAssociationChange(db, &device, func() error {
+		return db.Model(&device).Association("DeviceGroups").Replace(groups).Error
+	})
+	if err != nil {
+		return err
+	}
+	// A device kept for its other groups is a registered device from now on
+	if device.QuarantineRegistered {
+		if err := db.Model(&device).Update("quarantine_registered", false).Error; err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Released device %v\n", *mac)
+	return nil
+}
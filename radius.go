@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
@@ -16,8 +21,99 @@ import (
 type RadiusServer struct {
 	Addr string
 	DB   *gorm.DB
+	// AccountingAddr is the address accounting is received on, or empty to disable accounting
+	AccountingAddr string
 
-	server *radius.PacketServer
+	// RequireMessageAuthenticator drops Access-Requests that do not include a Message-Authenticator
+	RequireMessageAuthenticator bool
+	// RejectReplyMessage tells clients why a request was rejected in a Reply-Message
+	RejectReplyMessage bool
+	// EAP handles EAP authentication when it is enabled
+	EAP *EAPServer
+	// ClientResolveInterval is how often the addresses of clients configured by hostname are resolved again
+	ClientResolveInterval time.Duration
+	// MACRateLimit and NASRateLimit limit requests per MAC address and per RADIUS client, if set
+	MACRateLimit *RateLimiter
+	NASRateLimit *RateLimiter
+	// AuthListeners are told about the outcome of every authentication
+	AuthListeners []AuthListener
+	// AccountingListeners are told about every accounting session stored after a Start, Interim-Update, or Stop
+	AccountingListeners []AccountingListener
+	// SecretMismatchListeners are told the address of a client that sent an invalid Message-Authenticator
+	SecretMismatchListeners []func(client string)
+	// DuplicateCacheTTL is how long responses are kept for answering retransmitted requests, or 0 to process them again
+	DuplicateCacheTTL time.Duration
+	// DeviceCacheTTL is how long devices and networks are kept after being loaded from the database, or 0 to
+	// load them for every request
+	DeviceCacheTTL time.Duration
+	// MaxConcurrentRequests limits how many requests are handled at once, or 0 for no limit
+	MaxConcurrentRequests int
+	// RequestTimeout is how long a request may take before its response is dropped, or 0 for no limit
+	RequestTimeout time.Duration
+	// DatabaseTimeout is how long the lookups of a request may take before it is dropped, or 0 for no limit
+	DatabaseTimeout time.Duration
+	// ShutdownTimeout is how long Stop waits for the requests being handled to finish
+	ShutdownTimeout time.Duration
+	// Listeners are additional addresses authentication requests are received on
+	Listeners []RadiusListener
+	// QuarantineGroup is the device group whose devices only get its networks and reply attributes, or empty
+	QuarantineGroup string
+	// SharedCache holds the devices and networks looked up by all the instances sharing it, or nil
+	SharedCache *RedisCache
+	// PrewarmDevices loads all the devices into the cache before the server starts answering requests
+	PrewarmDevices bool
+	// ChangePollInterval is how often the change counter is checked to clear the cache after changes made by other
+	// processes, or 0 to not check it
+	ChangePollInterval time.Duration
+
+	server         *radius.PacketServer
+	droppedPackets uint64
+	listening      int32
+	hostnames      *clientHostnames
+	pollStop       chan struct{}
+	responses      *responseCache
+	devices        *deviceCache
+
+	accountingServer *radius.PacketServer
+	// ready is closed once the server is answering requests
+	ready chan struct{}
+	// stopped is closed once Stop is done waiting for the requests being handled
+	stopped         chan struct{}
+	listenerServers []*radius.PacketServer
+	// slots holds a value for each request being handled, when MaxConcurrentRequests is set
+	slots            chan struct{}
+	shedRequests     uint64
+	timedOutRequests uint64
+	databaseTimeouts uint64
+	panickedRequests uint64
+}
+
+// defaultListenerName is the name of the listener on Addr
+const defaultListenerName = "default"
+
+// RadiusListener is an additional address authentication requests are received on. Clients assigned to a
+// listener are only answered on it.
+type RadiusListener struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen"`
+}
+
+// validateRadiusListeners checks the listeners have an address and distinct names
+func validateRadiusListeners(listeners []RadiusListener) error {
+	var names []string
+	for _, listener := range listeners {
+		if listener.Name == "" || listener.Listen == "" {
+			return errors.New("listeners need a name and an address")
+		}
+		if listener.Name == defaultListenerName {
+			return fmt.Errorf("the listener name %q is reserved for radius.listen", defaultListenerName)
+		}
+		if stringInSlice(listener.Name, names) {
+			return fmt.Errorf("listener name %q is used more than once", listener.Name)
+		}
+		names = append(names, listener.Name)
+	}
+	return nil
 }
 
 // NewRadiusServer creates a new instance of RadiusServer
@@ -25,6 +121,16 @@ func NewRadiusServer(db *gorm.DB) RadiusServer {
 	radiusserver := RadiusServer{}
 	radiusserver.Addr = ":1812"
 	radiusserver.DB = db
+	radiusserver.ClientResolveInterval = 5 * time.Minute
+	radiusserver.DuplicateCacheTTL = 30 * time.Second
+	radiusserver.DeviceCacheTTL = 30 * time.Second
+	radiusserver.MaxConcurrentRequests = 256
+	radiusserver.RequestTimeout = 5 * time.Second
+	radiusserver.DatabaseTimeout = 2 * time.Second
+	radiusserver.ShutdownTimeout = 10 * time.Second
+	radiusserver.hostnames = newClientHostnames()
+	radiusserver.ready = make(chan struct{})
+	radiusserver.stopped = make(chan struct{})
 	return radiusserver
 }
 
@@ -32,17 +138,93 @@ func NewRadiusServer(db *gorm.DB) RadiusServer {
 func (rs *RadiusServer) Start(wait *sync.WaitGroup) {
 	// Initialize the RADIUS server handler
 	rs.server = &radius.PacketServer{
-		Handler:      radius.HandlerFunc(rs.radiusHandler),
-		SecretSource: radius.StaticSecretSource([]byte(`secret`)),
+		Handler:      rs.recoveredHandler(rs.limitedHandler),
+		SecretSource: listenerSecrets{rs, defaultListenerName},
 		Addr:         rs.Addr,
 	}
 
+	if rs.DuplicateCacheTTL > 0 {
+		rs.responses = newResponseCache(rs.DuplicateCacheTTL)
+	}
+	if rs.MaxConcurrentRequests > 0 {
+		rs.slots = make(chan struct{}, rs.MaxConcurrentRequests)
+	}
+	if rs.DeviceCacheTTL > 0 {
+		rs.devices = newDeviceCache(rs.DeviceCacheTTL)
+		registerDeviceCacheCallbacks(rs.DB, rs.devices)
+	}
+	rs.prewarmCache()
+	rs.startClientHostnameRefresh(rs.ClientResolveInterval)
+	rs.startChangePolling(rs.ChangePollInterval)
+
+	if rs.AccountingAddr != "" {
+		rs.accountingServer = &radius.PacketServer{
+			Handler:      rs.recoveredHandler(rs.accountingHandler),
+			SecretSource: rs,
+			Addr:         rs.AccountingAddr,
+		}
+		wait.Add(1)
+		go func() {
+			log.Printf("RADIUS: Starting accounting server on %v", rs.accountingServer.Addr)
+
+			conn, err := listenPacket(rs.accountingServer.Addr)
+			if err == nil {
+				err = rs.accountingServer.Serve(conn)
+				conn.Close()
+			}
+			if err != nil && err != radius.ErrServerShutdown {
+				log.Printf("RADIUS: Error starting accounting server: %v", err)
+			} else {
+				<-rs.stopped
+				log.Printf("RADIUS: Stopped accounting server")
+			}
+
+			wait.Done()
+		}()
+	}
+
+	for _, listener := range rs.Listeners {
+		server := &radius.PacketServer{
+			Handler:      rs.recoveredHandler(rs.limitedHandler),
+			SecretSource: listenerSecrets{rs, listener.Name},
+			Addr:         listener.Listen,
+		}
+		rs.listenerServers = append(rs.listenerServers, server)
+		wait.Add(1)
+		go func(name string) {
+			log.Printf("RADIUS: Starting %v listener on %v", name, server.Addr)
+
+			conn, err := listenPacket(server.Addr)
+			if err == nil {
+				err = server.Serve(conn)
+				conn.Close()
+			}
+			if err != nil && err != radius.ErrServerShutdown {
+				log.Printf("RADIUS: Error starting %v listener: %v", name, err)
+			} else {
+				<-rs.stopped
+				log.Printf("RADIUS: Stopped %v listener", name)
+			}
+
+			wait.Done()
+		}(listener.Name)
+	}
+
 	go func(rs *RadiusServer, wait *sync.WaitGroup) {
 		log.Printf("RADIUS: Starting server on %v", rs.server.Addr)
 
-		if err := rs.server.ListenAndServe(); err != nil && err != radius.ErrServerShutdown {
-			log.Printf("WEBUI: Error starting RADIUS server: %v", err)
+		conn, err := listenPacket(rs.server.Addr)
+		if err == nil {
+			atomic.StoreInt32(&rs.listening, 1)
+			close(rs.ready)
+			err = rs.server.Serve(conn)
+			atomic.StoreInt32(&rs.listening, 0)
+			conn.Close()
+		}
+		if err != nil && err != radius.ErrServerShutdown {
+			log.Printf("RADIUS: Error starting RADIUS server: %v", err)
 		} else {
+			<-rs.stopped
 			log.Printf("RADIUS: Stopped server")
 		}
 
@@ -50,55 +232,489 @@ func (rs *RadiusServer) Start(wait *sync.WaitGroup) {
 	}(rs, wait)
 }
 
-// Stop the RADIUS server
+// Listening reports whether the RADIUS server is bound to its address and answering requests
+func (rs *RadiusServer) Listening() bool {
+	return atomic.LoadInt32(&rs.listening) == 1
+}
+
+// Ready returns a channel that is closed once the RADIUS server is answering requests
+func (rs *RadiusServer) Ready() <-chan struct{} {
+	return rs.ready
+}
+
+// InvalidateCache makes the RADIUS server load devices and networks from the database again, to pick up changes
+// made by another process
+func (rs *RadiusServer) InvalidateCache() {
+	if rs.devices != nil {
+		rs.devices.invalidate()
+	}
+}
+
+// Stop the RADIUS server. It stops receiving packets and waits up to ShutdownTimeout for the requests being handled,
+// so they finish their changes and log their outcome before the database is closed.
 func (rs *RadiusServer) Stop() {
-	rs.server.Shutdown(context.Background())
+	rs.stopClientHostnameRefresh()
+	rs.stopChangePolling()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rs.ShutdownTimeout)
+	defer cancel()
+	servers := append([]*radius.PacketServer{rs.server}, rs.listenerServers...)
+	if rs.accountingServer != nil {
+		servers = append(servers, rs.accountingServer)
+	}
+	var drained sync.WaitGroup
+	for _, server := range servers {
+		drained.Add(1)
+		go func(server *radius.PacketServer) {
+			defer drained.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("RADIUS: Gave up waiting for the requests received on %v: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	drained.Wait()
+	close(rs.stopped)
 }
 
 func (rs *RadiusServer) radiusHandler(w radius.ResponseWriter, r *radius.Request) {
+	// Accounting is handled on its own port
+	if r.Code != radius.CodeAccessRequest {
+		return
+	}
+	r = withEventID(r, rs.requestEventID(r))
+
+	// Verify the Message-Authenticator so forged Access-Requests (BlastRADIUS) are discarded
+	present, valid := verifyMessageAuthenticator(r.Packet)
+	switch {
+	case present && !valid:
+		requestLogf(r, "Dropping request from %v with an invalid Message-Authenticator", r.RemoteAddr)
+		logSecurityEvent(securityBadAuthenticator, addrIP(r.RemoteAddr), "")
+		for _, listener := range rs.SecretMismatchListeners {
+			listener(addrIP(r.RemoteAddr).String())
+		}
+		return
+	case !present && rs.RequireMessageAuthenticator:
+		requestLogf(r, "Dropping request from %v without a Message-Authenticator", r.RemoteAddr)
+		return
+	}
+
+	// Answer retransmissions with the response already sent instead of processing them again, and drop those
+	// that arrive while the request is still being processed
+	if rs.responses != nil {
+		key := duplicateKey(r.RemoteAddr, r.Packet)
+		if response, seen := rs.responses.start(key); seen {
+			if response != nil {
+				w.Write(response)
+			}
+			return
+		}
+		defer rs.responses.done(key)
+		w = &cachingResponseWriter{ResponseWriter: w, cache: rs.responses, key: key}
+	}
+
+	// Drop requests from a client that is flooding us before they reach the database
+	if rs.NASRateLimit != nil {
+		nas := addrIP(r.RemoteAddr).String()
+		if allowed, first := rs.NASRateLimit.Allow(nas); !allowed {
+			if first {
+				requestLogf(r, "Rate limiting requests from client %v", nas)
+				logSecurityEvent(securityRateLimit, addrIP(r.RemoteAddr), "")
+			}
+			return
+		}
+	}
+
 	username := rfc2865.UserName_GetString(r.Packet)
 	nasPortType := rfc2865.NASPortType_Get(r.Packet)
 	calledStationID := rfc2865.CalledStationID_GetString(r.Packet)
-	// TODO: Use the password for something. Some WiFi controllers will pass the MAC address again while others may use a shared password for all devices.
-	//password := rfc2865.UserPassword_GetString(r.Packet)
+	// Some WiFi controllers will pass the MAC address again while others may use a shared password for all devices
+	password := rfc2865.UserPassword_GetString(r.Packet)
 
 	// Default to rejecting the request
 	code := radius.CodeAccessReject
+	var groups []DeviceGroup
+	// psk is the private PSK of the accepted device
+	var psk string
+
+	// Give up on the request if the database doesn't answer its lookups in time
+	db, cancel := rs.requestDB(r.Context())
+	defer cancel()
+
+	// Parse the SSID out of the Called-Station-Id the way the client formats it
+	var client Client
+	if !rs.timedLookup(db, r.RemoteAddr, func() { client, _ = rs.lookupClient(db, r.RemoteAddr) }) {
+		return
+	}
+	requestedSSID := calledStationSSID(client, calledStationID)
+	var network Network
+	if !rs.timedLookup(db, r.RemoteAddr, func() { network = rs.lookupNetwork(db, requestedSSID) }) {
+		return
+	}
 
-	// Convert username lowercase and remove delimiters
-	mac := normalizeMACAddress(username)
+	// Take the MAC address from the attributes the client puts it in, lowercase and without delimiters
+	mac := requestMAC(client, r.Packet)
 
-	// Parse the SSID out of the Called-Station-Id
-	csiParts := strings.Split(calledStationID, ":")
-	requestedSSID := csiParts[len(csiParts)-1]
+	event := AuthEvent{Method: authMethodMAC, Username: username, SSID: requestedSSID}
 
 	switch {
 	// Must be a wireless port type
 	case nasPortType != rfc2865.NASPortType_Value_Wireless80211 && nasPortType != rfc2865.NASPortType_Value_WirelessOther:
-		log.Println("RADIUS: Invalid NAS-Port-Type (must be wireless)")
+		requestLogf(r, "Invalid NAS-Port-Type (must be wireless)")
+		event.Reason = authReasonNotWireless
+	// Clients limited to some networks can't grant access to others, whatever the device
+	case !clientAllowsSSID(client, requestedSSID):
+		requestLogf(r, "Client %v may not grant access to %q", client.ClientIP, requestedSSID)
+		event.Reason = authReasonClientNotAllowed
+		if rs.rejectEAP(w, r, event) {
+			return
+		}
+	// Nothing legitimate asks for a honeypot network, whatever the device
+	case network.Honeypot:
+		if isValidMACFormat(mac) {
+			event.MAC = mac
+		}
+		requestLogf(r, "WARNING: %v asked for honeypot network %q through client %v", prettyPrintMACAddress(mac), requestedSSID, client.ClientIP)
+		event.Reason = authReasonHoneypot
+		if rs.rejectEAP(w, r, event) {
+			return
+		}
+	// Requests carrying EAP are authenticated by the EAP server instead of by MAC address
+	case len(getEAPMessage(r.Packet)) > 0:
+		rs.eapHandler(w, r, requestedSSID)
+		return
 	// Verify the value looks like a MAC address
 	case !isValidMACFormat(mac):
-		log.Println("RADIUS: Invalid MAC address format received")
-	// Look up the record
+		requestLogf(r, "Invalid MAC address format received")
+		event.Reason = authReasonInvalidMACAddress
+	// Drop requests from a device that is retrying too quickly
+	case !rs.allowMAC(mac):
+		return
+	// Check the password and look up the record
 	default:
-		var device Device
-		if !rs.DB.Preload("DeviceGroups").Preload("DeviceGroups.Networks").First(&device, "MAC = ?", mac).RecordNotFound() {
-			// Verify the requested SSID is allowed
-			for _, group := range device.DeviceGroups {
-				for _, network := range group.Networks {
-					if network.SSID == requestedSSID {
-						code = radius.CodeAccessAccept
-					}
-				}
+		event.MAC = mac
+		var decision macDecision
+		nas := addrIP(r.RemoteAddr).String()
+		if !rs.timedLookup(db, r.RemoteAddr, func() { decision = rs.authorizeMAC(db, client, nas, requestedSSID, mac, password) }) {
+			return
+		}
+		event.Reason = decision.reason
+		if decision.reason == authReasonWrongPassword {
+			requestLogf(r, "Wrong password for %v", prettyPrintMACAddress(mac))
+			break
+		}
+		switch {
+		case decision.disabled:
+			requestLogf(r, "Device disabled: %v", prettyPrintMACAddress(mac))
+		case decision.expired:
+			requestLogf(r, "Registration expired: %v", prettyPrintMACAddress(mac))
+		case !decision.found:
+			requestLogf(r, "Not found: %v", prettyPrintMACAddress(mac))
+		case rs.quarantined(decision.device):
+			requestLogf(r, "Found quarantined: %v", prettyPrintMACAddress(mac))
+		case decision.device.MAC == mac:
+			requestLogf(r, "Found: %v", prettyPrintMACAddress(decision.device.MAC))
+		default:
+			requestLogf(r, "Found: %v matching %v", prettyPrintMACAddress(mac), decision.device.MAC)
+		}
+		if decision.accepted {
+			code = radius.CodeAccessAccept
+			groups = decision.groups
+			if decision.registered() {
+				rs.deviceSeen(decision.device)
+				psk = decision.device.PSK
 			}
-			log.Println("RADIUS: Found:", prettyPrintMACAddress(device.MAC))
+		}
+
+		requestLogf(r, "%v received %v for %v", prettyPrintMACAddress(mac), code, requestedSSID)
+	}
+
+	event.Accepted = code == radius.CodeAccessAccept
+	rs.authEvent(r, event)
+
+	response := newResponse(r, code)
+	if code == radius.CodeAccessAccept {
+		rs.addReplyAttributes(r, response, groups, requestedSSID)
+		if psk != "" {
+			rs.addDevicePSK(r, response, psk, requestedSSID)
+		}
+	} else {
+		rs.addRejectReason(response, event.Reason)
+	}
+	rs.writeResponse(w, response)
+}
+
+// rejectEAP answers a request carrying EAP with an EAP failure, and reports whether it was one
+func (rs *RadiusServer) rejectEAP(w radius.ResponseWriter, r *radius.Request, event AuthEvent) bool {
+	eapMessage := getEAPMessage(r.Packet)
+	if len(eapMessage) == 0 {
+		return false
+	}
+	request, err := parseEAPPacket(eapMessage)
+	if err != nil {
+		return true
+	}
+	event.Method = authMethodEAP
+	rs.authEvent(r, event)
+	rs.eapFailure(w, r, request.Identifier, event.Reason)
+	return true
+}
+
+// addRejectReason tells the client why a request was rejected in a Reply-Message, if RejectReplyMessage is set
+func (rs *RadiusServer) addRejectReason(response *radius.Packet, reason string) {
+	if rs.RejectReplyMessage && reason != "" {
+		rfc2865.ReplyMessage_SetString(response, reason)
+	}
+}
+
+// macDecision is the outcome of MAC authentication and what it was based on
+type macDecision struct {
+	accepted bool
+	reason   string
+	device   Device
+	found    bool
+	expired  bool
+	disabled bool
+	// groups are the groups whose reply attributes are sent, which is none when the network grants access
+	groups []DeviceGroup
+	access NetworkAccess
+}
+
+// registered reports whether the device was found and may use its groups
+func (d macDecision) registered() bool {
+	return d.found && !d.expired && !d.disabled
+}
+
+// authorizeMAC decides whether a device may join an SSID through a client with MAC authentication, after the
+// request itself has been checked
+func (rs *RadiusServer) authorizeMAC(db *gorm.DB, client Client, nas, ssid, mac, password string) macDecision {
+	var d macDecision
+	// Check the password the way the network or client expects it
+	if !rs.checkPassword(db, client, ssid, mac, password) {
+		d.reason = authReasonWrongPassword
+		return d
+	}
+
+	d.device, d.found = rs.lookupDevice(db, mac)
+	d.expired = d.found && d.device.expired(time.Now())
+	d.disabled = d.found && d.device.Disabled
+	d.access = rs.networkAccess(db, ssid)
+
+	switch {
+	case d.registered():
+		// Verify the requested SSID is allowed
+		if groupsAllowSSID(d.device.DeviceGroups, ssid) {
+			d.accepted = true
+			d.groups = d.device.DeviceGroups
+		} else if d.access >= NetworkAccessKnownDevices {
+			d.accepted = true
 		} else {
-			// TODO: Pull allowed SSIDs for NULL group id
-			log.Println("RADIUS: Not found:", prettyPrintMACAddress(mac))
+			d.reason = authReasonSSIDNotAllowed
+		}
+		if d.accepted && rs.sessionLimitReached(db, nas, mac, d.device, d.device.DeviceGroups, ssid) {
+			d.accepted = false
+			d.groups = nil
+			d.reason = authReasonSessionLimit
+		}
+	// Devices that were disabled or expired stay rejected, even on open networks
+	case d.disabled:
+		d.reason = authReasonDisabled
+	case d.expired:
+		d.reason = authReasonExpired
+	// Open networks also allow devices that aren't registered
+	case d.access == NetworkAccessAnyDevice:
+		d.accepted = true
+	default:
+		d.reason = authReasonUnknownDevice
+	}
+	return d
+}
+
+// allowMAC checks the per-device rate limit
+func (rs *RadiusServer) allowMAC(mac string) bool {
+	if rs.MACRateLimit == nil {
+		return true
+	}
+
+	allowed, first := rs.MACRateLimit.Allow(mac)
+	if !allowed && first {
+		log.Printf("RADIUS: Rate limiting requests for %v", prettyPrintMACAddress(mac))
+	}
+	return allowed
+}
+
+// newResponse creates the response to a request. The Proxy-State attributes of the request are copied in
+// order, as RFC 2865 requires, or proxies in front of the server discard the response. An Access-Accept carries
+// the event ID of the request in a Class attribute.
+func newResponse(r *radius.Request, code radius.Code) *radius.Packet {
+	response := r.Response(code)
+	for _, avp := range r.Attributes {
+		if avp.Type == rfc2865.ProxyState_Type {
+			response.Add(avp.Type, avp.Attribute)
 		}
+	}
+	// The NAS copies the Class into the accounting of the session, tying it to the authentication
+	if id := eventID(r); id != "" && code == radius.CodeAccessAccept {
+		rfc2865.Class_AddString(response, eventClassPrefix+id)
+	}
+	return response
+}
 
-		log.Printf("RADIUS: %v received %v for %v", prettyPrintMACAddress(mac), code, requestedSSID)
+// writeResponse signs a response with a Message-Authenticator and sends it
+func (rs *RadiusServer) writeResponse(w radius.ResponseWriter, response *radius.Packet) {
+	if err := addMessageAuthenticator(response); err != nil {
+		log.Printf("RADIUS: Unable to sign response: %v", err)
+		return
 	}
+	w.Write(response)
+}
 
-	w.Write(r.Response(code))
+// lookupDevice loads a device by its normalized MAC address along with its groups and their networks
+func (rs *RadiusServer) lookupDevice(db *gorm.DB, mac string) (Device, bool) {
+	var generation uint64
+	if rs.devices != nil {
+		var cached cachedDevice
+		var ok bool
+		if cached, ok, generation = rs.devices.getDevice(mac); ok {
+			return cached.device, cached.found
+		}
+	}
+	var sharedGeneration int64
+	if rs.SharedCache != nil {
+		var cached cachedDevice
+		var ok bool
+		if cached, ok, sharedGeneration = rs.SharedCache.getDevice(mac); ok {
+			if rs.devices != nil {
+				rs.devices.putDevice(mac, cached.device, cached.found, generation)
+			}
+			return cached.device, cached.found
+		}
+	}
+
+	var device Device
+	result := db.Preload("DeviceGroups").Preload("DeviceGroups.Networks").Preload("DeviceGroups.ReplyProfile").Preload("DeviceGroups.Attributes").First(&device, "MAC = ?", mac)
+	// Fall back to the longest prefix matching the address
+	if result.RecordNotFound() {
+		if id, ok := rs.matchDevicePattern(db, mac); ok {
+			result = db.Preload("DeviceGroups").Preload("DeviceGroups.Networks").Preload("DeviceGroups.ReplyProfile").Preload("DeviceGroups.Attributes").First(&device, id)
+		}
+	}
+	found := result.Error == nil
+	if found {
+		device.DeviceGroups = inheritGroups(db, rs.quarantineGroups(device.DeviceGroups))
+	}
+	// Don't remember a device as missing because the database failed, or with the groups it didn't load in time
+	if lookupCutShort(db) {
+		return device, false
+	}
+	if found || result.RecordNotFound() {
+		if rs.devices != nil {
+			rs.devices.putDevice(mac, device, found, generation)
+		}
+		if rs.SharedCache != nil {
+			rs.SharedCache.putDevice(mac, device, found, sharedGeneration)
+		}
+	}
+	return device, found
+}
+
+// matchDevicePattern finds the device with the longest MAC address prefix matching mac
+func (rs *RadiusServer) matchDevicePattern(db *gorm.DB, mac string) (uint, bool) {
+	var patterns []Device
+	if err := db.Select("id, mac").Where("mac LIKE ?", "%"+macWildcard).Find(&patterns).Error; err != nil {
+		log.Printf("RADIUS: Unable to load MAC address prefixes: %v", err)
+		return 0, false
+	}
+
+	var best uint
+	bestLength := 0
+	for _, pattern := range patterns {
+		prefix := strings.TrimSuffix(pattern.MAC, macWildcard)
+		if isValidMACPattern(pattern.MAC) && strings.HasPrefix(mac, prefix) && len(prefix) > bestLength {
+			best = pattern.ID
+			bestLength = len(prefix)
+		}
+	}
+	return best, best != 0
+}
+
+// networkAccess looks up which devices may use an SSID without a group granting access
+func (rs *RadiusServer) networkAccess(db *gorm.DB, ssid string) NetworkAccess {
+	return rs.lookupNetwork(db, ssid).Access
+}
+
+// lookupNetwork loads the settings of an SSID, which are the defaults if it doesn't exist or can't be loaded
+func (rs *RadiusServer) lookupNetwork(db *gorm.DB, ssid string) Network {
+	if ssid == "" {
+		return Network{}
+	}
+	var generation uint64
+	if rs.devices != nil {
+		var network Network
+		var ok bool
+		if network, ok, generation = rs.devices.getNetwork(ssid); ok {
+			return network
+		}
+	}
+	var sharedGeneration int64
+	if rs.SharedCache != nil {
+		var network Network
+		var ok bool
+		if network, ok, sharedGeneration = rs.SharedCache.getNetwork(ssid); ok {
+			if rs.devices != nil {
+				rs.devices.putNetwork(ssid, network, generation)
+			}
+			return network
+		}
+	}
+
+	var network Network
+	result := db.Where(&Network{SSID: ssid}).First(&network)
+	if result.Error != nil && !result.RecordNotFound() {
+		return Network{}
+	}
+	if rs.devices != nil {
+		rs.devices.putNetwork(ssid, network, generation)
+	}
+	if rs.SharedCache != nil {
+		rs.SharedCache.putNetwork(ssid, network, sharedGeneration)
+	}
+	return network
+}
+
+// checkPassword checks the User-Password of a MAC authentication request with the password mode of the network,
+// or of the client if the network doesn't set one
+func (rs *RadiusServer) checkPassword(db *gorm.DB, client Client, ssid, mac, password string) bool {
+	mode, shared := client.PasswordMode, client.SharedPassword
+	if network := rs.lookupNetwork(db, ssid); network.PasswordMode != nil {
+		mode, shared = *network.PasswordMode, network.SharedPassword
+	}
+
+	switch mode {
+	case ClientPasswordModeMAC:
+		return normalizeMACAddress(password) == mac
+	case ClientPasswordModeSharedSecret:
+		return shared != "" && subtle.ConstantTimeCompare([]byte(password), []byte(shared)) == 1
+	default:
+		return true
+	}
+}
+
+// groupsAllowSSID checks if any of the groups grant access to the SSID
+func groupsAllowSSID(groups []DeviceGroup, ssid string) bool {
+	for _, group := range groups {
+		if groupAllowsSSID(group, ssid) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupAllowsSSID checks if a group grants access to the SSID, either by name or through the wildcard network
+func groupAllowsSSID(group DeviceGroup, ssid string) bool {
+	for _, network := range group.Networks {
+		if network.SSID == ssid || network.SSID == wildcardSSID {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// radiusTestDevices creates the networks Corp, which only accepts devices through their groups, Devices, which
+// accepts any registered device, and Guest, which accepts any device, along with devices in every state
+func radiusTestDevices(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	for _, network := range []Network{
+		{SSID: "Devices", Access: NetworkAccessKnownDevices},
+		{SSID: "Guest", Access: NetworkAccessAnyDevice},
+		{SSID: "Trap", Honeypot: true},
+	} {
+		if err := db.Create(&network).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	staff := DeviceGroup{Name: "staff", Networks: []Network{{SSID: "Corp"}}}
+	if err := db.Create(&staff).Error; err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Hour)
+	for _, device := range []Device{
+		{MAC: "001122334455", DeviceGroups: []DeviceGroup{staff}},
+		{MAC: "001122334466"},
+		{MAC: "001122334477", DeviceGroups: []DeviceGroup{staff}, Disabled: true},
+		{MAC: "001122334488", DeviceGroups: []DeviceGroup{staff}, ExpiresAt: &expired},
+		{MAC: "b827eb*", DeviceGroups: []DeviceGroup{staff}},
+	} {
+		if err := db.Create(&device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthorizeMAC(t *testing.T) {
+	db := openTestDatabase(t)
+	radiusTestDevices(t, db)
+	rs := NewRadiusServer(db)
+
+	tests := []struct {
+		name     string
+		mac      string
+		ssid     string
+		password string
+		accepted bool
+		reason   string
+		groups   int
+	}{
+		{"device in a group", "001122334455", "Corp", "", true, "", 1},
+		{"device on a network its groups don't grant", "001122334455", "Lab", "", false, authReasonSSIDNotAllowed, 0},
+		{"device on a network for known devices", "001122334455", "Devices", "", true, "", 0},
+		{"device without groups", "001122334466", "Corp", "", false, authReasonSSIDNotAllowed, 0},
+		{"device without groups on a network for known devices", "001122334466", "Devices", "", true, "", 0},
+		{"device matching a prefix", "b827eb000001", "Corp", "", true, "", 1},
+		{"unknown device", "aabbccddeeff", "Corp", "", false, authReasonUnknownDevice, 0},
+		{"unknown device on a network for known devices", "aabbccddeeff", "Devices", "", false, authReasonUnknownDevice, 0},
+		{"unknown device on an open network", "aabbccddeeff", "Guest", "", true, "", 0},
+		{"disabled device", "001122334477", "Corp", "", false, authReasonDisabled, 0},
+		{"disabled device on an open network", "001122334477", "Guest", "", false, authReasonDisabled, 0},
+		{"expired device", "001122334488", "Corp", "", false, authReasonExpired, 0},
+		{"expired device on an open network", "001122334488", "Guest", "", false, authReasonExpired, 0},
+		{"wrong password", "001122334455", "Corp", "aabbccddeeff", false, authReasonWrongPassword, 0},
+	}
+
+	client := Client{ClientIP: "127.0.0.1", PasswordMode: ClientPasswordModeMAC}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			password := test.password
+			if password == "" {
+				password = test.mac
+			}
+			d := rs.authorizeMAC(db, client, "127.0.0.1", test.ssid, test.mac, password)
+			if d.accepted != test.accepted || d.reason != test.reason || len(d.groups) != test.groups {
+				t.Errorf("got accepted %v with reason %q and %d groups", d.accepted, d.reason, len(d.groups))
+			}
+		})
+	}
+}
+
+// recordingResponseWriter keeps the responses written to it
+type recordingResponseWriter struct {
+	responses []*radius.Packet
+}
+
+func (w *recordingResponseWriter) Write(packet *radius.Packet) error {
+	w.responses = append(w.responses, packet)
+	return nil
+}
+
+func TestRadiusHandler(t *testing.T) {
+	db := openTestDatabase(t)
+	radiusTestDevices(t, db)
+	secret := []byte("s3cret")
+	if err := db.Create(&Client{ClientIP: "127.0.0.1", Secret: string(secret)}).Error; err != nil {
+		t.Fatal(err)
+	}
+	rs := NewRadiusServer(db)
+	rs.RejectReplyMessage = true
+
+	wireless := rfc2865.NASPortType_Value_Wireless80211
+	tests := []struct {
+		name        string
+		mac         string
+		portType    rfc2865.NASPortType
+		station     string
+		modify      func(p *radius.Packet)
+		code        radius.Code
+		replyReason string
+	}{
+		{"accepted", "00:11:22:33:44:55", wireless, "00-11-22-00-00-01:Corp", nil, radius.CodeAccessAccept, ""},
+		{"SSID not allowed", "00:11:22:33:44:55", wireless, "00-11-22-00-00-01:Lab", nil, radius.CodeAccessReject, authReasonSSIDNotAllowed},
+		{"unknown device on an open network", "aa:bb:cc:dd:ee:ff", wireless, "00-11-22-00-00-01:Guest", nil, radius.CodeAccessAccept, ""},
+		{"disabled device on an open network", "00:11:22:33:44:77", wireless, "00-11-22-00-00-01:Guest", nil, radius.CodeAccessReject, authReasonDisabled},
+		{"expired device on an open network", "00:11:22:33:44:88", wireless, "00-11-22-00-00-01:Guest", nil, radius.CodeAccessReject, authReasonExpired},
+		{"wired port", "00:11:22:33:44:55", rfc2865.NASPortType_Value_Ethernet, "00-11-22-00-00-01:Corp", nil, radius.CodeAccessReject, authReasonNotWireless},
+		{"invalid MAC address", "00:11:22:33:44", wireless, "00-11-22-00-00-01:Corp", nil, radius.CodeAccessReject, authReasonInvalidMACAddress},
+		{"honeypot", "00:11:22:33:44:55", wireless, "00-11-22-00-00-01:Trap", nil, radius.CodeAccessReject, authReasonHoneypot},
+		{"invalid Message-Authenticator", "00:11:22:33:44:55", wireless, "00-11-22-00-00-01:Corp", func(p *radius.Packet) {
+			p.Add(rfc2869.MessageAuthenticator_Type, make([]byte, 16))
+		}, 0, ""},
+		{"accounting", "00:11:22:33:44:55", wireless, "00-11-22-00-00-01:Corp", func(p *radius.Packet) {
+			p.Code = radius.CodeAccountingRequest
+		}, 0, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := radius.New(radius.CodeAccessRequest, secret)
+			rfc2865.UserName_SetString(packet, test.mac)
+			rfc2865.NASPortType_Set(packet, test.portType)
+			rfc2865.CalledStationID_SetString(packet, test.station)
+			if test.modify != nil {
+				test.modify(packet)
+			}
+			w := &recordingResponseWriter{}
+			rs.radiusHandler(w, &radius.Request{Packet: packet, RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1645}})
+
+			if test.code == 0 {
+				if len(w.responses) != 0 {
+					t.Errorf("got %v, want the request dropped", w.responses[0].Code)
+				}
+				return
+			}
+			if len(w.responses) != 1 {
+				t.Fatalf("got %d responses", len(w.responses))
+			}
+			response := w.responses[0]
+			if response.Code != test.code || rfc2865.ReplyMessage_GetString(response) != test.replyReason {
+				t.Errorf("got %v with reason %q", response.Code, rfc2865.ReplyMessage_GetString(response))
+			}
+			if present, valid := verifyMessageAuthenticator(response); !present || !valid {
+				t.Error("the response isn't signed")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are removed from a RateLimiter
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiter is a token bucket rate limiter keeping a separate bucket per key
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// limited is set while requests are being denied, so only the first denial is reported
+	limited bool
+}
+
+// NewRateLimiter creates a RateLimiter that allows rate requests per second per key, with bursts up to burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports if a request for key is allowed. first is true for the first request denied since the key
+// was last allowed, for logging a limited key only once.
+func (rl *RateLimiter) Allow(key string) (allowed bool, first bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, updated: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.refill(now, rl.rate, rl.burst)
+
+	if bucket.tokens < 1 {
+		first = !bucket.limited
+		bucket.limited = true
+		return false, first
+	}
+	bucket.tokens--
+	bucket.limited = false
+	return true, false
+}
+
+// sweep removes buckets that have refilled completely, since they behave the same as a new bucket
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range rl.buckets {
+		bucket.refill(now, rl.rate, rl.burst)
+		if bucket.tokens >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+}
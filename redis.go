@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// redisTimeout bounds each command, so a slow Redis server delays requests by at most this long before the
+	// database is used instead
+	redisTimeout = 500 * time.Millisecond
+	// redisRetryInterval is how long lookups skip an unreachable Redis server
+	redisRetryInterval = 10 * time.Second
+	// redisKeepAlive is how long the invalidation channel may be quiet before it is checked with a PING
+	redisKeepAlive = 60 * time.Second
+	// redisMaxBackoff is the longest wait between attempts to subscribe to the invalidation channel again
+	redisMaxBackoff = 5 * time.Minute
+	// redisMaxConns is how many idle connections are kept for lookups
+	redisMaxConns = 16
+	// redisMaxReply limits the length of a bulk string or array read from the server, and redisMaxNesting how deep
+	// arrays may be nested
+	redisMaxReply   = 16 << 20
+	redisMaxNesting = 8
+)
+
+// RedisConfig stores the Redis server holding the device cache shared by several instances
+type RedisConfig struct {
+	// Address is the host and port of the Redis server, or empty to only cache in memory
+	Address  string `json:"address"`
+	TLS      bool   `json:"tls"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Prefix starts the keys and the channel, so several deployments can share a Redis server
+	Prefix string `json:"prefix"`
+}
+
+// redisError is an error reply of the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a connection to a Redis server speaking RESP
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to the Redis server, logs in, and selects the database
+func dialRedis(config RedisConfig) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if config.TLS {
+		host, _, _ := net.SplitHostPort(config.Address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.Address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if config.Password != "" {
+		if _, err := c.do("AUTH", config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if config.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(config.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+// send writes a command as an array of bulk strings
+func (c *redisConn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// receive reads a reply: a string for a status, an int64 for an integer, a []byte for a bulk string, an
+// []interface{} for an array, or nil for a missing value
+func (c *redisConn) receive() (interface{}, error) {
+	return c.receiveNested(0)
+}
+
+// receiveNested reads a reply that is nested in depth arrays
+func (c *redisConn) receiveNested(depth int) (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		if length > redisMaxReply {
+			return nil, fmt.Errorf("reply of %d bytes is too large", length)
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, errors.New("invalid reply, the bulk string doesn't end with CRLF")
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		if depth >= redisMaxNesting {
+			return nil, errors.New("invalid reply, the arrays are nested too deeply")
+		}
+		if length > redisMaxReply {
+			return nil, fmt.Errorf("reply of %d items is too large", length)
+		}
+		// The items are added as they arrive, so a length the server doesn't send doesn't allocate memory
+		items := []interface{}{}
+		for i := 0; i < length; i++ {
+			item, err := c.receiveNested(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
+
+// RedisCache shares the devices and networks looked up by several instances in Redis, so an instance doesn't have
+// to load from the database what another one already did. Entries are stored under the current generation, which
+// every change to the records increments and announces on a channel, so the instances stop using the entries
+// from before the change and clear their own caches.
+type RedisCache struct {
+	config RedisConfig
+	ttl    time.Duration
+	// Invalidated is called when another process changed the records
+	Invalidated func()
+
+	conns      chan *redisConn
+	generation int64
+
+	mu         sync.Mutex
+	retryAt    time.Time
+	subscriber *redisConn
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// redisDevice is a device lookup as stored in Redis, including devices that don't exist
+type redisDevice struct {
+	Device Device
+	Found  bool
+}
+
+// NewRedisCache creates a RedisCache keeping entries for ttl
+func NewRedisCache(config RedisConfig, ttl time.Duration) (*RedisCache, error) {
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", config.Address, err)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("radius.device_cache_ttl must be positive, entries in Redis expire after it")
+	}
+	return &RedisCache{config: config, ttl: ttl, conns: make(chan *redisConn, redisMaxConns)}, nil
+}
+
+// do runs a command on an idle connection, or a new one
+func (rc *RedisCache) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-rc.conns:
+	default:
+		var err error
+		if conn, err = dialRedis(rc.config); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.close()
+		return nil, err
+	}
+	select {
+	case rc.conns <- conn:
+	default:
+		conn.close()
+	}
+	return reply, err
+}
+
+// lookup runs a command for a lookup, which skips Redis for a while after it failed so requests don't all wait
+// on the timeout
+func (rc *RedisCache) lookup(args ...string) (interface{}, bool) {
+	rc.mu.Lock()
+	skip := time.Now().Before(rc.retryAt)
+	rc.mu.Unlock()
+	if skip {
+		return nil, false
+	}
+
+	reply, err := rc.do(args...)
+	if err != nil {
+		log.Printf("REDIS: Unable to reach %v, using the database for %v: %v", rc.config.Address, redisRetryInterval, err)
+		rc.mu.Lock()
+		rc.retryAt = time.Now().Add(redisRetryInterval)
+		rc.mu.Unlock()
+		return nil, false
+	}
+	return reply, true
+}
+
+// key names an entry of a generation
+func (rc *RedisCache) key(generation int64, kind, name string) string {
+	return fmt.Sprintf("%v%d:%v:%v", rc.config.Prefix, generation, kind, name)
+}
+
+// get decodes the JSON entry stored under a key, reporting false if there is none
+func (rc *RedisCache) get(key string, v interface{}) bool {
+	reply, ok := rc.lookup("GET", key)
+	data, isData := reply.([]byte)
+	return ok && isData && json.Unmarshal(data, v) == nil
+}
+
+// put stores an entry as JSON, unless the records changed since the lookup started
+func (rc *RedisCache) put(generation int64, key string, v interface{}) {
+	if generation != atomic.LoadInt64(&rc.generation) {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	rc.lookup("SET", key, string(data), "PX", strconv.FormatInt(int64(rc.ttl/time.Millisecond), 10))
+}
+
+// getDevice returns a device lookup cached by any instance, otherwise the generation to pass to putDevice
+func (rc *RedisCache) getDevice(mac string) (cachedDevice, bool, int64) {
+	generation := atomic.LoadInt64(&rc.generation)
+	var cached redisDevice
+	if !rc.get(rc.key(generation, "device", mac), &cached) {
+		return cachedDevice{}, false, generation
+	}
+	return cachedDevice{device: cached.Device, found: cached.Found}, true, generation
+}
+
+// putDevice stores a device lookup for the other instances
+func (rc *RedisCache) putDevice(mac string, device Device, found bool, generation int64) {
+	rc.put(generation, rc.key(generation, "device", mac), redisDevice{Device: device, Found: found})
+}
+
+// getNetwork returns a network cached by any instance, otherwise the generation to pass to putNetwork
+func (rc *RedisCache) getNetwork(ssid string) (Network, bool, int64) {
+	generation := atomic.LoadInt64(&rc.generation)
+	var network Network
+	if !rc.get(rc.key(generation, "network", ssid), &network) {
+		return Network{}, false, generation
+	}
+	return network, true, generation
+}
+
+// putNetwork stores a network for the other instances
+func (rc *RedisCache) putNetwork(ssid string, network Network, generation int64) {
+	rc.put(generation, rc.key(generation, "network", ssid), network)
+}
+
+// invalidate starts a new generation and tells the instances about it
+func (rc *RedisCache) invalidate() {
+	reply, err := rc.do("INCR", rc.config.Prefix+"generation")
+	if err == nil {
+		atomic.StoreInt64(&rc.generation, reply.(int64))
+		_, err = rc.do("PUBLISH", rc.config.Prefix+"invalidate", strconv.FormatInt(reply.(int64), 10))
+	}
+	if err != nil {
+		log.Printf("REDIS: Unable to announce a change, the instances pick it up after radius.device_cache_ttl: %v", err)
+	}
+}
+
+// setGeneration switches to the generation announced on the channel, clearing the cache of this instance if it
+// is a new one
+func (rc *RedisCache) setGeneration(generation int64) {
+	if atomic.SwapInt64(&rc.generation, generation) != generation && rc.Invalidated != nil {
+		rc.Invalidated()
+	}
+}
+
+// Start subscribes to the changes announced by the other processes, until Stop is called
+func (rc *RedisCache) Start() {
+	rc.done = make(chan struct{})
+	rc.stopped = make(chan struct{})
+	go func() {
+		defer close(rc.stopped)
+		backoff := time.Second
+		for {
+			subscribed, err := rc.subscribe()
+			select {
+			case <-rc.done:
+				return
+			default:
+			}
+			if subscribed {
+				backoff = time.Second
+			}
+			log.Printf("REDIS: Lost the subscription to %v, retrying in %v: %v", rc.config.Address, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-rc.done:
+				return
+			}
+			if backoff *= 2; backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+		}
+	}()
+}
+
+// subscribe listens on the channel until the connection fails, reporting whether it got as far as subscribing
+func (rc *RedisCache) subscribe() (bool, error) {
+	conn, err := dialRedis(rc.config)
+	if err != nil {
+		return false, err
+	}
+	rc.mu.Lock()
+	select {
+	case <-rc.done:
+		rc.mu.Unlock()
+		conn.close()
+		return false, nil
+	default:
+	}
+	rc.subscriber = conn
+	rc.mu.Unlock()
+	defer conn.close()
+
+	if _, err := conn.do("SUBSCRIBE", rc.config.Prefix+"invalidate"); err != nil {
+		return false, err
+	}
+	// Changes made while unsubscribed were missed, and a restarted Redis server starts the generations over
+	reply, err := rc.do("GET", rc.config.Prefix+"generation")
+	if err != nil {
+		return false, err
+	}
+	var generation int64
+	if data, ok := reply.([]byte); ok {
+		if generation, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+			return false, err
+		}
+	}
+	rc.setGeneration(generation)
+	log.Printf("REDIS: Sharing the cache on %v", rc.config.Address)
+
+	pinged := false
+	for {
+		conn.conn.SetDeadline(time.Now().Add(redisKeepAlive))
+		reply, err := conn.receive()
+		if err, ok := err.(net.Error); ok && err.Timeout() && !pinged {
+			if err := conn.send("PING"); err != nil {
+				return true, err
+			}
+			pinged = true
+			continue
+		}
+		if err != nil {
+			return true, err
+		}
+		pinged = false
+
+		// Messages are ["message", channel, generation], and the answer to a PING is ["pong", ""]
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 {
+			continue
+		}
+		data, _ := message[2].([]byte)
+		if generation, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			rc.setGeneration(generation)
+		}
+	}
+}
+
+// Stop unsubscribes and closes the connections
+func (rc *RedisCache) Stop() {
+	if rc.done != nil {
+		close(rc.done)
+		rc.mu.Lock()
+		if rc.subscriber != nil {
+			rc.subscriber.close()
+		}
+		rc.mu.Unlock()
+		<-rc.stopped
+	}
+	for {
+		select {
+		case conn := <-rc.conns:
+			conn.close()
+		default:
+			return
+		}
+	}
+}
+
+// registerRedisInvalidation starts a new generation in Redis whenever this process changes a record, other than the
+// logs, including changes made by commands
+func registerRedisInvalidation(db *gorm.DB, rc *RedisCache) {
+	ignored := cacheIgnoredTables(db)
+	invalidate := func(scope *gorm.Scope) {
+		if !ignored[scope.TableName()] && !scope.HasError() {
+			rc.invalidate()
+		}
+	}
+
+	// gorm logs every callback it registers
+	db = db.New()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(ioutil.Discard, "", 0)})
+
+	db.Callback().Create().After("gorm:create").Register("redis:create", invalidate)
+	db.Callback().Update().After("gorm:update").Register("redis:update", invalidate)
+	db.Callback().Delete().After("gorm:delete").Register("redis:delete", invalidate)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// redisConnReading returns a connection that receives the replies
+func redisConnReading(replies string) *redisConn {
+	return &redisConn{reader: bufio.NewReader(strings.NewReader(replies))}
+}
+
+func TestRedisReceive(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+	}{
+		{"status", "+OK\r\n", "OK"},
+		{"empty status", "+\r\n", ""},
+		{"integer", ":-42\r\n", int64(-42)},
+		{"bulk string", "$5\r\nab\r\nc\r\n", []byte("ab\r\nc")},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}},
+		{"missing value", "$-1\r\n", nil},
+		{"array", "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n:7\r\n", []interface{}{[]byte("message"), []byte("ch"), int64(7)}},
+		{"empty array", "*0\r\n", []interface{}{}},
+		{"missing array", "*-1\r\n", nil},
+		{"nested arrays", "*1\r\n*1\r\n+a\r\n", []interface{}{[]interface{}{"a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := redisConnReading(test.reply).receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := redisConnReading("-ERR wrong password\r\n").receive(); err != redisError("ERR wrong password") {
+		t.Errorf("got error %v", err)
+	}
+
+	invalid := map[string]string{
+		"empty":                   "",
+		"empty line":              "\r\n",
+		"unknown type":            "!3\r\n",
+		"missing CR":              "+OK\n",
+		"invalid integer":         ":4x\r\n",
+		"invalid length":          "$x\r\n",
+		"truncated bulk string":   "$5\r\nab",
+		"bulk string without end": "$3\r\nabcde",
+		"longest length":          "$9223372036854775807\r\n",
+		"length beyond int64":     "$92233720368547758070\r\n",
+		"larger than the limit":   "$16777217\r\n",
+		"array beyond the limit":  "*16777217\r\n",
+		"truncated array":         "*2\r\n+a\r\n",
+		"nested too deeply":       strings.Repeat("*1\r\n", redisMaxNesting+1) + "+a\r\n",
+	}
+	// Every prefix of a reply is truncated
+	array := tests[6].reply
+	for i := 0; i < len(array); i++ {
+		invalid[array[:i]] = array[:i]
+	}
+	for name, reply := range invalid {
+		if got, err := redisConnReading(reply).receive(); err == nil {
+			t.Errorf("%q was read as %#v", name, got)
+		}
+	}
+}
+
+func TestRedisSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	sent := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(server)
+		sent <- string(data)
+	}()
+	c := &redisConn{conn: client}
+	if err := c.send("SET", "key", "a\r\nb", ""); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	command := <-sent
+	if want := "*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$4\r\na\r\nb\r\n$0\r\n\r\n"; command != want {
+		t.Errorf("got %q, want %q", command, want)
+	}
+
+	// The command reads back as an array of its arguments
+	got, err := redisConnReading(command).receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{[]byte("SET"), []byte("key"), []byte("a\r\nb"), []byte{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// replicationStateID is the row of the replication state
+	replicationStateID = 1
+	// replicationTimeout bounds taking, sending, and receiving a snapshot
+	replicationTimeout = 5 * time.Minute
+	// replicationTokenValidity is how far the clocks of the primary and the standby may differ
+	replicationTokenValidity = 5 * time.Minute
+)
+
+// ReplicationConfig stores the settings for keeping a copy of the records on a standby instance, which can take
+// over when the primary fails
+type ReplicationConfig struct {
+	// Listen is the address the primary serves snapshots of its records on, or empty
+	Listen string `json:"listen"`
+	// Primary is the URL of the primary's listener a standby pulls the records from, such as
+	// "http://10.0.0.10:8083", or empty on the primary
+	Primary string `json:"primary"`
+	// Secret authenticates the standby and encrypts the snapshots, which include secrets and credentials
+	Secret string `json:"secret"`
+	// Interval is how often a standby pulls the records
+	Interval Duration `json:"interval"`
+}
+
+// validate checks the replication settings read from the configuration file
+func (c ReplicationConfig) validate() error {
+	if len(c.Secret) < 16 {
+		return errors.New("a secret of at least 16 characters is required")
+	}
+	if c.Primary != "" {
+		parsed, err := url.Parse(c.Primary)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid primary URL %q", c.Primary)
+		}
+		if c.Interval.Duration <= 0 {
+			return errors.New("interval must be positive")
+		}
+	}
+	return nil
+}
+
+// ReplicationState is a single row recording the pulls of a standby and whether it was promoted
+type ReplicationState struct {
+	ID           uint `gorm:"primary_key;auto_increment:false"`
+	LastPulledAt *time.Time
+	LastError    string
+	PromotedAt   *time.Time
+}
+
+// replicationLocalTables are the tables every instance keeps for itself, such as the logs of the requests it
+// answered, which aren't replicated
+func replicationLocalTables(db *gorm.DB) map[string]bool {
+	tables := make(map[string]bool)
+	for _, model := range []interface{}{&AuthLog{}, &AccountingSession{}, &AccessPoint{}, &UnknownSSID{}, &JobLock{}, &ChangeCounter{},
+		&SchemaVersion{}, &ReplicationState{}} {
+		tables[db.NewScope(model).TableName()] = true
+	}
+	return tables
+}
+
+// replicationPromoted reports whether a standby was promoted to take over from its primary
+func replicationPromoted(db *gorm.DB) bool {
+	var state ReplicationState
+	return db.First(&state, replicationStateID).Error == nil && state.PromotedAt != nil
+}
+
+// registerStandbyGuard refuses changes to the replicated records until the standby is promoted, since the next
+// pull would overwrite them
+func registerStandbyGuard(db *gorm.DB) {
+	local := replicationLocalTables(db)
+	guard := func(scope *gorm.Scope) {
+		if !local[scope.TableName()] && !replicationPromoted(scope.NewDB()) {
+			scope.Err(errors.New("this instance is a standby, make the change on the primary or promote this instance first"))
+		}
+	}
+
+	// gorm logs every callback it registers
+	db = db.New()
+	db.SetLogger(gorm.Logger{LogWriter: log.New(ioutil.Discard, "", 0)})
+
+	db.Callback().Create().Before("gorm:create").Register("replication:create", guard)
+	db.Callback().Update().Before("gorm:update").Register("replication:update", guard)
+	db.Callback().Delete().Before("gorm:delete").Register("replication:delete", guard)
+}
+
+// replicationToken authenticates a request for a snapshot made at a time
+func replicationToken(secret string, at time.Time) string {
+	payload := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkReplicationToken checks the signature of a token and that it was made recently
+func checkReplicationToken(secret, token string, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	at, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(at, 0))
+	return hmac.Equal([]byte(replicationToken(secret, time.Unix(at, 0))), []byte(token)) &&
+		age < replicationTokenValidity && age > -replicationTokenValidity
+}
+
+// replicationCipher encrypts snapshots with a key derived from the secret
+func replicationCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSnapshot encrypts a snapshot, prefixed with its nonce
+func sealSnapshot(secret string, snapshot []byte) ([]byte, error) {
+	aead, err := replicationCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, snapshot, nil), nil
+}
+
+// openSnapshot decrypts a snapshot sealed by sealSnapshot
+func openSnapshot(secret string, sealed []byte) ([]byte, error) {
+	aead, err := replicationCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the snapshot is truncated")
+	}
+	snapshot, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("the snapshot can't be decrypted, check that both instances have the same secret")
+	}
+	return snapshot, nil
+}
+
+// takeSnapshot saves a consistent copy of the replicated records to a file, leaving out the local tables
+func takeSnapshot(db *gorm.DB, path string) error {
+	if err := db.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return err
+	}
+	snapshot, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	for table := range replicationLocalTables(db) {
+		// The standby checks the schema version of the snapshot
+		if table == db.NewScope(&SchemaVersion{}).TableName() {
+			continue
+		}
+		if err := snapshot.DropTableIfExists(table).Error; err != nil {
+			return err
+		}
+	}
+	return snapshot.Exec("VACUUM").Error
+}
+
+// applySnapshot replaces the replicated records with those of a snapshot in one transaction, so requests are
+// answered with either the old or the new records
+func applySnapshot(db *gorm.DB, path string) error {
+	if err := checkBackup(path); err != nil {
+		return err
+	}
+	snapshot, err := gorm.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	var version SchemaVersion
+	err = snapshot.Order("version DESC").First(&version).Error
+	snapshot.Close()
+	if err != nil {
+		return err
+	}
+	if version.Version != latestSchemaVersion() {
+		return fmt.Errorf("the primary has schema version %d and this instance %d, run the same version of the program on both", version.Version, latestSchemaVersion())
+	}
+
+	// The snapshot is only attached to a single connection
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS snapshot", path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE snapshot")
+
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM snapshot.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		if !replicationLocalTables(db)[table] {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		// Columns added by migrations are last, so the same columns can be in another order on each instance
+		columns, err := tableColumns(ctx, tx, "main", table)
+		if err == nil && len(columns) == 0 {
+			err = fmt.Errorf("the %v table of the primary is missing here", table)
+		}
+		var primaryColumns []string
+		if err == nil {
+			primaryColumns, err = tableColumns(ctx, tx, "snapshot", table)
+		}
+		// SQLite reads a quoted column that doesn't exist as a string, which would be copied into every row
+		if err == nil && !sameColumns(columns, primaryColumns) {
+			err = fmt.Errorf("the %v table has the columns %v on the primary and %v here", table, primaryColumns, columns)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		quoted := make([]string, len(columns))
+		for i, column := range columns {
+			quoted[i] = sqliteIdentifier(column)
+		}
+		list := strings.Join(quoted, ", ")
+		if _, err := tx.ExecContext(ctx, "DELETE FROM main."+sqliteIdentifier(table)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		query := fmt.Sprintf("INSERT INTO main.%v (%v) SELECT %v FROM snapshot.%v", sqliteIdentifier(table), list, list, sqliteIdentifier(table))
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("copying %v: %v", table, err)
+		}
+	}
+	// Tell the other instances sharing this database to clear their caches
+	if _, err := tx.ExecContext(ctx, "UPDATE change_counters SET count = count + 1 WHERE id = ?", changeCounterID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableColumns lists the columns of a table of an attached database, which are none if it doesn't have the table
+func tableColumns(ctx context.Context, tx *sql.Tx, schema, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA %v.table_info(%v)", schema, sqliteIdentifier(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// sameColumns reports whether two tables have the same columns, in any order
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	names := make(map[string]bool)
+	for _, column := range a {
+		names[column] = true
+	}
+	for _, column := range b {
+		if !names[column] {
+			return false
+		}
+	}
+	return true
+}
+
+// sqliteIdentifier quotes the name of a table or column for a query
+func sqliteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// ReplicationServer serves snapshots of the records to the standbys
+type ReplicationServer struct {
+	DB     *gorm.DB
+	Config ReplicationConfig
+
+	server *http.Server
+}
+
+// NewReplicationServer creates a ReplicationServer listening on the configured address
+func NewReplicationServer(config ReplicationConfig, db *gorm.DB) (*ReplicationServer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &ReplicationServer{DB: db, Config: config}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", s.snapshot)
+	s.server = &http.Server{
+		Addr:         config.Listen,
+		Handler:      accessLog("REPLICATION", mux),
+		ReadTimeout:  replicationTimeout,
+		WriteTimeout: replicationTimeout,
+	}
+	return s, nil
+}
+
+// Start the replication server
+func (s *ReplicationServer) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("REPLICATION: Starting server on %v", s.server.Addr)
+
+		listener, err := listen(s.server.Addr)
+		if err == nil {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("REPLICATION: Error starting replication server: %v", err)
+		} else {
+			log.Printf("REPLICATION: Stopped server")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop the replication server
+func (s *ReplicationServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// snapshot sends an encrypted snapshot of the records to an authenticated standby
+func (s *ReplicationServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkReplicationToken(s.Config.Secret, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), time.Now()) {
+		log.Printf("REPLICATION: Refused a snapshot to %v with an invalid token", r.RemoteAddr)
+		logSecurityEvent(securityTokenFailure, httpSource(r.RemoteAddr), "service=replication")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		log.Printf("REPLICATION: Unable to take a snapshot: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+	var sealed []byte
+	err = takeSnapshot(s.DB, path)
+	if err == nil {
+		var snapshot []byte
+		if snapshot, err = ioutil.ReadFile(path); err == nil {
+			sealed, err = sealSnapshot(s.Config.Secret, snapshot)
+		}
+	}
+	if err != nil {
+		log.Printf("REPLICATION: Unable to take a snapshot: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(sealed)
+}
+
+// Replicator pulls the records of the primary on a standby until it is promoted
+type Replicator struct {
+	DB     *gorm.DB
+	Config ReplicationConfig
+	// Applied is called after the records of the primary replaced those of the standby
+	Applied func()
+
+	client *http.Client
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewReplicator creates a Replicator pulling from the configured primary
+func NewReplicator(config ReplicationConfig, db *gorm.DB) (*Replicator, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Replicator{DB: db, Config: config, client: &http.Client{Timeout: replicationTimeout}}, nil
+}
+
+// Start pulls right away and then on every interval until Stop is called or the standby is promoted
+func (r *Replicator) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.Config.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			if replicationPromoted(r.DB) {
+				log.Printf("REPLICATION: This instance was promoted, no longer pulling from %v", r.Config.Primary)
+				return
+			}
+			r.Pull()
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running pull and stops the Replicator
+func (r *Replicator) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// Pull replaces the records with those of the primary, recording the outcome in the replication state
+func (r *Replicator) Pull() error {
+	err := r.pull()
+	state := map[string]interface{}{"last_error": ""}
+	if err != nil {
+		log.Printf("REPLICATION: Unable to pull from %v: %v", r.Config.Primary, err)
+		state["last_error"] = err.Error()
+	} else {
+		state["last_pulled_at"] = time.Now()
+	}
+	if err := r.DB.Model(&ReplicationState{ID: replicationStateID}).UpdateColumns(state).Error; err != nil {
+		log.Printf("REPLICATION: Unable to record the pull: %v", err)
+	}
+	if err == nil && r.Applied != nil {
+		r.Applied()
+	}
+	return err
+}
+
+func (r *Replicator) pull() error {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(r.Config.Primary, "/")+"/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+replicationToken(r.Config.Secret, time.Now()))
+	response, err := r.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("the primary answered %v", response.Status)
+	}
+	sealed, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	snapshot, err := openSnapshot(r.Config.Secret, sealed)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.db")
+	if err := ioutil.WriteFile(path, snapshot, 0600); err != nil {
+		return err
+	}
+	return applySnapshot(r.DB, path)
+}
+
+// promoteCommand makes a standby take over from its primary, so it stops pulling and accepts changes
+func promoteCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if config.Replication.Primary == "" {
+		return errors.New("this instance is not a standby, replication.primary is not set")
+	}
+	if replicationPromoted(db) {
+		return errors.New("this instance was already promoted")
+	}
+	if err := db.Model(&ReplicationState{ID: replicationStateID}).UpdateColumn("promoted_at", time.Now()).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Promoted this instance, it no longer pulls from %v and accepts changes. Remove replication.primary from "+
+		"its configuration, and make the old primary a standby of it before starting it again.\n", config.Replication.Primary)
+	return nil
+}
+
+// replicationStatusCommand shows whether this instance is a primary or a standby, and when a standby last pulled
+func replicationStatusCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("replication-status", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var state ReplicationState
+	if err := db.First(&state, replicationStateID).Error; err != nil {
+		return err
+	}
+	switch {
+	case config.Replication.Primary == "" && config.Replication.Listen == "":
+		fmt.Println("Role:        not replicated")
+	case config.Replication.Primary == "":
+		fmt.Printf("Role:        primary, serving standbys on %v\n", config.Replication.Listen)
+	case state.PromotedAt != nil:
+		fmt.Printf("Role:        promoted on %v, was a standby of %v\n", state.PromotedAt.Local().Format(time.RFC3339), config.Replication.Primary)
+	default:
+		fmt.Printf("Role:        standby of %v\n", config.Replication.Primary)
+	}
+	if state.LastPulledAt != nil {
+		fmt.Printf("Last pull:   %v\n", state.LastPulledAt.Local().Format(time.RFC3339))
+	}
+	if state.LastError != "" {
+		fmt.Printf("Last error:  %v\n", state.LastError)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestReplicationToken(t *testing.T) {
+	secret := "0123456789abcdef"
+	now := time.Unix(1700000000, 0)
+	token := replicationToken(secret, now)
+	if !strings.HasPrefix(token, "1700000000.") || len(token) != len("1700000000.")+64 {
+		t.Errorf("got token %q", token)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"current", token, true},
+		{"clock of the standby ahead", replicationToken(secret, now.Add(4*time.Minute)), true},
+		{"clock of the standby behind", replicationToken(secret, now.Add(-4*time.Minute)), true},
+		{"expired", replicationToken(secret, now.Add(-replicationTokenValidity)), false},
+		{"too far ahead", replicationToken(secret, now.Add(replicationTokenValidity)), false},
+		{"other secret", replicationToken("fedcba9876543210", now), false},
+		{"changed time", "1700000001" + token[10:], false},
+		{"changed signature", token[:len(token)-1] + "0", false},
+		{"uppercase signature", strings.ToUpper(token), false},
+		{"truncated signature", token[:len(token)-2], false},
+		{"signature only", token[11:], false},
+		{"time with a sign", "+" + token, false},
+		{"empty", "", false},
+		{"separator only", ".", false},
+		{"extra part", token + ".1", false},
+		{"time out of range", "99999999999999999999" + token[10:], false},
+		{"oldest time", "-9223372036854775808" + token[10:], false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkReplicationToken(secret, test.token, now); got != test.valid {
+				t.Errorf("got %v for %q", got, test.token)
+			}
+		})
+	}
+}
+
+func TestSealSnapshot(t *testing.T) {
+	secret := "0123456789abcdef"
+	snapshot := []byte("SQLite format 3\x00 and the records")
+	sealed, err := sealSnapshot(secret, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, snapshot[:15]) {
+		t.Error("the snapshot isn't encrypted")
+	}
+	opened, err := openSnapshot(secret, sealed)
+	if err != nil || !bytes.Equal(opened, snapshot) {
+		t.Errorf("got %q, %v", opened, err)
+	}
+
+	changed := append([]byte{}, sealed...)
+	changed[len(changed)-1] ^= 1
+	for name, invalid := range map[string][]byte{
+		"changed":                changed,
+		"truncated":              sealed[:len(sealed)-1],
+		"nonce only":             sealed[:12],
+		"shorter than the nonce": sealed[:5],
+		"empty":                  nil,
+	} {
+		if opened, err := openSnapshot(secret, invalid); err == nil {
+			t.Errorf("%v snapshot was opened as %q", name, opened)
+		}
+	}
+	if _, err := openSnapshot("fedcba9876543210", sealed); err == nil {
+		t.Error("the snapshot was opened with another secret")
+	}
+}
+
+// replicationTestDir creates a temporary directory, removed when the test finishes
+func replicationTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "test-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestApplySnapshot(t *testing.T) {
+	primary := openTestDatabase(t)
+	standby := openTestDatabase(t)
+	dir := replicationTestDir(t)
+
+	if err := primary.Create(&Device{MAC: "001122334455", Name: "primary"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Create(&AuthLog{MAC: "001122334455"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Create(&Device{MAC: "aabbccddeeff", Name: "standby"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Create(&AuthLog{MAC: "aabbccddeeff"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "snapshot.db")
+	if err := takeSnapshot(primary, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := applySnapshot(standby, path); err != nil {
+		t.Fatal(err)
+	}
+	var devices []Device
+	standby.Find(&devices)
+	if len(devices) != 1 || devices[0].Name != "primary" {
+		t.Errorf("got devices %+v", devices)
+	}
+	// The standby keeps its own logs
+	var logs []AuthLog
+	standby.Find(&logs)
+	if len(logs) != 1 || logs[0].MAC != "aabbccddeeff" {
+		t.Errorf("got auth logs %+v", logs)
+	}
+
+	invalid := map[string]func(snapshot *gorm.DB) error{
+		"older schema version": func(snapshot *gorm.DB) error {
+			return snapshot.Delete(SchemaVersion{}, "version = ?", latestSchemaVersion()).Error
+		},
+		"table missing here": func(snapshot *gorm.DB) error {
+			return snapshot.Exec("CREATE TABLE extra (id INTEGER)").Error
+		},
+		"table name with a quote": func(snapshot *gorm.DB) error {
+			return snapshot.Exec(`CREATE TABLE "devices"" (id INTEGER); --" (id INTEGER)`).Error
+		},
+		"column missing": func(snapshot *gorm.DB) error {
+			return snapshot.Exec("ALTER TABLE devices RENAME COLUMN name TO label").Error
+		},
+	}
+	for name, change := range invalid {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(name, " ", "-", -1)+".db")
+			if err := takeSnapshot(primary, path); err != nil {
+				t.Fatal(err)
+			}
+			snapshot, err := gorm.Open("sqlite3", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = change(snapshot)
+			snapshot.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := applySnapshot(standby, path); err == nil {
+				t.Error("the snapshot was applied")
+			}
+			var devices []Device
+			standby.Find(&devices)
+			if len(devices) != 1 || devices[0].Name != "primary" {
+				t.Errorf("the failed snapshot changed the devices to %+v", devices)
+			}
+		})
+	}
+
+	// Files that aren't complete databases
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"empty": nil, "truncated": data[:len(data)/2], "not a database": []byte("records")} {
+		broken := filepath.Join(dir, name+".db")
+		if err := ioutil.WriteFile(broken, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := applySnapshot(standby, broken); err == nil {
+			t.Errorf("the %v snapshot was applied", name)
+		}
+	}
+	if err := applySnapshot(standby, filepath.Join(dir, "missing.db")); err == nil {
+		t.Error("a missing snapshot was applied")
+	}
+}
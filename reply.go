@@ -0,0 +1,61 @@
+package main
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// addReplyAttributes adds the reply attributes of the groups granting access to the SSID to an Access-Accept.
+// When several groups apply, the shortest timeouts win, the first group with a reply profile sets the profile,
+// and each attribute of a GroupAttribute comes from the first group that sets it.
+func (rs *RadiusServer) addReplyAttributes(r *radius.Request, p *radius.Packet, groups []DeviceGroup, ssid string) {
+	var sessionTimeout, idleTimeout uint
+	reauthenticate := false
+	var profile *ReplyProfile
+	var attributes []GroupAttribute
+	for _, group := range groups {
+		if !groupAllowsSSID(group, ssid) {
+			continue
+		}
+		sessionTimeout = shortestTimeout(sessionTimeout, group.SessionTimeout)
+		idleTimeout = shortestTimeout(idleTimeout, group.IdleTimeout)
+		reauthenticate = reauthenticate || group.Reauthenticate
+		if profile == nil {
+			profile = group.ReplyProfile
+		}
+		attributes = inheritAttributes(attributes, group.Attributes)
+	}
+
+	if sessionTimeout > 0 {
+		rfc2865.SessionTimeout_Set(p, rfc2865.SessionTimeout(sessionTimeout))
+		// Ask the controller to reauthenticate the device when the session ends rather than disconnecting it
+		if reauthenticate {
+			rfc2865.TerminationAction_Set(p, rfc2865.TerminationAction_Value_RADIUSRequest)
+		}
+	}
+	if idleTimeout > 0 {
+		rfc2865.IdleTimeout_Set(p, rfc2865.IdleTimeout(idleTimeout))
+	}
+
+	if profile != nil {
+		// The client decides which vendor's attributes carry the profile
+		client, _ := rs.lookupClient(rs.DB, r.RemoteAddr)
+		template, ok := replyTemplates[client.Vendor]
+		if !ok {
+			requestLogf(r, "Unknown vendor %q for client %v, using standard attributes", client.Vendor, client.ClientIP)
+			template = standardReply
+		}
+		template(p, *profile)
+	}
+	for _, attribute := range attributes {
+		addGroupAttribute(p, attribute)
+	}
+}
+
+// shortestTimeout picks the shorter of two timeouts, where 0 means no timeout
+func shortestTimeout(a, b uint) uint {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/vendors/aruba"
+	"layeh.com/radius/vendors/mikrotik"
+)
+
+// tunnelTypeVLAN is the Tunnel-Type for assigning a VLAN (RFC 3580 section 3.31)
+const tunnelTypeVLAN rfc2868.TunnelType = 13
+
+// Vendor IDs and attribute types that the radius package has no dictionary for
+const (
+	vendorAirespace                               = 14179
+	airespaceACLName                              = 6
+	airespaceDataBandwidthAverageContract         = 7
+	airespaceDataBandwidthAverageContractUpstream = 13
+	vendorRuckus                                  = 25053
+	ruckusUserGroups                              = 1
+)
+
+// replyTemplate adds the attributes a controller understands for the settings in a ReplyProfile
+type replyTemplate func(p *radius.Packet, profile ReplyProfile)
+
+// replyTemplates are the built-in templates, selected by the Vendor of the Client. The empty vendor only uses
+// standard attributes.
+var replyTemplates = map[string]replyTemplate{
+	"":         standardReply,
+	"cisco":    ciscoReply,
+	"aruba":    arubaReply,
+	"ruckus":   ruckusReply,
+	"unifi":    unifiReply,
+	"mikrotik": mikrotikReply,
+}
+
+// replyVendors lists the vendors with a built-in template
+func replyVendors() []string {
+	var vendors []string
+	for vendor := range replyTemplates {
+		if vendor != "" {
+			vendors = append(vendors, vendor)
+		}
+	}
+	sort.Strings(vendors)
+	return vendors
+}
+
+// standardReply assigns the VLAN with the RFC 3580 tunnel attributes and the ACL with Filter-Id
+func standardReply(p *radius.Packet, profile ReplyProfile) {
+	addTunnelVLAN(p, profile.VLAN)
+	if profile.ACL != "" {
+		rfc2865.FilterID_SetString(p, profile.ACL)
+	}
+}
+
+// ciscoReply uses the Airespace attributes of Cisco wireless controllers for the ACL and rate limits
+func ciscoReply(p *radius.Packet, profile ReplyProfile) {
+	addTunnelVLAN(p, profile.VLAN)
+	if profile.ACL != "" {
+		addVendorAttribute(p, vendorAirespace, airespaceACLName, []byte(profile.ACL))
+	}
+	if profile.DownloadRate > 0 {
+		addVendorAttribute(p, vendorAirespace, airespaceDataBandwidthAverageContract, uint32Bytes(profile.DownloadRate))
+	}
+	if profile.UploadRate > 0 {
+		addVendorAttribute(p, vendorAirespace, airespaceDataBandwidthAverageContractUpstream, uint32Bytes(profile.UploadRate))
+	}
+}
+
+// arubaReply assigns the user role and VLAN. Aruba applies ACLs and rate limits through the role.
+func arubaReply(p *radius.Packet, profile ReplyProfile) {
+	if profile.VLAN > 0 {
+		aruba.ArubaUserVlan_Set(p, aruba.ArubaUserVlan(profile.VLAN))
+	}
+	if profile.Role != "" {
+		aruba.ArubaUserRole_SetString(p, profile.Role)
+	}
+}
+
+// ruckusReply assigns the user group used for role based access and the standard VLAN and ACL
+func ruckusReply(p *radius.Packet, profile ReplyProfile) {
+	standardReply(p, profile)
+	if profile.Role != "" {
+		addVendorAttribute(p, vendorRuckus, ruckusUserGroups, []byte(profile.Role))
+	}
+}
+
+// unifiReply only assigns the VLAN, which is the only authorization UniFi takes from RADIUS
+func unifiReply(p *radius.Packet, profile ReplyProfile) {
+	addTunnelVLAN(p, profile.VLAN)
+}
+
+// mikrotikReply uses the Mikrotik attributes for the VLAN, address list, group, and rate limit
+func mikrotikReply(p *radius.Packet, profile ReplyProfile) {
+	if profile.VLAN > 0 {
+		mikrotik.MikrotikWirelessVLANID_Set(p, mikrotik.MikrotikWirelessVLANID(profile.VLAN))
+		mikrotik.MikrotikWirelessVLANIDtype_Set(p, mikrotik.MikrotikWirelessVLANIDtype_Value_Eight021q)
+	}
+	if profile.ACL != "" {
+		mikrotik.MikrotikAddressList_SetString(p, profile.ACL)
+	}
+	if profile.Role != "" {
+		mikrotik.MikrotikGroup_SetString(p, profile.Role)
+	}
+	// The rate limit is from the router's point of view, so the upload from the device is received
+	if profile.UploadRate > 0 || profile.DownloadRate > 0 {
+		mikrotik.MikrotikRateLimit_SetString(p, fmt.Sprintf("%dk/%dk", profile.UploadRate, profile.DownloadRate))
+	}
+}
+
+func addTunnelVLAN(p *radius.Packet, vlan uint) {
+	if vlan == 0 {
+		return
+	}
+	rfc2868.TunnelType_Set(p, 0, tunnelTypeVLAN)
+	rfc2868.TunnelMediumType_Set(p, 0, rfc2868.TunnelMediumType_Value_IEEE802)
+	rfc2868.TunnelPrivateGroupID_SetString(p, 0, strconv.FormatUint(uint64(vlan), 10))
+}
+
+// addVendorAttribute adds a Vendor-Specific attribute for a vendor the radius package has no dictionary for
+func addVendorAttribute(p *radius.Packet, vendorID uint32, vendorType byte, value []byte) error {
+	attr := append([]byte{vendorType, byte(2 + len(value))}, value...)
+	vsa, err := radius.NewVendorSpecific(vendorID, attr)
+	if err != nil {
+		return err
+	}
+	p.Add(rfc2865.VendorSpecific_Type, vsa)
+	return nil
+}
+
+func uint32Bytes(value uint) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(value))
+	return b
+}
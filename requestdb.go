@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/jinzhu/gorm"
+)
+
+// contextDB runs the queries of a gorm handle with a context, which the SQLite driver interrupts them on once it
+// is done
+type contextDB struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+func (c contextDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c contextDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c contextDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c contextDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// requestDB returns the handle the lookups of a request are made with, whose queries are interrupted once the
+// request's context is done or DatabaseTimeout has passed, so a hung database fails the request instead of tying
+// up a handler. gorm doesn't take a context, so the handle is opened on top of the connection pool of rs.DB with
+// only the default callbacks: changes are still made through rs.DB.
+func (rs *RadiusServer) requestDB(ctx context.Context) (*gorm.DB, context.CancelFunc) {
+	if rs.DatabaseTimeout <= 0 || rs.DB.DB() == nil {
+		return rs.DB, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, rs.DatabaseTimeout)
+	db, err := gorm.Open(rs.DB.Dialect().GetName(), contextDB{db: rs.DB.DB(), ctx: ctx})
+	if err != nil {
+		cancel()
+		return rs.DB, func() {}
+	}
+	return db, cancel
+}
+
+// lookupCutShort reports whether the queries of a handle from requestDB were interrupted, in which case what
+// was loaded may be incomplete and mustn't be cached or answered with
+func lookupCutShort(db *gorm.DB) bool {
+	c, ok := db.CommonDB().(contextDB)
+	return ok && c.ctx.Err() != nil
+}
+
+// timedLookup runs the lookups of a request made with a handle from requestDB, reporting false and logging that
+// the request is dropped if they didn't finish in time. SQLite doesn't interrupt a query waiting on a lock, so
+// such a lookup is left to finish in the background, and whatever it sets mustn't be used.
+func (rs *RadiusServer) timedLookup(db *gorm.DB, from net.Addr, lookup func()) bool {
+	c, ok := db.CommonDB().(contextDB)
+	if !ok {
+		lookup()
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lookup()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.ctx.Done():
+	}
+	if c.ctx.Err() == nil {
+		return true
+	}
+	timedOut := atomic.AddUint64(&rs.databaseTimeouts, 1)
+	log.Printf("RADIUS: The database took longer than %v for the request from %v, dropping it (%d dropped)", rs.DatabaseTimeout, from, timedOut)
+	return false
+}
+
+// DatabaseTimeouts returns how many requests have been dropped because the database took too long
+func (rs *RadiusServer) DatabaseTimeouts() uint64 {
+	return atomic.LoadUint64(&rs.databaseTimeouts)
+}
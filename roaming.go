@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RoamingConfig stores the settings for alerts about a MAC address authenticating at two sites within a time no
+// device could travel between them in, which usually means the address is spoofed
+type RoamingConfig struct {
+	// Window is how soon after an authentication at one site one at another is implausible, or 0 to not alert
+	Window Duration `json:"window"`
+	// To are the addresses the alerts are emailed to
+	To []string `json:"to"`
+	// Sites maps the name of a site to the IP addresses, CIDR ranges, and NAS-Identifiers of its RADIUS clients.
+	// A client that isn't in any site is a site of its own.
+	Sites map[string][]string `json:"sites"`
+}
+
+// validate checks the roaming settings read from the configuration file
+func (c RoamingConfig) validate() error {
+	if c.Window.Duration <= 0 {
+		return errors.New("roaming.window must be positive")
+	}
+	_, err := parseRoamingSites(c.Sites)
+	return err
+}
+
+// roamingSites finds the site of the RADIUS client an authentication came from
+type roamingSites struct {
+	networks    []roamingNetwork
+	identifiers map[string]string
+}
+
+// roamingNetwork is a range of client addresses of a site
+type roamingNetwork struct {
+	site    string
+	network *net.IPNet
+}
+
+// parseRoamingSites reads the site mapping, refusing a client listed in two sites
+func parseRoamingSites(sites map[string][]string) (roamingSites, error) {
+	parsed := roamingSites{identifiers: make(map[string]string)}
+	seen := make(map[string]string)
+	for site, entries := range sites {
+		if site == "" {
+			return parsed, errors.New("roaming sites must have a name")
+		}
+		for _, entry := range entries {
+			key := entry
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				entry = fmt.Sprintf("%v/%d", ip, bits)
+			}
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				key = network.String()
+				parsed.networks = append(parsed.networks, roamingNetwork{site, network})
+			} else if entry == "" {
+				return parsed, fmt.Errorf("roaming site %q has an empty client", site)
+			} else {
+				parsed.identifiers[entry] = site
+			}
+			if other, ok := seen[key]; ok && other != site {
+				return parsed, fmt.Errorf("%v is in both roaming sites %q and %q", key, other, site)
+			}
+			seen[key] = site
+		}
+	}
+	return parsed, nil
+}
+
+// site returns the site of an authentication: the site listing its NAS-Identifier, or else the one with the
+// narrowest range holding its client address, or else the client address itself
+func (s roamingSites) site(event AuthEvent) string {
+	if site, ok := s.identifiers[event.NASIdentifier]; ok && event.NASIdentifier != "" {
+		return site
+	}
+	ip := net.ParseIP(event.Client)
+	site, narrowest := "", -1
+	for _, n := range s.networks {
+		ones, _ := n.network.Mask.Size()
+		if ip != nil && n.network.Contains(ip) && ones > narrowest {
+			site, narrowest = n.site, ones
+		}
+	}
+	if site == "" {
+		return event.Client
+	}
+	return site
+}
+
+// RoamingLocation is where and when a device authenticated
+type RoamingLocation struct {
+	Site          string    `json:"site"`
+	Client        string    `json:"client"`
+	NASIdentifier string    `json:"nas_identifier,omitempty"`
+	AccessPoint   string    `json:"access_point,omitempty"`
+	SSID          string    `json:"ssid,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// RoamingAlert is a MAC address that authenticated at a site too soon after authenticating at another one. It is
+// the data of the roaming email template and the auth.roaming webhook event.
+type RoamingAlert struct {
+	MAC  string          `json:"mac"`
+	From RoamingLocation `json:"from"`
+	To   RoamingLocation `json:"to"`
+}
+
+// Elapsed returns the time between the two authentications
+func (a RoamingAlert) Elapsed() time.Duration {
+	return a.To.Time.Sub(a.From.Time).Round(time.Second)
+}
+
+// roamingState is the latest accepted authentication of a MAC address
+type roamingState struct {
+	location RoamingLocation
+	// silencedUntil stops the same MAC address from sending another alert until the window has passed
+	silencedUntil time.Time
+}
+
+// RoamingDetector watches the accepted authentications for a MAC address showing up at two sites within the
+// window, and emails and posts an alert about it in the background so the RADIUS handler never waits
+type RoamingDetector struct {
+	config   RoamingConfig
+	sites    roamingSites
+	mailer   *Mailer
+	webhooks *Webhooks
+
+	mutex     sync.Mutex
+	states    map[string]*roamingState
+	lastSweep time.Time
+	queue     chan RoamingAlert
+	done      chan struct{}
+}
+
+// NewRoamingDetector checks the configuration, creates a RoamingDetector, and starts sending. The mailer is nil
+// when email isn't set up, and webhooks is nil when there are none.
+func NewRoamingDetector(config RoamingConfig, mailer *Mailer, webhooks *Webhooks) (*RoamingDetector, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	sites, _ := parseRoamingSites(config.Sites)
+	d := &RoamingDetector{
+		config:   config,
+		sites:    sites,
+		mailer:   mailer,
+		webhooks: webhooks,
+		states:   make(map[string]*roamingState),
+		queue:    make(chan RoamingAlert, alertQueueSize),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// Observe compares an accepted authentication with the previous one of the same MAC address
+func (d *RoamingDetector) Observe(event AuthEvent) {
+	if !event.Accepted || event.MAC == "" {
+		return
+	}
+	location := RoamingLocation{
+		Site:          d.sites.site(event),
+		Client:        event.Client,
+		NASIdentifier: event.NASIdentifier,
+		AccessPoint:   event.AccessPoint,
+		SSID:          event.SSID,
+		Time:          event.Time,
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state, ok := d.states[event.MAC]
+	if !ok {
+		state = &roamingState{}
+		d.states[event.MAC] = state
+	} else if state.location.Site != location.Site && event.Time.Sub(state.location.Time) < d.config.Window.Duration &&
+		!event.Time.Before(state.silencedUntil) {
+		state.silencedUntil = event.Time.Add(d.config.Window.Duration)
+		alert := RoamingAlert{MAC: event.MAC, From: state.location, To: location}
+		log.Printf("ALERT: %v authenticated at %v %v after authenticating at %v, it may be spoofed",
+			prettyPrintMACAddress(event.MAC), location.Site, alert.Elapsed(), alert.From.Site)
+		select {
+		case d.queue <- alert:
+		default:
+			log.Printf("ALERT: Queue is full, dropping roaming alert for %v", prettyPrintMACAddress(event.MAC))
+		}
+	}
+	state.location = location
+
+	if event.Time.Sub(d.lastSweep) >= time.Minute {
+		d.sweep(event.Time)
+		d.lastSweep = event.Time
+	}
+}
+
+// sweep forgets MAC addresses whose latest authentication is older than the window
+func (d *RoamingDetector) sweep(now time.Time) {
+	for mac, state := range d.states {
+		if now.Sub(state.location.Time) >= d.config.Window.Duration && now.After(state.silencedUntil) {
+			delete(d.states, mac)
+		}
+	}
+}
+
+// Stop sends the queued alerts and stops the RoamingDetector
+func (d *RoamingDetector) Stop() {
+	close(d.queue)
+	<-d.done
+}
+
+func (d *RoamingDetector) run() {
+	defer close(d.done)
+	for alert := range d.queue {
+		if d.webhooks != nil {
+			d.webhooks.Roaming(alert)
+		}
+		if len(d.config.To) == 0 || d.mailer == nil {
+			continue
+		}
+		// Emails show the MAC address as the other alerts do
+		mail := alert
+		mail.MAC = prettyPrintMACAddress(alert.MAC)
+		if err := d.mailer.Send(d.config.To, "roaming", mail); err != nil {
+			log.Printf("ALERT: Unable to send roaming alert for %v: %v", mail.MAC, err)
+		} else {
+			log.Printf("ALERT: Sent roaming alert for %v to %v", mail.MAC, d.config.To)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events of the security log
+const (
+	// securityLoginFailure is a wrong username or password for an administrative user
+	securityLoginFailure = "login-failure"
+	// securityTokenFailure is an invalid or expired token for the replication or sponsor server, or /presence
+	securityTokenFailure = "token-failure"
+	// securityUnknownClient is a RADIUS packet from an address that isn't a registered client
+	securityUnknownClient = "radius-unknown-client"
+	// securityBadAuthenticator is a RADIUS request with an invalid Message-Authenticator
+	securityBadAuthenticator = "radius-bad-authenticator"
+	// securityRateLimit is a RADIUS client going over radius.nas_rate_limit
+	securityRateLimit = "radius-rate-limit"
+)
+
+// A source may write securityLogBurst lines of an event every securityLogWindow. The lines over that are counted
+// and the count is added to the next line written, so a flood of packets can't fill the disk but the filters
+// still see every source.
+const (
+	securityLogBurst  = 10
+	securityLogWindow = time.Minute
+)
+
+// securityLog receives the failures and floods fail2ban or CrowdSec can block at the firewall, or is nil when
+// logging.security_file isn't set
+var securityLog io.Writer
+
+// securityLogSource counts the lines of an event from a source in the current window
+type securityLogSource struct {
+	windowStart time.Time
+	written     int
+	suppressed  uint64
+}
+
+var (
+	securityLogMutex     sync.Mutex
+	securityLogSources   = make(map[string]*securityLogSource)
+	securityLogLastSweep time.Time
+)
+
+// logSecurityEvent writes a line of the security log: the time, the event, and the source address, always in
+// that order and separated by spaces, followed by the details as key=value pairs
+func logSecurityEvent(event string, source net.IP, details string) {
+	if securityLog == nil {
+		return
+	}
+	address := "-"
+	if source != nil {
+		address = source.String()
+	}
+	now := time.Now()
+
+	securityLogMutex.Lock()
+	defer securityLogMutex.Unlock()
+
+	if now.Sub(securityLogLastSweep) >= securityLogWindow {
+		sweepSecurityLog(now)
+		securityLogLastSweep = now
+	}
+
+	key := event + " " + address
+	state, ok := securityLogSources[key]
+	if !ok || now.Sub(state.windowStart) >= securityLogWindow {
+		if ok && state.suppressed > 0 {
+			details = joinSecurityDetails(details, fmt.Sprintf("suppressed=%d", state.suppressed))
+		}
+		state = &securityLogSource{windowStart: now}
+		securityLogSources[key] = state
+	}
+	if state.written >= securityLogBurst {
+		state.suppressed++
+		return
+	}
+	state.written++
+	writeSecurityLine(now, event, address, details)
+}
+
+// sweepSecurityLog forgets the sources whose window has passed, writing how many of their lines were left out
+func sweepSecurityLog(now time.Time) {
+	for key, state := range securityLogSources {
+		if now.Sub(state.windowStart) < securityLogWindow {
+			continue
+		}
+		if state.suppressed > 0 {
+			fields := strings.SplitN(key, " ", 2)
+			writeSecurityLine(now, fields[0], fields[1], fmt.Sprintf("suppressed=%d", state.suppressed))
+		}
+		delete(securityLogSources, key)
+	}
+}
+
+func writeSecurityLine(now time.Time, event, address, details string) {
+	line := fmt.Sprintf("%v %v %v", now.Format(time.RFC3339), event, address)
+	if details != "" {
+		line += " " + details
+	}
+	securityLog.Write([]byte(line + "\n"))
+}
+
+func joinSecurityDetails(details, extra string) string {
+	if details == "" {
+		return extra
+	}
+	return details + " " + extra
+}
+
+// httpSource returns the address an HTTP request came from
+func httpSource(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
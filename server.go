@@ -1,6 +1,9 @@
 package main
 
 import (
+	"expvar"
+	"flag"
+	"log"
 	"os/signal"
 	"sync"
 
@@ -12,33 +15,421 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "config.json", "path to the configuration file")
+	admin := flag.String("admin", "", "administrative user proposing or deciding a change that needs approval")
+	adminPassword := flag.String("admin-password", "", "password of the -admin user")
+	flag.Parse()
+
+	// Load the configuration
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Unable to load configuration file %v: %v", *configPath, err)
+	}
+
+	// Tell the instances sharing the database apart
+	if config.Cluster.Instance != "" {
+		instanceName = config.Cluster.Instance
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+		log.SetPrefix(instanceName + ": ")
+	}
+
+	// Write the logs of the servers to files, while commands keep writing to the console
+	var logs *logFiles
+	if flag.NArg() == 0 {
+		logs, err = openLogFiles(config.Logging)
+		if err != nil {
+			log.Fatalf("Unable to open the log files: %v", err)
+		}
+		defer logs.Close()
+	}
+
+	// Load the attributes of other vendors
+	dict, err := loadDictionaries(config.RADIUS.Dictionaries)
+	if err != nil {
+		log.Fatalf("Unable to load RADIUS dictionary %v", err)
+	}
+	radiusDictionary = dict
+
 	// Open the database
-	db, err := gorm.Open("sqlite3", "data.db")
+	db, err := gorm.Open("sqlite3", databasePath)
 	if err != nil {
 		panic("Unable to create or open database")
 	}
 	defer db.Close()
 
 	// Migrate the schema
-	db.AutoMigrate(&Device{}, &DeviceGroup{}, &Network{}, &Client{}, &User{})
+	if err := migrateDatabase(db); err != nil {
+		log.Fatalf("Unable to migrate the database: %v", err)
+	}
+
+	// Send record changes to the webhooks, including those made by commands
+	webhooks, err := NewWebhooks(config.Webhooks)
+	if err != nil {
+		log.Fatalf("Invalid webhook configuration: %v", err)
+	}
+	var auditListeners []AuditListener
+	if webhooks != nil {
+		defer webhooks.Stop()
+		auditListeners = append(auditListeners, webhooks.RecordChanged)
+	}
+	registerAuditCallbacks(db, auditListeners...)
+	registerChangeCounter(db)
+	if config.Replication.Primary != "" {
+		registerStandbyGuard(db)
+	}
+	// Tell the instances sharing the cache in Redis about changes, including those made by commands
+	var sharedCache *RedisCache
+	if config.Redis.Address != "" {
+		sharedCache, err = NewRedisCache(config.Redis, config.RADIUS.DeviceCacheTTL.Duration)
+		if err != nil {
+			log.Fatalf("Invalid Redis configuration: %v", err)
+		}
+		defer sharedCache.Stop()
+		registerRedisInvalidation(db, sharedCache)
+	}
+
+	// Run an administrative command instead of the servers if one was given
+	if flag.NArg() > 0 {
+		if err := runCommand(config, withAdminLogin(withAuditActor(db, commandActor()), *admin, *adminPassword), flag.Args()); err != nil {
+			log.Printf("Error: %v", err)
+			if webhooks != nil {
+				webhooks.Stop()
+			}
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	// WaitGroup to track when our routines finish
 	var wait sync.WaitGroup
 
 	// Initialize the RADIUS server handler
 	radius := NewRadiusServer(db)
+	radius.RequireMessageAuthenticator = config.RADIUS.RequireMessageAuthenticator
+	radius.RejectReplyMessage = config.RADIUS.RejectReplyMessage
+	radius.Addr = config.RADIUS.Listen
+	radius.AccountingAddr = config.RADIUS.AccountingListen
+	if radius.AccountingAddr == radius.Addr {
+		log.Fatalf("Invalid RADIUS configuration: radius.accounting_listen must differ from radius.listen, or be empty to disable accounting")
+	} else if radius.AccountingAddr == "" {
+		log.Printf("RADIUS: Accounting is disabled")
+	}
+	radius.ClientResolveInterval = config.RADIUS.ClientResolveInterval.Duration
+	radius.MACRateLimit = config.RADIUS.MACRateLimit.NewRateLimiter()
+	radius.NASRateLimit = config.RADIUS.NASRateLimit.NewRateLimiter()
+	radius.DuplicateCacheTTL = config.RADIUS.DuplicateCacheTTL.Duration
+	radius.DeviceCacheTTL = config.RADIUS.DeviceCacheTTL.Duration
+	radius.PrewarmDevices = config.RADIUS.PrewarmDevices
+	if sharedCache != nil {
+		radius.SharedCache = sharedCache
+		sharedCache.Invalidated = radius.InvalidateCache
+		sharedCache.Start()
+	}
+	radius.ChangePollInterval = config.Cluster.PollInterval.Duration
+	radius.MaxConcurrentRequests = config.RADIUS.MaxConcurrentRequests
+	radius.RequestTimeout = config.RADIUS.RequestTimeout.Duration
+	radius.DatabaseTimeout = config.RADIUS.DatabaseTimeout.Duration
+	radius.ShutdownTimeout = config.RADIUS.ShutdownTimeout.Duration
+	if err := validateRadiusListeners(config.RADIUS.Listeners); err != nil {
+		log.Fatalf("Invalid RADIUS listener configuration: %v", err)
+	}
+	radius.Listeners = config.RADIUS.Listeners
+	radius.QuarantineGroup = config.Quarantine.Group
+	expvar.Publish("radius", expvar.Func(func() interface{} {
+		return map[string]uint64{
+			"dropped_packets":    radius.DroppedPackets(),
+			"shed_requests":      radius.ShedRequests(),
+			"timed_out_requests": radius.TimedOutRequests(),
+			"database_timeouts":  radius.DatabaseTimeouts(),
+			"panicked_requests":  radius.PanickedRequests(),
+		}
+	}))
+
+	// Record the authentications
+	if config.AuthLog.Enabled {
+		authLog := NewAuthLogWriter(db)
+		defer authLog.Stop()
+		radius.AuthListeners = append(radius.AuthListeners, authLog.Log)
+	}
+
+	// Keep the inventory of access points
+	accessPoints := NewAccessPointRecorder(db)
+	defer accessPoints.Stop()
+	radius.AuthListeners = append(radius.AuthListeners, accessPoints.AuthEvent)
+
+	// Keep the list of requested SSIDs without a network
+	unknownSSIDs := NewUnknownSSIDRecorder(db)
+	defer unknownSSIDs.Stop()
+	radius.AuthListeners = append(radius.AuthListeners, unknownSSIDs.AuthEvent)
+
+	if logs.auth != nil {
+		radius.AuthListeners = append(radius.AuthListeners, logs.AuthEvent)
+	}
+	if webhooks != nil {
+		radius.AuthListeners = append(radius.AuthListeners, webhooks.AuthEvent)
+	}
+
+	// Export the accounting data to InfluxDB
+	influx, err := NewInfluxExporter(config.Influx, db)
+	if err != nil {
+		log.Fatalf("Invalid InfluxDB configuration: %v", err)
+	}
+	if influx != nil {
+		defer influx.Stop()
+		radius.AccountingListeners = append(radius.AccountingListeners, influx.AccountingSession)
+	}
+
+	// Publish the authentications to MQTT
+	if mqtt := NewMQTTPublisher(config.MQTT); mqtt != nil {
+		defer mqtt.Stop()
+		radius.AuthListeners = append(radius.AuthListeners, mqtt.AuthEvent)
+	}
+
+	// Post notifications to chat services
+	chat, err := NewChatNotifier(config.Chat)
+	if err != nil {
+		log.Fatalf("Invalid chat configuration: %v", err)
+	}
+	if chat != nil {
+		defer chat.Stop()
+		radius.AuthListeners = append(radius.AuthListeners, chat.AuthEvent)
+		radius.SecretMismatchListeners = append(radius.SecretMismatchListeners, chat.SecretMismatch)
+	}
+
+	// Send email alerts and quarantine the devices triggering them
+	if len(config.Alerts) > 0 {
+		mailer := NewMailer(config.SMTP)
+		if mailer == nil {
+			log.Printf("Warning: Alerts are configured without an SMTP server and will not be emailed")
+		}
+		var quarantine func(mac string, event string) error
+		if config.Quarantine.Group != "" {
+			quarantine = func(mac string, event string) error {
+				if _, err := quarantineDevice(withAuditActor(db, "alert"), config.Quarantine.Group, mac, "quarantined by the "+event+" alert"); err != nil {
+					return err
+				}
+				radius.InvalidateCache()
+				return nil
+			}
+		}
+		alerter, err := NewAlerter(config.Alerts, mailer, quarantine)
+		if err != nil {
+			log.Fatalf("Invalid alert configuration: %v", err)
+		}
+		defer alerter.Stop()
+		radius.AuthListeners = append(radius.AuthListeners, alerter.Observe)
+	}
+
+	// Alert about MAC addresses authenticating at two sites too quickly
+	if config.Roaming.Window.Duration > 0 {
+		mailer := NewMailer(config.SMTP)
+		if mailer == nil && len(config.Roaming.To) > 0 {
+			log.Printf("Warning: Roaming alerts are configured without an SMTP server and will not be emailed")
+		}
+		roaming, err := NewRoamingDetector(config.Roaming, mailer, webhooks)
+		if err != nil {
+			log.Fatalf("Invalid roaming configuration: %v", err)
+		}
+		defer roaming.Stop()
+		radius.AuthListeners = append(radius.AuthListeners, roaming.Observe)
+	}
+
+	// Count the authentications for SNMP monitoring
+	var snmp *SNMPAgent
+	if config.SNMP.Listen != "" {
+		snmp, err = NewSNMPAgent(config.SNMP, &radius)
+		if err != nil {
+			log.Fatalf("Invalid SNMP configuration: %v", err)
+		}
+		radius.AuthListeners = append(radius.AuthListeners, snmp.AuthEvent)
+	}
+
+	// Stream the authentications to management API clients
+	var grpc *GRPCServer
+	if config.GRPC.Listen != "" {
+		grpc, err = NewGRPCServer(config.GRPC, config.Approval, db)
+		if err != nil {
+			log.Fatalf("Invalid gRPC configuration: %v", err)
+		}
+		radius.AuthListeners = append(radius.AuthListeners, grpc.AuthEvent)
+	}
+
+	// Set up EAP-TLS with the built-in CA
+	if config.EAP.Enabled {
+		serverName := config.EAP.ServerName
+		if serverName == "" {
+			serverName, _ = os.Hostname()
+		}
+		ca, err := loadCertificateAuthority(config.EAP.PKIDir)
+		if err != nil {
+			log.Fatalf("Unable to load the certificate authority: %v", err)
+		}
+		tlsConfig, err := newEAPTLSConfig(ca, serverName)
+		if err != nil {
+			log.Fatalf("Unable to load the EAP-TLS server certificate: %v", err)
+		}
+		radius.EAP = NewEAPServer(tlsConfig)
+	}
+
+	// Remove old logs and sessions
+	janitor := NewJanitor(db, config.Retention)
+	janitor.StaleDevices = config.StaleDevices
+	janitor.Mailer = NewMailer(config.SMTP)
+	if config.Replication.Primary != "" {
+		janitor.Standby = func() bool { return !replicationPromoted(db) }
+	}
+	janitor.Start()
+	defer janitor.Stop()
+
+	// Sync devices from the directory and the inventory
+	if config.LDAP.URL != "" && config.LDAP.Interval.Duration > 0 {
+		ldapSync, err := NewLDAPSync(config.LDAP, config.Approval, db)
+		if err != nil {
+			log.Fatalf("Invalid LDAP configuration: %v", err)
+		}
+		if config.Replication.Primary != "" {
+			ldapSync.Standby = func() bool { return !replicationPromoted(db) }
+		}
+		ldapSync.Start()
+		defer ldapSync.Stop()
+	}
+	if config.NetBox.URL != "" && config.NetBox.Interval.Duration > 0 {
+		netboxSync, err := NewNetBoxSync(config.NetBox, config.Approval, db)
+		if err != nil {
+			log.Fatalf("Invalid NetBox configuration: %v", err)
+		}
+		if config.Replication.Primary != "" {
+			netboxSync.Standby = func() bool { return !replicationPromoted(db) }
+		}
+		netboxSync.Start()
+		defer netboxSync.Stop()
+	}
+
+	// Close the sessions whose Stop was lost
+	if len(config.SessionPoller.Targets) > 0 {
+		poller, err := NewSessionPoller(config.SessionPoller, db)
+		if err != nil {
+			log.Fatalf("Invalid session poller configuration: %v", err)
+		}
+		if config.Replication.Primary != "" {
+			poller.Standby = func() bool { return !replicationPromoted(db) }
+		}
+		poller.Start()
+		defer poller.Stop()
+	}
 
 	// Run the RADIUS server
 	wait.Add(1)
 	radius.Start(&wait)
 
+	// Run the health check server
+	var status *StatusServer
+	if config.Status.Listen != "" {
+		status = NewStatusServer(config.Status.Listen, db, &radius)
+		status.PresenceToken = config.Status.PresenceToken
+		status.PresenceTimeout = config.Status.PresenceTimeout.Duration
+		wait.Add(1)
+		status.Start(&wait)
+	}
+
+	// Run the SNMP agent
+	if snmp != nil {
+		wait.Add(1)
+		snmp.Start(&wait)
+	}
+
+	// Run the profiling server
+	var debug *DebugServer
+	if config.Debug.Listen != "" {
+		debug = NewDebugServer(config.Debug.Listen, db)
+		if chat != nil {
+			debug.LoginFailureListeners = append(debug.LoginFailureListeners, chat.LoginFailure)
+		}
+		wait.Add(1)
+		debug.Start(&wait)
+	}
+
+	// Tell systemd the service is up once RADIUS requests are being answered
+	go func() {
+		<-radius.Ready()
+		sdNotify("READY=1")
+	}()
+
+	// Serve the links that approve or deny guest devices
+	var sponsor *SponsorServer
+	if config.Sponsor.Listen != "" {
+		sponsor, err = NewSponsorServer(config.Sponsor, db)
+		if err != nil {
+			log.Fatalf("Invalid sponsor configuration: %v", err)
+		}
+		wait.Add(1)
+		sponsor.Start(&wait)
+	}
+
+	// Serve the records to the standbys, or pull them from the primary
+	var replication *ReplicationServer
+	if config.Replication.Listen != "" {
+		replication, err = NewReplicationServer(config.Replication, db)
+		if err != nil {
+			log.Fatalf("Invalid replication configuration: %v", err)
+		}
+		wait.Add(1)
+		replication.Start(&wait)
+	}
+	if config.Replication.Primary != "" {
+		replicator, err := NewReplicator(config.Replication, db)
+		if err != nil {
+			log.Fatalf("Invalid replication configuration: %v", err)
+		}
+		replicator.Applied = radius.InvalidateCache
+		replicator.Start()
+		defer replicator.Stop()
+	}
+
+	// Run the management API
+	if grpc != nil {
+		wait.Add(1)
+		grpc.Start(&wait)
+	}
+
+	// Reload devices and networks from the database on SIGHUP, after changing them with a command
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Printf("Clearing the device cache")
+			radius.InvalidateCache()
+		}
+	}()
+
 	// Handle Ctrl-C
-	ctrlc := make(chan os.Signal)
+	ctrlc := make(chan os.Signal, 1)
 	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-ctrlc
 		// Print a blank line to the console so the ^C doesn't mess up the output
 		println("")
+		sdNotify("STOPPING=1")
 		radius.Stop()
+		if status != nil {
+			status.Stop()
+		}
+		if snmp != nil {
+			snmp.Stop()
+		}
+		if debug != nil {
+			debug.Stop()
+		}
+		if sponsor != nil {
+			sponsor.Stop()
+		}
+		if replication != nil {
+			replication.Stop()
+		}
+		if grpc != nil {
+			grpc.Stop()
+		}
 	}()
 
 	// Wait for the goroutines to finish
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// sessionLimit finds the most sessions a device may have open when connecting to the SSID: its own limit if
+// set, otherwise the smallest limit of its groups granting access to the SSID. 0 means no limit.
+func sessionLimit(device Device, groups []DeviceGroup, ssid string) uint {
+	if device.MaxSessions != nil {
+		return *device.MaxSessions
+	}
+	var limit uint
+	for _, group := range groups {
+		if groupAllowsSSID(group, ssid) {
+			limit = shortestTimeout(limit, group.MaxSessions)
+		}
+	}
+	return limit
+}
+
+// sessionLimitReached reports whether the MAC address of a request already has as many active accounting
+// sessions as its device may have. The sessions are counted for the MAC address rather than the device, since
+// a device such as "b827eb*" matches many addresses that each have their own limit. Sessions are active until
+// the controller sends a Stop, an Accounting-On or Off, or the janitor removes them.
+//
+// Sessions of the NAS sending the request aren't counted: a NAS only associates a MAC address once, so its open
+// session is the one being re-authenticated, or the one the device leaves when roaming between its access points.
+func (rs *RadiusServer) sessionLimitReached(db *gorm.DB, nas, mac string, device Device, groups []DeviceGroup, ssid string) bool {
+	limit := sessionLimit(device, groups, ssid)
+	if limit == 0 {
+		return false
+	}
+
+	var active uint
+	if err := db.Model(&AccountingSession{}).Where("mac = ? AND client <> ? AND stopped_at IS NULL", mac, nas).Count(&active).Error; err != nil {
+		log.Printf("RADIUS: Unable to count the sessions of %v: %v", prettyPrintMACAddress(mac), err)
+		return false
+	}
+	if active >= limit {
+		log.Printf("RADIUS: %v already has %d active sessions, the limit is %d", prettyPrintMACAddress(mac), active, limit)
+		return true
+	}
+	return false
+}
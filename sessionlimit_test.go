@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimitReached(t *testing.T) {
+	db := openTestDatabase(t)
+	rs := NewRadiusServer(db)
+	now := time.Now()
+	sessions := []AccountingSession{
+		{SessionID: "a", Client: "10.0.0.1", MAC: "b827eb000001", StartedAt: now},
+		{SessionID: "b", Client: "10.0.0.2", MAC: "b827eb000002", StartedAt: now},
+		{SessionID: "c", Client: "10.0.0.2", MAC: "b827eb000003", StartedAt: now, StoppedAt: &now},
+	}
+	for _, session := range sessions {
+		if err := db.Create(&session).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	one, two := uint(1), uint(2)
+	device := Device{MAC: "b827eb*", MaxSessions: &one}
+
+	tests := []struct {
+		name    string
+		nas     string
+		mac     string
+		device  Device
+		limited bool
+	}{
+		{"open session on another NAS", "10.0.0.2", "b827eb000001", device, true},
+		{"re-authenticating on the same NAS", "10.0.0.1", "b827eb000001", device, false},
+		{"other address under the prefix", "10.0.0.1", "b827eb000002", device, true},
+		{"stopped session", "10.0.0.1", "b827eb000003", device, false},
+		{"no sessions", "10.0.0.1", "b827eb000004", device, false},
+		{"higher limit", "10.0.0.2", "b827eb000001", Device{MAC: "b827eb*", MaxSessions: &two}, false},
+		{"no limit", "10.0.0.2", "b827eb000001", Device{MAC: "b827eb*"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rs.sessionLimitReached(db, test.nas, test.mac, test.device, nil, "Corp"); got != test.limited {
+				t.Errorf("got %v, want %v", got, test.limited)
+			}
+		})
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	zero := uint(0)
+	staff := DeviceGroup{Name: "staff", MaxSessions: 3, Networks: []Network{{SSID: "Corp"}}}
+	lab := DeviceGroup{Name: "lab", MaxSessions: 1, Networks: []Network{{SSID: "Lab"}}}
+	unlimited := DeviceGroup{Name: "any", Networks: []Network{{SSID: wildcardSSID}}}
+
+	tests := []struct {
+		name   string
+		device Device
+		groups []DeviceGroup
+		ssid   string
+		want   uint
+	}{
+		{"group granting the SSID", Device{}, []DeviceGroup{staff, lab}, "Corp", 3},
+		{"smallest limit", Device{}, []DeviceGroup{staff, lab, {Name: "corp", MaxSessions: 2, Networks: []Network{{SSID: "Corp"}}}}, "Corp", 2},
+		{"group without a limit", Device{}, []DeviceGroup{staff, unlimited}, "Corp", 3},
+		{"no group granting the SSID", Device{}, []DeviceGroup{lab}, "Corp", 0},
+		{"device without a limit", Device{MaxSessions: &zero}, []DeviceGroup{staff}, "Corp", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sessionLimit(test.device, test.groups, test.ssid); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
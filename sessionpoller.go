@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// snmpPollTimeout is how long a response to a request of the session poller is waited for, after which the
+	// request is sent again up to snmpPollRetries times
+	snmpPollTimeout = 5 * time.Second
+	snmpPollRetries = 2
+	// snmpPollRepetitions is how many rows of the station table are asked for at once
+	snmpPollRepetitions = 25
+	// snmpPollMaxRows stops walking a table that doesn't end, such as from an agent answering the same OID
+	snmpPollMaxRows = 100000
+	// accountingTerminateReconciled is recorded for the sessions the session poller closes
+	accountingTerminateReconciled = "Lost-Carrier"
+)
+
+// SessionPollerConfig stores the access points and controllers whose associated stations are polled over SNMP to
+// close the accounting sessions whose Stop was lost
+type SessionPollerConfig struct {
+	// Interval is how often the targets are polled
+	Interval Duration `json:"interval"`
+	// Targets are the access points and controllers to poll, or empty to not poll any
+	Targets []SessionPollTarget `json:"targets"`
+}
+
+// SessionPollTarget is a RADIUS client whose sessions are checked against the stations its SNMP agent lists
+type SessionPollTarget struct {
+	// Client is the address the client sends accounting from, which its sessions are recorded with
+	Client string `json:"client"`
+	// Address is the SNMP agent, by default port 161 of Client
+	Address string `json:"address"`
+	// Community is the SNMPv2c community of the agent
+	Community string `json:"community"`
+	// OID is a column of the station table, whose values or the last six numbers of whose indexes are the MAC
+	// addresses of the associated stations
+	OID string `json:"oid"`
+}
+
+// validate checks the session poller settings read from the configuration file
+func (c SessionPollerConfig) validate() error {
+	if c.Interval.Duration <= 0 {
+		return errors.New("session_poller.interval must be positive")
+	}
+	for _, target := range c.Targets {
+		if net.ParseIP(target.Client) == nil {
+			return fmt.Errorf("invalid session_poller client %q, it must be an IP address", target.Client)
+		}
+		if target.Community == "" {
+			return fmt.Errorf("session_poller client %v has no community", target.Client)
+		}
+		if _, err := parseOID(target.OID); err != nil {
+			return fmt.Errorf("invalid OID %q for session_poller client %v: %v", target.OID, target.Client, err)
+		}
+	}
+	return nil
+}
+
+// address returns the SNMP agent of the target
+func (t SessionPollTarget) address() string {
+	if t.Address != "" {
+		return t.Address
+	}
+	return net.JoinHostPort(t.Client, "161")
+}
+
+// snmpWalk lists the values under an OID with SNMPv2c GetBulk requests
+func snmpWalk(address, community string, root []uint32) ([]snmpVarbind, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var varbinds []snmpVarbind
+	next := root
+	for len(varbinds) < snmpPollMaxRows {
+		page, err := snmpGetBulk(conn, community, next)
+		if err != nil {
+			return nil, err
+		}
+		for _, varbind := range page {
+			// The walk ends once the agent answers an OID outside the table
+			if len(varbind.value) == 0 || varbind.value[0] == snmpEndOfMibView || varbind.value[0] == snmpNoSuchObject ||
+				len(varbind.oid) <= len(root) || compareOIDs(varbind.oid[:len(root)], root) != 0 {
+				return varbinds, nil
+			}
+			if compareOIDs(varbind.oid, next) <= 0 {
+				return nil, errors.New("the agent answered OIDs out of order")
+			}
+			varbinds = append(varbinds, varbind)
+			next = varbind.oid
+		}
+		if len(page) == 0 {
+			return varbinds, nil
+		}
+	}
+	return nil, fmt.Errorf("the table has more than %d rows", snmpPollMaxRows)
+}
+
+// snmpGetBulk sends a GetBulk request for the values following an OID, sending it again if no response arrives
+func snmpGetBulk(conn net.Conn, community string, oid []uint32) ([]snmpVarbind, error) {
+	requestID := rand.Int63n(1 << 31)
+	var body []byte
+	body = append(body, berInt(requestID)...)
+	body = append(body, berInt(0)...) // non-repeaters
+	body = append(body, berInt(snmpPollRepetitions)...)
+	body = append(body, berTLV(berSequence, berTLV(berSequence, append(berTLV(berOID, encodeOID(oid)), berTLV(berNull, nil)...)))...)
+	var request []byte
+	request = append(request, berInt(snmpVersion2c)...)
+	request = append(request, berTLV(berOctetString, []byte(community))...)
+	request = append(request, berTLV(snmpGetBulkRequest, body)...)
+	request = berTLV(berSequence, request)
+
+	buffer := make([]byte, snmpMaxPacket)
+	for attempt := 0; ; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(snmpPollTimeout))
+		for {
+			n, err := conn.Read(buffer)
+			if err, ok := err.(net.Error); ok && err.Timeout() && attempt < snmpPollRetries {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			varbinds, responseID, err := parseSNMPResponse(buffer[:n])
+			if err != nil {
+				return nil, err
+			}
+			// Responses to earlier attempts are skipped
+			if responseID == requestID {
+				return varbinds, nil
+			}
+		}
+	}
+}
+
+// parseSNMPResponse reads the variables and request ID of a Response
+func parseSNMPResponse(packet []byte) ([]snmpVarbind, int64, error) {
+	outer := &berReader{data: packet}
+	message := &berReader{data: outer.expect(berSequence)}
+	message.integer()
+	message.expect(berOctetString)
+	pdu := &berReader{data: message.expect(snmpResponse)}
+	requestID := pdu.integer()
+	errorStatus := pdu.integer()
+	pdu.integer()
+	list := &berReader{data: pdu.expect(berSequence)}
+	var varbinds []snmpVarbind
+	for list.err == nil && len(list.data) > 0 {
+		varbind := &berReader{data: list.expect(berSequence)}
+		oid, err := decodeOID(varbind.expect(berOID))
+		tag, value := varbind.read()
+		if varbind.err != nil {
+			list.err = varbind.err
+		} else if err != nil {
+			list.err = err
+		}
+		varbinds = append(varbinds, snmpVarbind{oid, berTLV(tag, value)})
+	}
+	for _, err := range []error{outer.err, message.err, pdu.err, list.err} {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if errorStatus != 0 {
+		return nil, requestID, fmt.Errorf("the agent answered error status %d", errorStatus)
+	}
+	return varbinds, requestID, nil
+}
+
+// stationMAC finds the MAC address of a row of a station table, in its value or at the end of its index
+func stationMAC(varbind snmpVarbind) string {
+	value := &berReader{data: varbind.value}
+	if tag, content := value.read(); value.err == nil && tag == berOctetString {
+		if len(content) == 6 {
+			return fmt.Sprintf("%x", content)
+		}
+		if mac := normalizeMACAddress(string(content)); isValidMACFormat(mac) {
+			return mac
+		}
+	}
+	if len(varbind.oid) < 6 {
+		return ""
+	}
+	var mac []byte
+	for _, arc := range varbind.oid[len(varbind.oid)-6:] {
+		if arc > 255 {
+			return ""
+		}
+		mac = append(mac, byte(arc))
+	}
+	return fmt.Sprintf("%x", mac)
+}
+
+// SessionPoller closes the accounting sessions of stations that are no longer associated with the access point or
+// controller that reported them, such as when a Stop was lost. A session is closed once it is missing from two
+// polls in a row, so a station roaming between two access points while one of them is polled keeps its session.
+type SessionPoller struct {
+	DB     *gorm.DB
+	Config SessionPollerConfig
+	// Standby reports whether the records are pulled from a primary, which polls instead
+	Standby func() bool
+
+	// missing holds the sessions that were missing from the last poll
+	missing map[uint]bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewSessionPoller checks the configuration and creates a SessionPoller
+func NewSessionPoller(config SessionPollerConfig, db *gorm.DB) (*SessionPoller, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &SessionPoller{DB: db, Config: config, missing: make(map[uint]bool)}, nil
+}
+
+// Start polls right away and then on every interval until Stop is called
+func (p *SessionPoller) Start() {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		runLocked(p.DB, "session poller", p.Config.Interval.Duration, p.Run)
+
+		ticker := time.NewTicker(p.Config.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runLocked(p.DB, "session poller", p.Config.Interval.Duration, p.Run)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running poll and stops the SessionPoller
+func (p *SessionPoller) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// Run polls every target once
+func (p *SessionPoller) Run() {
+	if p.Standby != nil && p.Standby() {
+		return
+	}
+	missing := make(map[uint]bool)
+	for _, target := range p.Config.Targets {
+		if err := p.reconcile(target, missing); err != nil {
+			log.Printf("SNMP: Unable to poll the stations of %v: %v", target.Client, err)
+		}
+	}
+	p.missing = missing
+}
+
+// reconcile closes the sessions of a target that were missing from its last poll and are still missing, adding
+// those missing for the first time to missing
+func (p *SessionPoller) reconcile(target SessionPollTarget, missing map[uint]bool) error {
+	polled := time.Now()
+	root, _ := parseOID(target.OID)
+	varbinds, err := snmpWalk(target.address(), target.Community, root)
+	if err != nil {
+		// Sessions missing from the previous poll stay so until a poll succeeds
+		for id := range p.missing {
+			missing[id] = true
+		}
+		return err
+	}
+	associated := make(map[string]bool)
+	for _, varbind := range varbinds {
+		if mac := stationMAC(varbind); isValidMACFormat(mac) {
+			associated[mac] = true
+		}
+	}
+
+	// Sessions started since the poll began may not be in the station table yet
+	var sessions []AccountingSession
+	err = p.DB.Where("client = ? AND stopped_at IS NULL AND started_at < ?", net.ParseIP(target.Client).String(), polled).
+		Find(&sessions).Error
+	if err != nil {
+		return err
+	}
+	closed := 0
+	for _, session := range sessions {
+		if associated[session.MAC] {
+			continue
+		}
+		if !p.missing[session.ID] {
+			missing[session.ID] = true
+			continue
+		}
+		err := p.DB.Model(&session).Where("stopped_at IS NULL").
+			Updates(map[string]interface{}{"stopped_at": &polled, "terminate_cause": accountingTerminateReconciled}).Error
+		if err != nil {
+			return err
+		}
+		closed++
+	}
+	if closed > 0 {
+		log.Printf("SNMP: Closed %d sessions of %v whose stations are no longer associated", closed, target.Client)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSNMPResponse(t *testing.T) {
+	// A response to request 7 with a station's MAC address as bytes and the end of the MIB
+	response := "3032" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a225" + "020107" + "020100" + "020100" +
+		"301a" + "300e" + "06062b0601040101" + "0404aabbccdd" + "3008" + "06042b060105" + "8200"
+	varbinds, requestID, err := parseSNMPResponse(decodeHex(t, response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []snmpVarbind{
+		{[]uint32{1, 3, 6, 1, 4, 1, 1}, decodeHex(t, "0404aabbccdd")},
+		{[]uint32{1, 3, 6, 1, 5}, decodeHex(t, "8200")},
+	}
+	if requestID != 7 || !reflect.DeepEqual(varbinds, want) {
+		t.Errorf("got request %d with %v", requestID, varbinds)
+	}
+
+	// Every prefix of the response is truncated
+	for i := 0; i < len(response)/2; i++ {
+		if varbinds, _, err := parseSNMPResponse(decodeHex(t, response[:2*i])); err == nil {
+			t.Errorf("a prefix of %d bytes was read as %v", i, varbinds)
+		}
+	}
+	for name, invalid := range map[string]string{
+		"error status":      "301a" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a20d" + "020107" + "020105" + "020101" + "3000",
+		"request":           "301a" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a00d" + "020107" + "020100" + "020100" + "3000",
+		"missing value":     "301e" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a211" + "020107" + "020100" + "020100" + "3004" + "30020600",
+		"invalid OID":       "3020" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a213" + "020107" + "020100" + "020100" + "3006" + "300406002b80",
+		"length of 4 bytes": "3084000000100201",
+	} {
+		if varbinds, _, err := parseSNMPResponse(decodeHex(t, invalid)); err == nil {
+			t.Errorf("%v was read as %v", name, varbinds)
+		}
+	}
+}
+
+func TestStationMAC(t *testing.T) {
+	root := []uint32{1, 3, 6, 1, 4, 1, 14179, 2, 1, 4, 1, 1}
+	tests := []struct {
+		name    string
+		varbind snmpVarbind
+		want    string
+	}{
+		{"value as bytes", snmpVarbind{root, berTLV(berOctetString, []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})}, "001122334455"},
+		{"value as text", snmpVarbind{root, berTLV(berOctetString, []byte("00-11-22-33-44-55"))}, "001122334455"},
+		{"index", snmpVarbind{oidAppend(root, 0, 17, 34, 51, 68, 85), berInt(1)}, "001122334455"},
+		{"index after another value", snmpVarbind{oidAppend(root, 0, 17, 34, 51, 68, 85), berTLV(berOctetString, []byte("ap-1"))}, "001122334455"},
+		{"index beyond a byte", snmpVarbind{oidAppend(root, 0, 17, 34, 51, 68, 256), berInt(1)}, ""},
+		{"short index", snmpVarbind{[]uint32{1, 3, 6}, berInt(1)}, ""},
+		{"truncated value", snmpVarbind{[]uint32{1, 3}, []byte{berOctetString, 6, 0}}, ""},
+		{"no value", snmpVarbind{[]uint32{1, 3}, nil}, ""},
+	}
+	for _, test := range tests {
+		if got := stationMAC(test.varbind); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// stationAgent starts an SNMP agent listing the MAC addresses in a station table under root
+func stationAgent(t *testing.T, root []uint32, macs ...[]byte) string {
+	agent := &SNMPAgent{Addr: "127.0.0.1:0", community: []byte("public")}
+	for _, mac := range macs {
+		value := berTLV(berOctetString, mac)
+		var index []uint32
+		for _, b := range mac {
+			index = append(index, uint32(b))
+		}
+		agent.objects = append(agent.objects, snmpObject{oidAppend(root, index...), func() []byte { return value }})
+	}
+	// An object after the table, where the walk has to stop
+	agent.objects = append(agent.objects, snmpObject{oidAppend(root[:len(root)-1], root[len(root)-1]+1), func() []byte { return berInt(1) }})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.serve(conn)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestSNMPWalk(t *testing.T) {
+	root := []uint32{1, 3, 6, 1, 4, 1, 9999, 1}
+	// More rows than fit in one GetBulk response, in the order of their OIDs
+	var macs [][]byte
+	for i := 0; i < snmpPollRepetitions*2+3; i++ {
+		macs = append(macs, []byte{0, 0x11, 0x22, 0x33, byte(i / 256), byte(i)})
+	}
+	address := stationAgent(t, root, macs...)
+
+	varbinds, err := snmpWalk(address, "public", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(varbinds) != len(macs) {
+		t.Fatalf("got %d rows, want %d", len(varbinds), len(macs))
+	}
+	for i, varbind := range varbinds {
+		if got, want := stationMAC(varbind), hex.EncodeToString(macs[i]); got != want {
+			t.Errorf("row %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	varbinds, err = snmpWalk(address, "public", []uint32{1, 3, 6, 1, 4, 1, 9998})
+	if err != nil || len(varbinds) != 0 {
+		t.Errorf("got %v, %v for a table the agent doesn't have", varbinds, err)
+	}
+}
+
+func TestSessionPoller(t *testing.T) {
+	db := openTestDatabase(t)
+	root := []uint32{1, 3, 6, 1, 4, 1, 9999, 1}
+	address := stationAgent(t, root, []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+
+	// A port nobody listens on, which refuses the requests right away
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.LocalAddr().String()
+	closed.Close()
+
+	started := time.Now().Add(-time.Minute)
+	sessions := []AccountingSession{
+		{SessionID: "associated", Client: "127.0.0.1", MAC: "001122334455", StartedAt: started},
+		{SessionID: "lost", Client: "127.0.0.1", MAC: "aabbccddeeff", StartedAt: started},
+		{SessionID: "other client", Client: "127.0.0.2", MAC: "aabbccddeeff", StartedAt: started},
+	}
+	for _, session := range sessions {
+		if err := db.Create(&session).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := SessionPollTarget{Client: "127.0.0.1", Address: address, Community: "public", OID: "1.3.6.1.4.1.9999.1"}
+	poller, err := NewSessionPoller(SessionPollerConfig{Interval: Duration{time.Minute}, Targets: []SessionPollTarget{target}}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func() []string {
+		var open []AccountingSession
+		db.Where("stopped_at IS NULL").Order("id").Find(&open)
+		var ids []string
+		for _, session := range open {
+			ids = append(ids, session.SessionID)
+		}
+		return ids
+	}
+
+	// A session is only closed once it was missing from two polls, and a failed poll doesn't count
+	poller.Run()
+	if got := open(); len(got) != 3 {
+		t.Errorf("the first poll left %v open", got)
+	}
+	poller.Config.Targets[0].Address = unreachable
+	poller.Run()
+	if got := open(); len(got) != 3 {
+		t.Errorf("the failed poll left %v open", got)
+	}
+	poller.Config.Targets[0].Address = address
+	poller.Run()
+	if got, want := open(), []string{"associated", "other client"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v open, want %v", got, want)
+	}
+	var lost AccountingSession
+	db.First(&lost, "session_id = ?", "lost")
+	if lost.TerminateCause != accountingTerminateReconciled {
+		t.Errorf("got terminate cause %q", lost.TerminateCause)
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNMP versions and PDU types
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+
+	snmpGetRequest     = 0xa0
+	snmpGetNextRequest = 0xa1
+	snmpResponse       = 0xa2
+	snmpSetRequest     = 0xa3
+	snmpGetBulkRequest = 0xa5
+)
+
+// BER tags of the values used by SNMP
+const (
+	berInteger       = 0x02
+	berOctetString   = 0x04
+	berNull          = 0x05
+	berOID           = 0x06
+	berSequence      = 0x30
+	snmpCounter32    = 0x41
+	snmpGauge32      = 0x42
+	snmpTimeTicks    = 0x43
+	snmpNoSuchObject = 0x80
+	snmpEndOfMibView = 0x82
+)
+
+// SNMP error statuses
+const (
+	snmpNoSuchName  = 2
+	snmpNotWritable = 17
+)
+
+const (
+	// snmpMaxPacket is the largest request read
+	snmpMaxPacket = 65535
+	// snmpMaxBulk limits the values in the response to a GetBulk request
+	snmpMaxBulk = 64
+	// snmpRateMinutes is how many minutes the reject rate covers
+	snmpRateMinutes = 5
+	// snmpDescription is the sysDescr of the agent
+	snmpDescription = "simple-wifi-radius-authenticator"
+)
+
+// snmpSystem is the system group of MIB-II
+var snmpSystem = []uint32{1, 3, 6, 1, 2, 1, 1}
+
+// SNMPConfig stores the settings for the SNMP agent
+type SNMPConfig struct {
+	// Listen is the UDP address the agent listens on, such as ":161", or empty to disable SNMP
+	Listen string `json:"listen"`
+	// Community is the read-only community string requests must use
+	Community string `json:"community"`
+	// OID is where the objects of the server are, and the sysObjectID of the agent
+	OID string `json:"oid"`
+}
+
+// validate checks the SNMP settings read from the configuration file
+func (c SNMPConfig) validate() error {
+	if c.Community == "" {
+		return errors.New("snmp.community must be set")
+	}
+	if _, err := parseOID(c.OID); err != nil {
+		return fmt.Errorf("invalid snmp.oid %q: %v", c.OID, err)
+	}
+	return nil
+}
+
+// parseOID reads a dotted OID such as "1.3.6.1.4.1.8072"
+func parseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, errors.New("at least two numbers are required")
+	}
+	oid := make([]uint32, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", part)
+		}
+		oid[i] = uint32(n)
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, errors.New("it doesn't start with a valid arc")
+	}
+	return oid, nil
+}
+
+// oidAppend returns a copy of oid followed by arcs
+func oidAppend(oid []uint32, arcs ...uint32) []uint32 {
+	return append(append([]uint32{}, oid...), arcs...)
+}
+
+// compareOIDs orders OIDs lexicographically, as GetNext walks them
+func compareOIDs(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// snmpObject is a scalar answered by the agent, with its value encoded when requested
+type snmpObject struct {
+	oid   []uint32
+	value func() []byte
+}
+
+// snmpVarbind is an OID and its encoded value in a response
+type snmpVarbind struct {
+	oid   []uint32
+	value []byte
+}
+
+// snmpMinute counts the authentications of a minute for the reject rate
+type snmpMinute struct {
+	minute  int64
+	accepts uint64
+	rejects uint64
+}
+
+// SNMPAgent answers SNMPv1 and SNMPv2c Get, GetNext, and GetBulk requests for the health of the server, for
+// monitoring that only speaks SNMP. It has no MIB of its own: the objects are scalars under the configured OID.
+type SNMPAgent struct {
+	Addr   string
+	Radius *RadiusServer
+
+	community []byte
+	objects   []snmpObject
+	started   time.Time
+
+	connMutex sync.Mutex
+	conn      net.PacketConn
+	stopped   bool
+
+	mutex   sync.Mutex
+	accepts uint64
+	rejects uint64
+	recent  [snmpRateMinutes]snmpMinute
+}
+
+// NewSNMPAgent checks the settings and creates an SNMPAgent reporting on radius
+func NewSNMPAgent(config SNMPConfig, radius *RadiusServer) (*SNMPAgent, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	base, _ := parseOID(config.OID)
+	hostname, _ := os.Hostname()
+
+	a := &SNMPAgent{
+		Addr:      config.Listen,
+		Radius:    radius,
+		community: []byte(config.Community),
+		started:   time.Now(),
+	}
+	counter := func(value func() uint64) func() []byte {
+		return func() []byte {
+			// Counter32 wraps around, which monitoring systems expect
+			return berUnsigned(snmpCounter32, uint32(value()))
+		}
+	}
+	a.objects = []snmpObject{
+		{oidAppend(snmpSystem, 1, 0), func() []byte { return berTLV(berOctetString, []byte(snmpDescription)) }},
+		{oidAppend(snmpSystem, 2, 0), func() []byte { return berTLV(berOID, encodeOID(base)) }},
+		{oidAppend(snmpSystem, 3, 0), func() []byte {
+			return berUnsigned(snmpTimeTicks, uint32(time.Since(a.started)/(10*time.Millisecond)))
+		}},
+		{oidAppend(snmpSystem, 5, 0), func() []byte { return berTLV(berOctetString, []byte(hostname)) }},
+		{oidAppend(base, 1, 0), counter(func() uint64 {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			return a.accepts
+		})},
+		{oidAppend(base, 2, 0), counter(func() uint64 {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			return a.rejects
+		})},
+		{oidAppend(base, 3, 0), func() []byte { return berUnsigned(snmpGauge32, a.rejectRate(time.Now())) }},
+		{oidAppend(base, 4, 0), counter(radius.DroppedPackets)},
+		{oidAppend(base, 5, 0), counter(radius.ShedRequests)},
+		{oidAppend(base, 6, 0), counter(radius.TimedOutRequests)},
+		{oidAppend(base, 7, 0), func() []byte {
+			// TruthValue
+			if radius.Listening() {
+				return berInt(1)
+			}
+			return berInt(2)
+		}},
+	}
+	sort.Slice(a.objects, func(i, j int) bool {
+		return compareOIDs(a.objects[i].oid, a.objects[j].oid) < 0
+	})
+	return a, nil
+}
+
+// AuthEvent counts an authentication
+func (a *SNMPAgent) AuthEvent(event AuthEvent) {
+	minute := event.Time.Unix() / 60
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	bucket := &a.recent[minute%snmpRateMinutes]
+	if bucket.minute != minute {
+		*bucket = snmpMinute{minute: minute}
+	}
+	if event.Accepted {
+		a.accepts++
+		bucket.accepts++
+	} else {
+		a.rejects++
+		bucket.rejects++
+	}
+}
+
+// rejectRate returns the percentage of authentications rejected in the last minutes
+func (a *SNMPAgent) rejectRate(now time.Time) uint32 {
+	minute := now.Unix() / 60
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var accepts, rejects uint64
+	for _, bucket := range a.recent {
+		if bucket.minute > minute-snmpRateMinutes && bucket.minute <= minute {
+			accepts += bucket.accepts
+			rejects += bucket.rejects
+		}
+	}
+	if accepts+rejects == 0 {
+		return 0
+	}
+	return uint32(rejects * 100 / (accepts + rejects))
+}
+
+// Start the SNMP agent
+func (a *SNMPAgent) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("SNMP: Starting agent on %v", a.Addr)
+
+		conn, err := listenPacket(a.Addr)
+		if err == nil {
+			a.connMutex.Lock()
+			a.conn = conn
+			if a.stopped {
+				conn.Close()
+			}
+			a.connMutex.Unlock()
+			err = a.serve(conn)
+		}
+		if err != nil {
+			log.Printf("SNMP: Error starting agent: %v", err)
+		} else {
+			log.Printf("SNMP: Stopped agent")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop the SNMP agent
+func (a *SNMPAgent) Stop() {
+	a.connMutex.Lock()
+	defer a.connMutex.Unlock()
+	a.stopped = true
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+func (a *SNMPAgent) serve(conn net.PacketConn) error {
+	defer conn.Close()
+	buffer := make([]byte, snmpMaxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			a.connMutex.Lock()
+			stopped := a.stopped
+			a.connMutex.Unlock()
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		if response := a.handle(buffer[:n]); response != nil {
+			if _, err := conn.WriteTo(response, addr); err != nil {
+				log.Printf("SNMP: Unable to answer %v: %v", addr, err)
+			}
+		}
+	}
+}
+
+// handle answers a request, or returns nil to drop it. Requests that can't be read or use another community
+// are dropped like SNMP agents usually do.
+func (a *SNMPAgent) handle(packet []byte) []byte {
+	outer := &berReader{data: packet}
+	message := &berReader{data: outer.expect(berSequence)}
+	version := message.integer()
+	community := message.expect(berOctetString)
+	tag, content := message.read()
+	pdu := &berReader{data: content}
+	requestID := pdu.integer()
+	// The error status and index are the non-repeaters and max-repetitions of GetBulk requests
+	nonRepeaters := pdu.integer()
+	maxRepetitions := pdu.integer()
+	list := &berReader{data: pdu.expect(berSequence)}
+	var oids [][]uint32
+	for list.err == nil && len(list.data) > 0 {
+		varbind := &berReader{data: list.expect(berSequence)}
+		oid, err := decodeOID(varbind.expect(berOID))
+		if varbind.err != nil {
+			list.err = varbind.err
+		} else if err != nil {
+			list.err = err
+		}
+		oids = append(oids, oid)
+	}
+	if outer.err != nil || message.err != nil || pdu.err != nil || list.err != nil {
+		return nil
+	}
+	if version != snmpVersion1 && version != snmpVersion2c {
+		return nil
+	}
+	if subtle.ConstantTimeCompare(community, a.community) != 1 {
+		return nil
+	}
+
+	var varbinds []snmpVarbind
+	var errorStatus, errorIndex int64
+	switch tag {
+	case snmpGetRequest:
+		for i, oid := range oids {
+			value := a.get(oid)
+			if value == nil && version == snmpVersion1 {
+				errorStatus, errorIndex = snmpNoSuchName, int64(i+1)
+				break
+			} else if value == nil {
+				value = berTLV(snmpNoSuchObject, nil)
+			}
+			varbinds = append(varbinds, snmpVarbind{oid, value})
+		}
+	case snmpGetNextRequest:
+		for i, oid := range oids {
+			varbind := a.next(oid)
+			if varbind.value[0] == snmpEndOfMibView && version == snmpVersion1 {
+				errorStatus, errorIndex = snmpNoSuchName, int64(i+1)
+				break
+			}
+			varbinds = append(varbinds, varbind)
+		}
+	case snmpGetBulkRequest:
+		if version == snmpVersion1 {
+			return nil
+		}
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		} else if nonRepeaters > int64(len(oids)) {
+			nonRepeaters = int64(len(oids))
+		}
+		for _, oid := range oids[:nonRepeaters] {
+			varbinds = append(varbinds, a.next(oid))
+		}
+		repeaters := append([][]uint32{}, oids[nonRepeaters:]...)
+		for r := int64(0); r < maxRepetitions && len(repeaters) > 0 && len(varbinds) < snmpMaxBulk; r++ {
+			ended := true
+			for i, oid := range repeaters {
+				varbind := a.next(oid)
+				varbinds = append(varbinds, varbind)
+				repeaters[i] = varbind.oid
+				if varbind.value[0] != snmpEndOfMibView {
+					ended = false
+				}
+			}
+			if ended {
+				break
+			}
+		}
+	case snmpSetRequest:
+		errorStatus, errorIndex = snmpNotWritable, 1
+		if version == snmpVersion1 {
+			errorStatus = snmpNoSuchName
+		}
+	default:
+		return nil
+	}
+
+	// Errors are answered with the variables of the request
+	if errorStatus != 0 {
+		varbinds = nil
+		for _, oid := range oids {
+			varbinds = append(varbinds, snmpVarbind{oid, berTLV(berNull, nil)})
+		}
+	}
+
+	var encoded []byte
+	for _, varbind := range varbinds {
+		encoded = append(encoded, berTLV(berSequence, append(berTLV(berOID, encodeOID(varbind.oid)), varbind.value...))...)
+	}
+	var body []byte
+	body = append(body, berInt(requestID)...)
+	body = append(body, berInt(errorStatus)...)
+	body = append(body, berInt(errorIndex)...)
+	body = append(body, berTLV(berSequence, encoded)...)
+	var response []byte
+	response = append(response, berInt(version)...)
+	response = append(response, berTLV(berOctetString, community)...)
+	response = append(response, berTLV(snmpResponse, body)...)
+	return berTLV(berSequence, response)
+}
+
+// get returns the encoded value of an object, or nil if there is no such object
+func (a *SNMPAgent) get(oid []uint32) []byte {
+	i := sort.Search(len(a.objects), func(i int) bool {
+		return compareOIDs(a.objects[i].oid, oid) >= 0
+	})
+	if i < len(a.objects) && compareOIDs(a.objects[i].oid, oid) == 0 {
+		return a.objects[i].value()
+	}
+	return nil
+}
+
+// next returns the object following oid, or endOfMibView after the last one
+func (a *SNMPAgent) next(oid []uint32) snmpVarbind {
+	i := sort.Search(len(a.objects), func(i int) bool {
+		return compareOIDs(a.objects[i].oid, oid) > 0
+	})
+	if i < len(a.objects) {
+		return snmpVarbind{a.objects[i].oid, a.objects[i].value()}
+	}
+	return snmpVarbind{oid, berTLV(snmpEndOfMibView, nil)}
+}
+
+// berReader reads BER-encoded values one after the other, remembering the first error
+type berReader struct {
+	data []byte
+	err  error
+}
+
+// read returns the tag and content of the next value
+func (r *berReader) read() (byte, []byte) {
+	if r.err != nil {
+		return 0, nil
+	}
+	if len(r.data) < 2 {
+		r.err = errors.New("truncated value")
+		return 0, nil
+	}
+	tag, length, data := r.data[0], int(r.data[1]), r.data[2:]
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 || len(data) < size {
+			r.err = errors.New("invalid length")
+			return 0, nil
+		}
+		length = 0
+		for _, b := range data[:size] {
+			length = length<<8 | int(b)
+		}
+		data = data[size:]
+	}
+	if length > len(data) {
+		r.err = errors.New("truncated value")
+		return 0, nil
+	}
+	r.data = data[length:]
+	return tag, data[:length]
+}
+
+// expect returns the content of the next value, which must have the tag
+func (r *berReader) expect(tag byte) []byte {
+	actual, content := r.read()
+	if r.err == nil && actual != tag {
+		r.err = fmt.Errorf("expected tag %#x, got %#x", tag, actual)
+	}
+	return content
+}
+
+// integer reads the next value as an INTEGER
+func (r *berReader) integer() int64 {
+	content := r.expect(berInteger)
+	if r.err == nil && (len(content) == 0 || len(content) > 8) {
+		r.err = errors.New("invalid integer")
+	}
+	if r.err != nil {
+		return 0
+	}
+	var n int64
+	if content[0]&0x80 != 0 {
+		n = -1
+	}
+	for _, b := range content {
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+// berTLV encodes a value with its tag and length
+func berTLV(tag byte, content []byte) []byte {
+	encoded := []byte{tag}
+	if n := len(content); n < 0x80 {
+		encoded = append(encoded, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		encoded = append(encoded, 0x80|byte(len(length)))
+		encoded = append(encoded, length...)
+	}
+	return append(encoded, content...)
+}
+
+// berInt encodes an INTEGER in as few bytes as its two's complement needs
+func berInt(n int64) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(n)}, content...)
+		if n >= -128 && n < 128 {
+			break
+		}
+		n >>= 8
+	}
+	return berTLV(berInteger, content)
+}
+
+// berUnsigned encodes an unsigned value such as a Counter32, which needs a leading zero when its high bit is set
+func berUnsigned(tag byte, n uint32) []byte {
+	content := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		content = append([]byte{byte(n)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(tag, content)
+}
+
+// encodeOID encodes the content of an OBJECT IDENTIFIER, with the first two arcs in the first number
+func encodeOID(oid []uint32) []byte {
+	var content []byte
+	arcs := append([]uint32{oid[0]*40 + oid[1]}, oid[2:]...)
+	for _, arc := range arcs {
+		chunk := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			chunk = append([]byte{byte(arc&0x7f) | 0x80}, chunk...)
+		}
+		content = append(content, chunk...)
+	}
+	return content
+}
+
+// decodeOID reads the content of an OBJECT IDENTIFIER
+func decodeOID(content []byte) ([]uint32, error) {
+	if len(content) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var oid []uint32
+	var n uint64
+	for _, b := range content {
+		n = n<<7 | uint64(b&0x7f)
+		if n > math.MaxUint32 {
+			return nil, errors.New("OID number too large")
+		}
+		if b&0x80 != 0 {
+			continue
+		}
+		switch {
+		case len(oid) > 0:
+			oid = append(oid, uint32(n))
+		case n < 80:
+			oid = append(oid, uint32(n/40), uint32(n%40))
+		default:
+			oid = append(oid, 2, uint32(n-80))
+		}
+		n = 0
+	}
+	if content[len(content)-1]&0x80 != 0 {
+		return nil, errors.New("truncated OID")
+	}
+	return oid, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// snmpRequest encodes a request for the OIDs
+func snmpRequest(version int64, community string, tag byte, nonRepeaters, maxRepetitions int64, oids ...[]uint32) []byte {
+	var list []byte
+	for _, oid := range oids {
+		list = append(list, berTLV(berSequence, append(berTLV(berOID, encodeOID(oid)), berTLV(berNull, nil)...))...)
+	}
+	pdu := append(berInt(1), berInt(nonRepeaters)...)
+	pdu = append(pdu, berInt(maxRepetitions)...)
+	pdu = append(pdu, berTLV(berSequence, list)...)
+	message := append(berInt(version), berTLV(berOctetString, []byte(community))...)
+	return berTLV(berSequence, append(message, berTLV(tag, pdu)...))
+}
+
+// handleSNMP returns the variables the agent answers a request with
+func handleSNMP(t *testing.T, agent *SNMPAgent, request []byte) []snmpVarbind {
+	t.Helper()
+	varbinds, requestID, err := parseSNMPResponse(agent.handle(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestID != 1 && requestID != 0x12345678 {
+		t.Errorf("got request ID %d", requestID)
+	}
+	return varbinds
+}
+
+// snmpErrorStatus returns the error the agent answers a request with
+func snmpErrorStatus(agent *SNMPAgent, request []byte) string {
+	if _, _, err := parseSNMPResponse(agent.handle(request)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestOIDEncoding(t *testing.T) {
+	tests := []struct {
+		oid     []uint32
+		encoded string
+	}{
+		{[]uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}, "2b06010201010100"},
+		{[]uint32{1, 3, 6, 1, 4, 1, 8072}, "2b06010401bf08"},
+		{[]uint32{1, 3, 4294967295}, "2b8fffffff7f"},
+		{[]uint32{2, 999, 3}, "883703"},
+		{[]uint32{0, 0}, "00"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(encodeOID(test.oid)); got != test.encoded {
+			t.Errorf("%v: got %v, want %v", test.oid, got, test.encoded)
+		}
+		decoded, err := decodeOID(decodeHex(t, test.encoded))
+		if err != nil || !reflect.DeepEqual(decoded, test.oid) {
+			t.Errorf("%v: got %v, %v", test.encoded, decoded, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "2b86", "2b8fffffffff7f", "2b90808080808000"} {
+		if oid, err := decodeOID(decodeHex(t, invalid)); err == nil {
+			t.Errorf("%v was decoded as %v", invalid, oid)
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	tests := []struct {
+		n       int64
+		encoded string
+	}{
+		{0, "020100"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+		{1 << 40, "02060100000000" + "00"},
+		{-1 << 63, "02088000000000000000"},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(berInt(test.n)); got != test.encoded {
+			t.Errorf("%d: got %v, want %v", test.n, got, test.encoded)
+		}
+		r := &berReader{data: decodeHex(t, test.encoded)}
+		if n := r.integer(); n != test.n || r.err != nil {
+			t.Errorf("%v: got %d, %v", test.encoded, n, r.err)
+		}
+	}
+
+	for _, invalid := range []string{"", "02", "0200", "0201", "0209010203040506070809", "040100", "0281", "0284000000010000"} {
+		r := &berReader{data: decodeHex(t, invalid)}
+		if n := r.integer(); r.err == nil {
+			t.Errorf("%v was read as %d", invalid, n)
+		}
+	}
+}
+
+func TestSNMPHandle(t *testing.T) {
+	radius := NewRadiusServer(nil)
+	agent, err := NewSNMPAgent(SNMPConfig{Community: "public", OID: "1.3.6.1.4.1.8072.9999"}, &radius)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysDescr := []uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	sysObjectID := []uint32{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	last := []uint32{1, 3, 6, 1, 4, 1, 8072, 9999, 7, 0}
+
+	// snmpget -v2c -c public with request ID 0x12345678
+	get := "3029" + "020101" + "0406" + hex.EncodeToString([]byte("public")) + "a01c" + "020412345678" + "020100" + "020100" +
+		"300e" + "300c" + "06082b06010201010100" + "0500"
+	varbinds := handleSNMP(t, agent, decodeHex(t, get))
+	want := []snmpVarbind{{sysDescr, berTLV(berOctetString, []byte(snmpDescription))}}
+	if !reflect.DeepEqual(varbinds, want) {
+		t.Errorf("got %v", varbinds)
+	}
+
+	varbinds = handleSNMP(t, agent, snmpRequest(snmpVersion2c, "public", snmpGetNextRequest, 0, 0, sysDescr, last))
+	if len(varbinds) != 2 || !reflect.DeepEqual(varbinds[0].oid, sysObjectID) || varbinds[1].value[0] != snmpEndOfMibView {
+		t.Errorf("got %v", varbinds)
+	}
+	if err := snmpErrorStatus(agent, snmpRequest(snmpVersion1, "public", snmpGetNextRequest, 0, 0, last)); err != "the agent answered error status 2" {
+		t.Errorf("got %q for SNMPv1 past the last object", err)
+	}
+	if err := snmpErrorStatus(agent, snmpRequest(snmpVersion2c, "public", snmpSetRequest, 0, 0, sysDescr)); err != "the agent answered error status 17" {
+		t.Errorf("got %q for a set", err)
+	}
+
+	// A large max-repetitions is limited by snmpMaxBulk, and negative non-repeaters count as none
+	varbinds = handleSNMP(t, agent, snmpRequest(snmpVersion2c, "public", snmpGetBulkRequest, -5, 1<<40, []uint32{0, 0}, []uint32{1, 3}))
+	if len(varbinds) > snmpMaxBulk || len(varbinds) < 2 || varbinds[len(varbinds)-1].value[0] != snmpEndOfMibView {
+		t.Errorf("got %d values", len(varbinds))
+	}
+	varbinds = handleSNMP(t, agent, snmpRequest(snmpVersion2c, "public", snmpGetBulkRequest, 10, 0, sysDescr))
+	if len(varbinds) != 1 || !reflect.DeepEqual(varbinds[0].oid, sysObjectID) {
+		t.Errorf("got %v for non-repeaters beyond the variables", varbinds)
+	}
+
+	dropped := map[string][]byte{
+		"wrong community":   snmpRequest(snmpVersion2c, "private", snmpGetRequest, 0, 0, sysDescr),
+		"SNMPv3":            snmpRequest(3, "public", snmpGetRequest, 0, 0, sysDescr),
+		"SNMPv1 GetBulk":    snmpRequest(snmpVersion1, "public", snmpGetBulkRequest, 0, 10, sysDescr),
+		"response":          snmpRequest(snmpVersion2c, "public", snmpResponse, 0, 0, sysDescr),
+		"empty":             nil,
+		"invalid OID":       decodeHex(t, "3021"+"020101"+"0406"+hex.EncodeToString([]byte("public"))+"a014"+"020101020100020100"+"3009"+"3007"+"06032b8680"+"0500"),
+		"length of 4 bytes": decodeHex(t, "30840000ffff"),
+	}
+	// Every prefix of a request is dropped
+	for i := 0; i < len(get)/2; i++ {
+		dropped[get[:2*i]] = decodeHex(t, get[:2*i])
+	}
+	for name, request := range dropped {
+		if response := agent.handle(request); response != nil {
+			t.Errorf("%v was answered with %x", name, response)
+		}
+	}
+}
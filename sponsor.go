@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Sponsor decisions
+const (
+	sponsorApprove = "approve"
+	sponsorDeny    = "deny"
+)
+
+const sponsorTimeout = 10 * time.Second
+
+// SponsorConfig stores the settings for guest devices approved by a sponsor
+type SponsorConfig struct {
+	// Listen is the address serving the approve and deny links, or empty to disable sponsor approval
+	Listen string `json:"listen"`
+	// URL is where sponsors reach the listener, such as "https://wifi.example.com"
+	URL string `json:"url"`
+	// Secret signs the links, so they can't be made up for another request
+	Secret string `json:"secret"`
+	// Group is the device group approved devices are added to
+	Group string `json:"group"`
+	// Duration is how long an approved device is allowed on the network
+	Duration Duration `json:"duration"`
+	// LinkValidity is how long the links in the email can be used
+	LinkValidity Duration `json:"link_validity"`
+}
+
+// validate checks the sponsor settings read from the configuration file
+func (c SponsorConfig) validate() error {
+	parsed, err := url.Parse(c.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid sponsor URL %q", c.URL)
+	}
+	if c.Secret == "" || c.Group == "" {
+		return errors.New("a secret and a group are required")
+	}
+	if c.Duration.Duration <= 0 || c.LinkValidity.Duration <= 0 {
+		return errors.New("duration and link_validity must be positive")
+	}
+	return nil
+}
+
+// SponsorRequest is a guest's request for a device to be allowed, waiting for the sponsor to decide
+type SponsorRequest struct {
+	Model
+	MAC       string `gorm:"not null"`
+	GuestName string
+	// Sponsor is the email address of the person deciding
+	Sponsor string `gorm:"not null"`
+	// Decision is empty until the sponsor approves or denies the request
+	Decision  string
+	DecidedAt *time.Time
+}
+
+// sponsorToken signs a decision on a request, valid until expires
+func sponsorToken(secret string, id uint, decision string, expires time.Time) string {
+	payload := fmt.Sprintf("%d.%s.%d", id, decision, expires.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSponsorToken checks the signature and expiry of a token, returning the request and decision it is for
+func parseSponsorToken(secret, token string, now time.Time) (uint, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return 0, "", errors.New("it is invalid")
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", errors.New("it is invalid")
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("it is invalid")
+	}
+	expected := sponsorToken(secret, uint(id), parts[1], time.Unix(expires, 0))
+	if !hmac.Equal([]byte(expected), []byte(token)) {
+		return 0, "", errors.New("it is invalid")
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return 0, "", errors.New("it has expired")
+	}
+	return uint(id), parts[1], nil
+}
+
+// requestSponsorApproval stores a guest's request and emails the sponsor links to approve or deny it
+func requestSponsorApproval(db *gorm.DB, mailer *Mailer, config SponsorConfig, mac, guestName, sponsor string) error {
+	request := SponsorRequest{MAC: mac, GuestName: guestName, Sponsor: sponsor}
+	if err := db.Create(&request).Error; err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(config.LinkValidity.Duration)
+	link := func(decision string) string {
+		return strings.TrimSuffix(config.URL, "/") + "/sponsor?token=" + url.QueryEscape(sponsorToken(config.Secret, request.ID, decision, expires))
+	}
+	data := struct {
+		Guest      string
+		MAC        string
+		Duration   time.Duration
+		ApproveURL string
+		DenyURL    string
+		Expires    time.Time
+	}{guestName, prettyPrintMACAddress(mac), config.Duration.Duration, link(sponsorApprove), link(sponsorDeny), expires}
+	return mailer.Send([]string{sponsor}, "sponsor-request", data)
+}
+
+// decideSponsorRequest records the sponsor's decision, registering the device for the configured duration when
+// it is approved. A request can only be decided once.
+func decideSponsorRequest(db *gorm.DB, config SponsorConfig, id uint, decision string, now time.Time) (SponsorRequest, error) {
+	var request SponsorRequest
+	if db.First(&request, id).RecordNotFound() {
+		return request, errors.New("the request no longer exists")
+	}
+	if request.Decision != "" {
+		return request, fmt.Errorf("the request has already been %s", sponsorDecisionText(request.Decision))
+	}
+
+	tx := withAuditActor(db, "sponsor:"+request.Sponsor).Begin()
+	result := tx.Model(&request).Where("decision = ?", "").Updates(map[string]interface{}{"decision": decision, "decided_at": now})
+	if result.Error != nil {
+		tx.Rollback()
+		return request, result.Error
+	}
+	if result.RowsAffected != 1 {
+		tx.Rollback()
+		return request, errors.New("the request has already been decided")
+	}
+	if decision == sponsorApprove {
+		var group DeviceGroup
+		if tx.First(&group, "name = ?", config.Group).RecordNotFound() {
+			tx.Rollback()
+			return request, fmt.Errorf("device group %q does not exist", config.Group)
+		}
+		if _, err := registerTemporaryDevice(tx, request.MAC, group, now.Add(config.Duration.Duration)); err != nil {
+			tx.Rollback()
+			return request, err
+		}
+	}
+	return request, tx.Commit().Error
+}
+
+// sponsorDecisionText describes a decision in a sentence
+func sponsorDecisionText(decision string) string {
+	if decision == sponsorApprove {
+		return "approved"
+	}
+	return "denied"
+}
+
+// sponsorPage is shown for the links in the email. The decision is only made when the form is posted, since
+// mail scanners open the links in messages.
+var sponsorPage = template.Must(template.New("sponsor").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>WiFi access</title></head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>
+{{else}}<p>{{if eq .Decision "approve"}}Approve{{else}}Deny{{end}} WiFi access for {{.Request.GuestName}} ({{.MAC}})?</p>
+<form method="post"><input type="hidden" name="token" value="{{.Token}}"><button type="submit">{{if eq .Decision "approve"}}Approve{{else}}Deny{{end}}</button></form>
+{{end}}</body>
+</html>
+`))
+
+// SponsorServer serves the links sponsors use to approve or deny guest devices
+type SponsorServer struct {
+	DB     *gorm.DB
+	Config SponsorConfig
+
+	server *http.Server
+}
+
+// NewSponsorServer creates a SponsorServer listening on the configured address
+func NewSponsorServer(config SponsorConfig, db *gorm.DB) (*SponsorServer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &SponsorServer{DB: db, Config: config}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sponsor", s.sponsor)
+	s.server = &http.Server{
+		Addr:         config.Listen,
+		Handler:      accessLog("SPONSOR", mux),
+		ReadTimeout:  sponsorTimeout,
+		WriteTimeout: sponsorTimeout,
+	}
+	return s, nil
+}
+
+// Start the sponsor server
+func (s *SponsorServer) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("SPONSOR: Starting server on %v", s.server.Addr)
+
+		listener, err := listen(s.server.Addr)
+		if err == nil {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("SPONSOR: Error starting sponsor server: %v", err)
+		} else {
+			log.Printf("SPONSOR: Stopped server")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop the sponsor server
+func (s *SponsorServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), sponsorTimeout)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// sponsor asks the sponsor to confirm the decision of a link, and records it when confirmed
+func (s *SponsorServer) sponsor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	token := r.FormValue("token")
+	page := struct {
+		Message  string
+		Decision string
+		Token    string
+		MAC      string
+		Request  SponsorRequest
+	}{Token: token}
+
+	id, decision, err := parseSponsorToken(s.Config.Secret, token, time.Now())
+	switch {
+	case err != nil:
+		logSecurityEvent(securityTokenFailure, httpSource(r.RemoteAddr), fmt.Sprintf("service=sponsor reason=%q", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		page.Message = "This link can't be used: " + err.Error() + "."
+	case r.Method == http.MethodGet:
+		if s.DB.First(&page.Request, id).RecordNotFound() {
+			page.Message = "The request no longer exists."
+		} else if page.Request.Decision != "" {
+			page.Message = "The request has already been " + sponsorDecisionText(page.Request.Decision) + "."
+		}
+		page.Decision = decision
+		page.MAC = prettyPrintMACAddress(page.Request.MAC)
+	default:
+		request, err := decideSponsorRequest(s.DB, s.Config, id, decision, time.Now())
+		if err != nil {
+			log.Printf("SPONSOR: Unable to %v request %d: %v", decision, id, err)
+			page.Message = "Unable to record the decision: " + err.Error() + "."
+			break
+		}
+		log.Printf("SPONSOR: %v %v %v for %q", request.Sponsor, sponsorDecisionText(decision), prettyPrintMACAddress(request.MAC), request.GuestName)
+		page.Message = "WiFi access for " + request.GuestName + " has been " + sponsorDecisionText(decision) + "."
+	}
+
+	if err := sponsorPage.Execute(w, page); err != nil {
+		log.Printf("SPONSOR: Unable to render page: %v", err)
+	}
+}
+
+// requestSponsorCommand registers a guest device pending the approval of a sponsor, who is sent the links by email
+func requestSponsorCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("request-sponsor", flag.ContinueOnError)
+	macFlag := flags.String("mac", "", "MAC address of the guest's device")
+	guest := flags.String("name", "", "name of the guest")
+	sponsor := flags.String("sponsor", "", "email address of the sponsor")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := config.Sponsor.validate(); err != nil {
+		return fmt.Errorf("sponsor approval is not configured: %v", err)
+	}
+	mailer := NewMailer(config.SMTP)
+	if mailer == nil {
+		return errors.New("sponsor approval requires an SMTP server")
+	}
+	mac := normalizeMACAddress(*macFlag)
+	if !isValidMACFormat(mac) {
+		return errors.New("a valid -mac is required")
+	}
+	if *guest == "" {
+		return errors.New("-name is required")
+	}
+	if _, err := mail.ParseAddress(*sponsor); err != nil {
+		return fmt.Errorf("invalid -sponsor: %v", err)
+	}
+
+	if err := requestSponsorApproval(db, mailer, config.Sponsor, mac, *guest, *sponsor); err != nil {
+		return err
+	}
+	fmt.Printf("Asked %v to approve %v\n", *sponsor, prettyPrintMACAddress(mac))
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// deviceSeenInterval is how often the last time a device was seen is written, so busy devices don't write to
+// the database on every authentication
+const deviceSeenInterval = time.Hour
+
+// deviceSeen records that a device was accepted. It writes the column directly, since the audit log and the
+// device cache don't need to know.
+func (rs *RadiusServer) deviceSeen(device Device) {
+	now := time.Now()
+	if device.LastSeenAt != nil && now.Sub(*device.LastSeenAt) < deviceSeenInterval {
+		return
+	}
+	err := rs.DB.Exec("UPDATE devices SET last_seen_at = ? WHERE id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)",
+		now, device.ID, now.Add(-deviceSeenInterval)).Error
+	if err != nil {
+		log.Printf("RADIUS: Unable to record when %v was seen: %v", device.MAC, err)
+	}
+}
+
+// findStaleDevices finds the enabled devices not seen since cutoff. Devices never seen count from when they
+// were registered.
+func findStaleDevices(db *gorm.DB, cutoff time.Time) ([]Device, error) {
+	var devices []Device
+	err := db.Where("disabled = ? AND (last_seen_at < ? OR (last_seen_at IS NULL AND created_at < ?))", false, cutoff, cutoff).
+		Order("mac").Find(&devices).Error
+	return devices, err
+}
+
+// disableStaleDevices disables the devices not seen since cutoff and returns them
+func disableStaleDevices(db *gorm.DB, cutoff time.Time) ([]Device, error) {
+	devices, err := findStaleDevices(db, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		devices[i].Disabled = true
+		if err := db.Save(&devices[i]).Error; err != nil {
+			return devices[:i], err
+		}
+	}
+	return devices, nil
+}
+
+// staleDevice describes a stale device in the notification email
+type staleDevice struct {
+	MAC      string
+	Name     string
+	LastSeen string
+}
+
+func newStaleDevice(device Device) staleDevice {
+	stale := staleDevice{MAC: prettyPrintMACAddress(device.MAC), Name: device.Name, LastSeen: "never"}
+	if stale.MAC == "" {
+		stale.MAC = device.MAC
+	}
+	if device.LastSeenAt != nil {
+		stale.LastSeen = device.LastSeenAt.Local().Format("2006-01-02")
+	}
+	return stale
+}
+
+// staleDevicesEmail is the data passed to the stale device email template
+type staleDevicesEmail struct {
+	Days    int
+	Devices []staleDevice
+}
+
+// staleDevicesCommand lists the devices not seen in a number of days and optionally disables them
+func staleDevicesCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("stale-devices", flag.ContinueOnError)
+	days := flags.Int("days", 90, "number of days since the devices were last seen")
+	disable := flags.Bool("disable", false, "disable the devices listed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days < 1 {
+		return fmt.Errorf("-days must be at least 1")
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -*days)
+	var devices []Device
+	var err error
+	if *disable {
+		devices, err = disableStaleDevices(db, cutoff)
+	} else {
+		devices, err = findStaleDevices(db, cutoff)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "MAC\tNAME\tLAST SEEN\tREGISTERED")
+	for _, device := range devices {
+		stale := newStaleDevice(device)
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\n", stale.MAC, stale.Name, stale.LastSeen, device.CreatedAt.Local().Format("2006-01-02"))
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if *disable {
+		fmt.Printf("Disabled %d devices\n", len(devices))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const statusTimeout = 5 * time.Second
+
+// StatusServer answers health checks over HTTP for container and orchestrator probes
+type StatusServer struct {
+	DB     *gorm.DB
+	Radius *RadiusServer
+	// PresenceToken is the bearer token /presence needs, which is disabled if it is empty
+	PresenceToken string
+	// PresenceTimeout is how long an accounting session without updates counts as online, or 0 until it stops
+	PresenceTimeout time.Duration
+
+	server *http.Server
+}
+
+// NewStatusServer creates a StatusServer listening on addr
+func NewStatusServer(addr string, db *gorm.DB, radius *RadiusServer) *StatusServer {
+	s := &StatusServer{DB: db, Radius: radius}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/presence", s.presence)
+	s.server = &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  statusTimeout,
+		WriteTimeout: statusTimeout,
+	}
+	return s
+}
+
+// Start the status server
+func (s *StatusServer) Start(wait *sync.WaitGroup) {
+	go func() {
+		log.Printf("STATUS: Starting server on %v", s.server.Addr)
+
+		listener, err := listen(s.server.Addr)
+		if err == nil {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("STATUS: Error starting status server: %v", err)
+		} else {
+			log.Printf("STATUS: Stopped server")
+		}
+
+		wait.Done()
+	}()
+}
+
+// Stop the status server
+func (s *StatusServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+// healthz reports that the process is up
+func (s *StatusServer) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readiness is the answer to /readyz
+type readiness struct {
+	Ready  bool                      `json:"ready"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// readinessCheck is the outcome of one of the checks of /readyz
+type readinessCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Details are what the check found, such as the schema version of the database
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// readyz reports whether the database can be used, has no pending migrations, and the RADIUS server is listening
+func (s *StatusServer) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), statusTimeout)
+	defer cancel()
+	result := readiness{Ready: true, Checks: make(map[string]readinessCheck)}
+	add := func(name string, check readinessCheck, err error) {
+		check.OK = err == nil
+		if err != nil {
+			check.Error = err.Error()
+			result.Ready = false
+		}
+		result.Checks[name] = check
+	}
+
+	versions, err := s.schemaVersions(ctx)
+	add("database", readinessCheck{}, err)
+	if err == nil {
+		add(s.migrationsCheck(versions))
+	}
+	add(s.radiusCheck())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// schemaVersions loads the applied migrations in a transaction, which fails if the database is locked for too long
+func (s *StatusServer) schemaVersions(ctx context.Context) (map[uint]bool, error) {
+	tx, err := s.DB.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT version FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make(map[uint]bool)
+	for rows.Next() {
+		var version uint
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+	return versions, rows.Err()
+}
+
+// migrationsCheck reports migrations that weren't applied, or were applied by a newer version of the program
+func (s *StatusServer) migrationsCheck(versions map[uint]bool) (string, readinessCheck, error) {
+	var current uint
+	for version := range versions {
+		if version > current {
+			current = version
+		}
+	}
+	pending := []uint{}
+	for _, m := range migrations {
+		if !versions[m.version] {
+			pending = append(pending, m.version)
+		}
+	}
+	check := readinessCheck{Details: map[string]interface{}{
+		"schema_version": current,
+		"latest":         latestSchemaVersion(),
+		"pending":        pending,
+	}}
+	var err error
+	if current > latestSchemaVersion() {
+		err = fmt.Errorf("the database has schema version %d, newer than %d", current, latestSchemaVersion())
+	} else if len(pending) > 0 {
+		err = fmt.Errorf("%d migrations are pending", len(pending))
+	}
+	return "migrations", check, err
+}
+
+// radiusCheck reports whether the RADIUS server is bound to its address
+func (s *StatusServer) radiusCheck() (string, readinessCheck, error) {
+	check := readinessCheck{Details: map[string]interface{}{"listen": s.Radius.Addr}}
+	var err error
+	if !s.Radius.Listening() {
+		err = errors.New("not listening")
+	}
+	return "radius", check, err
+}
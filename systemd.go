@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The first file descriptor passed by systemd socket activation
+const systemdListenFDsStart = 3
+
+// systemdSockets holds the sockets passed by systemd that haven't been claimed by a server yet
+var systemdSockets struct {
+	sync.Mutex
+	loaded bool
+	files  []*os.File
+}
+
+// inheritedSockets loads the sockets passed by systemd, if this process was started by socket activation
+func inheritedSockets() []*os.File {
+	if systemdSockets.loaded {
+		return systemdSockets.files
+	}
+	systemdSockets.loaded = true
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil
+	}
+	// The variables are meant for this process only, not for anything it starts
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+count; fd++ {
+		systemdSockets.files = append(systemdSockets.files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+	}
+	return systemdSockets.files
+}
+
+// listenPacket returns the UDP socket systemd passed for addr, or binds addr if there is none
+func listenPacket(addr string) (net.PacketConn, error) {
+	systemdSockets.Lock()
+	defer systemdSockets.Unlock()
+
+	for i, file := range inheritedSockets() {
+		if file == nil {
+			continue
+		}
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			continue
+		}
+		if socketMatches(conn.LocalAddr(), addr) {
+			log.Printf("SYSTEMD: Using the socket passed for %v", conn.LocalAddr())
+			file.Close()
+			systemdSockets.files[i] = nil
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return net.ListenPacket("udp", addr)
+}
+
+// listen returns the TCP socket systemd passed for addr, or binds addr if there is none
+func listen(addr string) (net.Listener, error) {
+	systemdSockets.Lock()
+	defer systemdSockets.Unlock()
+
+	for i, file := range inheritedSockets() {
+		if file == nil {
+			continue
+		}
+		listener, err := net.FileListener(file)
+		if err != nil {
+			continue
+		}
+		if socketMatches(listener.Addr(), addr) {
+			log.Printf("SYSTEMD: Using the socket passed for %v", listener.Addr())
+			file.Close()
+			systemdSockets.files[i] = nil
+			return listener, nil
+		}
+		listener.Close()
+	}
+	return net.Listen("tcp", addr)
+}
+
+// socketMatches reports whether a socket is bound to the configured address. A configured address without a
+// host, or with an unspecified one, matches a socket bound to the same port on any address.
+func socketMatches(local net.Addr, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	var localIP net.IP
+	var localPort int
+	switch local := local.(type) {
+	case *net.UDPAddr:
+		localIP, localPort = local.IP, local.Port
+		if p, err := net.LookupPort("udp", port); err != nil || p != localPort {
+			return false
+		}
+	case *net.TCPAddr:
+		localIP, localPort = local.IP, local.Port
+		if p, err := net.LookupPort("tcp", port); err != nil || p != localPort {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsUnspecified() || ip.Equal(localIP))
+}
+
+// sdNotify sends a state change such as READY=1 to systemd, when it is supervising this process
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	// Abstract socket names are given with a leading @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("SYSTEMD: Unable to notify %v: %v", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("SYSTEMD: Unable to notify %v: %v", state, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// testAuthCommand sends a single MAC authentication request to a RADIUS server, the way a controller does, and
+// prints the reply, to check the server and its policy end to end without radtest
+func testAuthCommand(args []string) error {
+	flags := flag.NewFlagSet("test-auth", flag.ContinueOnError)
+	server := flags.String("server", "127.0.0.1:1812", "address of the RADIUS server")
+	secret := flags.String("secret", "", "shared secret of this host as a RADIUS client")
+	mac := flags.String("mac", "", "MAC address of the device")
+	ssid := flags.String("ssid", "", "SSID sent in the Called-Station-Id")
+	userName := flags.String("user-name", "", "User-Name to send instead of the MAC address, as controllers with a shared username do")
+	password := flags.String("password", "", "User-Password to send instead of the MAC address")
+	accessPoint := flags.String("ap-mac", benchAccessPoint, "MAC address of the access point sent in the Called-Station-Id")
+	nasIdentifier := flags.String("nas-identifier", "", "NAS-Identifier to send, such as the name of the access point")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for the response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *secret == "" {
+		return errors.New("-secret is required")
+	}
+	*mac = normalizeMACAddress(*mac)
+	if !isValidMACFormat(*mac) {
+		return fmt.Errorf("invalid MAC address %q", *mac)
+	}
+	if len(*password) > 128 {
+		return errors.New("-password must not be longer than 128 characters")
+	}
+
+	calledStationID := *accessPoint
+	if *ssid != "" {
+		calledStationID += ":" + *ssid
+	}
+	packet := newMACAuthRequest(*secret, *mac, calledStationID)
+	if *userName != "" {
+		rfc2865.UserName_SetString(packet, *userName)
+	}
+	// Most controllers send the MAC address as the password too
+	if *password == "" {
+		*password = *mac
+	}
+	if err := setTestAuthPassword(packet, *password); err != nil {
+		return err
+	}
+	if *nasIdentifier != "" {
+		rfc2865.NASIdentifier_SetString(packet, *nasIdentifier)
+	}
+	if err := addMessageAuthenticator(packet); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sending to %v:\n%v\n\n", *server, dumpPacket(radiusDictionary, packet))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	start := time.Now()
+	response, err := (&radius.Client{}).Exchange(ctx, packet, *server)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("no response from %v within %v, check the secret and that this host is a registered client", *server, *timeout)
+	}
+	if err != nil {
+		return err
+	}
+	latency := time.Since(start)
+
+	fmt.Printf("Received in %v:\n%v\n", latency.Round(time.Microsecond), dumpPacket(radiusDictionary, response))
+	// The Message-Authenticator of a reply is calculated with the authenticator of the request
+	signed := *response
+	signed.Authenticator = packet.Authenticator
+	switch present, valid := verifyMessageAuthenticator(&signed); {
+	case !present:
+		fmt.Println("\nWarning: the response has no Message-Authenticator")
+	case !valid:
+		fmt.Println("\nWarning: the Message-Authenticator of the response is invalid")
+	}
+	if reply, _ := rfc2865.ReplyMessage_GetStrings(response); len(reply) > 0 {
+		fmt.Printf("\nResult: %v, %v\n", response.Code, strings.Join(reply, " "))
+	} else {
+		fmt.Printf("\nResult: %v\n", response.Code)
+	}
+	return nil
+}
+
+// setTestAuthPassword sets the User-Password, padded with nulls to a multiple of 16 bytes as RFC 2865 requires
+func setTestAuthPassword(packet *radius.Packet, password string) error {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	return rfc2865.UserPassword_Set(packet, padded)
+}
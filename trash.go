@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Removed devices and device groups are moved to the trash, where they are no longer used for authentication
+// nor listed, until they are restored or purged permanently. The trash keeps their group memberships and
+// networks, so restoring a record brings them back.
+
+// trashed selects the records in the trash
+func trashed(db *gorm.DB) *gorm.DB {
+	return db.Unscoped().Where("deleted_at IS NOT NULL")
+}
+
+// countTrash counts the devices and device groups in the trash
+func countTrash(db *gorm.DB) (int, error) {
+	var devices, groups int
+	if err := trashed(db).Model(&Device{}).Count(&devices).Error; err != nil {
+		return 0, err
+	}
+	if err := trashed(db).Model(&DeviceGroup{}).Count(&groups).Error; err != nil {
+		return 0, err
+	}
+	return devices + groups, nil
+}
+
+// purgeTrashedDevice permanently deletes the device in the trash with a MAC address, since registering the
+// address again replaces it
+func purgeTrashedDevice(db *gorm.DB, mac string) error {
+	var device Device
+	if trashed(db).First(&device, "mac = ?", mac).RecordNotFound() {
+		return nil
+	}
+	return purgeDevice(db, device)
+}
+
+// checkGroupNotTrashed refuses to create a device group with the name of one in the trash, which would lose
+// the devices of the removed group
+func checkGroupNotTrashed(db *gorm.DB, name string) error {
+	if trashed(db).First(&DeviceGroup{}, "name = ?", name).RecordNotFound() {
+		return nil
+	}
+	return fmt.Errorf("device group %q is in the trash, restore it with restore-group or purge it with purge-trash first", name)
+}
+
+// purgeDevice permanently deletes a device and its group memberships
+func purgeDevice(db *gorm.DB, device Device) error {
+	if err := db.Exec("DELETE FROM device_devicegroups WHERE device_id = ?", device.ID).Error; err != nil {
+		return err
+	}
+	return db.Unscoped().Delete(&device).Error
+}
+
+// purgeGroup permanently deletes a device group with its memberships, networks, and attributes. Groups in the
+// trash that inherited from it no longer have a parent.
+func purgeGroup(db *gorm.DB, group DeviceGroup) error {
+	for _, table := range []string{"device_devicegroups", "credential_devicegroups", "devicegroup_ssids", "group_attributes"} {
+		if err := db.Exec("DELETE FROM "+table+" WHERE device_group_id = ?", group.ID).Error; err != nil {
+			return err
+		}
+	}
+	if err := db.Unscoped().Model(&DeviceGroup{}).Where("parent_id = ?", group.ID).UpdateColumn("parent_id", nil).Error; err != nil {
+		return err
+	}
+	return db.Unscoped().Delete(&group).Error
+}
+
+// purgeTrash permanently deletes the devices and device groups moved to the trash before cutoff
+func purgeTrash(db *gorm.DB, cutoff time.Time) (devices int, groups int, err error) {
+	var trashedDevices []Device
+	if err := trashed(db).Where("deleted_at < ?", cutoff).Find(&trashedDevices).Error; err != nil {
+		return 0, 0, err
+	}
+	for _, device := range trashedDevices {
+		if err := purgeDevice(db, device); err != nil {
+			return devices, groups, err
+		}
+		devices++
+	}
+
+	var trashedGroups []DeviceGroup
+	if err := trashed(db).Where("deleted_at < ?", cutoff).Find(&trashedGroups).Error; err != nil {
+		return devices, 0, err
+	}
+	for _, group := range trashedGroups {
+		if err := purgeGroup(db, group); err != nil {
+			return devices, groups, err
+		}
+		groups++
+	}
+	return devices, groups, nil
+}
+
+// trashCommand lists the devices and device groups in the trash, the most recently removed first
+func trashCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("trash", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var devices []Device
+	if err := trashed(db).Order("deleted_at desc").Find(&devices).Error; err != nil {
+		return err
+	}
+	var groups []DeviceGroup
+	if err := trashed(db).Order("deleted_at desc").Find(&groups).Error; err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "TYPE\tMAC/NAME\tDESCRIPTION\tREMOVED")
+	for _, device := range devices {
+		mac := prettyPrintMACAddress(device.MAC)
+		if mac == "" {
+			mac = device.MAC
+		}
+		fmt.Fprintf(out, "device\t%v\t%v\t%v\n", mac, device.Name, device.DeletedAt.Local().Format(time.RFC3339))
+	}
+	for _, group := range groups {
+		var members int
+		if err := db.Table("device_devicegroups").Where("device_group_id = ?", group.ID).Count(&members).Error; err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "group\t%v\t%d devices\t%v\n", group.Name, members, group.DeletedAt.Local().Format(time.RFC3339))
+	}
+	return out.Flush()
+}
+
+// restoreDeviceCommand takes a device out of the trash with the groups it had
+func restoreDeviceCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("restore-device", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*mac = normalizeMACAddress(*mac)
+
+	var device Device
+	if trashed(db).First(&device, "mac = ?", *mac).RecordNotFound() {
+		return fmt.Errorf("device %v is not in the trash", *mac)
+	}
+	if err := db.Unscoped().Model(&device).Update("deleted_at", nil).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored device %v\n", device.MAC)
+	return nil
+}
+
+// restoreGroupCommand takes a device group out of the trash with its devices and networks
+func restoreGroupCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("restore-group", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the device group")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var group DeviceGroup
+	if trashed(db).First(&group, "name = ?", *name).RecordNotFound() {
+		return fmt.Errorf("device group %q is not in the trash", *name)
+	}
+	if group.ParentID != nil {
+		var parent DeviceGroup
+		if !trashed(db).First(&parent, *group.ParentID).RecordNotFound() {
+			return fmt.Errorf("the parent of device group %q, %q, is in the trash, restore it first", group.Name, parent.Name)
+		}
+	}
+	if err := db.Unscoped().Model(&group).Update("deleted_at", nil).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored device group %q\n", group.Name)
+	return nil
+}
+
+// purgeTrashCommand permanently deletes a device or device group in the trash, or everything removed a number
+// of days ago
+func purgeTrashCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("purge-trash", flag.ContinueOnError)
+	mac := flags.String("mac", "", "MAC address or prefix of a device to purge")
+	name := flags.String("group", "", "name of a device group to purge")
+	days := flags.Int("days", -1, "purge everything removed at least this many days ago, or 0 for the whole trash")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case *mac != "":
+		*mac = normalizeMACAddress(*mac)
+		var device Device
+		if trashed(db).First(&device, "mac = ?", *mac).RecordNotFound() {
+			return fmt.Errorf("device %v is not in the trash", *mac)
+		}
+		if err := purgeDevice(db, device); err != nil {
+			return err
+		}
+		fmt.Printf("Purged device %v\n", device.MAC)
+	case *name != "":
+		var group DeviceGroup
+		if trashed(db).First(&group, "name = ?", *name).RecordNotFound() {
+			return fmt.Errorf("device group %q is not in the trash", *name)
+		}
+		if err := purgeGroup(db, group); err != nil {
+			return err
+		}
+		fmt.Printf("Purged device group %q\n", group.Name)
+	case *days >= 0:
+		devices, groups, err := purgeTrash(db, time.Now().AddDate(0, 0, -*days))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d devices and %d device groups\n", devices, groups)
+	default:
+		return errors.New("one of -mac, -group, or -days is required")
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// trashTestGroups creates the device group laptops, inheriting from staff, with a device in it
+func trashTestGroups(t *testing.T, db *gorm.DB) (staff, laptops DeviceGroup, device Device) {
+	t.Helper()
+	staff = DeviceGroup{Name: "staff", Networks: []Network{{SSID: "Corp"}}}
+	if err := db.Create(&staff).Error; err != nil {
+		t.Fatal(err)
+	}
+	laptops = DeviceGroup{Name: "laptops", ParentID: &staff.ID}
+	if err := db.Create(&laptops).Error; err != nil {
+		t.Fatal(err)
+	}
+	device = Device{MAC: "001122334455", Name: "laptop", DeviceGroups: []DeviceGroup{laptops}}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	return staff, laptops, device
+}
+
+// countRows counts the rows of a table, including those in the trash
+func countRows(t *testing.T, db *gorm.DB, table string) int {
+	t.Helper()
+	var count int
+	if err := db.Table(table).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRestoreDevice(t *testing.T) {
+	db := openTestDatabase(t)
+	_, laptops, _ := trashTestGroups(t, db)
+
+	if err := removeDeviceCommand(db, []string{"-mac", "00:11:22:33:44:55"}); err != nil {
+		t.Fatal(err)
+	}
+	if !db.First(&Device{}, "mac = ?", "001122334455").RecordNotFound() {
+		t.Error("the removed device is still registered")
+	}
+	if count, err := countTrash(db); err != nil || count != 1 {
+		t.Errorf("got %d in the trash, %v", count, err)
+	}
+	if err := removeDeviceCommand(db, []string{"-mac", "001122334455"}); err == nil {
+		t.Error("the device was removed twice")
+	}
+
+	if err := restoreDeviceCommand(db, []string{"-mac", "00-11-22-33-44-55"}); err != nil {
+		t.Fatal(err)
+	}
+	var device Device
+	if err := db.Preload("DeviceGroups").First(&device, "mac = ?", "001122334455").Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(device.DeviceGroups) != 1 || device.DeviceGroups[0].ID != laptops.ID {
+		t.Errorf("the restored device is in %v", device.DeviceGroups)
+	}
+	if err := restoreDeviceCommand(db, []string{"-mac", "001122334455"}); err == nil {
+		t.Error("a registered device was restored")
+	}
+	if err := restoreDeviceCommand(db, []string{"-mac", "aabbccddeeff"}); err == nil {
+		t.Error("an unknown device was restored")
+	}
+}
+
+func TestRestoreGroup(t *testing.T) {
+	db := openTestDatabase(t)
+	trashTestGroups(t, db)
+
+	if err := removeGroupCommand(db, []string{"-name", "staff"}); err == nil {
+		t.Error("the parent of a group was removed")
+	}
+	for _, name := range []string{"laptops", "staff"} {
+		if err := removeGroupCommand(db, []string{"-name", name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := countTrash(db); err != nil || count != 2 {
+		t.Errorf("got %d in the trash, %v", count, err)
+	}
+	if err := setGroupCommand(db, []string{"-name", "laptops"}); err == nil {
+		t.Error("a group was created with the name of one in the trash")
+	}
+
+	// A group can't be restored before the group it inherits from
+	if err := restoreGroupCommand(db, []string{"-name", "laptops"}); err == nil {
+		t.Error("a group was restored while its parent is in the trash")
+	}
+	for _, name := range []string{"staff", "laptops"} {
+		if err := restoreGroupCommand(db, []string{"-name", name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var laptops DeviceGroup
+	if err := db.Preload("Networks").First(&laptops, "name = ?", "laptops").Error; err != nil {
+		t.Fatal(err)
+	}
+	var staff DeviceGroup
+	if err := db.Preload("Networks").First(&staff, "name = ?", "staff").Error; err != nil {
+		t.Fatal(err)
+	}
+	if laptops.ParentID == nil || *laptops.ParentID != staff.ID || len(staff.Networks) != 1 {
+		t.Errorf("the restored groups lost their parent or networks: %+v, %+v", laptops, staff)
+	}
+	if members := countRows(t, db, "device_devicegroups"); members != 1 {
+		t.Errorf("got %d group memberships", members)
+	}
+	if err := restoreGroupCommand(db, []string{"-name", "laptops"}); err == nil {
+		t.Error("a group was restored twice")
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	db := openTestDatabase(t)
+	staff, laptops, device := trashTestGroups(t, db)
+	recent := Device{MAC: "aabbccddeeff", DeviceGroups: []DeviceGroup{laptops}}
+	if err := db.Create(&recent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The staff group and the first device were removed a week ago, the second device an hour ago
+	weekAgo := time.Now().AddDate(0, 0, -7)
+	for _, record := range []interface{}{&device, &staff} {
+		if err := db.Model(record).UpdateColumn("deleted_at", weekAgo).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Model(&recent).UpdateColumn("deleted_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	devices, groups, err := purgeTrash(db, time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices != 1 || groups != 1 {
+		t.Errorf("purged %d devices and %d groups", devices, groups)
+	}
+	if count, err := countTrash(db); err != nil || count != 1 {
+		t.Errorf("got %d left in the trash, %v", count, err)
+	}
+	if ssids := countRows(t, db, "devicegroup_ssids"); ssids != 0 {
+		t.Errorf("got %d networks of purged groups", ssids)
+	}
+	// The membership of the device still in the trash is kept
+	if members := countRows(t, db, "device_devicegroups"); members != 1 {
+		t.Errorf("got %d group memberships", members)
+	}
+	if err := db.First(&laptops, laptops.ID).Error; err != nil || laptops.ParentID != nil {
+		t.Errorf("the child of a purged group has parent %v, %v", laptops.ParentID, err)
+	}
+
+	if err := purgeTrashCommand(db, nil); err == nil {
+		t.Error("the trash was purged without -mac, -group, or -days")
+	}
+	if err := purgeTrashCommand(db, []string{"-days", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countTrash(db); err != nil || count != 0 {
+		t.Errorf("got %d left in the trash, %v", count, err)
+	}
+}
+
+func TestRegisterTrashedDevice(t *testing.T) {
+	db := openTestDatabase(t)
+	_, _, device := trashTestGroups(t, db)
+	if err := deleteDevice(db, device); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering the address again replaces the device in the trash and its groups
+	if err := addDeviceCommand(db, []string{"-mac", "00:11:22:33:44:55", "-name", "new laptop"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := countTrash(db); err != nil || count != 0 {
+		t.Errorf("got %d in the trash, %v", count, err)
+	}
+	var registered Device
+	if err := db.Preload("DeviceGroups").First(&registered, "mac = ?", "001122334455").Error; err != nil {
+		t.Fatal(err)
+	}
+	if registered.ID == device.ID || registered.Name != "new laptop" || len(registered.DeviceGroups) != 0 {
+		t.Errorf("got %+v", registered)
+	}
+	if err := purgeTrashedDevice(db, "001122334455"); err != nil {
+		t.Error(err)
+	}
+	if db.First(&Device{}, "mac = ?", "001122334455").RecordNotFound() {
+		t.Error("a registered device was purged")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const unifiTimeout = 30 * time.Second
+
+// UniFiConfig stores how to reach a UniFi Network controller to import its clients
+type UniFiConfig struct {
+	// URL is the address of the controller, such as "https://unifi.example.com:8443"
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Site is the name of the site in the controller's URLs, not its description
+	Site string `json:"site"`
+	// UniFiOS is set for controllers running on UniFi OS, such as a Dream Machine or Cloud Key Gen2
+	UniFiOS bool `json:"unifi_os"`
+	// InsecureSkipVerify accepts the self-signed certificate most controllers use
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// unifiStation is a client associated with the controller's access points
+type unifiStation struct {
+	MAC      string `json:"mac"`
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	ESSID    string `json:"essid"`
+	IP       string `json:"ip"`
+}
+
+// displayName prefers the name given in the controller over the hostname the device sent
+func (s unifiStation) displayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Hostname
+}
+
+// unifiController talks to the API of a UniFi Network controller
+type unifiController struct {
+	config UniFiConfig
+	client *http.Client
+}
+
+func newUniFiController(config UniFiConfig) (*unifiController, error) {
+	parsed, err := url.Parse(config.URL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid UniFi controller URL %q", config.URL)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &unifiController{
+		config: config,
+		client: &http.Client{
+			Jar:     jar,
+			Timeout: unifiTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+			},
+		},
+	}, nil
+}
+
+// login starts a session, which the cookie jar keeps for the following requests
+func (c *unifiController) login() error {
+	path := "/api/login"
+	if c.config.UniFiOS {
+		path = "/api/auth/login"
+	}
+	body, err := json.Marshal(map[string]string{"username": c.config.Username, "password": c.config.Password})
+	if err != nil {
+		return err
+	}
+	response, err := c.client.Post(strings.TrimSuffix(c.config.URL, "/")+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("login to the UniFi controller failed: %v", response.Status)
+	}
+	return nil
+}
+
+// stations lists the clients currently associated with the site
+func (c *unifiController) stations() ([]unifiStation, error) {
+	path := "/api/s/" + url.PathEscape(c.config.Site) + "/stat/sta"
+	if c.config.UniFiOS {
+		path = "/proxy/network" + path
+	}
+	response, err := c.client.Get(strings.TrimSuffix(c.config.URL, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to list the UniFi clients: %v", response.Status)
+	}
+
+	var result struct {
+		Data []unifiStation `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	for i := range result.Data {
+		result.Data[i].MAC = normalizeMACAddress(result.Data[i].MAC)
+	}
+	return result.Data, nil
+}
+
+// listUniFiStations logs in to the configured controller and lists its clients
+func listUniFiStations(config UniFiConfig) ([]unifiStation, error) {
+	if config.URL == "" {
+		return nil, errors.New("no UniFi controller is configured")
+	}
+	controller, err := newUniFiController(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.login(); err != nil {
+		return nil, err
+	}
+	return controller.stations()
+}
+
+// unifiClientsCommand lists the clients associated with the UniFi controller and whether they are registered
+func unifiClientsCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("unifi-clients", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stations, err := listUniFiStations(config.UniFi)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "MAC\tNAME\tSSID\tIP\tREGISTERED")
+	for _, station := range stations {
+		registered := "no"
+		if !db.First(&Device{}, "MAC = ?", station.MAC).RecordNotFound() {
+			registered = "yes"
+		}
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\n", prettyPrintMACAddress(station.MAC), station.displayName(), station.ESSID, station.IP, registered)
+	}
+	return out.Flush()
+}
+
+// unifiImportCommand registers clients of the UniFi controller as devices, named as in the controller
+func unifiImportCommand(config Config, db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("unifi-import", flag.ContinueOnError)
+	var macs stringListFlag
+	flags.Var(&macs, "mac", "MAC address of a client to import (repeatable)")
+	all := flags.Bool("all", false, "import every client that isn't registered yet")
+	var groupNames stringListFlag
+	flags.Var(&groupNames, "group", "device group to add the devices to (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(macs) == 0 && !*all {
+		return errors.New("-mac or -all is required")
+	}
+	selected := make(map[string]bool)
+	for _, mac := range macs {
+		mac = normalizeMACAddress(mac)
+		if !isValidMACFormat(mac) {
+			return fmt.Errorf("invalid MAC address %q", mac)
+		}
+		selected[mac] = true
+	}
+	var groups []DeviceGroup
+	for _, name := range groupNames {
+		var group DeviceGroup
+		if db.First(&group, "name = ?", name).RecordNotFound() {
+			return fmt.Errorf("device group %q does not exist", name)
+		}
+		groups = append(groups, group)
+	}
+
+	stations, err := listUniFiStations(config.UniFi)
+	if err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		if !isValidMACFormat(station.MAC) || (!*all && !selected[station.MAC]) {
+			continue
+		}
+		delete(selected, station.MAC)
+		if !db.First(&Device{}, "MAC = ?", station.MAC).RecordNotFound() {
+			fmt.Printf("Skipped %v, which is already registered\n", prettyPrintMACAddress(station.MAC))
+			continue
+		}
+		if err := purgeTrashedDevice(db, station.MAC); err != nil {
+			return err
+		}
+		device := Device{MAC: station.MAC, Name: station.displayName(), DeviceGroups: groups}
+		if err := db.Create(&device).Error; err != nil {
+			return err
+		}
+		fmt.Printf("Imported %v %q\n", prettyPrintMACAddress(device.MAC), device.Name)
+	}
+	for mac := range selected {
+		fmt.Printf("Skipped %v, which is not connected to the controller\n", prettyPrintMACAddress(mac))
+	}
+	return nil
+}
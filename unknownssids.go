@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	unknownSSIDQueueSize = 64
+	// unknownSSIDSeenInterval is how often an SSID whose client hasn't changed is checked and written again
+	unknownSSIDSeenInterval = 5 * time.Minute
+)
+
+// UnknownSSID is an SSID requested in the Called-Station-Id that has no network, so no group can grant access to
+// it by name. Unknown SSIDs are added automatically and hidden once a network is created for them.
+type UnknownSSID struct {
+	Model
+	SSID string `gorm:"unique_index;not null"`
+	// Client is the address of the RADIUS client the latest request came from
+	Client     string
+	LastSeenAt time.Time
+}
+
+// UnknownSSIDRecorder keeps the UnknownSSID table up to date from the authentications, checking and writing in
+// the background and only when the client of an SSID changed or it hasn't been written for a while
+type UnknownSSIDRecorder struct {
+	db      *gorm.DB
+	events  chan AuthEvent
+	done    chan struct{}
+	dropped uint64
+
+	mutex sync.Mutex
+	// seen holds the latest event written for each SSID
+	seen      map[string]AuthEvent
+	lastSweep time.Time
+}
+
+// NewUnknownSSIDRecorder creates an UnknownSSIDRecorder and starts writing
+func NewUnknownSSIDRecorder(db *gorm.DB) *UnknownSSIDRecorder {
+	r := &UnknownSSIDRecorder{
+		db:     db,
+		events: make(chan AuthEvent, unknownSSIDQueueSize),
+		done:   make(chan struct{}),
+		seen:   make(map[string]AuthEvent),
+	}
+	go r.run()
+	return r
+}
+
+// AuthEvent records the SSID of an authentication if it has no network
+func (r *UnknownSSIDRecorder) AuthEvent(event AuthEvent) {
+	if event.SSID == "" || event.SSID == wildcardSSID {
+		return
+	}
+
+	r.mutex.Lock()
+	last, ok := r.seen[event.SSID]
+	if ok && event.Time.Sub(last.Time) < unknownSSIDSeenInterval && last.Client == event.Client {
+		r.mutex.Unlock()
+		return
+	}
+	r.seen[event.SSID] = event
+	// Forget the SSIDs not seen for a while, so requests with random SSIDs don't use up memory
+	if event.Time.Sub(r.lastSweep) >= time.Minute {
+		for ssid, written := range r.seen {
+			if event.Time.Sub(written.Time) >= unknownSSIDSeenInterval {
+				delete(r.seen, ssid)
+			}
+		}
+		r.lastSweep = event.Time
+	}
+	r.mutex.Unlock()
+
+	select {
+	case r.events <- event:
+	default:
+		if dropped := atomic.AddUint64(&r.dropped, 1); dropped == 1 || dropped%1000 == 0 {
+			log.Printf("RADIUS: Unknown SSID queue is full, %d updates dropped", dropped)
+		}
+	}
+}
+
+// Stop writes the queued SSIDs and stops the recorder
+func (r *UnknownSSIDRecorder) Stop() {
+	close(r.events)
+	<-r.done
+}
+
+func (r *UnknownSSIDRecorder) run() {
+	defer close(r.done)
+	for event := range r.events {
+		if err := r.record(event); err != nil {
+			log.Printf("RADIUS: Unable to record unknown SSID %q: %v", event.SSID, err)
+		}
+	}
+}
+
+// record adds or updates the SSID of an event, or removes it from the unknown SSIDs if it has a network now
+func (r *UnknownSSIDRecorder) record(event AuthEvent) error {
+	var count int
+	if err := r.db.Model(&Network{}).Where(&Network{SSID: event.SSID}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return r.db.Where(&UnknownSSID{SSID: event.SSID}).Delete(&UnknownSSID{}).Error
+	}
+
+	var unknown UnknownSSID
+	if err := r.db.FirstOrInit(&unknown, UnknownSSID{SSID: event.SSID}).Error; err != nil {
+		return err
+	}
+	if unknown.ID == 0 {
+		log.Printf("RADIUS: Client %v asked for SSID %q, which has no network", event.Client, event.SSID)
+	}
+	unknown.Client = event.Client
+	unknown.LastSeenAt = event.Time
+	return r.db.Save(&unknown).Error
+}
+
+// listUnknownSSIDsCommand lists the requested SSIDs that have no network, the most recently seen first
+func listUnknownSSIDsCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("list-unknown-ssids", flag.ContinueOnError)
+	days := flags.Int("days", 0, "only list the SSIDs seen in this many days, or 0 for all of them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := db.Order("last_seen_at desc")
+	if *days > 0 {
+		query = query.Where("last_seen_at >= ?", time.Now().AddDate(0, 0, -*days))
+	}
+	var recorded []UnknownSSID
+	if err := query.Find(&recorded).Error; err != nil {
+		return err
+	}
+	var networks []Network
+	if err := db.Find(&networks).Error; err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, network := range networks {
+		known[network.SSID] = true
+	}
+	// SSIDs whose network was created since they were last seen are hidden
+	var unknown []UnknownSSID
+	for _, ssid := range recorded {
+		if !known[ssid.SSID] {
+			unknown = append(unknown, ssid)
+		}
+	}
+	if len(unknown) == 0 {
+		fmt.Println("Every requested SSID has a network")
+		return nil
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "SSID\tCLIENT\tFIRST SEEN\tLAST SEEN")
+	for _, ssid := range unknown {
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\n", ssid.SSID, ssid.Client, ssid.CreatedAt.Local().Format(time.RFC3339),
+			ssid.LastSeenAt.Local().Format(time.RFC3339))
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	fmt.Println("\nAdd a network with set-network -ssid <SSID>, or allow a group on it with set-group -network <SSID>")
+	return nil
+}
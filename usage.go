@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// usageTotals adds up the accounting of a device, group, or network
+type usageTotals struct {
+	Name     string
+	Sessions int
+	Time     time.Duration
+	// Upload and Download are from the device's point of view, which is the reverse of the client's Input and
+	// Output counters
+	Upload   uint64
+	Download uint64
+	Packets  uint64
+}
+
+func (u *usageTotals) add(session AccountingSession) {
+	u.Sessions++
+	u.Time += time.Duration(session.SessionTime) * time.Second
+	u.Upload += session.InputOctets
+	u.Download += session.OutputOctets
+	u.Packets += session.InputPackets + session.OutputPackets
+}
+
+// aggregateUsage totals the sessions by a key. Sessions can count towards several keys, such as a device in
+// several groups.
+func aggregateUsage(sessions []AccountingSession, keys func(session AccountingSession) []string) []*usageTotals {
+	totals := make(map[string]*usageTotals)
+	for _, session := range sessions {
+		for _, key := range keys(session) {
+			if totals[key] == nil {
+				totals[key] = &usageTotals{Name: key}
+			}
+			totals[key].add(session)
+		}
+	}
+
+	var sorted []*usageTotals
+	for _, total := range totals {
+		sorted = append(sorted, total)
+	}
+	// The chattiest first
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Upload+sorted[i].Download, sorted[j].Upload+sorted[j].Download
+		if a != b {
+			return a > b
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// formatBytes shows a byte count with a binary unit
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// usageCommand shows the traffic of the devices, groups, or networks from the accounting sessions
+func usageCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	by := flags.String("by", "device", "total by device, group, or ssid")
+	macAddress := flags.String("mac", "", "only show this device, by network")
+	days := flags.Int("days", 30, "count the sessions active in this many days")
+	limit := flags.Int("limit", 20, "number of rows to show, or 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *days < 1 {
+		return errors.New("-days must be at least 1")
+	}
+	query := db.Where("updated_at >= ?", time.Now().AddDate(0, 0, -*days))
+	if *macAddress != "" {
+		mac := normalizeMACAddress(*macAddress)
+		if !isValidMACFormat(mac) {
+			return fmt.Errorf("invalid MAC address %q", *macAddress)
+		}
+		query = query.Where("mac = ?", mac)
+		*by = "ssid"
+	}
+	var sessions []AccountingSession
+	if err := query.Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	var keys func(session AccountingSession) []string
+	switch *by {
+	case "device":
+		keys = func(session AccountingSession) []string {
+			if session.MAC == "" {
+				return []string{session.Username}
+			}
+			return []string{prettyPrintMACAddress(session.MAC)}
+		}
+	case "ssid":
+		keys = func(session AccountingSession) []string { return []string{session.SSID} }
+	case "group":
+		var devices []Device
+		if err := db.Preload("DeviceGroups").Find(&devices).Error; err != nil {
+			return err
+		}
+		groups := make(map[string][]string)
+		for _, device := range devices {
+			for _, group := range device.DeviceGroups {
+				groups[device.MAC] = append(groups[device.MAC], group.Name)
+			}
+		}
+		keys = func(session AccountingSession) []string { return groups[session.MAC] }
+	default:
+		return fmt.Errorf("unknown -by %q", *by)
+	}
+
+	totals := aggregateUsage(sessions, keys)
+	if *limit > 0 && len(totals) > *limit {
+		totals = totals[:*limit]
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(out, "%v\tSESSIONS\tTIME\tDOWNLOAD\tUPLOAD\tPACKETS\n", map[string]string{"device": "DEVICE", "ssid": "SSID", "group": "GROUP"}[*by])
+	for _, total := range totals {
+		fmt.Fprintf(out, "%v\t%d\t%v\t%v\t%v\t%d\n", total.Name, total.Sessions, total.Time,
+			formatBytes(total.Download), formatBytes(total.Upload), total.Packets)
+	}
+	return out.Flush()
+}
@@ -17,6 +17,25 @@ func isValidMACFormat(mac string) bool {
 	return err == nil && validFormat
 }
 
+// macWildcard ends a device MAC address that matches every address starting with the same digits
+const macWildcard = "*"
+
+// isValidMACPattern validates a normalized MAC address prefix followed by the wildcard, such as b827eb*
+func isValidMACPattern(pattern string) bool {
+	validFormat, err := regexp.MatchString(`^[0-9a-f]{1,11}\*$`, pattern)
+	return err == nil && validFormat
+}
+
+// stringInSlice reports whether value is one of list
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 // prettyPrintMACAddress takes a normalized MAC address and makes it presentable for display
 func prettyPrintMACAddress(mac string) string {
 	if !isValidMACFormat(mac) {
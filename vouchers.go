@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// voucherAlphabet leaves out letters and digits that are easily confused when typed from a printout
+const voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const voucherCodeLength = 10
+
+// Voucher is a one-time code that registers a device in a group for a limited time
+type Voucher struct {
+	Model
+	Code          string `gorm:"unique;not null"`
+	DeviceGroupID uint   `gorm:"not null"`
+	DeviceGroup   DeviceGroup
+	// Validity is how long a device registered with the voucher is allowed on the network, in seconds
+	Validity uint
+	// ExpiresAt is when the voucher can no longer be redeemed
+	ExpiresAt time.Time
+
+	RedeemedAt *time.Time
+	DeviceID   *uint
+}
+
+// generateVoucherCode creates a random code
+func generateVoucherCode() (string, error) {
+	max := big.NewInt(int64(len(voucherAlphabet)))
+	code := make([]byte, voucherCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = voucherAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeVoucherCode removes the formatting from a code typed in by a person
+func normalizeVoucherCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+}
+
+// prettyPrintVoucherCode splits a code in two halves so it is easier to read
+func prettyPrintVoucherCode(code string) string {
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
+
+// registerTemporaryDevice adds a device to a group until expires, extending the registration of a device that
+// was registered for a limited time before. Devices registered permanently are left alone.
+func registerTemporaryDevice(tx *gorm.DB, mac string, group DeviceGroup, expires time.Time) (Device, error) {
+	var device Device
+	result := tx.First(&device, "MAC = ?", mac)
+	if result.Error != nil && !result.RecordNotFound() {
+		return Device{}, result.Error
+	}
+	if !result.RecordNotFound() && device.ExpiresAt == nil {
+		return Device{}, fmt.Errorf("device %v is already registered", prettyPrintMACAddress(mac))
+	}
+	if result.RecordNotFound() {
+		if err := purgeTrashedDevice(tx, mac); err != nil {
+			return Device{}, err
+		}
+	}
+	device.MAC = mac
+	device.ExpiresAt = &expires
+	if err := tx.Save(&device).Error; err != nil {
+		return Device{}, err
+	}
+	err := auditAssociationChange(tx, &device, func() error {
+		return tx.Model(&device).Association("DeviceGroups").Append(group).Error
+	})
+	if err != nil {
+		return Device{}, err
+	}
+	return device, nil
+}
+
+// redeemVoucher registers a device with a voucher
+func redeemVoucher(db *gorm.DB, code, mac string, now time.Time) (Device, error) {
+	tx := db.Begin()
+	device, err := redeemVoucherTx(tx, code, mac, now)
+	if err != nil {
+		tx.Rollback()
+		return Device{}, err
+	}
+	return device, tx.Commit().Error
+}
+
+func redeemVoucherTx(tx *gorm.DB, code, mac string, now time.Time) (Device, error) {
+	var voucher Voucher
+	if tx.Preload("DeviceGroup").First(&voucher, "code = ?", code).RecordNotFound() {
+		return Device{}, errors.New("unknown voucher")
+	}
+	if voucher.RedeemedAt != nil {
+		return Device{}, errors.New("voucher has already been used")
+	}
+	if now.After(voucher.ExpiresAt) {
+		return Device{}, errors.New("voucher has expired")
+	}
+	if voucher.DeviceGroup.ID == 0 {
+		return Device{}, errors.New("the device group of the voucher no longer exists")
+	}
+
+	device, err := registerTemporaryDevice(tx, mac, voucher.DeviceGroup, now.Add(time.Duration(voucher.Validity)*time.Second))
+	if err != nil {
+		return Device{}, err
+	}
+
+	// Only one redemption can mark the voucher as used
+	result := tx.Model(&Voucher{}).Where("id = ? AND redeemed_at IS NULL", voucher.ID).
+		Updates(map[string]interface{}{"redeemed_at": now, "device_id": device.ID})
+	if result.Error != nil {
+		return Device{}, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return Device{}, errors.New("voucher has already been used")
+	}
+	return device, nil
+}
+
+// issueVouchersCommand creates a batch of vouchers for a group and prints their codes
+func issueVouchersCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("issue-vouchers", flag.ContinueOnError)
+	groupName := flags.String("group", "", "device group the devices are added to")
+	count := flags.Int("count", 10, "number of vouchers")
+	validity := flags.Duration("validity", 24*time.Hour, "how long a device is allowed after redeeming a voucher")
+	expires := flags.Duration("expires", 30*24*time.Hour, "how long the vouchers can be redeemed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var group DeviceGroup
+	if *groupName == "" || db.First(&group, "name = ?", *groupName).RecordNotFound() {
+		return fmt.Errorf("device group %q does not exist", *groupName)
+	}
+	if *count < 1 || *validity < time.Second || *expires <= 0 {
+		return errors.New("-count, -validity, and -expires must be positive")
+	}
+
+	expiresAt := time.Now().Add(*expires)
+	for i := 0; i < *count; i++ {
+		code, err := generateVoucherCode()
+		if err != nil {
+			return err
+		}
+		voucher := Voucher{
+			Code:          code,
+			DeviceGroupID: group.ID,
+			Validity:      uint(validity.Seconds()),
+			ExpiresAt:     expiresAt,
+		}
+		if err := db.Create(&voucher).Error; err != nil {
+			return err
+		}
+		fmt.Println(prettyPrintVoucherCode(code))
+	}
+	return nil
+}
+
+// redeemVoucherCommand registers a device with a voucher on behalf of its owner
+func redeemVoucherCommand(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("redeem-voucher", flag.ContinueOnError)
+	code := flags.String("code", "", "voucher code")
+	macFlag := flags.String("mac", "", "MAC address of the device")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	mac := normalizeMACAddress(*macFlag)
+	if !isValidMACFormat(mac) {
+		return errors.New("a valid -mac is required")
+	}
+	device, err := redeemVoucher(db, normalizeVoucherCode(*code), mac, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Registered %v until %v\n", prettyPrintMACAddress(device.MAC), device.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Webhook events
+const (
+	webhookEventAuthAccept   = "auth.accept"
+	webhookEventAuthReject   = "auth.reject"
+	webhookEventAuthHoneypot = "auth.honeypot"
+	webhookEventAuthRoaming  = "auth.roaming"
+	webhookEventRecordCreate = "record.create"
+	webhookEventRecordUpdate = "record.update"
+	webhookEventRecordDelete = "record.delete"
+)
+
+var webhookEvents = []string{webhookEventAuthAccept, webhookEventAuthReject, webhookEventAuthHoneypot, webhookEventAuthRoaming, webhookEventRecordCreate, webhookEventRecordUpdate, webhookEventRecordDelete}
+
+const (
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+	// webhookAttempts is how many times a delivery is tried, waiting twice as long after each failure
+	webhookAttempts     = 4
+	webhookRetryBackoff = time.Second
+	// webhookSignatureHeader holds the hex encoded HMAC-SHA256 of the body, keyed with the webhook secret
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+)
+
+// WebhookConfig stores the settings for one webhook
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Secret signs the payloads, so the receiver can check they came from this server
+	Secret string `json:"secret"`
+	// Events selects the events sent to the webhook, or all of them if empty
+	Events []string `json:"events"`
+}
+
+// validate checks a webhook read from the configuration file
+func (c WebhookConfig) validate() error {
+	parsed, err := url.Parse(c.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", c.URL)
+	}
+	for _, event := range c.Events {
+		if !stringInSlice(event, webhookEvents) {
+			return fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body posted to the webhooks
+type WebhookPayload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// webhookRecord is the data of a record change, with the values as recorded in the audit log
+type webhookRecord struct {
+	Actor  string          `json:"actor"`
+	Type   string          `json:"type"`
+	ID     uint            `json:"id"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// webhook delivers the payloads of one configured webhook in order
+type webhook struct {
+	config WebhookConfig
+	queue  chan WebhookPayload
+}
+
+// Webhooks posts authentication events and record changes to the configured URLs. Each webhook is delivered
+// in the background and retried with backoff, so neither the RADIUS handler nor the database waits on them.
+type Webhooks struct {
+	hooks  []*webhook
+	client *http.Client
+	wait   sync.WaitGroup
+}
+
+// NewWebhooks checks the configured webhooks and starts delivering, or returns nil if there are none
+func NewWebhooks(configs []WebhookConfig) (*Webhooks, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	w := &Webhooks{client: &http.Client{Timeout: webhookTimeout}}
+	for _, config := range configs {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		w.hooks = append(w.hooks, &webhook{config: config, queue: make(chan WebhookPayload, webhookQueueSize)})
+	}
+	for _, hook := range w.hooks {
+		w.wait.Add(1)
+		go w.run(hook)
+	}
+	return w, nil
+}
+
+// AuthEvent sends an authentication to the webhooks
+func (w *Webhooks) AuthEvent(event AuthEvent) {
+	name := webhookEventAuthReject
+	if event.Accepted {
+		name = webhookEventAuthAccept
+	}
+	w.send(WebhookPayload{Event: name, Time: event.Time, Data: event})
+	if event.Reason == authReasonHoneypot {
+		w.send(WebhookPayload{Event: webhookEventAuthHoneypot, Time: event.Time, Data: event})
+	}
+}
+
+// Roaming sends an alert about a MAC address authenticating at two sites within the roaming window
+func (w *Webhooks) Roaming(alert RoamingAlert) {
+	w.send(WebhookPayload{Event: webhookEventAuthRoaming, Time: alert.To.Time, Data: alert})
+}
+
+// RecordChanged sends a change recorded in the audit log to the webhooks
+func (w *Webhooks) RecordChanged(entry AuditLog) {
+	record := webhookRecord{Actor: entry.Actor, Type: entry.ObjectType, ID: entry.ObjectID}
+	if entry.Before != "" {
+		record.Before = json.RawMessage(entry.Before)
+	}
+	if entry.After != "" {
+		record.After = json.RawMessage(entry.After)
+	}
+	w.send(WebhookPayload{Event: "record." + entry.Action, Time: entry.CreatedAt, Data: record})
+}
+
+// send queues a payload for the webhooks that want its event, dropping it if a webhook has fallen too far behind
+func (w *Webhooks) send(payload WebhookPayload) {
+	for _, hook := range w.hooks {
+		if len(hook.config.Events) > 0 && !stringInSlice(payload.Event, hook.config.Events) {
+			continue
+		}
+		select {
+		case hook.queue <- payload:
+		default:
+			log.Printf("WEBHOOK: Queue for %v is full, dropping %v event", hook.config.URL, payload.Event)
+		}
+	}
+}
+
+// Stop delivers the queued payloads and stops the webhooks
+func (w *Webhooks) Stop() {
+	for _, hook := range w.hooks {
+		close(hook.queue)
+	}
+	w.wait.Wait()
+}
+
+func (w *Webhooks) run(hook *webhook) {
+	defer w.wait.Done()
+	for payload := range hook.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("WEBHOOK: Unable to encode %v event: %v", payload.Event, err)
+			continue
+		}
+
+		backoff := webhookRetryBackoff
+		for attempt := 1; ; attempt++ {
+			err = w.deliver(hook.config, payload.Event, body)
+			if err == nil || attempt == webhookAttempts {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			log.Printf("WEBHOOK: Unable to deliver %v event to %v after %d attempts: %v", payload.Event, hook.config.URL, webhookAttempts, err)
+		}
+	}
+}
+
+// deliver posts a signed payload once
+func (w *Webhooks) deliver(config WebhookConfig, event string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, event)
+	if config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(config.Secret))
+		mac.Write(body)
+		request.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("server replied %v", response.Status)
+	}
+	return nil
+}